@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage/disk"
+)
+
+// restore a database to a point in time from a base backup and the change log
+func main() {
+	base := flag.String("base", "", "base backup made by KV.Backup()")
+	archive := flag.String("archive", "", "change log archived since the base backup")
+	out := flag.String("out", "", "the new database file")
+	seq := flag.Uint64("seq", 0, "the last commit to replay (0 for no limit)")
+	until := flag.String("time", "", "replay the commits made at or before this RFC 3339 time")
+	flag.Parse()
+
+	if *base == "" || *archive == "" || *out == "" {
+		flag.Usage()
+		log.Fatal("-base, -archive and -out are required")
+	}
+	target := disk.RestoreTarget{Seq: *seq}
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339Nano, *until)
+		if err != nil {
+			log.Fatalf("Bad -time: %v", err)
+		}
+		target.Time = t
+	}
+
+	last, err := disk.Restore(*base, *archive, *out, target)
+	if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+	fmt.Printf("Restored %s to commit %d\n", *out, last)
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/migration"
 	"govetachun/go-mini-db/refactor_code/internal/query/executor"
 	"govetachun/go-mini-db/refactor_code/internal/query/parser"
 	"govetachun/go-mini-db/refactor_code/internal/storage"
@@ -13,8 +20,8 @@ import (
 func TestDatabaseIntegration(t *testing.T) {
 	fmt.Println("Testing Database Integration...")
 
-	// Initialize the key-value store
-	store := storage.NewKVStore("./test_integration.db")
+	// Initialize the key-value store, in a new file as the catalog persists
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_integration.db"))
 
 	// Open the store
 	if err := store.Open(); err != nil {
@@ -23,10 +30,7 @@ func TestDatabaseIntegration(t *testing.T) {
 	defer store.Close()
 
 	// Create a simple database instance
-	db := &SimpleDB{
-		store:  store,
-		tables: make(map[string]*executor.TableDef),
-	}
+	db := &SimpleDB{store: store}
 
 	// Create a transaction
 	txImpl := transaction.NewDBTX(db)
@@ -147,6 +151,47 @@ func TestDatabaseIntegration(t *testing.T) {
 
 	fmt.Printf("Query result: %v\n", result)
 
+	// Test 8: Range queries with INDEX BY
+	fmt.Println("Test 8: Range queries...")
+	for id := int64(1); id <= 5; id++ {
+		record := executor.Record{
+			Cols: []string{"id", "name", "age"},
+			Vals: []executor.Value{
+				{Type: executor.TYPE_INT64, I64: id},
+				{Type: executor.TYPE_BYTES, Str: []byte(fmt.Sprint("user", id))},
+				{Type: executor.TYPE_INT64, I64: 20 + id},
+			},
+		}
+		if err := tx.Insert("users", record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+	ranges := map[string]string{
+		`SELECT id FROM users`:                             "[1 2 3 4 5]",
+		`SELECT id FROM users INDEX BY id > 2`:             "[3 4 5]",
+		`SELECT id FROM users INDEX BY id >= 2 AND id < 4`: "[2 3]",
+		`SELECT id FROM users INDEX BY id <= 4 AND id > 1`: "[4 3 2]",
+		`SELECT id FROM users INDEX BY id = 3`:             "[3]",
+		`SELECT id FROM users INDEX BY id > 1 LIMIT 2`:     "[2 3]",
+	}
+	for query, want := range ranges {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		result, err := executor.ExecuteQuery(stmt, tx)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		ids := []int64{}
+		for _, rec := range result.([]executor.Record) {
+			ids = append(ids, rec.Vals[0].I64)
+		}
+		if fmt.Sprint(ids) != want {
+			t.Errorf("%s: expected %s, got %v", query, want, ids)
+		}
+	}
+
 	fmt.Println("All tests completed successfully!")
 }
 
@@ -193,3 +238,1654 @@ func TestScannerMethods(t *testing.T) {
 
 	fmt.Println("Scanner test completed successfully!")
 }
+
+func TestUniqueConstraints(t *testing.T) {
+	fmt.Println("Testing Unique Constraints...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_unique.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &ExecutorTX{txImpl}
+
+	exec := func(query string) (interface{}, error) {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return executor.ExecuteQuery(stmt, tx)
+	}
+	mustExec := func(query string) interface{} {
+		result, err := exec(query)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		return result
+	}
+
+	mustExec(`CREATE TABLE accounts (
+		email bytes UNIQUE,
+		id int64,
+		team int64,
+		PRIMARY KEY (id),
+		INDEX (team)
+	)`)
+	def := txImpl.GetDB().GetTableDef("accounts")
+	if def == nil || def.Cols[0] != "id" || fmt.Sprint(def.IndexNames) != "[accounts_email_key accounts_team_idx]" {
+		t.Fatalf("Unexpected table definition: %+v", def)
+	}
+	mustExec(`INSERT INTO accounts (id, email, team) VALUES (1, "a@x", 1)`)
+	mustExec(`INSERT INTO accounts (id, email, team) VALUES (2, "b@x", 1)`)
+
+	// The column-level UNIQUE
+	_, err := exec(`INSERT INTO accounts (id, email, team) VALUES (3, "a@x", 2)`)
+	var cerr *database.ConstraintError
+	if !errors.As(err, &cerr) || cerr.Index != "accounts_email_key" {
+		t.Errorf("Expected a ConstraintError, got %v", err)
+	}
+	result := mustExec(`SELECT id FROM accounts INDEX BY email = "a@x"`)
+	if rows := result.([]executor.Record); len(rows) != 1 || rows[0].Vals[0].I64 != 1 {
+		t.Errorf("Unexpected rows: %v", rows)
+	}
+
+	// CREATE UNIQUE INDEX checks the existing rows
+	_, err = exec(`CREATE UNIQUE INDEX accounts_team_key ON accounts (team)`)
+	if !errors.As(err, &cerr) || cerr.Index != "accounts_team_key" {
+		t.Errorf("Expected a ConstraintError, got %v", err)
+	}
+	if def := txImpl.GetDB().GetTableDef("accounts"); len(def.IndexNames) != 2 {
+		t.Errorf("The failed index is left in the table: %v", def.IndexNames)
+	}
+	mustExec(`CREATE UNIQUE INDEX accounts_id_team_key ON accounts (team, id)`)
+
+	fmt.Println("Unique Constraints tests passed!")
+}
+
+// scanRecorder records the scans of the executor
+type scanRecorder struct {
+	*ExecutorTX
+	scans []executor.Scanner
+}
+
+func (r *scanRecorder) Scan(table string, scanner *executor.Scanner) error {
+	r.scans = append(r.scans, *scanner)
+	return r.ExecutorTX.Scan(table, scanner)
+}
+
+func TestIndexSelection(t *testing.T) {
+	fmt.Println("Testing Index Selection...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_plan.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &scanRecorder{ExecutorTX: &ExecutorTX{txImpl}}
+
+	exec := func(query string) []executor.Record {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		result, err := executor.ExecuteQuery(stmt, tx)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		rows, _ := result.([]executor.Record)
+		return rows
+	}
+
+	exec(`CREATE TABLE orders (
+		id int64,
+		customer int64,
+		status bytes,
+		PRIMARY KEY (id),
+		INDEX (customer, status),
+		INDEX (status)
+	)`)
+	for id := int64(1); id <= 12; id++ {
+		status := []string{"new", "paid", "sent"}[id%3]
+		exec(fmt.Sprintf(`INSERT INTO orders (id, customer, status) VALUES (%d, %d, "%s")`,
+			id, id%4, status))
+	}
+
+	cases := []struct {
+		query string
+		index string // the selected index, "-" for the primary key
+		want  string
+	}{
+		{`SELECT id FROM orders FILTER id > 3 AND id <= 6`, "-", "[4 5 6]"},
+		{`SELECT id FROM orders WHERE 10 < id`, "-", "[11 12]"},
+		{`SELECT id FROM orders WHERE customer = 1 AND status = "paid"`, "orders_customer_status_idx", "[1]"},
+		{`SELECT id FROM orders WHERE customer = 2 AND status >= "paid"`, "orders_customer_status_idx", "[10 2]"},
+		{`SELECT id FROM orders WHERE status = "new" AND id > 4`, "orders_status_idx", "[6 9 12]"},
+		{`SELECT id FROM orders WHERE status < "paid"`, "orders_status_idx", "[3 6 9 12]"},
+		{`SELECT id FROM orders WHERE id = 5 AND status = "paid"`, "-", "[]"},
+		{`SELECT id FROM orders WHERE customer = 1 OR id = 2`, "-", "[1 2 5 9]"},
+		{`SELECT id FROM orders WHERE status = "sent" AND customer != 2 LIMIT 2`, "orders_status_idx", "[5 8]"},
+		{`SELECT id FROM orders INDEX BY id > 9 FILTER customer = 3`, "-", "[11]"},
+	}
+	for _, c := range cases {
+		tx.scans = nil
+		ids := []int64{}
+		for _, rec := range exec(c.query) {
+			ids = append(ids, rec.Vals[0].I64)
+		}
+		if fmt.Sprint(ids) != c.want {
+			t.Errorf("%s: expected %s, got %v", c.query, c.want, ids)
+		}
+		index := tx.scans[0].Index
+		if index == "" {
+			index = "-"
+		}
+		if index != c.index {
+			t.Errorf("%s: expected index %s, got %s", c.query, c.index, index)
+		}
+	}
+
+	// Updates and deletes select the index too
+	exec(`UPDATE orders SET customer = 9 WHERE status = "new" AND customer = 0`)
+	if rows := exec(`SELECT id FROM orders WHERE customer = 9`); len(rows) != 1 || rows[0].Vals[0].I64 != 12 {
+		t.Errorf("Unexpected updated rows: %v", rows)
+	}
+	tx.scans = nil
+	exec(`DELETE FROM orders WHERE customer = 9`)
+	if tx.scans[0].Index != "orders_customer_status_idx" {
+		t.Errorf("Expected the delete to use the index, got %q", tx.scans[0].Index)
+	}
+	if rows := exec(`SELECT id FROM orders`); len(rows) != 11 {
+		t.Errorf("Expected 11 rows, got %d", len(rows))
+	}
+
+	fmt.Println("Index Selection tests passed!")
+}
+
+func TestNullSupport(t *testing.T) {
+	fmt.Println("Testing NULL Support...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_null.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &scanRecorder{ExecutorTX: &ExecutorTX{txImpl}}
+
+	exec := func(query string) (interface{}, error) {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return executor.ExecuteQuery(stmt, tx)
+	}
+	ids := func(query string) string {
+		result, err := exec(query)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		out := []int64{}
+		for _, rec := range result.([]executor.Record) {
+			out = append(out, rec.Vals[0].I64)
+		}
+		return fmt.Sprint(out)
+	}
+
+	if _, err := exec(`CREATE TABLE tasks (
+		id int64,
+		title bytes NOT NULL,
+		owner int64 NULL,
+		PRIMARY KEY (id),
+		INDEX (owner)
+	)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, values := range []string{
+		`(1, "a", 10)`, `(2, "b", NULL)`, `(3, "c", 30)`, `(4, "d", NULL)`,
+	} {
+		if _, err := exec(`INSERT INTO tasks (id, title, owner) VALUES ` + values); err != nil {
+			t.Fatalf("Failed to insert %s: %v", values, err)
+		}
+	}
+	if _, err := exec(`INSERT INTO tasks (id, title, owner) VALUES (5, NULL, 1)`); err == nil {
+		t.Errorf("Expected an error for a NULL in a NOT NULL column")
+	}
+
+	cases := map[string]string{
+		`SELECT id FROM tasks WHERE owner IS NULL`:                 "[2 4]",
+		`SELECT id FROM tasks WHERE owner IS NOT NULL`:             "[1 3]",
+		`SELECT id FROM tasks WHERE owner < 20`:                    "[1]",
+		`SELECT id FROM tasks WHERE owner = NULL`:                  "[]",
+		`SELECT id FROM tasks WHERE NOT (owner = 10)`:              "[3]",
+		`SELECT id FROM tasks WHERE owner = 10 OR id = 2`:          "[1 2]",
+		`SELECT id FROM tasks WHERE owner > 0 AND title = "a"`:     "[1]",
+		`SELECT id FROM tasks WHERE NOT (owner > 0 AND id > 3)`:    "[1 2 3]",
+		`SELECT id FROM tasks WHERE (owner > 0 OR id = 4) IS NULL`: "[2]",
+	}
+	for query, want := range cases {
+		if got := ids(query); got != want {
+			t.Errorf("%s: expected %s, got %s", query, want, got)
+		}
+	}
+
+	// IS NULL is an index lookup
+	tx.scans = nil
+	ids(`SELECT id FROM tasks WHERE owner IS NULL`)
+	if tx.scans[0].Index != "tasks_owner_idx" {
+		t.Errorf("Expected an index scan, got %q", tx.scans[0].Index)
+	}
+
+	// Setting NULL
+	if _, err := exec(`UPDATE tasks SET owner = NULL WHERE id = 1`); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if got := ids(`SELECT id FROM tasks WHERE owner IS NULL`); got != "[1 2 4]" {
+		t.Errorf("Unexpected NULL rows after the update: %s", got)
+	}
+
+	fmt.Println("NULL Support tests passed!")
+}
+
+func TestValueTypes(t *testing.T) {
+	fmt.Println("Testing Value Types...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_types.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &scanRecorder{ExecutorTX: &ExecutorTX{txImpl}}
+
+	exec := func(query string) (interface{}, error) {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return executor.ExecuteQuery(stmt, tx)
+	}
+	ids := func(query string) string {
+		result, err := exec(query)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		out := []int64{}
+		for _, rec := range result.([]executor.Record) {
+			out = append(out, rec.Vals[0].I64)
+		}
+		return fmt.Sprint(out)
+	}
+
+	if _, err := exec(`CREATE TABLE orders (
+		id int64,
+		price float64,
+		paid bool,
+		at timestamp,
+		PRIMARY KEY (id),
+		INDEX (price)
+	)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, values := range []string{
+		`(1, 1.5, true, TIMESTAMP '2024-01-02 03:04:05')`,
+		`(2, 2, false, TIMESTAMP '2024-01-03')`,
+		`(3, -0.25, true, TIMESTAMP '2024-01-01T00:00:00Z')`,
+	} {
+		if _, err := exec(`INSERT INTO orders (id, price, paid, at) VALUES ` + values); err != nil {
+			t.Fatalf("Failed to insert %s: %v", values, err)
+		}
+	}
+	if _, err := exec(`INSERT INTO orders (id, price, paid, at) VALUES (4, "x", true, TIMESTAMP '2024-01-01')`); err == nil {
+		t.Errorf("Expected an error for a string in a float column")
+	}
+
+	cases := map[string]string{
+		`SELECT id FROM orders WHERE price > 1`:                                     "[1 2]",
+		`SELECT id FROM orders WHERE price * 2 = 3`:                                 "[1]",
+		`SELECT id FROM orders WHERE price + 1 < 1`:                                 "[3]",
+		`SELECT id FROM orders WHERE paid = true`:                                   "[1 3]",
+		`SELECT id FROM orders WHERE NOT paid`:                                      "[2]",
+		`SELECT id FROM orders WHERE at > TIMESTAMP '2024-01-02'`:                   "[1 2]",
+		`SELECT id FROM orders WHERE at + 86400000000 > TIMESTAMP '2024-01-03'`:     "[1 2]",
+		`SELECT id FROM orders WHERE at - TIMESTAMP '2024-01-01' = 172800000000`:    "[2]",
+		`SELECT id FROM orders WHERE id % 2 = 1 AND price >= -0.25 AND price < 1.5`: "[3]",
+	}
+	for query, want := range cases {
+		if got := ids(query); got != want {
+			t.Errorf("%s: expected %s, got %s", query, want, got)
+		}
+	}
+
+	// The float range is an index scan
+	tx.scans = nil
+	ids(`SELECT id FROM orders WHERE price > 1`)
+	if tx.scans[0].Index != "orders_price_idx" {
+		t.Errorf("Expected an index scan, got %q", tx.scans[0].Index)
+	}
+
+	if _, err := exec(`SELECT id FROM orders WHERE id / 0 = 1`); err == nil {
+		t.Errorf("Expected an error for a division by zero")
+	}
+
+	fmt.Println("Value Types tests passed!")
+}
+
+func TestDecimalType(t *testing.T) {
+	fmt.Println("Testing Decimal Type...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_decimal.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &scanRecorder{ExecutorTX: &ExecutorTX{txImpl}}
+
+	exec := func(query string) (interface{}, error) {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return executor.ExecuteQuery(stmt, tx)
+	}
+	rows := func(query string) string {
+		result, err := exec(query)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		out := []string{}
+		for _, rec := range result.([]executor.Record) {
+			out = append(out, rec.Vals[0].Dec.String())
+		}
+		return fmt.Sprint(out)
+	}
+
+	if _, err := exec(`CREATE TABLE invoices (
+		amount decimal(10, 2),
+		rate decimal(6, 4) NOT NULL,
+		id int64,
+		PRIMARY KEY (amount),
+		INDEX (rate)
+	)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, values := range []string{
+		`(DECIMAL '19.99', DECIMAL '0.0825', 1)`,
+		`(DECIMAL '-5', 0.1, 2)`,
+		`(100, DECIMAL '1.00005', 3)`,
+		`(DECIMAL '0.005', 0, 4)`,
+	} {
+		if _, err := exec(`INSERT INTO invoices (amount, rate, id) VALUES ` + values); err != nil {
+			t.Fatalf("Failed to insert %s: %v", values, err)
+		}
+	}
+	if _, err := exec(`INSERT INTO invoices (amount, rate, id) VALUES (DECIMAL '123456789.5', 0, 5)`); err == nil {
+		t.Errorf("Expected an error for a number out of range")
+	}
+
+	cases := map[string]string{
+		// the primary key order, 0.005 is rounded to 0.01
+		`SELECT amount FROM invoices`:                                     "[-5.00 0.01 19.99 100.00]",
+		`SELECT amount FROM invoices WHERE amount > DECIMAL '0.0100'`:     "[19.99 100.00]",
+		`SELECT amount FROM invoices WHERE amount * rate = 1.649175`:      "[19.99]",
+		`SELECT amount FROM invoices WHERE amount / 3 = 33.33333333`:      "[100.00]",
+		`SELECT amount FROM invoices WHERE amount + 0.1 = 0.11`:           "[0.01]",
+		`SELECT amount FROM invoices WHERE -amount > 1 OR amount % 7 = 2`: "[-5.00 100.00]",
+		`SELECT amount FROM invoices WHERE rate >= 0.1`:                   "[-5.00 100.00]",
+	}
+	for query, want := range cases {
+		if got := rows(query); got != want {
+			t.Errorf("%s: expected %s, got %s", query, want, got)
+		}
+	}
+
+	// The results keep the column scale
+	result, _ := exec(`SELECT rate FROM invoices WHERE amount = 100`)
+	if recs := result.([]executor.Record); len(recs) != 1 || recs[0].Vals[0].Dec.String() != "1.0001" {
+		t.Errorf("Unexpected rate: %v", recs)
+	}
+
+	// The decimal range is an index scan
+	tx.scans = nil
+	rows(`SELECT amount FROM invoices WHERE rate > DECIMAL '0.05' AND rate < 0.5`)
+	if tx.scans[0].Index != "invoices_rate_idx" {
+		t.Errorf("Expected an index scan, got %q", tx.scans[0].Index)
+	}
+
+	if _, err := exec(`SELECT amount FROM invoices WHERE amount / DECIMAL '0.00' = 1`); err == nil {
+		t.Errorf("Expected an error for a division by zero")
+	}
+	if _, err := parser.Parse([]byte(`SELECT amount FROM invoices WHERE amount = DECIMAL '1.2.3'`)); err == nil {
+		t.Errorf("Expected a parse error for a bad decimal")
+	}
+
+	fmt.Println("Decimal Type tests passed!")
+}
+
+func TestJSONType(t *testing.T) {
+	fmt.Println("Testing JSON Type...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_json.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+	if err := txImpl.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txImpl.Abort()
+	tx := &scanRecorder{ExecutorTX: &ExecutorTX{txImpl}}
+
+	exec := func(query string) (interface{}, error) {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return executor.ExecuteQuery(stmt, tx)
+	}
+	// the first column of the rows
+	rows := func(query string) string {
+		result, err := exec(query)
+		if err != nil {
+			t.Fatalf("Execution error for %s: %v", query, err)
+		}
+		out := []string{}
+		for _, rec := range result.([]executor.Record) {
+			v := rec.Vals[0]
+			switch {
+			case v.Null:
+				out = append(out, "NULL")
+			case v.Type == executor.TYPE_INT64:
+				out = append(out, fmt.Sprint(v.I64))
+			case v.Type == executor.TYPE_DECIMAL:
+				out = append(out, v.Dec.String())
+			case v.Type == executor.TYPE_BOOL:
+				out = append(out, fmt.Sprint(v.I64 != 0))
+			default:
+				out = append(out, string(v.Str))
+			}
+		}
+		return fmt.Sprint(out)
+	}
+
+	if _, err := exec(`CREATE TABLE docs (
+		id int64,
+		doc json,
+		PRIMARY KEY (id)
+	)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, values := range []string{
+		`(1, '{"kind": "book", "n": 3, "meta": {"title": "Go"}}')`,
+		`(2, '{"kind": "pen", "n": 10.5, "tags": ["a", "b"]}')`,
+		`(3, '{"kind": "book", "n": 7,  "meta": {"title": "SQL"}}')`,
+		`(4, '[1, 2, 3]')`,
+		`(5, NULL)`,
+	} {
+		if _, err := exec(`INSERT INTO docs (id, doc) VALUES ` + values); err != nil {
+			t.Fatalf("Failed to insert %s: %v", values, err)
+		}
+	}
+	if _, err := exec(`INSERT INTO docs (id, doc) VALUES (6, '{"kind": ')`); err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+
+	cases := map[string]string{
+		`SELECT doc FROM docs WHERE id = 1`:                                 `[{"kind":"book","n":3,"meta":{"title":"Go"}}]`,
+		`SELECT doc->'meta'->>'title' FROM docs WHERE id < 4`:               "[Go NULL SQL]",
+		`SELECT doc->'meta' FROM docs WHERE id = 3`:                         `[{"title":"SQL"}]`,
+		`SELECT doc->>'$.tags[1]' FROM docs WHERE id = 2`:                   "[b]",
+		`SELECT doc->>1 FROM docs WHERE id = 4`:                             "[2]",
+		`SELECT id FROM docs WHERE doc->>'kind' = 'book'`:                   "[1 3]",
+		`SELECT id FROM docs WHERE json_extract(doc, '$.n') > 5`:            "[2 3]",
+		`SELECT json_extract(doc, '$.n') FROM docs WHERE id = 2`:            "[10.5]",
+		`SELECT id FROM docs WHERE doc->>'kind' IS NULL`:                    "[4 5]",
+		`SELECT json_type(doc) FROM docs WHERE id >= 3`:                     "[object array NULL]",
+		`SELECT json_type(doc, 'tags') FROM docs WHERE id = 2`:              "[array]",
+		`SELECT json_valid('{"a": 1}') FROM docs WHERE id = 1`:              "[true]",
+		`SELECT json_valid('{"a": ') FROM docs WHERE id = 1`:                "[false]",
+		`SELECT id FROM docs WHERE doc->'meta' = doc->'meta' AND id > 2`:    "[3]",
+		`SELECT id FROM docs WHERE '{"a": [1]}'->'a'->>0 = 1 AND id = 1`:    "[1]",
+		`SELECT id FROM docs WHERE doc->>'kind' = 'pen' OR doc->>0 = 1`:     "[2 4]",
+		`SELECT id FROM docs WHERE json_extract(doc, '$.meta.title') > 'H'`: "[3]",
+	}
+	for query, want := range cases {
+		if got := rows(query); got != want {
+			t.Errorf("%s: expected %s, got %s", query, want, got)
+		}
+	}
+	if _, err := exec(`SELECT json_extract(doc, 'n') FROM docs`); err == nil {
+		t.Errorf("Expected an error for a bad path")
+	}
+	if _, err := exec(`SELECT doc->'a' FROM docs WHERE id = 1 AND id->'a' = 1`); err == nil {
+		t.Errorf("Expected an error for a path of an integer")
+	}
+
+	// An expression index over a path narrows the scan
+	if _, err := exec(`CREATE INDEX docs_kind ON docs (doc->>'kind')`); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if _, err := exec(`CREATE INDEX docs_n ON docs (json_extract(doc, '$.n'))`); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if _, err := exec(`CREATE INDEX docs_bad ON docs (doc->>id)`); err == nil {
+		t.Errorf("Expected an error for a path that is not a constant")
+	}
+	if _, err := exec(`CREATE INDEX docs_bad ON docs (id->>'a')`); err == nil {
+		t.Errorf("Expected an error for a path of an integer column")
+	}
+	if _, err := exec(`INSERT INTO docs (id, doc) VALUES (7, '{"kind": "book", "n": 1}')`); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	indexed := map[string]string{
+		`SELECT id FROM docs WHERE doc->>'kind' = 'book'`:                   "docs_kind:[1 3 7]",
+		`SELECT id FROM docs WHERE json_extract(doc, '$.n') > 5`:            "docs_n:[3 2]",
+		`SELECT id FROM docs WHERE doc->>'n' <= 3 AND doc->>'n' >= 1`:       "docs_n:[7 1]",
+		`SELECT id FROM docs WHERE doc->>'$.kind' IS NULL`:                  "docs_kind:[4 5]",
+		`SELECT id FROM docs WHERE doc->>'kind' = 'book' AND id > 1`:        "docs_kind:[3 7]",
+		`SELECT id FROM docs WHERE doc->>'kind' = 'book' AND doc->>'n' = 7`: "docs_kind:[3]",
+	}
+	for query, want := range indexed {
+		tx.scans = nil
+		got := rows(query)
+		if got = tx.scans[0].Index + ":" + got; got != want {
+			t.Errorf("%s: expected %s, got %s", query, want, got)
+		}
+	}
+	if _, err := exec(`UPDATE docs SET doc = '{"kind": "pen"}' WHERE id = 7`); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if got := rows(`SELECT id FROM docs WHERE doc->>'kind' = 'pen'`); got != "[2 7]" {
+		t.Errorf("Unexpected rows after the update: %s", got)
+	}
+
+	fmt.Println("JSON Type tests passed!")
+}
+
+// sqlHarness runs SQL statements in the transactions of a test database
+type sqlHarness struct {
+	t     *testing.T
+	store storage.KVStore
+	db    transaction.DB // the database of the transactions
+	tx    *ExecutorTX    // the current transaction, see Begin()
+	// Query() quotes the strings, to tell them from the numbers
+	quote bool
+}
+
+// newSQLHarness opens a database file in the temporary directory of the test
+func newSQLHarness(t *testing.T, name string) *sqlHarness {
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), name))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(store.Close)
+	return &sqlHarness{t: t, store: store, db: &SimpleDB{store: store}}
+}
+
+// Begin starts a new transaction
+func (h *sqlHarness) Begin() {
+	txImpl := transaction.NewDBTX(h.db)
+	if err := txImpl.Begin(); err != nil {
+		h.t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	h.tx = &ExecutorTX{txImpl}
+}
+
+// Commit commits the current transaction
+func (h *sqlHarness) Commit() {
+	if err := h.tx.tx.Commit(); err != nil {
+		h.t.Fatalf("Failed to commit: %v", err)
+	}
+}
+
+// Run executes a statement in the current transaction
+func (h *sqlHarness) Run(query string) (interface{}, error) {
+	stmt, err := parser.Parse([]byte(query))
+	if err != nil {
+		h.t.Fatalf("Parse error for %s: %v", query, err)
+	}
+	return executor.ExecuteQuery(stmt, h.tx)
+}
+
+// Exec executes a statement that must succeed
+func (h *sqlHarness) Exec(query string) interface{} {
+	result, err := h.Run(query)
+	if err != nil {
+		h.t.Fatalf("Execution error for %s: %v", query, err)
+	}
+	return result
+}
+
+// ExpectErr executes a statement that must fail with `msg`
+func (h *sqlHarness) ExpectErr(query string, msg string) {
+	if _, err := h.Run(query); err == nil || !strings.Contains(err.Error(), msg) {
+		h.t.Errorf("%s: expected an error with %q, got %v", query, msg, err)
+	}
+}
+
+// Query returns the rows of a SELECT as "[a:b c:d]"
+func (h *sqlHarness) Query(query string) string {
+	result, err := h.Run(query)
+	if err != nil {
+		h.t.Fatalf("Failed to select: %v", err)
+	}
+	got := []string{}
+	for _, rec := range result.([]executor.Record) {
+		vals := []string{}
+		for _, v := range rec.Vals {
+			switch {
+			case v.Null:
+				vals = append(vals, "NULL")
+			case v.Type == executor.TYPE_BYTES && h.quote:
+				vals = append(vals, "'"+string(v.Str)+"'")
+			case v.Type == executor.TYPE_BYTES:
+				vals = append(vals, string(v.Str))
+			case v.Type == executor.TYPE_DECIMAL:
+				vals = append(vals, v.Dec.String())
+			default:
+				vals = append(vals, fmt.Sprint(v.I64))
+			}
+		}
+		got = append(got, strings.Join(vals, ":"))
+	}
+	return fmt.Sprint(got)
+}
+
+// Check compares the rows of a SELECT with `want`, see Query()
+func (h *sqlHarness) Check(query string, want string) {
+	if got := h.Query(query); got != want {
+		h.t.Errorf("%s: expected %s, got %s", query, want, got)
+	}
+}
+
+func TestDefaultsAndChecks(t *testing.T) {
+	fmt.Println("Testing Defaults And Checks...")
+
+	h := newSQLHarness(t, "test_checks.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE orders (
+		id int64,
+		qty int64 NOT NULL DEFAULT 1 CHECK (qty > 0),
+		price decimal(8, 2) DEFAULT 9.5,
+		status bytes DEFAULT 'new',
+		note bytes,
+		created timestamp DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (id),
+		CONSTRAINT cheap CHECK (price * qty < 1000),
+		CHECK (status = 'new' OR status = 'paid')
+	)`)
+	h.Commit()
+
+	// The definition is read back from the catalog
+	before := time.Now().UnixMicro()
+	h.Begin()
+	defer h.tx.tx.Abort()
+	h.Exec(`INSERT INTO orders (id) VALUES (1)`)
+	h.Exec(`INSERT INTO orders (id, qty, status) VALUES (2, 3, 'paid')`)
+	h.Exec(`INSERT INTO orders VALUES (3, 2)`)
+	h.Exec(`INSERT INTO orders (id, price, note) VALUES (4, NULL, 'no price')`)
+
+	result, err := h.Run(`SELECT id, qty, price, status, note, created FROM orders`)
+	if err != nil {
+		t.Fatalf("Failed to select: %v", err)
+	}
+	got := []string{}
+	for _, rec := range result.([]executor.Record) {
+		v := rec.Vals
+		price := "NULL"
+		if !v[2].Null {
+			price = v[2].Dec.String()
+		}
+		got = append(got, fmt.Sprintf("%d:%d:%s:%s:%v", v[0].I64, v[1].I64, price, v[3].Str, v[4].Null))
+		if v[5].Null || v[5].I64 < before || v[5].I64 > time.Now().UnixMicro() {
+			t.Errorf("Unexpected created time of %d: %+v", v[0].I64, v[5])
+		}
+	}
+	want := "[1:1:9.50:new:true 2:3:9.50:paid:true 3:2:9.50:new:true 4:1:NULL:new:false]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Expected %s, got %v", want, got)
+	}
+
+	// The violations name the constraint
+	violations := map[string]string{
+		`INSERT INTO orders (id, qty) VALUES (5, 0)`:             "orders_qty_check",
+		`INSERT INTO orders (id, qty) VALUES (5, 200)`:           "cheap",
+		`INSERT INTO orders (id, status) VALUES (5, 'lost')`:     "orders_check3",
+		`UPDATE orders SET qty = -1 WHERE id = 1`:                "orders_qty_check",
+		`UPDATE orders SET status = 'lost' WHERE id > 0`:         "orders_check3",
+		`UPDATE orders SET price = 999.99, qty = 2 WHERE id = 2`: "cheap",
+	}
+	for query, name := range violations {
+		_, err := h.Run(query)
+		if err == nil || !strings.Contains(err.Error(), "violates CHECK constraint "+name) {
+			t.Errorf("%s: expected a violation of %s, got %v", query, name, err)
+		}
+	}
+	if _, err := h.Run(`INSERT INTO orders (id, qty) VALUES (5, NULL)`); err == nil {
+		t.Errorf("Expected an error for NULL in a NOT NULL column")
+	}
+	// a NULL price passes the check, as unknown is not false
+	h.Exec(`UPDATE orders SET qty = 50 WHERE id = 4`)
+	h.Exec(`UPDATE orders SET status = 'paid' WHERE id = 1`)
+
+	// Bad definitions are rejected
+	for _, query := range []string{
+		`CREATE TABLE bad (id int64, n int64 DEFAULT 'x', PRIMARY KEY (id))`,
+		`CREATE TABLE bad (id int64, n int64 DEFAULT id + 1, PRIMARY KEY (id))`,
+		`CREATE TABLE bad (id int64, PRIMARY KEY (id), CHECK (m > 0))`,
+		`CREATE TABLE bad (id int64, PRIMARY KEY (id), CONSTRAINT c CHECK (id > 0), CONSTRAINT c CHECK (id < 9))`,
+	} {
+		if _, err := h.Run(query); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+	if _, err := parser.Parse([]byte(`CREATE TABLE bad (id int64 CHECK id > 0, PRIMARY KEY (id))`)); err == nil {
+		t.Errorf("Expected a parse error for CHECK without parentheses")
+	}
+
+	// The constraints follow the columns
+	if err := executor.ExecuteRenameColumn("orders", "qty", "n", h.tx); err == nil {
+		t.Errorf("Expected an error for renaming a column of a CHECK constraint")
+	}
+	if err := executor.ExecuteAlterTableDropColumn("orders", "status", h.tx); err != nil {
+		t.Fatalf("Failed to drop column: %v", err)
+	}
+	h.Exec(`INSERT INTO orders (id) VALUES (6)`)
+	tdef := h.tx.GetDB().GetTableDef("orders")
+	if fmt.Sprint(tdef.CheckNames) != "[orders_qty_check cheap]" || tdef.Defaults["status"] != "" {
+		t.Errorf("Unexpected constraints after dropping a column: %v %v", tdef.CheckNames, tdef.Defaults)
+	}
+
+	fmt.Println("Defaults And Checks tests passed!")
+}
+
+func TestForeignKeys(t *testing.T) {
+	fmt.Println("Testing Foreign Keys...")
+
+	h := newSQLHarness(t, "test_fkeys.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE authors (id int64, PRIMARY KEY (id))`)
+	h.Exec(`CREATE TABLE books (
+		id int64,
+		author int64 REFERENCES authors ON DELETE CASCADE ON UPDATE CASCADE,
+		PRIMARY KEY (id)
+	)`)
+	h.Exec(`CREATE TABLE reviews (
+		id int64, book int64,
+		PRIMARY KEY (id),
+		CONSTRAINT review_book FOREIGN KEY (book) REFERENCES books (id) ON DELETE SET NULL
+	)`)
+	h.Exec(`CREATE TABLE loans (id int64, book int64 NOT NULL REFERENCES books (id), PRIMARY KEY (id))`)
+	h.Commit()
+
+	// The definitions are read back from the catalog
+	h.Begin()
+	h.Exec(`INSERT INTO authors VALUES (1)`)
+	h.Exec(`INSERT INTO authors VALUES (2)`)
+	h.Exec(`INSERT INTO books VALUES (10, 1)`)
+	h.Exec(`INSERT INTO books VALUES (11, 1)`)
+	h.Exec(`INSERT INTO books VALUES (20, 2)`)
+	h.Exec(`INSERT INTO books VALUES (30, NULL)`)
+	h.Exec(`INSERT INTO reviews VALUES (100, 10)`)
+	h.Exec(`INSERT INTO reviews VALUES (101, 20)`)
+	h.Exec(`INSERT INTO loans VALUES (1000, 11)`)
+
+	h.ExpectErr(`INSERT INTO books VALUES (12, 9)`, "key (author=9) is not present for foreign key books_author_fkey")
+	h.ExpectErr(`UPDATE reviews SET book = 12 WHERE id = 100`, "foreign key review_book")
+	h.ExpectErr(`DELETE FROM books WHERE id = 11`, "still referenced by foreign key loans_book_fkey")
+	h.ExpectErr(`UPDATE books SET id = 12 WHERE id = 11`, "still referenced by foreign key loans_book_fkey")
+	if err := h.tx.DropTable("books"); err == nil {
+		t.Errorf("Expected an error for dropping a referenced table")
+	}
+
+	// CASCADE and SET NULL
+	h.Exec(`DELETE FROM authors WHERE id = 2`)
+	h.Exec(`UPDATE authors SET id = 3 WHERE id = 1`)
+	if got := h.Query(`SELECT id, author FROM books`); got != "[10:3 11:3 30:NULL]" {
+		t.Errorf("Unexpected books: %s", got)
+	}
+	if got := h.Query(`SELECT id, book FROM reviews`); got != "[100:10 101:NULL]" {
+		t.Errorf("Unexpected reviews: %s", got)
+	}
+	h.Exec(`DELETE FROM loans WHERE id = 1000`)
+	h.Exec(`DELETE FROM authors WHERE id = 3`)
+	if got := h.Query(`SELECT id, author FROM books`); got != "[30:NULL]" {
+		t.Errorf("Unexpected books: %s", got)
+	}
+	if got := h.Query(`SELECT id, book FROM reviews`); got != "[100:NULL 101:NULL]" {
+		t.Errorf("Unexpected reviews: %s", got)
+	}
+
+	// Bad definitions are rejected
+	for _, query := range []string{
+		`CREATE TABLE bad (id int64, a int64 REFERENCES nowhere, PRIMARY KEY (id))`,
+		`CREATE TABLE bad (id int64, a int64 REFERENCES books (author), PRIMARY KEY (id))`,
+		`CREATE TABLE bad (id int64, a bytes REFERENCES authors, PRIMARY KEY (id))`,
+		`CREATE TABLE bad (id int64, a int64 NOT NULL REFERENCES authors ON DELETE SET NULL, PRIMARY KEY (id))`,
+	} {
+		if _, err := h.Run(query); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+	if err := executor.ExecuteRenameColumn("reviews", "book", "b", h.tx); err == nil {
+		t.Errorf("Expected an error for renaming a column of a foreign key")
+	}
+	h.Commit()
+
+	// A failed cascade undoes the whole delete, which is not committed
+	h.Begin()
+	h.Exec(`INSERT INTO authors VALUES (5)`)
+	h.Exec(`INSERT INTO books VALUES (50, 5)`)
+	h.Exec(`INSERT INTO books VALUES (51, 5)`)
+	h.Exec(`INSERT INTO reviews VALUES (500, 50)`)
+	h.Exec(`INSERT INTO loans VALUES (5000, 51)`)
+	h.Commit()
+	h.Begin()
+	h.ExpectErr(`DELETE FROM authors WHERE id = 5`, "still referenced by foreign key loans_book_fkey")
+	h.Commit()
+	h.Begin()
+	h.Check(`SELECT id FROM authors`, "[5]")
+	h.Check(`SELECT id, author FROM books`, "[30:NULL 50:5 51:5]")
+	h.Check(`SELECT id, book FROM reviews`, "[100:NULL 101:NULL 500:50]")
+	h.Commit()
+
+	// A deferred foreign key is checked at the commit
+	h.Begin()
+	h.Exec(`CREATE TABLE parts (id int64, parent int64, PRIMARY KEY (id),
+		FOREIGN KEY (parent) REFERENCES parts DEFERRABLE INITIALLY DEFERRED)`)
+	h.Exec(`INSERT INTO parts VALUES (2, 1)`)
+	h.Exec(`INSERT INTO parts VALUES (1, NULL)`)
+	h.Commit()
+
+	h.Begin()
+	h.Exec(`INSERT INTO parts VALUES (3, 4)`)
+	h.Exec(`DELETE FROM parts WHERE id = 1`)
+	h.Exec(`INSERT INTO parts VALUES (4, 1)`)
+	h.Exec(`INSERT INTO parts VALUES (1, NULL)`)
+	h.Commit()
+
+	h.Begin()
+	h.Exec(`DELETE FROM parts WHERE id = 4`)
+	err := h.tx.tx.Commit()
+	if err == nil || !strings.Contains(err.Error(), "key (parent=4) is not present for foreign key parts_parent_fkey") {
+		t.Errorf("Expected a deferred violation, got %v", err)
+	}
+	h.Begin()
+	defer h.tx.tx.Abort()
+	if got := h.Query(`SELECT id, parent FROM parts`); got != "[1:NULL 2:1 3:4 4:1]" {
+		t.Errorf("Expected the failed commit to be rolled back, got %s", got)
+	}
+
+	fmt.Println("Foreign Keys tests passed!")
+}
+
+func TestSequences(t *testing.T) {
+	fmt.Println("Testing Sequences...")
+
+	h := newSQLHarness(t, "test_seqs.db")
+	// The transactions share the blocks of the database
+	h.db = database.NewSimpleDB(h.store)
+	ids := func(query string) string {
+		got := []int64{}
+		for _, rec := range h.Exec(query).([]executor.Record) {
+			got = append(got, rec.Vals[0].I64)
+		}
+		return fmt.Sprint(got)
+	}
+
+	h.Begin()
+	h.Exec(`CREATE TABLE users (id int64 AUTO_INCREMENT, name bytes, PRIMARY KEY (id))`)
+	h.Exec(`CREATE SEQUENCE tickets START WITH 100 INCREMENT BY 10 CACHE 4`)
+	h.Exec(`CREATE TABLE orders (id int64, ticket int64, PRIMARY KEY (id))`)
+	h.Commit()
+
+	h.Begin()
+	h.Exec(`INSERT INTO users (name) VALUES ('a')`)
+	h.Exec(`INSERT INTO users VALUES (NULL, 'b')`)
+	h.Exec(`INSERT INTO users VALUES (10, 'c')`)
+	h.Exec(`INSERT INTO users (name) VALUES ('d')`)
+	if got := ids(`SELECT id FROM users`); got != "[1 2 3 10]" {
+		t.Errorf("Unexpected AUTO_INCREMENT keys: %s", got)
+	}
+
+	if _, err := h.Run(`SELECT currval('tickets') FROM users`); err == nil {
+		t.Errorf("Expected an error for currval before nextval")
+	}
+	h.Exec(`INSERT INTO orders VALUES (1, nextval('tickets'))`)
+	h.Exec(`INSERT INTO orders VALUES (2, nextval('tickets'))`)
+	h.Exec(`UPDATE orders SET ticket = nextval('tickets') WHERE id = 2`)
+	if got := ids(`SELECT ticket FROM orders`); got != "[100 120]" {
+		t.Errorf("Unexpected tickets: %s", got)
+	}
+	if got := ids(`SELECT currval('tickets') FROM orders INDEX BY id = 1`); got != "[120]" {
+		t.Errorf("Unexpected currval: %s", got)
+	}
+	h.tx.tx.Abort()
+
+	// The values are not reused after an abort
+	h.Begin()
+	h.Exec(`INSERT INTO users (name) VALUES ('e')`)
+	h.Exec(`INSERT INTO orders VALUES (3, nextval('tickets'))`)
+	if got := ids(`SELECT id FROM users`); got != "[4]" {
+		t.Errorf("Unexpected AUTO_INCREMENT keys after an abort: %s", got)
+	}
+	if got := ids(`SELECT ticket FROM orders`); got != "[130]" {
+		t.Errorf("Unexpected tickets after an abort: %s", got)
+	}
+
+	// The sequence of AUTO_INCREMENT belongs to the table
+	for _, query := range []string{
+		`DROP SEQUENCE users_id_seq`,
+		`CREATE SEQUENCE tickets`,
+		`DROP SEQUENCE nothing`,
+		`CREATE TABLE bad (id bytes AUTO_INCREMENT, PRIMARY KEY (id))`,
+		`SELECT nextval('nothing') FROM users`,
+	} {
+		if _, err := h.Run(query); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+	if _, err := parser.Parse([]byte(`CREATE TABLE bad (id int64, n int64 AUTO_INCREMENT, PRIMARY KEY (id))`)); err == nil {
+		t.Errorf("Expected a parse error for AUTO_INCREMENT on a non-key column")
+	}
+	if _, err := h.Run(`CREATE TABLE bad (id int64 DEFAULT nextval('tickets'), PRIMARY KEY (id))`); err == nil {
+		t.Errorf("Expected an error for nextval() in DEFAULT")
+	}
+	if err := h.tx.DropTable("users"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	h.Exec(`CREATE SEQUENCE users_id_seq`)
+	h.Exec(`DROP SEQUENCE tickets`)
+	h.Commit()
+
+	fmt.Println("Sequences tests passed!")
+}
+
+func TestAlterTableRows(t *testing.T) {
+	fmt.Println("Testing Alter Table Rows...")
+
+	h := newSQLHarness(t, "test_alter.db")
+	h.quote = true
+
+	h.Begin()
+	h.Exec(`CREATE TABLE items (id int64, code bytes, qty int64, PRIMARY KEY (id))`)
+	h.Exec(`CREATE INDEX items_code_idx ON items (code)`)
+	h.Exec(`CREATE UNIQUE INDEX items_qty_key ON items (qty)`)
+	h.Exec(`INSERT INTO items (id, code, qty) VALUES (1, '10', 5)`)
+	h.Exec(`INSERT INTO items (id, code, qty) VALUES (2, '20', 6)`)
+	h.Exec(`INSERT INTO items (id, code, qty) VALUES (3, 'x', 7)`)
+
+	// A new column is NULL in the existing rows
+	if err := executor.ExecuteAlterTableAddColumn("items", "note", executor.TYPE_BYTES, h.tx); err != nil {
+		t.Fatalf("Failed to add column: %v", err)
+	}
+	h.Check(`SELECT id, note FROM items`, "[1:NULL 2:NULL 3:NULL]")
+	h.Exec(`UPDATE items SET note = 'hi' WHERE id = 2`)
+
+	// The values are converted to the new type, or the table is intact
+	err := executor.ExecuteAlterTableModifyColumn("items", "code", executor.TYPE_INT64, h.tx)
+	if err == nil || !strings.Contains(err.Error(), "column code") {
+		t.Errorf("Expected a conversion error for column code, got %v", err)
+	}
+	h.Check(`SELECT id, code, qty, note FROM items WHERE code = '20'`, "[2:'20':6:'hi']")
+	h.Exec(`UPDATE items SET code = '30' WHERE id = 3`)
+	if err := executor.ExecuteAlterTableModifyColumn("items", "code", executor.TYPE_INT64, h.tx); err != nil {
+		t.Fatalf("Failed to modify column: %v", err)
+	}
+	h.Check(`SELECT id, code FROM items WHERE code = 30`, "[3:30]")
+	if err := executor.ExecuteAlterTableModifyColumn("items", "id", executor.TYPE_BYTES, h.tx); err == nil {
+		t.Errorf("Expected an error for modifying the primary key")
+	}
+
+	// The indexes on a dropped column are dropped with it
+	if err := executor.ExecuteAlterTableDropColumn("items", "qty", h.tx); err != nil {
+		t.Fatalf("Failed to drop column: %v", err)
+	}
+	h.Check(`SELECT id, code, note FROM items`, "[1:10:NULL 2:20:'hi' 3:30:NULL]")
+	if names := h.tx.GetDB().GetTableDef("items").IndexNames; fmt.Sprint(names) != "[items_code_idx]" {
+		t.Errorf("Unexpected indexes after dropping a column: %v", names)
+	}
+
+	// The renamed column keeps its values, the index columns are not renamed
+	if err := executor.ExecuteRenameColumn("items", "note", "remark", h.tx); err != nil {
+		t.Fatalf("Failed to rename column: %v", err)
+	}
+	if err := executor.ExecuteRenameColumn("items", "code", "c", h.tx); err == nil {
+		t.Errorf("Expected an error for renaming an indexed column")
+	}
+	h.Commit()
+
+	h.Begin()
+	h.Check(`SELECT id, remark FROM items WHERE remark = 'hi'`, "[2:'hi']")
+	h.Check(`SELECT id FROM items WHERE code >= 20`, "[2 3]")
+	h.Exec(`INSERT INTO items (id, code, remark) VALUES (4, 20, 'new')`)
+	h.Check(`SELECT id FROM items WHERE code = 20`, "[2 4]")
+	h.Commit()
+
+	fmt.Println("Alter Table Rows tests passed!")
+}
+
+func TestMigrations(t *testing.T) {
+	fmt.Println("Testing Migrations...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "test_migrations.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	begin := func() (migration.TX, error) {
+		txImpl := transaction.NewDBTX(&SimpleDB{store: store})
+		if err := txImpl.Begin(); err != nil {
+			return nil, err
+		}
+		return &ExecutorTX{txImpl}, nil
+	}
+	files := fstest.MapFS{
+		"0010_users.up.sql": {Data: []byte(`
+			-- the first table
+			CREATE TABLE users (id int64, name bytes, PRIMARY KEY (id));
+			INSERT INTO users (id, name) VALUES (1, 'root');
+		`)},
+		"0010_users.down.sql": {Data: []byte(`DROP TABLE users`)},
+		"0020_posts.up.sql": {Data: []byte(`
+			CREATE TABLE posts (id int64, author int64 REFERENCES users, PRIMARY KEY (id));
+			CREATE INDEX posts_author_idx ON posts (author);
+		`)},
+		"0020_posts.down.sql": {Data: []byte(`DROP INDEX posts_author_idx; DROP TABLE posts;`)},
+		"0030_tags.up.sql":    {Data: []byte(`CREATE TABLE tags (id int64, PRIMARY KEY (id)); INSERT INTO nope (id) VALUES (1);`)},
+	}
+	load := func() *migration.Runner {
+		migrations, err := migration.Load(files)
+		if err != nil {
+			t.Fatalf("Failed to load migrations: %v", err)
+		}
+		return migration.NewRunner(begin, migrations)
+	}
+	versions := func(r *migration.Runner) string {
+		applied, err := r.Applied()
+		if err != nil {
+			t.Fatalf("Failed to read the applied migrations: %v", err)
+		}
+		got := []string{}
+		for _, a := range applied {
+			got = append(got, fmt.Sprint(a.Version, a.Name))
+		}
+		return fmt.Sprint(got)
+	}
+	hasTable := func(name string) bool {
+		tx, err := begin()
+		if err != nil {
+			t.Fatalf("Failed to begin transaction: %v", err)
+		}
+		defer tx.Abort()
+		return tx.GetDB().GetTableDef(name) != nil
+	}
+
+	// The migrations are applied in order, up to a version
+	r := load()
+	if n, err := r.Up(10); err != nil || n != 1 {
+		t.Fatalf("Expected 1 migration applied, got %d, %v", n, err)
+	}
+	if got := versions(r); got != "[10users]" {
+		t.Errorf("Unexpected applied migrations: %s", got)
+	}
+
+	// A failed migration leaves no change
+	n, err := r.Up(0)
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "migration 30 (tags): statement 2") {
+		t.Errorf("Expected migration 30 to fail after 1 migration, got %d, %v", n, err)
+	}
+	if got := versions(r); got != "[10users 20posts]" || hasTable("tags") {
+		t.Errorf("Unexpected state after a failed migration: %s", got)
+	}
+	files["0030_tags.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE tags (id int64, PRIMARY KEY (id))`)}
+	files["0030_tags.down.sql"] = &fstest.MapFile{Data: []byte(`DROP TABLE IF EXISTS tags;`)}
+	r = load()
+	if n, err := r.Up(0); err != nil || n != 1 || !hasTable("tags") {
+		t.Fatalf("Expected 1 migration applied, got %d, %v", n, err)
+	}
+	if n, err := r.Up(0); err != nil || n != 0 {
+		t.Errorf("Expected no pending migration, got %d, %v", n, err)
+	}
+
+	// The recorded checksums must match the files
+	up := files["0010_users.up.sql"].Data
+	files["0010_users.up.sql"] = &fstest.MapFile{Data: append([]byte("-- edited\n"), up...)}
+	if _, err := load().Up(0); err == nil || !strings.Contains(err.Error(), "checksum of migration 10") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	files["0010_users.up.sql"] = &fstest.MapFile{Data: up}
+	files["0005_early.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE early (id int64, PRIMARY KEY (id))`)}
+	if _, err := load().Verify(); err == nil || !strings.Contains(err.Error(), "older than") {
+		t.Errorf("Expected an error for an older pending migration, got %v", err)
+	}
+	delete(files, "0005_early.up.sql")
+
+	// the checksums also cover the down files
+	down := files["0020_posts.down.sql"].Data
+	files["0020_posts.down.sql"] = &fstest.MapFile{Data: []byte(`DROP TABLE posts;`)}
+	if _, err := load().Down(1); err == nil || !strings.Contains(err.Error(), "checksum of migration 20") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	files["0020_posts.down.sql"] = &fstest.MapFile{Data: down}
+
+	// Down reverts the last migrations
+	r = load()
+	if n, err := r.Down(2); err != nil || n != 2 {
+		t.Fatalf("Expected 2 migrations reverted, got %d, %v", n, err)
+	}
+	if got := versions(r); got != "[10users]" || hasTable("posts") || hasTable("tags") || !hasTable("users") {
+		t.Errorf("Unexpected state after down migrations: %s", got)
+	}
+	if n, err := r.Down(5); err != nil || n != 1 || hasTable("users") {
+		t.Errorf("Expected 1 migration reverted, got %d, %v", n, err)
+	}
+
+	// the history is in the catalog, not in a user table
+	if tables, err := database.NewSimpleDB(store).ListTables(); err != nil || len(tables) != 0 {
+		t.Errorf("Expected no table, got %v, %v", tables, err)
+	}
+
+	// Bad file names are rejected
+	if _, err := migration.Load(fstest.MapFS{"users.up.sql": {}}); err == nil {
+		t.Errorf("Expected an error for a file name without a version")
+	}
+	if _, err := migration.Load(fstest.MapFS{"0010_users.down.sql": {}}); err == nil {
+		t.Errorf("Expected an error for a migration without an up file")
+	}
+
+	fmt.Println("Migrations tests passed!")
+}
+
+func TestViews(t *testing.T) {
+	fmt.Println("Testing Views...")
+
+	h := newSQLHarness(t, "test_views.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE users (id int64, name bytes, age int64, PRIMARY KEY (id))`)
+	h.Exec(`INSERT INTO users (id, name, age) VALUES (1, 'ann', 34)`)
+	h.Exec(`INSERT INTO users (id, name, age) VALUES (2, 'bob', 12)`)
+	h.Exec(`INSERT INTO users (id, name, age) VALUES (3, 'cat', 25)`)
+	h.Exec(`INSERT INTO users (id, name, age) VALUES (4, 'dan', 61)`)
+
+	// A view is expanded in FROM, with the outer FILTER and LIMIT
+	h.Exec(`CREATE VIEW adults AS SELECT id, name, age FROM users WHERE age >= 18`)
+	h.Check(`SELECT name FROM adults`, "[ann cat dan]")
+	h.Check(`SELECT id, name FROM adults WHERE age < 40 LIMIT 1`, "[1:ann]")
+	h.Check(`SELECT name FROM adults LIMIT 5, 1`, "[cat dan]")
+
+	// Views of views, with the column names or the expressions named by AS
+	h.Exec(`CREATE VIEW adult_names (n) AS SELECT name FROM adults`)
+	h.Check(`SELECT n FROM adult_names WHERE n != 'cat'`, "[ann dan]")
+	h.Exec(`CREATE VIEW next_ages AS SELECT id, age + 1 AS next FROM users`)
+	h.Check(`SELECT next FROM next_ages WHERE id = 2`, "[13]")
+
+	// The query is checked when the view is created
+	h.ExpectErr(`CREATE VIEW bad AS SELECT age * 2 FROM users`, "needs a name")
+	h.ExpectErr(`CREATE VIEW bad AS SELECT id FROM users WHERE nope > 1`, "unknown column nope")
+	h.ExpectErr(`CREATE VIEW bad AS SELECT id FROM nope`, "table nope does not exist")
+	h.ExpectErr(`CREATE VIEW bad (a, b) AS SELECT id FROM users`, "got 2 names")
+	h.ExpectErr(`CREATE VIEW users AS SELECT id FROM users`, "table users already exists")
+	h.ExpectErr(`CREATE TABLE adults (id int64, PRIMARY KEY (id))`, "view adults already exists")
+
+	// Views are read-only
+	h.ExpectErr(`INSERT INTO adults (id, name, age) VALUES (5, 'eve', 40)`, "not found")
+	h.ExpectErr(`SELECT id FROM adults INDEX BY id > 1`, "INDEX BY is not supported")
+	h.Commit()
+
+	// Views are listed with the tables
+	h.Begin()
+	tables, err := executor.ListTables(h.tx)
+	if err != nil || fmt.Sprint(tables) != "[adult_names adults next_ages users]" {
+		t.Errorf("Unexpected tables: %v, %v", tables, err)
+	}
+	info, err := executor.GetTableInfo("adult_names", h.tx)
+	if err != nil || info.View != "SELECT name FROM adults" || len(info.Columns) != 1 ||
+		info.Columns[0].Type != int(executor.TYPE_BYTES) {
+		t.Errorf("Unexpected view info: %+v, %v", info, err)
+	}
+	if info, err := executor.GetTableInfo("next_ages", h.tx); err != nil || info.Columns[1].Type != int(executor.TYPE_ERROR) {
+		t.Errorf("Unexpected view info: %+v, %v", info, err)
+	}
+
+	// The columns used by the views cannot be dropped or retyped
+	if err := executor.ExecuteAlterTableDropColumn("users", "age", h.tx); err == nil ||
+		!strings.Contains(err.Error(), "column age is used by view adults") {
+		t.Errorf("Expected an error for dropping a column used by a view, got %v", err)
+	}
+	if err := executor.ExecuteRenameColumn("users", "name", "login", h.tx); err == nil {
+		t.Errorf("Expected an error for renaming a column used by a view")
+	}
+	if err := executor.ExecuteAlterTableModifyColumn("users", "age", executor.TYPE_BYTES, h.tx); err == nil ||
+		!strings.Contains(err.Error(), "cannot change the type of column age") {
+		t.Errorf("Expected an error for retyping a column used by a view, got %v", err)
+	}
+	if err := executor.ExecuteAlterTableAddColumn("users", "email", executor.TYPE_BYTES, h.tx); err != nil {
+		t.Errorf("Failed to add a column: %v", err)
+	}
+	h.Check(`SELECT name FROM adults`, "[ann cat dan]")
+
+	// The views must be dropped before the tables or the views they use
+	h.ExpectErr(`DROP TABLE users`, "users is used by view adults")
+	h.ExpectErr(`DROP VIEW adults`, "adults is used by view adult_names")
+	if err := executor.ExecuteRenameTable("users", "people", h.tx); err == nil {
+		t.Errorf("Expected an error for renaming a table used by a view")
+	}
+	h.Exec(`DROP VIEW adult_names`)
+	h.Exec(`DROP VIEW IF EXISTS adult_names`)
+	h.ExpectErr(`DROP VIEW adult_names`, "view adult_names does not exist")
+	h.Exec(`DROP VIEW adults`)
+	h.Exec(`DROP VIEW next_ages`)
+	h.Exec(`DROP TABLE users`)
+	if tables, _ := executor.ListTables(h.tx); len(tables) != 0 {
+		t.Errorf("Expected no tables, got %v", tables)
+	}
+	h.Commit()
+
+	fmt.Println("Views tests passed!")
+}
+
+func TestMaterializedViews(t *testing.T) {
+	fmt.Println("Testing Materialized Views...")
+
+	h := newSQLHarness(t, "test_matviews.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE customers (id int64, name bytes, PRIMARY KEY (id))`)
+	h.Exec(`CREATE TABLE orders (
+		id int64, customer int64 REFERENCES customers ON DELETE CASCADE,
+		amount decimal(10, 2), paid bool, PRIMARY KEY (id)
+	)`)
+	h.Exec(`INSERT INTO customers (id, name) VALUES (1, 'ann')`)
+	h.Exec(`INSERT INTO customers (id, name) VALUES (2, 'bob')`)
+	h.Exec(`INSERT INTO orders (id, customer, amount, paid) VALUES (10, 1, DECIMAL '5.50', true)`)
+	h.Exec(`INSERT INTO orders (id, customer, amount, paid) VALUES (11, 2, 20, false)`)
+	h.Exec(`INSERT INTO orders (id, customer, amount, paid) VALUES (12, 1, 7, false)`)
+
+	// The rows of the query are stored when the view is created
+	h.Exec(`CREATE MATERIALIZED VIEW unpaid AS
+		SELECT customer, amount * 2 AS due, id FROM orders WHERE NOT paid`)
+	h.Check(`SELECT id, customer, due FROM unpaid`, "[11:2:40.00 12:1:14.00]")
+	info, err := executor.GetTableInfo("unpaid", h.tx)
+	if err != nil || info.PrimaryKeys != 1 || info.Columns[0].Name != "id" ||
+		info.Columns[2].Type != int(executor.TYPE_DECIMAL) || !strings.HasPrefix(info.View, "SELECT customer") {
+		t.Errorf("Unexpected view info: %+v, %v", info, err)
+	}
+
+	// The writes of the table maintain the view, including the cascades
+	h.Exec(`INSERT INTO orders (id, customer, amount, paid) VALUES (13, 2, DECIMAL '0.125', false)`)
+	h.Exec(`UPDATE orders SET paid = true WHERE id = 11`)
+	h.Exec(`UPDATE orders SET paid = false, amount = 1 WHERE id = 10`)
+	h.Check(`SELECT id, due FROM unpaid`, "[10:2.00 12:14.00 13:0.26]")
+	h.Exec(`UPDATE orders SET id = 14 WHERE id = 12`)
+	h.Check(`SELECT id FROM unpaid`, "[10 13 14]")
+	h.Exec(`DELETE FROM customers WHERE id = 1`)
+	h.Check(`SELECT id, customer FROM unpaid`, "[13:2]")
+
+	// The view can be indexed, but not written
+	h.Exec(`CREATE INDEX unpaid_customer ON unpaid (customer)`)
+	h.Check(`SELECT id FROM unpaid INDEX BY customer = 2`, "[13]")
+	h.ExpectErr(`INSERT INTO unpaid (id, customer, due) VALUES (1, 1, 1)`, "cannot modify materialized view unpaid")
+	h.ExpectErr(`DELETE FROM unpaid WHERE id = 13`, "cannot modify materialized view unpaid")
+	h.ExpectErr(`DROP TABLE unpaid`, "unpaid is a materialized view")
+	h.ExpectErr(`DROP VIEW unpaid`, "view unpaid does not exist")
+	h.ExpectErr(`DROP TABLE orders`, "orders is used by view unpaid")
+	if err := executor.ExecuteAlterTableDropColumn("orders", "paid", h.tx); err == nil ||
+		!strings.Contains(err.Error(), "column paid is used by view unpaid") {
+		t.Errorf("Expected an error for dropping a column used by a view, got %v", err)
+	}
+	if err := executor.ExecuteAlterTableModifyColumn("orders", "amount", executor.TYPE_INT64, h.tx); err == nil ||
+		!strings.Contains(err.Error(), "cannot change the type of column amount") {
+		t.Errorf("Expected an error for retyping a column used by a view, got %v", err)
+	}
+
+	// REFRESH recomputes the rows, and TRUNCATE empties the view
+	h.Exec(`REFRESH MATERIALIZED VIEW unpaid`)
+	h.Check(`SELECT id, due FROM unpaid`, "[13:0.26]")
+	h.Check(`SELECT id FROM unpaid INDEX BY customer = 2`, "[13]")
+	if err := h.tx.TruncateTable("orders"); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	h.Check(`SELECT id FROM unpaid`, "[]")
+	h.ExpectErr(`REFRESH MATERIALIZED VIEW orders`, "orders is not a materialized view")
+
+	// The query is checked when the view is created
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT customer FROM orders`,
+		"must select the primary key column id")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT id FROM orders LIMIT 1`, "LIMIT is not supported")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT id FROM orders INDEX BY id > 1`, "INDEX BY is not supported")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT id, NULL AS x FROM orders`, "the type of column x is unknown")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT id FROM unpaid`, "cannot select from materialized view")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW unpaid AS SELECT id FROM orders`, "table unpaid already exists")
+
+	// The JSON elements have the type of the operator
+	h.Exec(`CREATE TABLE docs (id int64, doc json, PRIMARY KEY (id))`)
+	h.Exec(`INSERT INTO docs (id, doc) VALUES (1, '{"tags": ["a", "b"], "n": 2}')`)
+	h.Exec(`CREATE MATERIALIZED VIEW doc_tags AS
+		SELECT id, doc->'tags' AS tags, json_type(doc, 'n') AS n FROM docs`)
+	h.Exec(`INSERT INTO docs (id, doc) VALUES (2, '{"tags": {}}')`)
+	h.Check(`SELECT id, json_type(tags), n FROM doc_tags`, "[1:array:number 2:object:NULL]")
+	h.ExpectErr(`CREATE MATERIALIZED VIEW bad AS SELECT id, doc->>'n' AS n FROM docs`,
+		"the type of column n is unknown")
+	h.Commit()
+
+	// The view is stored with the committed rows
+	h.Begin()
+	h.Exec(`INSERT INTO customers (id, name) VALUES (3, 'cat')`)
+	h.Exec(`INSERT INTO orders (id, customer, amount, paid) VALUES (20, 3, 3, false)`)
+	h.Check(`SELECT id, due FROM unpaid`, "[20:6.00]")
+	tables, err := executor.ListTables(h.tx)
+	if err != nil || fmt.Sprint(tables) != "[customers doc_tags docs orders unpaid]" {
+		t.Errorf("Unexpected tables: %v, %v", tables, err)
+	}
+	h.Exec(`DROP MATERIALIZED VIEW unpaid`)
+	h.Exec(`DROP MATERIALIZED VIEW IF EXISTS unpaid`)
+	h.ExpectErr(`DROP MATERIALIZED VIEW orders`, "orders is not a materialized view")
+	h.Exec(`DROP TABLE orders`)
+	h.Commit()
+
+	// A view row that cannot be computed undoes the write of the table
+	h.Begin()
+	h.Exec(`CREATE TABLE parts (id int64, qty int64, PRIMARY KEY (id))`)
+	h.Exec(`INSERT INTO parts (id, qty) VALUES (1, 4)`)
+	h.Exec(`CREATE MATERIALIZED VIEW shares AS SELECT id, 100 / qty AS share FROM parts`)
+	h.Commit()
+	h.Begin()
+	h.ExpectErr(`INSERT INTO parts (id, qty) VALUES (2, 0)`, "division by zero")
+	h.ExpectErr(`UPDATE parts SET qty = 0 WHERE id = 1`, "division by zero")
+	h.Commit()
+	h.Begin()
+	h.Check(`SELECT id, qty FROM parts`, "[1:4]")
+	h.Check(`SELECT id, share FROM shares`, "[1:25]")
+	h.Commit()
+
+	fmt.Println("Materialized Views tests passed!")
+}
+
+func TestTriggers(t *testing.T) {
+	fmt.Println("Testing Triggers...")
+
+	h := newSQLHarness(t, "test_triggers.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE items (id int64, name bytes, qty int64, total int64, PRIMARY KEY (id))`)
+	h.Exec(`CREATE TABLE audit (
+		n int64 AUTO_INCREMENT, action bytes, item int64, old_qty int64, new_qty int64, PRIMARY KEY (n)
+	)`)
+
+	// The statements see the new and the old rows
+	h.Exec(`CREATE TRIGGER items_ins AFTER INSERT ON items FOR EACH ROW
+		INSERT INTO audit (action, item, new_qty) VALUES ('insert', NEW.id, NEW.qty)`)
+	h.Exec(`CREATE TRIGGER items_upd AFTER UPDATE ON items FOR EACH ROW
+		INSERT INTO audit (action, item, old_qty, new_qty) VALUES ('update', NEW.id, OLD.qty, NEW.qty)`)
+	h.Exec(`CREATE TRIGGER items_del BEFORE DELETE ON items FOR EACH ROW
+		INSERT INTO audit (action, item, old_qty) VALUES ('delete', OLD.id, OLD.qty)`)
+	// A BEFORE trigger changes the new row, the triggers run by name
+	h.Exec(`CREATE TRIGGER a_total BEFORE INSERT ON items FOR EACH ROW SET NEW.total = NEW.qty * 10`)
+	h.Exec(`CREATE TRIGGER b_total BEFORE UPDATE ON items FOR EACH ROW
+		SET NEW.total = NEW.qty * 10, NEW.name = 'changed'`)
+
+	h.Exec(`INSERT INTO items (id, name, qty) VALUES (1, 'pen', 3)`)
+	h.Exec(`INSERT INTO items (id, name, qty) VALUES (2, 'ink', 5)`)
+	h.Exec(`UPDATE items SET qty = qty + 1 WHERE id = 1`)
+	h.Exec(`DELETE FROM items WHERE id = 2`)
+	h.Check(`SELECT id, name, qty, total FROM items`, "[1:changed:4:40]")
+	h.Check(`SELECT n, action, item, old_qty, new_qty FROM audit`,
+		"[1:insert:1:NULL:3 2:insert:2:NULL:5 3:update:1:3:4 4:delete:2:5:NULL]")
+
+	// An error of a trigger fails the statement
+	h.Exec(`CREATE TRIGGER no_big BEFORE INSERT ON items FOR EACH ROW
+		INSERT INTO audit (n, action) VALUES (NEW.qty / (100 - NEW.qty), 'big')`)
+	h.ExpectErr(`INSERT INTO items (id, name, qty) VALUES (3, 'box', 100)`, "trigger no_big")
+	h.Check(`SELECT id FROM items`, "[1]")
+	h.Exec(`DROP TRIGGER no_big`)
+	h.Exec(`DROP TRIGGER IF EXISTS no_big`)
+	h.ExpectErr(`DROP TRIGGER no_big`, "trigger no_big does not exist")
+
+	// A trigger that fires itself stops at the maximum nesting
+	h.Exec(`CREATE TRIGGER again AFTER UPDATE ON items FOR EACH ROW
+		UPDATE items SET qty = qty + 1 WHERE id = NEW.id`)
+	h.ExpectErr(`UPDATE items SET qty = 0 WHERE id = 1`, "nested triggers")
+	h.Exec(`DROP TRIGGER again`)
+
+	// A failed trigger undoes the row and the writes of the other
+	// triggers, and the transaction goes on
+	h.Check(`SELECT id, qty FROM items`, "[1:4]")
+	h.Exec(`CREATE TRIGGER z_big AFTER INSERT ON items FOR EACH ROW
+		INSERT INTO audit (n, action) VALUES (NEW.qty / (100 - NEW.qty), 'big')`)
+	h.ExpectErr(`INSERT INTO items (id, name, qty) VALUES (3, 'box', 100)`, "trigger z_big")
+	h.Exec(`DROP TRIGGER z_big`)
+	h.Commit()
+	h.Begin()
+	h.Check(`SELECT id, qty FROM items`, "[1:4]")
+	h.Check(`SELECT n, action FROM audit`, "[1:insert 2:insert 3:update 4:delete]")
+
+	// The other entry points of the writes fire the triggers too
+	parse := func(query string) interface{} {
+		stmt, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", query, err)
+		}
+		return stmt
+	}
+	for _, query := range []string{
+		`INSERT INTO items (id, name, qty) VALUES (5, 'cap', 2)`,
+		`INSERT INTO items (id, name, qty) VALUES (5, 'cap', 6)`,
+	} {
+		if _, err := executor.ExecuteInsertWithMode(parse(query).(*executor.QLInsert), h.tx, executor.InsertModeUpsert); err != nil {
+			t.Fatalf("Failed to upsert: %v", err)
+		}
+	}
+	h.Check(`SELECT id, name, total FROM items WHERE id = 5`, "[5:changed:60]")
+	update := parse(`UPDATE items SET qty = 7 WHERE id = 5`).(*executor.QLUpdate)
+	if n, err := executor.ExecuteUpdateWithCondition(update, h.tx, executor.QLNode{}); err != nil || n != 1 {
+		t.Fatalf("Failed to update: %d, %v", n, err)
+	}
+	key := *(&executor.Record{}).AddInt64("id", 5)
+	del := &executor.QLDelete{QLScan: executor.QLScan{Table: "items"}}
+	if n, err := executor.ExecuteDeleteBatch(del, h.tx, []executor.Record{key}); err != nil || n != 1 {
+		t.Fatalf("Failed to delete: %d, %v", n, err)
+	}
+	h.Check(`SELECT action, old_qty, new_qty FROM audit WHERE item = 5`,
+		"[insert:NULL:2 update:2:6 update:6:7 delete:7:NULL]")
+
+	// The statement is checked when the trigger is created
+	h.ExpectErr(`CREATE TRIGGER bad AFTER INSERT ON items FOR EACH ROW SET NEW.qty = 1`,
+		"only allowed in BEFORE INSERT and BEFORE UPDATE")
+	h.ExpectErr(`CREATE TRIGGER bad BEFORE INSERT ON items FOR EACH ROW SET NEW.nope = 1`, "unknown column NEW.nope")
+	h.ExpectErr(`CREATE TRIGGER bad BEFORE INSERT ON items FOR EACH ROW SET NEW.qty = qty`, "expect NEW.qty")
+	h.ExpectErr(`CREATE TRIGGER bad AFTER INSERT ON items FOR EACH ROW DELETE FROM audit WHERE item = OLD.id`,
+		"OLD is not available in INSERT triggers")
+	h.ExpectErr(`CREATE TRIGGER bad AFTER DELETE ON items FOR EACH ROW SELECT id FROM items`,
+		"must be INSERT, UPDATE, DELETE or SET NEW")
+	h.ExpectErr(`CREATE TRIGGER bad AFTER DELETE ON nope FOR EACH ROW DELETE FROM audit`, "table nope does not exist")
+	h.ExpectErr(`CREATE TRIGGER items_ins AFTER DELETE ON items FOR EACH ROW DELETE FROM audit`,
+		"trigger items_ins already exists")
+	// the parser only makes NEW.col and OLD.col, the others are rejected
+	body := `DELETE FROM audit WHERE item = OLD.id`
+	stmt, err := parser.ParseTriggerBody([]byte(body))
+	if err != nil {
+		t.Fatalf("Parse error for %s: %v", body, err)
+	}
+	stmt.(*executor.QLDelete).Filter.Kids[1].Value.Str = []byte("row.id")
+	req := &executor.QLCreateTrigger{Name: "bad", Timing: "AFTER", Event: "DELETE", Table: "items",
+		Body: body, Stmt: stmt}
+	if err := executor.ExecuteCreateTrigger(req, h.tx); err == nil ||
+		!strings.Contains(err.Error(), "unknown column row.id, expect NEW.id or OLD.id") {
+		t.Errorf("Expected an error for a bad row qualifier, got %v", err)
+	}
+	h.Commit()
+
+	// The triggers follow a renamed table, and are dropped with it
+	h.Begin()
+	if err := executor.ExecuteRenameTable("items", "goods", h.tx); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	h.Exec(`INSERT INTO goods (id, name, qty) VALUES (7, 'cup', 1)`)
+	h.Check(`SELECT id, total FROM goods WHERE id = 7`, "[7:10]")
+	h.Check(`SELECT action, item FROM audit WHERE item = 7`, "[insert:7]")
+	h.Exec(`DROP TABLE goods`)
+	if triggers, err := h.tx.GetTriggers("goods"); err != nil || len(triggers) != 0 {
+		t.Errorf("Expected the triggers to be dropped, got %v, %v", triggers, err)
+	}
+	h.Commit()
+
+	fmt.Println("Triggers tests passed!")
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	fmt.Println("Testing Generated Columns...")
+
+	h := newSQLHarness(t, "test_generated.db")
+
+	h.Begin()
+	h.Exec(`CREATE TABLE users (
+		id int64, email bytes, first bytes, last bytes, qty int64,
+		email_key bytes GENERATED ALWAYS AS (lower(email)) STORED UNIQUE,
+		full_name bytes GENERATED ALWAYS AS (concat(first, ' ', last)) VIRTUAL,
+		qty2 int64 GENERATED ALWAYS AS (qty * 2) CHECK (qty2 < 100),
+		PRIMARY KEY (id)
+	)`)
+	h.Exec(`INSERT INTO users (id, email, first, last, qty) VALUES (1, 'Ann@X.com', 'Ann', 'Lee', 3)`)
+	h.Exec(`INSERT INTO users (id, email, first, last, qty) VALUES (2, 'bob@y.com', 'Bob', 'Ray', 4)`)
+	h.Check(`SELECT id, email_key, full_name, qty2 FROM users`, "[1:ann@x.com:Ann Lee:6 2:bob@y.com:Bob Ray:8]")
+
+	// Both kinds are indexed, the virtual ones by the computed values
+	h.ExpectErr(`INSERT INTO users (id, email, first, last, qty) VALUES (3, 'ANN@x.com', 'A', 'L', 1)`,
+		"violates unique index users_email_key_key")
+	h.Exec(`CREATE INDEX users_name ON users (full_name)`)
+	h.Exec(`CREATE INDEX users_qty2 ON users (qty2)`)
+	h.Check(`SELECT id FROM users INDEX BY full_name = 'Bob Ray'`, "[2]")
+	h.Check(`SELECT id FROM users INDEX BY qty2 > 7`, "[2]")
+
+	// The columns are computed again on UPDATE
+	h.Exec(`UPDATE users SET last = 'Kim', qty = qty + 1 WHERE id = 2`)
+	h.Check(`SELECT id FROM users INDEX BY full_name = 'Bob Ray'`, "[]")
+	h.Check(`SELECT id, full_name, qty2 FROM users INDEX BY full_name = 'Bob Kim'`, "[2:Bob Kim:10]")
+	h.ExpectErr(`UPDATE users SET qty = 60 WHERE id = 1`, "violates CHECK constraint")
+
+	// They cannot be written
+	h.ExpectErr(`INSERT INTO users (id, email_key) VALUES (5, 'x')`, "cannot write generated column email_key")
+	h.ExpectErr(`INSERT INTO users VALUES (5, 'e', 'f', 'l', 1, 'x')`, "cannot write generated column email_key")
+	h.ExpectErr(`UPDATE users SET full_name = 'x' WHERE id = 1`, "cannot write generated column full_name")
+	h.ExpectErr(`CREATE TRIGGER bad BEFORE INSERT ON users FOR EACH ROW SET NEW.qty2 = 1`,
+		"cannot write generated column NEW.qty2")
+
+	// After SET NEW of a trigger
+	h.Exec(`CREATE TRIGGER upper_first BEFORE INSERT ON users FOR EACH ROW SET NEW.first = upper(NEW.first)`)
+	h.Exec(`INSERT INTO users (id, email, first, last, qty) VALUES (3, 'c@z.com', 'Cy', 'Orr', 0)`)
+	h.Check(`SELECT full_name FROM users WHERE id = 3`, "[CY Orr]")
+	h.Exec(`DROP TRIGGER upper_first`)
+
+	// The expressions are checked with the table
+	h.ExpectErr(`CREATE TABLE bad (id int64, a int64 GENERATED ALWAYS AS (b), b int64 GENERATED ALWAYS AS (id),
+		PRIMARY KEY (id))`, "cannot refer to generated column")
+	h.ExpectErr(`CREATE TABLE bad (id int64, a int64 GENERATED ALWAYS AS (nope), PRIMARY KEY (id))`,
+		"unknown column nope")
+	h.ExpectErr(`CREATE TABLE bad (id int64, a int64 GENERATED ALWAYS AS (lower('x')), PRIMARY KEY (id))`,
+		"expected type")
+	h.ExpectErr(`CREATE TABLE bad (id int64 GENERATED ALWAYS AS (1), PRIMARY KEY (id))`, "cannot be generated")
+	h.Commit()
+
+	// The virtual columns are computed by the next transactions
+	h.Begin()
+	h.Check(`SELECT id, full_name FROM users INDEX BY full_name >= 'B'`, "[2:Bob Kim 3:CY Orr]")
+	h.Exec(`DELETE FROM users WHERE id = 3`)
+	h.Check(`SELECT id FROM users INDEX BY full_name >= 'B'`, "[2]")
+	if err := executor.ExecuteRenameColumn("users", "first", "given", h.tx); err == nil ||
+		!strings.Contains(err.Error(), "used by generated column full_name") {
+		t.Errorf("Expected the rename to fail, got %v", err)
+	}
+	if err := executor.ExecuteAlterTableDropColumn("users", "full_name", h.tx); err != nil {
+		t.Fatalf("Failed to drop the column: %v", err)
+	}
+	h.Exec(`UPDATE users SET first = 'Al' WHERE id = 1`)
+	h.Check(`SELECT id, email_key, qty2 FROM users`, "[1:ann@x.com:6 2:bob@y.com:10]")
+
+	// The ALTERs keep the generated columns of the new rows
+	if err := executor.ExecuteAlterTableAddColumn("users", "note", executor.TYPE_BYTES, h.tx); err != nil {
+		t.Fatalf("Failed to add the column: %v", err)
+	}
+	h.Exec(`INSERT INTO users (id, email, first, last, qty) VALUES (4, 'Dee@W.com', 'Dee', 'Fox', 5)`)
+	h.Check(`SELECT id, email_key, qty2, note FROM users WHERE id = 4`, "[4:dee@w.com:10:NULL]")
+	h.Commit()
+
+	h.Begin()
+	h.Exec(`INSERT INTO users (id, email, first, last, qty) VALUES (5, 'EVE@v.com', 'Eve', 'Ng', 7)`)
+	h.Check(`SELECT id, email_key, qty2 FROM users WHERE id >= 4`, "[4:dee@w.com:10 5:eve@v.com:14]")
+	h.ExpectErr(`INSERT INTO users (id, email_key) VALUES (6, 'x')`, "cannot write generated column email_key")
+	h.Commit()
+
+	fmt.Println("Generated Columns tests passed!")
+}
+
+func TestDeleteAll(t *testing.T) {
+	fmt.Println("Testing Delete All...")
+
+	h := newSQLHarness(t, "test_delete_all.db")
+
+	// enough rows for several leaves
+	const rows = 3000
+	h.Begin()
+	h.Exec("CREATE TABLE logs (id int64, msg bytes, PRIMARY KEY (id))")
+	for i := int64(0); i < rows; i++ {
+		rec := (&executor.Record{}).AddInt64("id", i).AddStr("msg", []byte(fmt.Sprint("message ", i)))
+		if err := h.tx.Insert("logs", *rec); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	h.Commit()
+
+	h.Begin()
+	req := &executor.QLDelete{QLScan: executor.QLScan{Table: "logs"}}
+	id := func(v int64) executor.Record { return *(&executor.Record{}).AddInt64("id", v) }
+	n, err := executor.ExecuteDeleteByRange(req, h.tx, id(1000), id(1999))
+	if err != nil || n != 1000 {
+		t.Fatalf("Expected 1000 rows deleted by range, got %d, %v", n, err)
+	}
+	h.Check(`SELECT id FROM logs WHERE id >= 998 AND id <= 2001`, "[998 999 2000 2001]")
+	n, err = executor.ExecuteDeleteAll(req, h.tx)
+	if err != nil || n != rows-1000 {
+		t.Fatalf("Expected %d rows deleted, got %d, %v", rows-1000, n, err)
+	}
+	h.Commit()
+
+	h.Begin()
+	h.Check(`SELECT id FROM logs`, "[]")
+	h.Commit()
+
+	fmt.Println("Delete All tests passed!")
+}
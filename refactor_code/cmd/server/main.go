@@ -4,30 +4,46 @@ import (
 	"fmt"
 	"log"
 
+	"govetachun/go-mini-db/refactor_code/internal/database"
 	"govetachun/go-mini-db/refactor_code/internal/query/executor"
 	"govetachun/go-mini-db/refactor_code/internal/query/parser"
 	"govetachun/go-mini-db/refactor_code/internal/storage"
 	"govetachun/go-mini-db/refactor_code/internal/transaction"
 )
 
-// SimpleDB represents a simple database implementation
+// SimpleDB represents a simple database implementation.
+// The table definitions are stored in the catalog of the KV store.
 type SimpleDB struct {
-	store  storage.KVStore
-	tables map[string]*executor.TableDef
+	store storage.KVStore
 }
 
 // GetTableDef returns a table definition
 func (db *SimpleDB) GetTableDef(name string) *executor.TableDef {
-	return db.tables[name]
+	tdef, err := database.CatalogGet(db.store, name)
+	if err != nil {
+		return nil
+	}
+	return tdef
 }
 
-// ListTables returns a list of all table names
+// ListTables returns a list of all table and view names
 func (db *SimpleDB) ListTables() ([]string, error) {
-	tables := make([]string, 0, len(db.tables))
-	for name := range db.tables {
-		tables = append(tables, name)
-	}
-	return tables, nil
+	return database.CatalogNames(db.store)
+}
+
+// GetStore returns the KV store, so transactions can update the catalog
+func (db *SimpleDB) GetStore() storage.KVStore {
+	return db.store
+}
+
+// ViewRowFunc lets the transactions maintain the materialized views
+func (db *SimpleDB) ViewRowFunc(view *executor.TableDef) (func(executor.Record) (*executor.Record, error), error) {
+	return executor.ViewRowFunc(view)
+}
+
+// VirtualFunc lets the transactions compute the virtual generated columns
+func (db *SimpleDB) VirtualFunc(tdef *executor.TableDef) (func([]executor.Value) error, error) {
+	return executor.VirtualFunc(tdef)
 }
 
 // ExecutorTX wraps transaction.DBTX to implement executor.DBTX
@@ -36,25 +52,13 @@ type ExecutorTX struct {
 }
 
 func (etx *ExecutorTX) TableNew(def *executor.TableDef) error {
-	// Convert to transaction.TableDef
-	txDef := &transaction.TableDef{
-		Name:  def.Name,
-		Cols:  def.Cols,
-		Types: def.Types,
-		PKeys: def.PKeys,
-	}
-	return etx.tx.TableNew(txDef)
+	// Both are database.TableDef, the whole definition is passed
+	return etx.tx.TableNew(def)
 }
 
 func (etx *ExecutorTX) Scan(table string, scanner *executor.Scanner) error {
-	// Convert to transaction.Scanner
-	txScanner := &transaction.Scanner{
-		Key1: transaction.Record{Cols: scanner.Key1.Cols, Vals: convertValues(scanner.Key1.Vals)},
-		Key2: transaction.Record{Cols: scanner.Key2.Cols, Vals: convertValues(scanner.Key2.Vals)},
-		Cmp1: scanner.Cmp1,
-		Cmp2: scanner.Cmp2,
-	}
-	return etx.tx.Scan(table, txScanner)
+	// Both are database.Scanner, the iterator state is set in place
+	return etx.tx.Scan(table, scanner)
 }
 
 func (etx *ExecutorTX) Delete(table string, key executor.Record) (bool, error) {
@@ -97,20 +101,22 @@ func (etx *ExecutorTX) DropTable(tableName string) error {
 }
 
 func (etx *ExecutorTX) AlterTable(tableName string, newDef *executor.TableDef) error {
-	// Convert to transaction.TableDef
-	txDef := &transaction.TableDef{
-		Name:  newDef.Name,
-		Cols:  newDef.Cols,
-		Types: newDef.Types,
-		PKeys: newDef.PKeys,
-	}
-	return etx.tx.AlterTable(tableName, txDef)
+	return etx.AlterTableRows(tableName, newDef, nil)
+}
+
+func (etx *ExecutorTX) AlterTableRows(tableName string, newDef *executor.TableDef, convert func(executor.Record) (executor.Record, error)) error {
+	// Both are database.TableDef, the whole definition is passed
+	return etx.tx.AlterTableRows(tableName, newDef, convert)
 }
 
 func (etx *ExecutorTX) CreateIndex(indexName string, tableName string, columnNames []string) error {
 	return etx.tx.CreateIndex(indexName, tableName, columnNames)
 }
 
+func (etx *ExecutorTX) CreateUniqueIndex(indexName string, tableName string, columnNames []string) error {
+	return etx.tx.CreateUniqueIndex(indexName, tableName, columnNames)
+}
+
 func (etx *ExecutorTX) DropIndex(indexName string) error {
 	return etx.tx.DropIndex(indexName)
 }
@@ -123,6 +129,86 @@ func (etx *ExecutorTX) RenameTable(oldName string, newName string) error {
 	return etx.tx.RenameTable(oldName, newName)
 }
 
+func (etx *ExecutorTX) CreateSequence(seq *executor.Sequence) error {
+	return etx.tx.CreateSequence(seq)
+}
+
+func (etx *ExecutorTX) DropSequence(name string) error {
+	return etx.tx.DropSequence(name)
+}
+
+func (etx *ExecutorTX) NextVal(name string) (int64, error) {
+	return etx.tx.NextVal(name)
+}
+
+func (etx *ExecutorTX) CurrVal(name string) (int64, error) {
+	return etx.tx.CurrVal(name)
+}
+
+func (etx *ExecutorTX) CreateView(view *executor.View) error {
+	return etx.tx.CreateView(view)
+}
+
+func (etx *ExecutorTX) DropView(name string) error {
+	return etx.tx.DropView(name)
+}
+
+func (etx *ExecutorTX) GetView(name string) (*executor.View, error) {
+	return etx.tx.GetView(name)
+}
+
+func (etx *ExecutorTX) CreateMatView(def *executor.TableDef) error {
+	return etx.tx.CreateMatView(def)
+}
+
+func (etx *ExecutorTX) RefreshMatView(name string) error {
+	return etx.tx.RefreshMatView(name)
+}
+
+func (etx *ExecutorTX) DropMatView(name string) error {
+	return etx.tx.DropMatView(name)
+}
+
+func (etx *ExecutorTX) CreateTrigger(trig *executor.Trigger) error {
+	return etx.tx.CreateTrigger(trig)
+}
+
+func (etx *ExecutorTX) DropTrigger(name string) error {
+	return etx.tx.DropTrigger(name)
+}
+
+func (etx *ExecutorTX) GetTrigger(name string) (*executor.Trigger, error) {
+	return etx.tx.GetTrigger(name)
+}
+
+func (etx *ExecutorTX) GetTriggers(table string) ([]executor.Trigger, error) {
+	return etx.tx.GetTriggers(table)
+}
+
+func (etx *ExecutorTX) Atomic(write func() error) error {
+	return etx.tx.Atomic(write)
+}
+
+func (etx *ExecutorTX) Migrations() ([]database.SchemaMigration, error) {
+	return etx.tx.Migrations()
+}
+
+func (etx *ExecutorTX) RecordMigration(m *database.SchemaMigration) error {
+	return etx.tx.RecordMigration(m)
+}
+
+func (etx *ExecutorTX) ForgetMigration(version int64) error {
+	return etx.tx.ForgetMigration(version)
+}
+
+func (etx *ExecutorTX) Commit() error {
+	return etx.tx.Commit()
+}
+
+func (etx *ExecutorTX) Abort() error {
+	return etx.tx.Abort()
+}
+
 func (etx *ExecutorTX) GetDB() executor.DB {
 	return &ExecutorDBWrapper{db: etx.tx.GetDB()}
 }
@@ -133,18 +219,8 @@ type ExecutorDBWrapper struct {
 }
 
 func (w *ExecutorDBWrapper) GetTableDef(name string) *executor.TableDef {
-	txDef := w.db.GetTableDef(name)
-	if txDef == nil {
-		return nil
-	}
-
-	// Convert transaction.TableDef to executor.TableDef
-	return &executor.TableDef{
-		Name:  txDef.Name,
-		Cols:  txDef.Cols,
-		Types: txDef.Types,
-		PKeys: txDef.PKeys,
-	}
+	// Both are database.TableDef, the indexes are used by the executor
+	return w.db.GetTableDef(name)
 }
 
 func (w *ExecutorDBWrapper) ListTables() ([]string, error) {
@@ -155,7 +231,7 @@ func (w *ExecutorDBWrapper) ListTables() ([]string, error) {
 func convertValues(vals []executor.Value) []transaction.Value {
 	result := make([]transaction.Value, len(vals))
 	for i, v := range vals {
-		result[i] = transaction.Value{Type: v.Type, I64: v.I64, Str: v.Str}
+		result[i] = transaction.Value{Type: v.Type, I64: v.I64, Str: v.Str, F64: v.F64, Dec: v.Dec, Null: v.Null}
 	}
 	return result
 }
@@ -164,7 +240,7 @@ func convertValues(vals []executor.Value) []transaction.Value {
 func convertValuesFromTransaction(vals []transaction.Value) []executor.Value {
 	result := make([]executor.Value, len(vals))
 	for i, v := range vals {
-		result[i] = executor.Value{Type: v.Type, I64: v.I64, Str: v.Str}
+		result[i] = executor.Value{Type: v.Type, I64: v.I64, Str: v.Str, F64: v.F64, Dec: v.Dec, Null: v.Null}
 	}
 	return result
 }
@@ -197,10 +273,7 @@ func main() {
 	fmt.Printf("Parsed statement type: %T\n", stmt)
 
 	// Create a simple database instance
-	db := &SimpleDB{
-		store:  store,
-		tables: make(map[string]*executor.TableDef),
-	}
+	db := &SimpleDB{store: store}
 
 	// Create a transaction
 	txImpl := transaction.NewDBTX(db)
@@ -2,6 +2,8 @@ package concurrency
 
 import (
 	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/storage/disk"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -493,3 +495,227 @@ func TestLockTimeout(t *testing.T) {
 
 	fmt.Println("Lock Timeout tests passed!")
 }
+
+func TestGroupCommit(t *testing.T) {
+	fmt.Println("Testing group commit...")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	kv := &KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	const writers = 16
+	const commits = 20
+	// the first flush waits until the other writers have queued their
+	// first commits, which are then flushed together
+	release := make(chan struct{})
+	var first sync.Once
+	kv.syncHook = func() { first.Do(func() { <-release }) }
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*commits)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < commits; i++ {
+				tx := KVTX{}
+				kv.Begin(&tx)
+				key := []byte(fmt.Sprintf("w%02d-%03d", w, i))
+				if err := tx.Set(key, []byte("value")); err != nil {
+					kv.Abort(&tx)
+					errs <- err
+					continue
+				}
+				if err := kv.Commit(&tx); err != nil {
+					errs <- err
+					continue
+				}
+				// durable and visible once Commit returns
+				reader := KVReader{}
+				kv.BeginRead(&reader)
+				if _, ok := reader.Get(key); !ok {
+					errs <- fmt.Errorf("key %s is not visible after commit", key)
+				}
+				kv.EndRead(&reader)
+			}
+		}(w)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		kv.commit.mu.Lock()
+		queued := len(kv.commit.queue)
+		kv.commit.mu.Unlock()
+		if queued == writers-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued commits, got %d", writers-1, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Commit failed: %v", err)
+	}
+	if kv.GetVersion() >= writers*commits {
+		t.Errorf("Expected fewer than %d group flushes, got %d", writers*commits, kv.GetVersion())
+	}
+	fmt.Printf("%d commits in %d group flushes\n", writers*commits, kv.GetVersion())
+	kv.Close()
+
+	// everything survives a reopen
+	kv = &KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer kv.Close()
+	reader := KVReader{}
+	kv.BeginRead(&reader)
+	defer kv.EndRead(&reader)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < commits; i++ {
+			key := []byte(fmt.Sprintf("w%02d-%03d", w, i))
+			if _, ok := reader.Get(key); !ok {
+				t.Errorf("Key %s is missing after reopen", key)
+			}
+		}
+	}
+
+	fmt.Println("Group commit tests passed!")
+}
+
+func TestPageReuse(t *testing.T) {
+	fmt.Println("Testing page reuse...")
+
+	kv := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer kv.Close()
+	set := func(key string, val string) {
+		t.Helper()
+		tx := KVTX{}
+		kv.Begin(&tx)
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			kv.Abort(&tx)
+			t.Fatalf("Set failed: %v", err)
+		}
+		if err := kv.Commit(&tx); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		set(fmt.Sprintf("key%03d", i), "value")
+	}
+
+	// a reader keeps the pages of its version
+	reader := KVReader{}
+	kv.BeginRead(&reader)
+	for i := 0; i < 20; i++ {
+		set("key050", fmt.Sprintf("new%d", i))
+	}
+	if val, _ := reader.Get([]byte("key050")); string(val) != "value" {
+		t.Errorf("Expected the reader to see its version, got %q", val)
+	}
+	kv.EndRead(&reader)
+
+	// then the freed pages are reused instead of growing the file
+	set("key050", "last")
+	used := kv.GetPageFlushed()
+	for i := 0; i < 100; i++ {
+		set("key050", fmt.Sprintf("again%d", i))
+	}
+	if kv.GetPageFlushed() != used {
+		t.Errorf("Expected the database to stay at %d pages, got %d", used, kv.GetPageFlushed())
+	}
+
+	reader = KVReader{}
+	kv.BeginRead(&reader)
+	defer kv.EndRead(&reader)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		want := "value"
+		if i == 50 {
+			want = "again99"
+		}
+		if val, _ := reader.Get([]byte(key)); string(val) != want {
+			t.Errorf("Expected %s=%s, got %q", key, want, val)
+		}
+	}
+
+	fmt.Println("Page reuse tests passed!")
+}
+
+func TestSharedFile(t *testing.T) {
+	fmt.Println("Testing a file shared with disk.KV...")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	var seq uint64
+	for round := 0; round < 3; round++ {
+		// a commit through disk.KV, which logs it
+		db := &disk.KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatalf("Failed to open disk.KV: %v", err)
+		}
+		if db.Seq() != seq {
+			t.Errorf("Expected commit %d, got %d", seq, db.Seq())
+		}
+		if err := db.Set([]byte(fmt.Sprintf("disk%d", round)), []byte("value")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		seq = db.Seq()
+		db.Close()
+
+		// a commit through this KV
+		kv := &KV{Path: path}
+		if err := kv.Open(); err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		tx := KVTX{}
+		kv.Begin(&tx)
+		if err := tx.Set([]byte(fmt.Sprintf("concurrent%d", round)), []byte("value")); err != nil {
+			kv.Abort(&tx)
+			t.Fatalf("Set failed: %v", err)
+		}
+		if err := kv.Commit(&tx); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		kv.Close()
+	}
+
+	// the keys of both and the change log of disk.KV survive
+	db := &disk.KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open disk.KV: %v", err)
+	}
+	defer db.Close()
+	if db.Seq() != seq {
+		t.Errorf("Expected commit %d, got %d", seq, db.Seq())
+	}
+	for round := 0; round < 3; round++ {
+		for _, key := range []string{fmt.Sprintf("disk%d", round), fmt.Sprintf("concurrent%d", round)} {
+			if _, ok := db.Get([]byte(key)); !ok {
+				t.Errorf("Key %s is missing", key)
+			}
+		}
+	}
+	w, err := db.Watch([]byte("disk"), 0)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer w.Close()
+	for round := 0; round < 3; round++ {
+		select {
+		case ev := <-w.C:
+			if string(ev.Key) != fmt.Sprintf("disk%d", round) {
+				t.Errorf("Unexpected change: %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Change %d is missing from the log", round)
+		}
+	}
+
+	fmt.Println("Shared file tests passed!")
+}
@@ -0,0 +1,138 @@
+package concurrency
+
+import (
+	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+	"govetachun/go-mini-db/refactor_code/internal/storage/disk"
+	"sync"
+)
+
+// The file, the mmap and the master page are those of disk.KV, see
+// disk.PageFile. This KV differs by its concurrency control.
+
+func (kv *KV) Open() error {
+	// open or create the DB file
+	if err := kv.file.Open(kv.Path); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	kv.tree.SetGet(kv.pageRead)
+	// read the master page
+	m, err := kv.file.LoadMaster()
+	if err != nil {
+		kv.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	kv.tree.SetRoot(m.Root)
+	kv.page.flushed = m.Used
+	kv.seq = m.Seq
+	// writers start from the durable tree
+	kv.commit.cond = sync.NewCond(&kv.commit.mu)
+	kv.commit.root = kv.tree.GetRoot()
+	kv.commit.flushed = kv.page.flushed
+	return nil
+}
+
+// cleanups
+func (kv *KV) Close() {
+	kv.file.Close()
+}
+
+// read a page from the mmap. the caller holds `writer` or `mu`.
+func (kv *KV) pageRead(ptr uint64) btree.BNode {
+	return kv.file.Page(ptr)
+}
+
+// read a page from the mmap of a snapshot
+func (tx *KVReader) pageRead(ptr uint64) btree.BNode {
+	return disk.MappedPage(tx.mmap.chunks, ptr)
+}
+
+// update the master page. it must be atomic.
+// the commit sequence number is that of disk.KV, which logs its commits.
+// it is kept, or the next disk.KV.Open() discards its change log.
+func masterStore(kv *KV, root uint64, used uint64) error {
+	return kv.file.StoreMaster(disk.Master{Root: root, Used: used, Seq: kv.seq})
+}
+
+// copy the pages of a transaction to the file, without waiting for the disk.
+// they are not reachable until the master page points to the new tree.
+func writePages(kv *KV, tx *KVTX) error {
+	// readers copy the mmap list in BeginRead()
+	kv.mu.Lock()
+	err := kv.file.Extend(int(tx.flushed) + tx.page.nappend)
+	kv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for ptr, page := range tx.page.updates {
+		if page != nil {
+			copy(kv.pageRead(ptr).GetData(), page)
+		}
+	}
+	return nil
+}
+
+// make the written pages durable and switch the readers to the new tree
+func syncPages(kv *KV, root uint64, used uint64) error {
+	if kv.syncHook != nil {
+		kv.syncHook()
+	}
+	// the page data must reach disk before the master page.
+	// the `fsync` serves as a barrier here.
+	if err := kv.file.Sync(); err != nil {
+		return err
+	}
+	if err := masterStore(kv, root, used); err != nil {
+		return err
+	}
+	if err := kv.file.Sync(); err != nil {
+		return err
+	}
+	// the transactions are visible at this point.
+	kv.mu.Lock()
+	kv.tree.SetRoot(root)
+	kv.page.flushed = used
+	kv.version++
+	kv.mu.Unlock()
+	return nil
+}
+
+// flush the queued transactions as one group: one pair of fsyncs for all.
+// the caller holds `commit.mu`, which is released during the I/O.
+func flushPages(kv *KV) error {
+	group := kv.commit.queue
+	root, used := kv.commit.root, kv.commit.flushed
+	kv.commit.queue = nil
+	kv.commit.syncing = true
+	kv.commit.mu.Unlock()
+
+	err := syncPages(kv, root, used)
+
+	kv.commit.mu.Lock()
+	kv.commit.syncing = false
+	if err != nil {
+		// the queued transactions are built on top of the failed group.
+		// NOTE: the state of the master page is unknown after a failure.
+		// the pages they took from the free list are not reused.
+		group = append(group, kv.commit.queue...)
+		kv.commit.queue = nil
+		kv.commit.root = kv.tree.GetRoot()
+		kv.commit.flushed = kv.page.flushed
+		kv.commit.epoch++
+	}
+	for _, tx := range group {
+		tx.commit.done = true
+		tx.commit.err = err
+		if err != nil {
+			continue
+		}
+		// the new readers cannot reach the freed pages
+		for ptr, page := range tx.page.updates {
+			if page == nil {
+				kv.commit.free = append(kv.commit.free, freedPage{ptr, kv.version})
+			}
+		}
+	}
+	kv.commit.cond.Broadcast()
+	return err
+}
@@ -0,0 +1,185 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+)
+
+// KVTX is a read-write KV transaction.
+// Writers are serialized by `KV.writer`, but a committing transaction
+// releases it once its pages are written, so the next one can start while
+// the previous ones wait for a group flush.
+type KVTX struct {
+	db   *KV
+	tree btree.BTree
+	// the state it started from
+	base    uint64 // the root
+	flushed uint64 // database size in number of pages
+	epoch   uint64 // see KV.commit.epoch
+	page    struct {
+		// the freed pages that no reader can reach, the first `nfree`
+		// ones are reused by this transaction
+		free    []freedPage
+		nfree   int
+		nappend int // number of pages to be appended
+		// newly allocated or deallocated pages keyed by the pointer.
+		// nil value denotes a deallocated page.
+		updates map[uint64][]byte
+	}
+	// the result of the group flush, guarded by `KV.commit.mu`
+	commit struct {
+		done bool
+		err  error
+	}
+}
+
+var errCommitFailed = errors.New("KV.Commit: an earlier commit has failed")
+
+// begin a transaction
+func (kv *KV) Begin(tx *KVTX) {
+	kv.writer.Lock()
+	tx.db = kv
+	tx.page.nfree = 0
+	tx.page.nappend = 0
+	tx.page.updates = map[uint64][]byte{}
+	tx.commit.done, tx.commit.err = false, nil
+	// the oldest version that is still read
+	kv.mu.Lock()
+	minReader := kv.version
+	if len(kv.readers) > 0 {
+		minReader = kv.readers[0].version
+	}
+	kv.mu.Unlock()
+	// start from the last written transaction, durable or not
+	kv.commit.mu.Lock()
+	tx.base = kv.commit.root
+	tx.flushed = kv.commit.flushed
+	tx.epoch = kv.commit.epoch
+	n := 0
+	for n < len(kv.commit.free) && kv.commit.free[n].version <= minReader {
+		n++
+	}
+	tx.page.free = kv.commit.free[:n:n]
+	kv.commit.mu.Unlock()
+	// btree
+	tx.tree = btree.BTree{}
+	tx.tree.SetRoot(tx.base)
+	tx.tree.SetGet(tx.pageGet)
+	tx.tree.SetNew(tx.pageNew)
+	tx.tree.SetDel(tx.pageDel)
+}
+
+// end a transaction: commit updates.
+// It returns once the updates are durable. Transactions that commit close
+// together share the fsyncs of the same group flush.
+func (kv *KV) Commit(tx *KVTX) error {
+	if tx.tree.GetRoot() == tx.base {
+		kv.writer.Unlock()
+		return nil // no updates?
+	}
+	// phase 1: write the page data, the disk is synced later.
+	if err := writePages(kv, tx); err != nil {
+		kv.writer.Unlock()
+		return err
+	}
+	kv.commit.mu.Lock()
+	if tx.epoch != kv.commit.epoch {
+		kv.commit.mu.Unlock()
+		kv.writer.Unlock()
+		return errCommitFailed
+	}
+	kv.commit.root = tx.tree.GetRoot()
+	kv.commit.flushed = tx.flushed + uint64(tx.page.nappend)
+	kv.commit.free = kv.commit.free[tx.page.nfree:]
+	kv.commit.queue = append(kv.commit.queue, tx)
+	// the next transaction can build on this one now
+	kv.writer.Unlock()
+	// phase 2: wait for a group flush, or lead one.
+	for !tx.commit.done {
+		if kv.commit.syncing {
+			kv.commit.cond.Wait()
+		} else {
+			flushPages(kv)
+		}
+	}
+	err := tx.commit.err
+	kv.commit.mu.Unlock()
+	return err
+}
+
+// end a transaction: rollback
+func (kv *KV) Abort(tx *KVTX) {
+	// nothing was written
+	kv.writer.Unlock()
+}
+
+// KV operations
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	return tx.tree.Get(key)
+}
+
+// find the closest position that is less or equal to the key
+func (tx *KVTX) Seek(key []byte) *btree.BIter {
+	return tx.tree.SeekLE(key)
+}
+
+func (tx *KVTX) Update(key []byte, val []byte, mode int) (bool, error) {
+	_, exists := tx.tree.Get(key)
+	switch mode {
+	case 0: // MODE_UPSERT - insert or replace
+	case 1: // MODE_UPDATE_ONLY - update existing keys
+		if !exists {
+			return false, nil
+		}
+	case 2: // MODE_INSERT_ONLY - only add new keys
+		if exists {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("invalid mode: %d", mode)
+	}
+	if err := tx.tree.Insert(key, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	_, err := tx.Update(key, val, 0)
+	return err
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	return tx.tree.Delete(key), nil
+}
+
+// callback for BTree, dereference a pointer.
+func (tx *KVTX) pageGet(ptr uint64) btree.BNode {
+	if page, ok := tx.page.updates[ptr]; ok {
+		return btree.NewBNode(page) // for new pages
+	}
+	return tx.db.pageRead(ptr) // for written pages
+}
+
+// callback for BTree, allocate a new page.
+func (tx *KVTX) pageNew(node btree.BNode) uint64 {
+	ptr := uint64(0)
+	if tx.page.nfree < len(tx.page.free) {
+		// reuse a deallocated page
+		ptr = tx.page.free[tx.page.nfree].ptr
+		tx.page.nfree++
+	} else {
+		// append a new page
+		ptr = tx.flushed + uint64(tx.page.nappend)
+		tx.page.nappend++
+	}
+	tx.page.updates[ptr] = node.GetData()
+	return ptr
+}
+
+// callback for BTree, deallocate a page.
+// it is reused once the group flush of this transaction is read by all.
+func (tx *KVTX) pageDel(ptr uint64) {
+	tx.page.updates[ptr] = nil
+}
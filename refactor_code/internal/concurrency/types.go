@@ -3,7 +3,7 @@ package concurrency
 import (
 	"container/heap"
 	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
-	"os"
+	"govetachun/go-mini-db/refactor_code/internal/storage/disk"
 	"sync"
 )
 
@@ -11,25 +11,35 @@ import (
 type KV struct {
 	Path string
 	// internals
-	fp *os.File
-	// moved the B-tree and the free list
+	file disk.PageFile
+	// moved the B-tree
 	tree btree.BTree
-	free FreeListData
-	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
 	// moved the page management
 	page struct {
 		flushed uint64 // database size in number of pages
 	}
+	// the commit sequence number of the master page, see masterStore()
+	seq uint64
 	// mutexes
 	mu     sync.Mutex
 	writer sync.Mutex
 	// version number and the reader list
 	version uint64
 	readers ReaderList // heap, for tracking the minimum reader version
+	// group commit, see KV.Commit()
+	commit struct {
+		mu      sync.Mutex
+		cond    *sync.Cond // signaled when a group flush ends
+		root    uint64     // the last written tree, may not be durable yet
+		flushed uint64     // the database size after the last written transaction
+		epoch   uint64     // incremented when a group flush fails
+		queue   []*KVTX    // written transactions waiting for a group flush
+		syncing bool       // a group flush is in progress
+		// the pages freed by the flushed groups, oldest first
+		free []freedPage
+	}
+	// called before the fsyncs of a group flush, for tests
+	syncHook func()
 }
 
 // KVReader represents a read-only KV transaction
@@ -46,8 +56,9 @@ type KVReader struct {
 
 func (kv *KV) BeginRead(tx *KVReader) {
 	kv.mu.Lock()
-	tx.mmap.chunks = kv.mmap.chunks
+	tx.mmap.chunks = kv.file.Chunks()
 	tx.tree = kv.tree
+	tx.tree.SetGet(tx.pageRead)
 	tx.version = kv.version
 	heap.Push(&kv.readers, tx)
 	kv.mu.Unlock()
@@ -86,7 +97,8 @@ func (tx *KVReader) Get(key []byte) ([]byte, bool) {
 	return tx.tree.Get(key)
 }
 
-func (tx *KVReader) Seek(key []byte, cmp int) *btree.BIter {
+// find the closest position that is less or equal to the key
+func (tx *KVReader) Seek(key []byte) *btree.BIter {
 	return tx.tree.SeekLE(key)
 }
 
@@ -110,60 +122,42 @@ func (tx *KVReader) SetVersion(version uint64) {
 	tx.version = version
 }
 
-// FreeListData represents the in-memory data structure that is updated and committed by transactions
-type FreeListData struct {
-	head uint64
-	// cached pointers to list nodes for accessing both ends.
-	nodes []uint64 // from the tail to the head
-	// cached total number of items; stored in the head node.
-	total int
-	// cached number of discarded items in the tail node.
-	offset int
-}
-
-// FreeList represents the free list with version control
-type FreeList struct {
-	FreeListData
-	// for each transaction
-	version   uint64   // current version
-	minReader uint64   // minimum reader version
-	freed     []uint64 // pages that will be added to the free list
-	// callbacks for managing on-disk pages
-	get func(uint64) btree.BNode  // dereference a pointer
-	new func(btree.BNode) uint64  // append a new page
-	use func(uint64, btree.BNode) // reuse a page
-}
-
-// Pop tries to remove an item from the tail. returns 0 on failure.
-// the removed pointer must not be reachable by the minimum version reader.
-func (fl *FreeList) Pop() uint64 {
-	// Simplified implementation
-	if fl.total == 0 {
-		return 0
-	}
-	fl.total--
-	return fl.head
-}
-
-// Add adds some new pointers to the head and finalize the update
-func (fl *FreeList) Add(freed []uint64) {
-	fl.freed = append(fl.freed, freed...)
-	fl.total += len(freed)
+// a page freed by a commit, it is unreachable from the trees of
+// `version` and later, so it can be reused once the readers are there.
+type freedPage struct {
+	ptr     uint64
+	version uint64
 }
 
 // Helper methods for KV
+
+// FlushPages waits until the committed transactions are durable
 func (kv *KV) FlushPages() error {
-	// Simplified implementation - would need actual page flushing logic
+	kv.commit.mu.Lock()
+	defer kv.commit.mu.Unlock()
+	epoch := kv.commit.epoch
+	for kv.commit.syncing || len(kv.commit.queue) > 0 {
+		if kv.commit.syncing {
+			kv.commit.cond.Wait()
+		} else if err := flushPages(kv); err != nil {
+			return err
+		}
+	}
+	// a group flushed by another transaction has failed
+	if kv.commit.epoch != epoch {
+		return errCommitFailed
+	}
 	return nil
 }
 
 func (kv *KV) StoreMaster() error {
-	// Simplified implementation - would need actual master page storage logic
-	return nil
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return masterStore(kv, kv.tree.GetRoot(), kv.page.flushed)
 }
 
 func (kv *KV) Sync() error {
-	return kv.fp.Sync()
+	return kv.file.Sync()
 }
 
 func (kv *KV) GetVersion() uint64 {
@@ -174,10 +168,6 @@ func (kv *KV) GetTree() *btree.BTree {
 	return &kv.tree
 }
 
-func (kv *KV) GetFreeList() *FreeListData {
-	return &kv.free
-}
-
 func (kv *KV) GetPageFlushed() uint64 {
 	return kv.page.flushed
 }
@@ -191,11 +181,7 @@ func (kv *KV) GetReaders() *ReaderList {
 }
 
 func (kv *KV) GetMmapChunks() [][]byte {
-	return kv.mmap.chunks
-}
-
-func (kv *KV) SetMmapChunks(chunks [][]byte) {
-	kv.mmap.chunks = chunks
+	return kv.file.Chunks()
 }
 
 func (kv *KV) GetWriterMutex() *sync.Mutex {
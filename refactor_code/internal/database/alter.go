@@ -0,0 +1,266 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the number of rows read at once by TableRewrite() and MatViewRefresh()
+const TABLE_REWRITE_BATCH = 1000
+
+// TableRewrite converts the stored rows of a table from `oldDef` to
+// `newDef`, such as after adding, dropping or modifying a column.
+// The new rows and their index entries are written under new prefixes,
+// which are set in `newDef`, and the old data is deleted at the end.
+// So the old rows are intact if it fails, such as on a value that
+// cannot be converted, and the caller keeps the old definition.
+// The rows are read and written in batches. A nil `convert` keeps the
+// columns by name, see ConvertRow().
+func TableRewrite(kv KVWriter, oldDef *TableDef, newDef *TableDef, convert func(Record) (Record, error)) error {
+	if convert == nil {
+		convert = func(row Record) (Record, error) {
+			return ConvertRow(newDef, row)
+		}
+	}
+	prefix, err := AllocPrefixes(kv, 1+len(newDef.Indexes))
+	if err != nil {
+		return err
+	}
+	newDef.Prefix = prefix
+	newDef.IndexPrefixes = make([]uint32, len(newDef.Indexes))
+	for i := range newDef.IndexPrefixes {
+		newDef.IndexPrefixes[i] = prefix + 1 + uint32(i)
+	}
+	if err := rewriteRows(kv, oldDef, newDef, convert); err != nil {
+		TableTruncate(kv, newDef)
+		return err
+	}
+	return TableTruncate(kv, oldDef)
+}
+
+func rewriteRows(kv KVWriter, oldDef *TableDef, newDef *TableDef, convert func(Record) (Record, error)) error {
+	return scanRowBatches(kv, oldDef, func(row Record) error {
+		rec, err := convert(row)
+		if err != nil {
+			return err
+		}
+		added, err := dbUpdate(kv, newDef, rec, MODE_INSERT_ONLY)
+		if err != nil {
+			return err
+		}
+		if !added {
+			key, _ := primaryKey(newDef, rec)
+			return &ConstraintError{Table: newDef.Name, Index: "PRIMARY KEY", Key: key}
+		}
+		return nil
+	})
+}
+
+// call `fn` on each row of a table in batches, so it can update the KV
+func scanRowBatches(kv KVWriter, tdef *TableDef, fn func(Record) error) error {
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	start := prefix
+	for start != nil {
+		// collect a batch first, the KV cannot be updated while scanning
+		rows := []Record{}
+		var next []byte
+		var err error
+		kv.Scan(start, func(key []byte, val []byte) bool {
+			if !bytes.HasPrefix(key, prefix) {
+				return false
+			}
+			if len(rows) == TABLE_REWRITE_BATCH {
+				next = append([]byte{}, key...)
+				return false
+			}
+			var row Record
+			if row, err = decodeRow(tdef, key[len(prefix):], val); err != nil {
+				return false
+			}
+			rows = append(rows, row)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		start = next
+	}
+	return nil
+}
+
+// KeepIndexes copies the indexes of `oldDef` to `newDef`, except the
+// indexes on the columns that are removed or no longer JSON
+func KeepIndexes(oldDef *TableDef, newDef *TableDef) {
+	newDef.Indexes, newDef.IndexNames, newDef.UniqueCols = nil, nil, nil
+	newDef.IndexPrefixes, newDef.Building = nil, nil
+	for i, index := range oldDef.Indexes {
+		ok := true
+		for _, c := range index {
+			ok = ok && IndexColType(newDef, c) != TYPE_ERROR
+		}
+		if !ok {
+			continue
+		}
+		newDef.Indexes = append(newDef.Indexes, index)
+		newDef.IndexNames = append(newDef.IndexNames, oldDef.IndexNames[i])
+		if len(oldDef.UniqueCols) != 0 {
+			newDef.UniqueCols = append(newDef.UniqueCols, oldDef.UniqueCols[i])
+		}
+	}
+}
+
+// ConvertRow converts a row to the columns of a table by name,
+// the missing columns are NULL
+func ConvertRow(tdef *TableDef, row Record) (Record, error) {
+	rec := Record{}
+	for i, c := range tdef.Cols {
+		v := Value{Type: tdef.Types[i], Null: true}
+		if old := row.Get(c); old != nil {
+			var err error
+			if v, err = ConvertValue(*old, tdef.Types[i]); err != nil {
+				return Record{}, fmt.Errorf("column %s: %w", c, err)
+			}
+		}
+		rec.Cols = append(rec.Cols, c)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// ConvertValue converts a value to the type of a column, for the rows
+// of ALTER TABLE. It fails on the values that cannot be represented,
+// such as a fraction for INT64 or a text that is not a number.
+func ConvertValue(v Value, typ uint32) (Value, error) {
+	if v.Null || v.Type == typ {
+		v.Type = typ
+		return v, nil
+	}
+	out := Value{Type: typ}
+	bad := fmt.Errorf("cannot convert %s to type %d", valueToString(v), typ)
+	switch typ {
+	case TYPE_BYTES:
+		out.Str = []byte(valueToString(v))
+	case TYPE_INT64:
+		switch v.Type {
+		case TYPE_BOOL, TYPE_TIMESTAMP:
+			out.I64 = v.I64
+		case TYPE_FLOAT64:
+			if v.F64 != math.Trunc(v.F64) || v.F64 < math.MinInt64 || v.F64 >= math.MaxInt64 {
+				return Value{}, bad
+			}
+			out.I64 = int64(v.F64)
+		case TYPE_DECIMAL:
+			n := v.Dec.Round(0)
+			if n.Cmp(v.Dec) != 0 || !n.coef().IsInt64() {
+				return Value{}, bad
+			}
+			out.I64 = n.coef().Int64()
+		case TYPE_BYTES:
+			n, err := strconv.ParseInt(strings.TrimSpace(string(v.Str)), 10, 64)
+			if err != nil {
+				return Value{}, bad
+			}
+			out.I64 = n
+		default:
+			return Value{}, bad
+		}
+	case TYPE_FLOAT64:
+		switch v.Type {
+		case TYPE_INT64:
+			out.F64 = float64(v.I64)
+		case TYPE_DECIMAL:
+			out.F64 = v.Dec.Float64()
+		case TYPE_BYTES:
+			f, err := strconv.ParseFloat(strings.TrimSpace(string(v.Str)), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return Value{}, bad
+			}
+			out.F64 = f
+		default:
+			return Value{}, bad
+		}
+	case TYPE_DECIMAL:
+		var err error
+		switch v.Type {
+		case TYPE_INT64:
+			out.Dec = DecimalFromInt64(v.I64)
+		case TYPE_FLOAT64:
+			out.Dec, err = DecimalFromFloat64(v.F64)
+		case TYPE_BYTES:
+			out.Dec, err = ParseDecimal(strings.TrimSpace(string(v.Str)))
+		default:
+			err = bad
+		}
+		if err != nil {
+			return Value{}, bad
+		}
+	case TYPE_BOOL:
+		switch {
+		case v.Type == TYPE_INT64 && (v.I64 == 0 || v.I64 == 1):
+			out.I64 = v.I64
+		case v.Type == TYPE_BYTES:
+			b, err := strconv.ParseBool(strings.TrimSpace(string(v.Str)))
+			if err != nil {
+				return Value{}, bad
+			}
+			if b {
+				out.I64 = 1
+			}
+		default:
+			return Value{}, bad
+		}
+	case TYPE_TIMESTAMP:
+		switch v.Type {
+		case TYPE_INT64:
+			out.I64 = v.I64
+		case TYPE_BYTES:
+			t, ok := parseTimestamp(strings.TrimSpace(string(v.Str)))
+			if !ok {
+				return Value{}, bad
+			}
+			out.I64 = t.UnixMicro()
+		default:
+			return Value{}, bad
+		}
+	case TYPE_JSON:
+		switch v.Type {
+		case TYPE_BYTES:
+			if !json.Valid(v.Str) {
+				return Value{}, bad
+			}
+			out.Str = v.Str
+		default:
+			return JSONFromValue(v)
+		}
+	default:
+		return Value{}, bad
+	}
+	return out, nil
+}
+
+// the layouts of the TIMESTAMP literals
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseTimestamp(s string) (time.Time, bool) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,368 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// The catalog is stored in the KV store as internal tables,
+// so the table definitions and the prefix allocation are updated
+// in the same transactions as the data.
+
+// internal table: metadata
+var TDEF_META = &TableDef{
+	Prefix: 1,
+	Name:   "@meta",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"key", "val"},
+	PKeys:  1,
+}
+
+// internal table: table schemas
+var TDEF_TABLE = &TableDef{
+	Prefix: 2,
+	Name:   "@table",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"name", "def"},
+	PKeys:  1,
+}
+
+// the first prefix for user tables, the lower ones are internal
+const TABLE_PREFIX_MIN = 3
+
+// CatalogGet returns a table definition, or nil if the table does not exist
+func CatalogGet(kv KVReader, name string) (*TableDef, error) {
+	rec := (&Record{}).AddStr("name", []byte(name))
+	ok, err := dbGet(kv, TDEF_TABLE, rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil, fmt.Errorf("bad definition of table %s: %w", name, err)
+	}
+	return tdef, nil
+}
+
+// CatalogList returns the names of all tables in order
+func CatalogList(kv KVReader) ([]string, error) {
+	prefix := encodeKey(nil, TDEF_TABLE.Prefix, nil)
+	names := []string{}
+	kv.Scan(prefix, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		name := []Value{{Type: TYPE_BYTES}}
+		decodeValues(key[len(prefix):], name)
+		names = append(names, string(name[0].Str))
+		return true
+	})
+	return names, nil
+}
+
+// CatalogCreate adds a table definition and assigns the key prefixes
+// of the table and its indexes
+func CatalogCreate(kv KVWriter, tdef *TableDef) error {
+	if err := validateTableDef(tdef); err != nil {
+		return err
+	}
+	if !isValidIdentifier(tdef.Name) {
+		return fmt.Errorf("invalid table name: %s", tdef.Name)
+	}
+	if len(tdef.UniqueCols) != 0 && len(tdef.UniqueCols) != len(tdef.Indexes) {
+		return fmt.Errorf("unique columns count mismatch")
+	}
+	for i, index := range tdef.Indexes {
+		if n := uniqueCols(tdef, i); n < 0 || n > len(index) {
+			return fmt.Errorf("bad unique columns count for index %d: %d", i, n)
+		}
+		index, err := checkIndexKeys(tdef, index)
+		if err != nil {
+			return err
+		}
+		tdef.Indexes[i] = index
+	}
+	if len(tdef.IndexNames) != len(tdef.Indexes) {
+		return fmt.Errorf("index names count mismatch")
+	}
+	// check the existing table
+	old, err := CatalogGet(kv, tdef.Name)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		return fmt.Errorf("table %s already exists", tdef.Name)
+	}
+	if err := checkNotView(kv, tdef.Name); err != nil {
+		return err
+	}
+	// allocate new prefixes
+	prefix, err := AllocPrefixes(kv, 1+len(tdef.Indexes))
+	if err != nil {
+		return err
+	}
+	tdef.Prefix = prefix
+	tdef.IndexPrefixes = nil
+	for i := range tdef.Indexes {
+		tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix+1+uint32(i))
+	}
+	// store the definition
+	return catalogPut(kv, tdef, MODE_INSERT_ONLY)
+}
+
+// CatalogUpdate replaces the definition of an existing table
+func CatalogUpdate(kv KVWriter, tdef *TableDef) error {
+	if err := validateTableDef(tdef); err != nil {
+		return err
+	}
+	return catalogPut(kv, tdef, MODE_UPDATE_ONLY)
+}
+
+// CatalogDrop removes a table definition.
+// The prefixes of the table are not reused.
+func CatalogDrop(kv KVWriter, name string) (bool, error) {
+	rec := (&Record{}).AddStr("name", []byte(name))
+	return dbDelete(kv, TDEF_TABLE, *rec)
+}
+
+// CatalogRename moves a table definition to a new name.
+// The table keeps its prefixes, so the data stays in place.
+func CatalogRename(kv KVWriter, oldName string, newName string) error {
+	if !isValidIdentifier(newName) {
+		return fmt.Errorf("invalid table name: %s", newName)
+	}
+	tdef, err := CatalogGet(kv, oldName)
+	if err != nil {
+		return err
+	}
+	if tdef == nil {
+		return fmt.Errorf("table %s does not exist", oldName)
+	}
+	if err := checkNotView(kv, newName); err != nil {
+		return err
+	}
+	if _, err := CatalogDrop(kv, oldName); err != nil {
+		return err
+	}
+	tdef.Name = newName
+	return catalogPut(kv, tdef, MODE_INSERT_ONLY)
+}
+
+// CatalogAddIndex adds a secondary index to a table definition.
+// Index names are unique in the database.
+// For a unique index, the `cols` of the rows must be distinct.
+// The new index is not used by scans until CatalogIndexReady(),
+// see IndexBuild() and IndexBackfill() for adding the existing rows.
+func CatalogAddIndex(kv KVWriter, table string, name string, cols []string, unique bool) (*TableDef, error) {
+	if !isValidIdentifier(name) {
+		return nil, fmt.Errorf("invalid index name: %s", name)
+	}
+	owner, _, err := CatalogFindIndex(kv, name)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		return nil, fmt.Errorf("index %s already exists", name)
+	}
+	tdef, err := CatalogGet(kv, table)
+	if err != nil {
+		return nil, err
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	index, err := checkIndexKeys(tdef, cols)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := AllocPrefixes(kv, 1)
+	if err != nil {
+		return nil, err
+	}
+	if unique || len(tdef.UniqueCols) != 0 {
+		n := 0
+		if unique {
+			n = len(cols)
+		}
+		// the UniqueCols of the existing indexes can be omitted
+		for len(tdef.UniqueCols) < len(tdef.Indexes) {
+			tdef.UniqueCols = append(tdef.UniqueCols, 0)
+		}
+		tdef.UniqueCols = append(tdef.UniqueCols, n)
+	}
+	tdef.Indexes = append(tdef.Indexes, index)
+	tdef.IndexNames = append(tdef.IndexNames, name)
+	tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix)
+	tdef.Building = append(tdef.Building, name)
+	return tdef, catalogPut(kv, tdef, MODE_UPDATE_ONLY)
+}
+
+// CatalogIndexReady marks a complete index as usable by scans
+func CatalogIndexReady(kv KVWriter, name string) (*TableDef, error) {
+	tdef, _, err := CatalogFindIndex(kv, name)
+	if err != nil {
+		return nil, err
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("index %s does not exist", name)
+	}
+	tdef.Building = removeName(tdef.Building, name)
+	return tdef, catalogPut(kv, tdef, MODE_UPDATE_ONLY)
+}
+
+// CatalogDropIndex removes a secondary index from its table definition.
+// It returns the definition before the update, or nil if there is no such index.
+func CatalogDropIndex(kv KVWriter, name string) (*TableDef, error) {
+	tdef, i, err := CatalogFindIndex(kv, name)
+	if err != nil || tdef == nil {
+		return nil, err
+	}
+	ndef := *tdef
+	ndef.Indexes = append(tdef.Indexes[:i:i], tdef.Indexes[i+1:]...)
+	ndef.IndexNames = append(tdef.IndexNames[:i:i], tdef.IndexNames[i+1:]...)
+	ndef.IndexPrefixes = append(tdef.IndexPrefixes[:i:i], tdef.IndexPrefixes[i+1:]...)
+	if len(tdef.UniqueCols) != 0 {
+		ndef.UniqueCols = append(tdef.UniqueCols[:i:i], tdef.UniqueCols[i+1:]...)
+	}
+	ndef.Building = removeName(tdef.Building, name)
+	return tdef, catalogPut(kv, &ndef, MODE_UPDATE_ONLY)
+}
+
+// CatalogFindIndex returns the table that owns an index and the index number
+func CatalogFindIndex(kv KVReader, name string) (*TableDef, int, error) {
+	tables, err := CatalogList(kv)
+	if err != nil {
+		return nil, -1, err
+	}
+	for _, table := range tables {
+		tdef, err := CatalogGet(kv, table)
+		if err != nil {
+			return nil, -1, err
+		}
+		for i, iname := range tdef.IndexNames {
+			if iname == name {
+				return tdef, i, nil
+			}
+		}
+	}
+	return nil, -1, nil
+}
+
+func catalogPut(kv KVWriter, tdef *TableDef, mode int) error {
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	rec := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+	ok, err := dbUpdate(kv, TDEF_TABLE, *rec, mode)
+	if err != nil {
+		return err
+	}
+	if !ok && mode == MODE_INSERT_ONLY {
+		return fmt.Errorf("table %s already exists", tdef.Name)
+	}
+	if !ok && mode == MODE_UPDATE_ONLY {
+		return fmt.Errorf("table %s does not exist", tdef.Name)
+	}
+	return nil
+}
+
+// AllocPrefixes reserves `n` consecutive key prefixes and returns the first.
+// The next prefix is kept in @meta, so prefixes are never reused.
+func AllocPrefixes(kv KVWriter, n int) (uint32, error) {
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err := dbGet(kv, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	prefix := uint32(TABLE_PREFIX_MIN)
+	if ok {
+		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+	} else {
+		meta.AddStr("val", make([]byte, 4))
+	}
+	// update the next prefix
+	binary.LittleEndian.PutUint32(meta.Get("val").Str, prefix+uint32(n))
+	if _, err := dbUpdate(kv, TDEF_META, *meta, MODE_UPSERT); err != nil {
+		return 0, err
+	}
+	return prefix, nil
+}
+
+// check the index columns and add the primary key to the index
+func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
+	index = append([]string{}, index...)
+	icols := map[string]bool{}
+	for _, c := range index {
+		if IndexColType(tdef, c) == TYPE_ERROR {
+			return nil, fmt.Errorf("column %s does not exist in table %s", c, tdef.Name)
+		}
+		if icols[c] {
+			return nil, fmt.Errorf("duplicate index column: %s", c)
+		}
+		icols[c] = true
+	}
+	if len(index) == 0 {
+		return nil, fmt.Errorf("index must have at least one column")
+	}
+	for _, c := range tdef.Cols[:tdef.PKeys] {
+		if !icols[c] {
+			index = append(index, c)
+		}
+	}
+	return index, nil
+}
+
+// whether the index `i` is being built
+func isBuilding(tdef *TableDef, i int) bool {
+	for _, name := range tdef.Building {
+		if name == tdef.IndexNames[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the column is declared NOT NULL, the primary key is always NOT NULL
+func isNotNull(tdef *TableDef, col string) bool {
+	for _, name := range tdef.NotNull {
+		if name == col {
+			return true
+		}
+	}
+	return false
+}
+
+// a copy of `names` without `name`
+func removeName(names []string, name string) []string {
+	out := []string{}
+	for _, n := range names {
+		if n != name {
+			out = append(out, n)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// the number of unique columns of the index `i`, 0 if it is not unique
+func uniqueCols(tdef *TableDef, i int) int {
+	if i < len(tdef.UniqueCols) {
+		return tdef.UniqueCols[i]
+	}
+	return 0
+}
+
+// the position of a column, or -1
+func colIndex(tdef *TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
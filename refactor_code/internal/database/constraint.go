@@ -0,0 +1,70 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ConstraintError is returned when a write violates a constraint.
+// The write is not applied.
+type ConstraintError struct {
+	Table string
+	Index string // the violated index
+	Key   Record // the conflicting key
+}
+
+func (e *ConstraintError) Error() string {
+	vals := make([]string, len(e.Key.Vals))
+	for i, v := range e.Key.Vals {
+		vals[i] = fmt.Sprintf("%s=%s", e.Key.Cols[i], valueToString(v))
+	}
+	return fmt.Sprintf("duplicate key (%s) violates unique index %s of table %s",
+		strings.Join(vals, ", "), e.Index, e.Table)
+}
+
+// check the unique indexes before adding a row.
+// `old` is the row being replaced or nil, its index entries are not conflicts.
+func checkUnique(kv KVReader, tdef *TableDef, values []Value, old []Value) error {
+	for i := range tdef.Indexes {
+		if err := checkUniqueIndex(kv, tdef, i, values, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkUniqueIndex(kv KVReader, tdef *TableDef, i int, values []Value, old []Value) error {
+	n := uniqueCols(tdef, i)
+	if n == 0 {
+		return nil
+	}
+	key := Record{}
+	for _, c := range tdef.Indexes[i][:n] {
+		v := indexValue(tdef, values, c)
+		if v.Null {
+			return nil // NULLs are distinct from each other
+		}
+		key.Cols = append(key.Cols, c)
+		key.Vals = append(key.Vals, v)
+	}
+	var own []byte
+	if old != nil {
+		own = indexKey(tdef, i, old)
+	}
+
+	// any other entry with the same unique columns is a conflict
+	prefix := encodeKey(nil, tdef.IndexPrefixes[i], key.Vals)
+	conflict := false
+	kv.Scan(prefix, func(ikey []byte, val []byte) bool {
+		if !bytes.HasPrefix(ikey, prefix) {
+			return false
+		}
+		conflict = !bytes.Equal(ikey, own)
+		return !conflict
+	})
+	if conflict {
+		return &ConstraintError{Table: tdef.Name, Index: tdef.IndexNames[i], Key: key}
+	}
+	return nil
+}
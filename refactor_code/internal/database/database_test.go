@@ -1,8 +1,16 @@
 package database
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage"
 )
 
 func TestTableManager(t *testing.T) {
@@ -183,11 +191,33 @@ func TestIndexOperations(t *testing.T) {
 		t.Errorf("Expected 1 record, got %d", len(records))
 	}
 
+	// Test range lookup, in the index order
+	for i, name := range []string{"Mary", "Adam", "John"} {
+		rec := (&Record{}).AddInt64("id", int64(i+2)).AddStr("name", []byte(name)).AddInt64("age", 30)
+		if err := index.Add(rec); err != nil {
+			t.Errorf("Failed to add record to index: %v", err)
+		}
+	}
+	records, err = index.RangeLookup(*(&Record{}).AddStr("name", []byte("B")), *(&Record{}).AddStr("name", []byte("Mary")))
+	if err != nil {
+		t.Errorf("Failed to range lookup records: %v", err)
+	}
+	ids := []int64{}
+	for _, rec := range records {
+		ids = append(ids, rec.Get("id").I64)
+	}
+	if fmt.Sprint(ids) != "[1 4 2]" {
+		t.Errorf("Unexpected range lookup result: %v", ids)
+	}
+
 	// Test removing record from index
 	err = index.Remove(record)
 	if err != nil {
 		t.Errorf("Failed to remove record from index: %v", err)
 	}
+	if records, _ := index.Lookup(lookupKey); len(records) != 1 || records[0].Get("id").I64 != 4 {
+		t.Errorf("Expected only the other John after the removal, got %v", records)
+	}
 
 	fmt.Println("Index Operations tests passed!")
 }
@@ -251,6 +281,126 @@ func TestSchemaManager(t *testing.T) {
 	fmt.Println("Schema Manager tests passed!")
 }
 
+func TestSchemaManagerCatalog(t *testing.T) {
+	fmt.Println("Testing Schema Manager on the catalog...")
+
+	path := filepath.Join(t.TempDir(), "schema.db")
+	store := storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	sm := NewKVSchemaManager(store)
+	err := sm.CreateTable(&TableDef{
+		Name:       "users",
+		Cols:       []string{"id", "name", "age"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		PKeys:      1,
+		Indexes:    [][]string{{"name"}},
+		IndexNames: []string{"idx_name"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	// the rows are written by another manager on the same catalog
+	tm := NewKVTableManager(store)
+	users := tm.GetTable("users")
+	if users == nil {
+		t.Fatalf("The table manager does not see the new table")
+	}
+	for i, name := range []string{"alice", "bob"} {
+		rec := (&Record{}).AddInt64("id", int64(i+1)).AddStr("name", []byte(name)).AddInt64("age", 30)
+		if err := users.Insert(*rec); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	// the column changes rewrite the rows
+	if err := sm.AddColumn("users", "email", TYPE_BYTES); err != nil {
+		t.Fatalf("Failed to add column: %v", err)
+	}
+	if err := sm.ModifyColumn("users", "age", TYPE_BYTES); err != nil {
+		t.Fatalf("Failed to modify column: %v", err)
+	}
+	if err := sm.RenameColumn("users", "name", "login"); err != nil {
+		t.Fatalf("Failed to rename column: %v", err)
+	}
+	if err := sm.DropColumn("users", "id"); err == nil {
+		t.Errorf("Expected an error dropping a primary key column")
+	}
+	if err := sm.ModifyColumn("users", "login", TYPE_INT64); err == nil {
+		t.Errorf("Expected an error converting names to numbers")
+	}
+
+	// the definitions are read from the catalog after reopen
+	store.Close()
+	store = storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	sm = NewKVSchemaManager(store)
+	tdef := sm.GetTableDef("users")
+	if tdef == nil {
+		t.Fatalf("Table definition lost after reopen")
+	}
+	if fmt.Sprint(tdef.Cols, tdef.Types) != fmt.Sprint([]string{"id", "login", "age", "email"},
+		[]uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES, TYPE_BYTES}) {
+		t.Errorf("Unexpected columns: %v %v", tdef.Cols, tdef.Types)
+	}
+	if fmt.Sprint(tdef.Indexes) != "[[login id]]" {
+		t.Errorf("Expected the index on login, got %v", tdef.Indexes)
+	}
+	row, err := TableGet(store, tdef, *(&Record{}).AddInt64("id", 2))
+	if err != nil || row == nil {
+		t.Fatalf("Failed to get a row: %v, %v", row, err)
+	}
+	if string(row.Get("login").Str) != "bob" || string(row.Get("age").Str) != "30" || !row.Get("email").Null {
+		t.Errorf("Unexpected row: %v", row)
+	}
+
+	// the columns of a view are kept
+	view := &View{Name: "logins", Query: "SELECT login FROM users", Cols: []string{"login"},
+		Table: "users", Uses: []string{"login"}}
+	if err := ViewCreate(store, view); err != nil {
+		t.Fatalf("Failed to create view: %v", err)
+	}
+	if err := sm.DropColumn("users", "login"); err == nil {
+		t.Errorf("Expected an error dropping a column used by a view")
+	}
+	if err := sm.RenameColumn("users", "login", "name"); err == nil {
+		t.Errorf("Expected an error renaming a column used by a view")
+	}
+	if _, err := ViewDrop(store, "logins"); err != nil {
+		t.Fatalf("Failed to drop view: %v", err)
+	}
+
+	// the schema can be copied without the rows
+	data, err := sm.ExportSchema()
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	clone := NewSchemaManager()
+	if err := clone.ImportSchema(data); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if info := clone.GetSchemaInfo(); info.TableCount != 1 || len(info.Tables[0].Columns) != 4 ||
+		info.Tables[0].IndexCount != 1 {
+		t.Errorf("Unexpected imported schema: %+v", info)
+	}
+	if err := clone.ImportSchema(data); err == nil {
+		t.Errorf("Expected an error importing an existing table")
+	}
+
+	if err := sm.DropTable("users"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	if sm.GetTableDef("users") != nil || len(sm.ListTables()) != 0 {
+		t.Errorf("Expected no table after the drop")
+	}
+
+	fmt.Println("Schema Manager on the catalog tests passed!")
+}
+
 func TestIntegration(t *testing.T) {
 	fmt.Println("Testing Database Integration...")
 
@@ -360,3 +510,1375 @@ func TestIntegration(t *testing.T) {
 	fmt.Printf("Final state: %d tables, %d indexes, %d records\n",
 		len(sm.ListTables()), len(im.ListIndexes()), table.GetRecordCount())
 }
+
+func TestCatalogPersistence(t *testing.T) {
+	fmt.Println("Testing Catalog Persistence...")
+
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	store := storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	db := NewSimpleDB(store)
+
+	// Create a table with an index
+	err := db.CreateTable(&TableDef{
+		Name:       "users",
+		Cols:       []string{"id", "name", "age"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		PKeys:      1,
+		Indexes:    [][]string{{"age"}},
+		IndexNames: []string{"idx_age"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := db.CreateTable(&TableDef{
+		Name:  "users",
+		Cols:  []string{"id"},
+		Types: []uint32{TYPE_INT64},
+		PKeys: 1,
+	}); err == nil {
+		t.Errorf("Expected an error for an existing table")
+	}
+
+	// An aborted transaction leaves no trace
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	err = CatalogCreate(tx, &TableDef{
+		Name:  "aborted",
+		Cols:  []string{"id"},
+		Types: []uint32{TYPE_INT64},
+		PKeys: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table in a transaction: %v", err)
+	}
+	if tdef, _ := CatalogGet(tx, "aborted"); tdef == nil {
+		t.Errorf("The transaction does not see its own table")
+	}
+	tx.Abort()
+
+	// Reopen
+	store.Close()
+	store = storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	db = NewSimpleDB(store)
+
+	tables, err := db.ListTables()
+	if err != nil || len(tables) != 1 || tables[0] != "users" {
+		t.Errorf("Expected [users], got %v (%v)", tables, err)
+	}
+	users := db.GetTableDef("users")
+	if users == nil {
+		t.Fatalf("Table definition lost after reopen")
+	}
+	if users.Prefix != TABLE_PREFIX_MIN || len(users.IndexPrefixes) != 1 ||
+		users.IndexPrefixes[0] != TABLE_PREFIX_MIN+1 {
+		t.Errorf("Unexpected prefixes: %d %v", users.Prefix, users.IndexPrefixes)
+	}
+	if len(users.Indexes) != 1 || len(users.Indexes[0]) != 2 || users.Indexes[0][1] != "id" {
+		t.Errorf("Expected the index [age id], got %v", users.Indexes)
+	}
+
+	// The prefix allocation continues after reopen
+	if err := db.CreateTable(&TableDef{
+		Name:  "orders",
+		Cols:  []string{"id", "amount"},
+		Types: []uint32{TYPE_INT64, TYPE_INT64},
+		PKeys: 1,
+	}); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if orders := db.GetTableDef("orders"); orders == nil || orders.Prefix != TABLE_PREFIX_MIN+2 {
+		t.Errorf("Expected prefix %d, got %+v", TABLE_PREFIX_MIN+2, orders)
+	}
+
+	// Renaming keeps the prefix
+	if err := db.RenameTable("orders", "purchases"); err != nil {
+		t.Fatalf("Failed to rename table: %v", err)
+	}
+	if tdef := db.GetTableDef("purchases"); tdef == nil || tdef.Prefix != TABLE_PREFIX_MIN+2 {
+		t.Errorf("Rename lost the prefix: %+v", tdef)
+	}
+	if db.GetTableDef("orders") != nil {
+		t.Errorf("The old name still exists")
+	}
+
+	fmt.Println("Catalog Persistence tests passed!")
+}
+
+func TestKeyEncoding(t *testing.T) {
+	fmt.Println("Testing Key Encoding...")
+
+	// The encoded keys sort like the values
+	vals := [][]Value{
+		{{Type: TYPE_INT64, Null: true}, {Type: TYPE_BYTES, Str: []byte("z")}},
+		{{Type: TYPE_INT64, I64: -5}, {Type: TYPE_BYTES, Null: true}},
+		{{Type: TYPE_INT64, I64: -5}, {Type: TYPE_BYTES, Str: []byte("")}},
+		{{Type: TYPE_INT64, I64: -5}, {Type: TYPE_BYTES, Str: []byte("b")}},
+		{{Type: TYPE_INT64, I64: 0}, {Type: TYPE_BYTES, Str: []byte("a\x00")}},
+		{{Type: TYPE_INT64, I64: 0}, {Type: TYPE_BYTES, Str: []byte("a\x01")}},
+		{{Type: TYPE_INT64, I64: 0}, {Type: TYPE_BYTES, Str: []byte("ab")}},
+		{{Type: TYPE_INT64, I64: 7}, {Type: TYPE_BYTES, Str: []byte("")}},
+	}
+	var prev []byte
+	for i, v := range vals {
+		key := encodeKey(nil, 3, v)
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("Key %d is not ordered", i)
+		}
+		prev = key
+
+		out := []Value{{Type: TYPE_INT64}, {Type: TYPE_BYTES}}
+		if rest := decodeValues(key[4:], out); len(rest) != 0 {
+			t.Errorf("Key %d: %d bytes left", i, len(rest))
+		}
+		if out[0].I64 != v[0].I64 || !bytes.Equal(out[1].Str, v[1].Str) ||
+			out[0].Null != v[0].Null || out[1].Null != v[1].Null {
+			t.Errorf("Key %d: decoded %+v, expected %+v", i, out, v)
+		}
+	}
+
+	// The other types
+	prev = nil
+	for i, v := range []Value{
+		{Type: TYPE_FLOAT64, F64: math.Inf(-1)},
+		{Type: TYPE_FLOAT64, F64: -2.5},
+		{Type: TYPE_FLOAT64, F64: -1e-300},
+		{Type: TYPE_FLOAT64, F64: 0},
+		{Type: TYPE_FLOAT64, F64: 1e-300},
+		{Type: TYPE_FLOAT64, F64: 3},
+		{Type: TYPE_FLOAT64, F64: math.Inf(1)},
+		{Type: TYPE_BOOL, I64: 0},
+		{Type: TYPE_BOOL, I64: 1},
+		{Type: TYPE_TIMESTAMP, I64: -1},
+		{Type: TYPE_TIMESTAMP, I64: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixMicro()},
+	} {
+		key := encodeKey(nil, uint32(v.Type), []Value{v})
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("Value %d is not ordered", i)
+		}
+		prev = key
+		out := []Value{{Type: v.Type}}
+		decodeValues(key[4:], out)
+		if out[0].I64 != v.I64 || out[0].F64 != v.F64 || out[0].Null {
+			t.Errorf("Value %d: decoded %+v, expected %+v", i, out[0], v)
+		}
+	}
+	negZero := encodeKey(nil, 0, []Value{{Type: TYPE_FLOAT64, F64: math.Copysign(0, -1)}})
+	if !bytes.Equal(negZero, encodeKey(nil, 0, []Value{{Type: TYPE_FLOAT64}})) {
+		t.Errorf("-0 and 0 are different keys")
+	}
+
+	fmt.Println("Key Encoding tests passed!")
+}
+
+func TestTableStorage(t *testing.T) {
+	fmt.Println("Testing Table Storage...")
+
+	path := filepath.Join(t.TempDir(), "tables.db")
+	store := storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	tm := NewKVTableManager(store)
+	err := tm.CreateTable(&TableDef{
+		Name:  "events",
+		Cols:  []string{"id", "name"},
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		PKeys: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	table := tm.GetTable("events")
+	for _, id := range []int64{30, -7, 1000, 0, 2} {
+		rec := (&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("e", id)))
+		if err := table.Insert(*rec); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+	if err := table.Insert(*(&Record{}).AddInt64("id", 2).AddStr("name", nil)); err == nil {
+		t.Errorf("Expected an error for a duplicate primary key")
+	}
+
+	// Change the primary key of a row
+	key := (&Record{}).AddInt64("id", 1000)
+	if err := table.Update(*key, *(&Record{}).AddInt64("id", 5).AddStr("name", []byte("e5"))); err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+	if rec, _ := table.Get(*key); rec != nil {
+		t.Errorf("The old primary key still exists")
+	}
+	store.Close()
+
+	// The rows persist and are scanned in the primary key order
+	store = storage.NewKVStore(path)
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	table = NewKVTableManager(store).GetTable("events")
+	if table == nil {
+		t.Fatalf("Table lost after reopen")
+	}
+	rec, err := table.Get(*(&Record{}).AddInt64("id", 5))
+	if err != nil || rec == nil || string(rec.Get("name").Str) != "e5" {
+		t.Errorf("Unexpected record: %+v (%v)", rec, err)
+	}
+	ids := []int64{}
+	scanRows(store, table.Def, func(rec Record) bool {
+		ids = append(ids, rec.Get("id").I64)
+		return true
+	})
+	if fmt.Sprint(ids) != "[-7 0 2 5 30]" {
+		t.Errorf("Unexpected order: %v", ids)
+	}
+	if n := table.GetRecordCount(); n != 5 {
+		t.Errorf("Expected 5 records, got %d", n)
+	}
+
+	fmt.Println("Table Storage tests passed!")
+}
+
+func TestRangeScan(t *testing.T) {
+	fmt.Println("Testing Range Scan...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:       "events",
+		Cols:       []string{"id", "name"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES},
+		PKeys:      1,
+		Indexes:    [][]string{{"name"}},
+		IndexNames: []string{"idx_name"},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, id := range []int64{30, -7, 5, 0, 2} {
+		rec := (&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("e", id)))
+		if _, err := TableSet(kv, tdef, *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+		// the index entry, ordered by (name, id)
+		ikey := encodeKey(nil, tdef.IndexPrefixes[0], []Value{rec.Vals[1], rec.Vals[0]})
+		if _, err := kv.Update(ikey, nil, MODE_UPSERT); err != nil {
+			t.Fatalf("Failed to insert index entry: %v", err)
+		}
+	}
+
+	id := func(v int64) Record { return *(&Record{}).AddInt64("id", v) }
+	name := func(v string) Record { return *(&Record{}).AddStr("name", []byte(v)) }
+	tests := []struct {
+		sc   Scanner
+		want string
+	}{
+		// primary key
+		{Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}, "[-7 0 2 5 30]"},
+		{Scanner{Cmp1: CMP_LE, Cmp2: CMP_GE}, "[30 5 2 0 -7]"},
+		{Scanner{Cmp1: CMP_GT, Key1: id(0), Cmp2: CMP_LT, Key2: id(30)}, "[2 5]"},
+		{Scanner{Cmp1: CMP_GE, Key1: id(0), Cmp2: CMP_LE, Key2: id(30)}, "[0 2 5 30]"},
+		{Scanner{Cmp1: CMP_LE, Key1: id(5), Cmp2: CMP_GT, Key2: id(0)}, "[5 2]"},
+		{Scanner{Cmp1: CMP_LT, Key1: id(4), Cmp2: CMP_GE, Key2: id(-100)}, "[2 0 -7]"},
+		{Scanner{Cmp1: CMP_GT, Key1: id(30), Cmp2: CMP_LE}, "[]"},
+		// secondary index, a prefix of (name, id)
+		{Scanner{Cmp1: CMP_GE, Key1: name("e2"), Cmp2: CMP_LE, Key2: name("e5")}, "[2 30 5]"},
+		{Scanner{Cmp1: CMP_GT, Key1: name("e2"), Cmp2: CMP_LT, Key2: name("e5")}, "[30]"},
+		{Scanner{Cmp1: CMP_LT, Key1: name("e30"), Cmp2: CMP_GE, Key2: name("e0")}, "[2 0]"},
+		{Scanner{Cmp1: CMP_LE, Key1: name("e5"), Cmp2: CMP_GE, Key2: name("")}, "[5 30 2 0 -7]"},
+	}
+	for _, test := range tests {
+		sc := test.sc
+		if err := TableScan(kv, tdef, &sc); err != nil {
+			t.Fatalf("Failed to scan %+v: %v", test.sc, err)
+		}
+		ids := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			var rec Record
+			sc.Deref(&rec)
+			if string(rec.Get("name").Str) != fmt.Sprint("e", rec.Get("id").I64) {
+				t.Errorf("Unexpected record: %+v", rec)
+			}
+			ids = append(ids, rec.Get("id").I64)
+		}
+		if fmt.Sprint(ids) != test.want {
+			t.Errorf("Scan %v %+v %v %+v: expected %s, got %v",
+				test.sc.Cmp1, test.sc.Key1.Vals, test.sc.Cmp2, test.sc.Key2.Vals, test.want, ids)
+		}
+	}
+
+	// an index entry without its row is an error, not a crash
+	dangling := *(&Record{}).AddInt64("id", 99).AddStr("name", []byte("e99"))
+	ikey := encodeKey(nil, tdef.IndexPrefixes[0], []Value{dangling.Vals[1], dangling.Vals[0]})
+	if _, err := kv.Update(ikey, nil, MODE_UPSERT); err != nil {
+		t.Fatalf("Failed to insert index entry: %v", err)
+	}
+	sc := Scanner{Cmp1: CMP_GE, Key1: name("e99"), Cmp2: CMP_LE, Key2: name("e99")}
+	if err := TableScan(kv, tdef, &sc); err != nil || !sc.Valid() {
+		t.Fatalf("Failed to scan the dangling entry: %v", err)
+	}
+	var rec Record
+	if sc.Deref(&rec); sc.Err() == nil || !strings.Contains(sc.Err().Error(), "dangling index entry") {
+		t.Errorf("Expected a dangling index entry error, got %v", sc.Err())
+	}
+
+	// bad ranges
+	bad := []Scanner{
+		{Cmp1: CMP_GE, Cmp2: CMP_GT},
+		{Cmp1: CMP_EQ, Cmp2: CMP_LE},
+		{Cmp1: CMP_GE, Key1: *(&Record{}).AddStr("nope", nil), Cmp2: CMP_LE},
+		{Cmp1: CMP_GE, Key1: *(&Record{}).AddStr("id", nil), Cmp2: CMP_LE},
+	}
+	for _, sc := range bad {
+		if err := TableScan(kv, tdef, &sc); err == nil {
+			t.Errorf("Expected an error for %+v", sc)
+		}
+	}
+
+	fmt.Println("Range Scan tests passed!")
+}
+
+func TestUniqueIndex(t *testing.T) {
+	fmt.Println("Testing Unique Index...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:       "users",
+		Cols:       []string{"id", "email", "team"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		PKeys:      1,
+		Indexes:    [][]string{{"email"}, {"team"}},
+		IndexNames: []string{"users_email_key", "users_team_idx"},
+		UniqueCols: []int{1, 0},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	user := func(id int64, email string, team int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email)).AddInt64("team", team)
+	}
+	for _, rec := range []Record{user(1, "a@x", 1), user(2, "b@x", 1)} {
+		if _, err := TableSet(kv, tdef, rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	table := &Table{Def: tdef, kv: kv}
+
+	// A duplicate is rejected with a typed error, and nothing is written
+	_, err := TableSet(kv, tdef, user(3, "a@x", 2), MODE_INSERT_ONLY)
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a ConstraintError, got %v", err)
+	}
+	if cerr.Index != "users_email_key" || string(cerr.Key.Get("email").Str) != "a@x" {
+		t.Errorf("Unexpected constraint error: %v", cerr)
+	}
+	if rec, _ := TableGet(kv, tdef, user(3, "", 0)); rec != nil {
+		t.Errorf("The rejected row was written")
+	}
+	if err := table.ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+
+	// Updates can keep their own key, not take another one
+	if _, err := TableSet(kv, tdef, user(1, "a@x", 5), MODE_UPDATE_ONLY); err != nil {
+		t.Errorf("Failed to update a row with its own unique key: %v", err)
+	}
+	if _, err := TableSet(kv, tdef, user(1, "b@x", 5), MODE_UPSERT); !errors.As(err, &cerr) {
+		t.Errorf("Expected a ConstraintError for an update, got %v", err)
+	}
+	if _, err := TableReplace(kv, tdef, user(1, "", 0), user(10, "a@x", 5)); err != nil {
+		t.Errorf("Failed to change the primary key of a row: %v", err)
+	}
+	if _, err := TableReplace(kv, tdef, user(10, "", 0), user(11, "b@x", 5)); !errors.As(err, &cerr) {
+		t.Errorf("Expected a ConstraintError for a primary key change, got %v", err)
+	}
+	if rec, _ := TableGet(kv, tdef, user(10, "", 0)); rec == nil {
+		t.Errorf("The row is lost after a rejected primary key change")
+	}
+	if err := table.ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+
+	// Deleted keys can be reused
+	if _, err := TableDelete(kv, tdef, user(2, "", 0)); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := TableSet(kv, tdef, user(4, "b@x", 1), MODE_INSERT_ONLY); err != nil {
+		t.Errorf("Failed to reuse a deleted unique key: %v", err)
+	}
+
+	// A unique index cannot be built on duplicates
+	if _, err := TableSet(kv, tdef, user(5, "c@x", 1), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	tdef, err = CatalogAddIndex(kv, "users", "users_team_key", []string{"team"}, true)
+	if err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	if err := IndexBuild(kv, tdef, 2); !errors.As(err, &cerr) || cerr.Index != "users_team_key" {
+		t.Errorf("Expected a ConstraintError for the index build, got %v", err)
+	}
+
+	// Standalone indexes
+	im := NewIndexManager()
+	im.CreateUniqueIndex("idx_email", "users", []string{"email"}, []uint32{TYPE_BYTES})
+	index := im.GetIndex("idx_email")
+	rec := user(1, "a@x", 1)
+	if err := index.Add(&rec); err != nil {
+		t.Errorf("Failed to add record to index: %v", err)
+	}
+	if err := index.Add(&rec); err != nil {
+		t.Errorf("Adding the same record again is not a conflict: %v", err)
+	}
+	rec = user(2, "a@x", 1)
+	if err := index.Add(&rec); !errors.As(err, &cerr) {
+		t.Errorf("Expected a ConstraintError, got %v", err)
+	}
+
+	fmt.Println("Unique Index tests passed!")
+}
+
+func TestOnlineIndexBuild(t *testing.T) {
+	fmt.Println("Testing Online Index Build...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "build.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	db := NewSimpleDB(store)
+	tdef := &TableDef{
+		Name:  "events",
+		Cols:  []string{"id", "name"},
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		PKeys: 1,
+	}
+	if err := db.CreateTable(tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	event := func(id int64, name string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+	}
+	write := func(rec Record) {
+		err := db.update(func(tx *storage.KVTX) error {
+			_, err := TableSet(tx, db.GetTableDef("events"), rec, MODE_UPSERT)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	for id := int64(0); id < 100; id += 2 {
+		write(event(id, fmt.Sprint("e", id)))
+	}
+
+	// Rows written between the batches are indexed, and scans do not
+	// use the index until it is complete
+	reports := []IndexBuildProgress{}
+	progress := func(p IndexBuildProgress) {
+		reports = append(reports, p)
+		sc := Scanner{
+			Cmp1: CMP_GE, Cmp2: CMP_LE,
+			Key1: *(&Record{}).AddStr("name", []byte("a")),
+			Key2: *(&Record{}).AddStr("name", []byte("z")),
+		}
+		tx, err := store.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin: %v", err)
+		}
+		if err := TableScan(tx, db.GetTableDef("events"), &sc); err == nil {
+			t.Errorf("An incomplete index was used by a scan")
+		}
+		tx.Abort()
+		n := int64(len(reports))
+		write(event(n*20+1, fmt.Sprint("new", n))) // behind and ahead of the build
+		write(event(n*20-20, fmt.Sprint("upd", n)))
+	}
+	err := db.CreateIndex("events", "events_name_idx", []string{"name"},
+		IndexBuildOptions{BatchSize: 10, Progress: progress})
+	if err != nil {
+		t.Fatalf("Failed to build index: %v", err)
+	}
+	if len(reports) < 5 {
+		t.Errorf("Expected at least 5 progress reports, got %d", len(reports))
+	}
+	last := reports[len(reports)-1]
+	if last.Index != "events_name_idx" || last.Rows < 50 || last.Total < last.Rows {
+		t.Errorf("Unexpected progress: %+v", last)
+	}
+
+	table := NewKVTableManager(store).GetTable("events")
+	if isBuilding(table.Def, 0) {
+		t.Errorf("The index is not ready after the build")
+	}
+	if err := table.ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+	sc := Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LT,
+		Key1: *(&Record{}).AddStr("name", []byte("new")),
+		Key2: *(&Record{}).AddStr("name", []byte("nex")),
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if err := TableScan(tx, table.Def, &sc); err != nil {
+		t.Fatalf("Failed to scan the index: %v", err)
+	}
+	found := 0
+	for ; sc.Valid(); sc.Next() {
+		found++
+	}
+	tx.Abort()
+	if found != len(reports) {
+		t.Errorf("Expected %d rows written during the build, got %d", len(reports), found)
+	}
+
+	// A failed unique build removes the index
+	write(event(1000, "e2"))
+	err = db.CreateIndex("events", "events_name_key", []string{"name"},
+		IndexBuildOptions{Unique: true, BatchSize: 10})
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) {
+		t.Errorf("Expected a ConstraintError, got %v", err)
+	}
+	if tdef := db.GetTableDef("events"); len(tdef.Indexes) != 1 || len(tdef.Building) != 0 {
+		t.Errorf("The failed index was not removed: %v %v", tdef.IndexNames, tdef.Building)
+	}
+	if err := NewKVTableManager(store).GetTable("events").ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+
+	fmt.Println("Online Index Build tests passed!")
+}
+
+func TestNullValues(t *testing.T) {
+	fmt.Println("Testing NULL Values...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:       "people",
+		Cols:       []string{"id", "name", "email"},
+		Types:      []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+		PKeys:      1,
+		NotNull:    []string{"name"},
+		Indexes:    [][]string{{"email"}},
+		IndexNames: []string{"people_email_key"},
+		UniqueCols: []int{1},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	person := func(id int64, name string, email string) Record {
+		rec := (&Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+		if email == "" {
+			return *rec.AddNull("email")
+		}
+		return *rec.AddStr("email", []byte(email))
+	}
+
+	// NULLs are not duplicates of each other
+	for _, rec := range []Record{person(1, "a", ""), person(2, "b", "b@x"), person(3, "c", "")} {
+		if _, err := TableSet(kv, tdef, rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	rec, err := TableGet(kv, tdef, *(&Record{}).AddInt64("id", 3))
+	if err != nil || rec == nil || !rec.Get("email").Null || rec.Get("email").Type != TYPE_BYTES {
+		t.Errorf("Unexpected row: %+v (%v)", rec, err)
+	}
+
+	// NOT NULL and the primary key
+	if _, err := TableSet(kv, tdef, *(&Record{}).AddInt64("id", 4).AddNull("name").AddNull("email"), MODE_UPSERT); err == nil {
+		t.Errorf("Expected an error for a NULL in a NOT NULL column")
+	}
+	if _, err := TableSet(kv, tdef, *(&Record{}).AddNull("id").AddStr("name", nil).AddNull("email"), MODE_UPSERT); err == nil {
+		t.Errorf("Expected an error for a NULL primary key")
+	}
+
+	// The NULLs sort first in the index, `> NULL` skips them
+	scan := func(key1 Record, cmp1 int) []int64 {
+		sc := Scanner{Key1: key1, Cmp1: cmp1, Cmp2: CMP_LE}
+		if err := TableScan(kv, tdef, &sc); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		ids := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			var rec Record
+			sc.Deref(&rec)
+			ids = append(ids, rec.Get("id").I64)
+		}
+		return ids
+	}
+	null := Record{Cols: []string{"email"}, Vals: []Value{{Type: TYPE_BYTES, Null: true}}}
+	if ids := scan(null, CMP_GE); fmt.Sprint(ids) != "[1 3 2]" {
+		t.Errorf("Unexpected index order: %v", ids)
+	}
+	if ids := scan(null, CMP_GT); fmt.Sprint(ids) != "[2]" {
+		t.Errorf("Unexpected non-NULL rows: %v", ids)
+	}
+	if err := (&Table{Def: tdef, kv: kv}).ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+
+	fmt.Println("NULL Values tests passed!")
+}
+
+func TestValueTypes(t *testing.T) {
+	fmt.Println("Testing Value Types...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:       "events",
+		Cols:       []string{"id", "price", "paid", "at"},
+		Types:      []uint32{TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP},
+		PKeys:      1,
+		Indexes:    [][]string{{"price"}},
+		IndexNames: []string{"events_price_idx"},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+	for i, price := range []float64{9.5, -1.25, 100} {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddFloat64("price", price).
+			AddBool("paid", i%2 == 0).AddTimestamp("at", at.Add(time.Duration(i)*time.Hour))
+		if _, err := TableSet(kv, tdef, *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	rec, err := TableGet(kv, tdef, *(&Record{}).AddInt64("id", 2))
+	if err != nil || rec == nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if rec.Get("price").F64 != 100 || rec.Get("paid").I64 != 1 ||
+		time.UnixMicro(rec.Get("at").I64).UTC() != at.Add(2*time.Hour) {
+		t.Errorf("Unexpected row: %+v", rec)
+	}
+	if s := valueToString(*rec.Get("at")); s != "2024-05-06T09:08:09.123456Z" {
+		t.Errorf("Unexpected timestamp string: %s", s)
+	}
+
+	// The index is in the numeric order
+	sc := Scanner{
+		Key1: *(&Record{}).AddFloat64("price", -5), Cmp1: CMP_GE,
+		Key2: *(&Record{}).AddFloat64("price", 50), Cmp2: CMP_LE,
+	}
+	if err := TableScan(kv, tdef, &sc); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	ids := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		var rec Record
+		sc.Deref(&rec)
+		ids = append(ids, rec.Get("id").I64)
+	}
+	if fmt.Sprint(ids) != "[1 0]" {
+		t.Errorf("Unexpected rows: %v", ids)
+	}
+
+	// Values that have no key
+	bad := *(&Record{}).AddInt64("id", 9).AddFloat64("price", math.NaN()).
+		AddBool("paid", false).AddTimestamp("at", at)
+	if _, err := TableSet(kv, tdef, bad, MODE_UPSERT); err == nil {
+		t.Errorf("Expected an error for NaN")
+	}
+
+	fmt.Println("Value Types tests passed!")
+}
+
+func TestDecimal(t *testing.T) {
+	fmt.Println("Testing Decimal...")
+
+	dec := func(s string) Decimal {
+		d, err := ParseDecimal(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", s, err)
+		}
+		return d
+	}
+
+	// Exact arithmetic
+	cases := map[string]string{
+		dec("0.1").Add(dec("0.2")).String():                              "0.3",
+		dec("1.50").Sub(dec("2.255")).String():                           "-0.755",
+		dec("-1.5").Mul(dec("0.25")).String():                            "-0.375",
+		dec("1").Div(dec("3")).String():                                  "0.333333",
+		dec("2.00").Div(dec("3")).String():                               "0.66666667",
+		dec("-1").Div(dec("8")).String():                                 "-0.125000",
+		dec("7.5").Mod(dec("-2")).String():                               "1.5",
+		dec("2.345").Round(2).String():                                   "2.35",
+		dec("-2.345").Round(2).String():                                  "-2.35",
+		dec("-2.344").Round(2).String():                                  "-2.34",
+		dec("0.005").Round(0).String():                                   "0",
+		dec("12").Round(2).String():                                      "12.00",
+		dec("-0.07").String():                                            "-0.07",
+		DecimalFromInt64(-42).String():                                   "-42",
+		dec("1.5e3").String():                                            "1500",
+		dec("-25E-3").String():                                           "-0.025",
+		dec("123456789012345678901234567890.1").Add(dec("0.9")).String(): "123456789012345678901234567891.0",
+	}
+	for got, want := range cases {
+		if got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+	if f, _ := DecimalFromFloat64(0.1); f.String() != "0.1" {
+		t.Errorf("Unexpected decimal from float: %s", f)
+	}
+	for _, s := range []string{"", "-", "1.2.3", "--1", "1e", "1e5000", "abc"} {
+		if _, err := ParseDecimal(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+
+	// The encoded keys sort like the numbers, regardless of the scale
+	var prev []byte
+	for i, s := range []string{
+		"-1000", "-999.99", "-10", "-1.5", "-1.25", "-1", "-0.151", "-0.15",
+		"-0.000001", "0", "0.000001", "0.15", "0.151", "1", "1.25", "1.5", "10", "999.99", "1000",
+	} {
+		v := Value{Type: TYPE_DECIMAL, Dec: dec(s)}
+		key := encodeValues(nil, []Value{v})
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("Key %d (%s) is not ordered", i, s)
+		}
+		prev = key
+
+		out := []Value{{Type: TYPE_DECIMAL, Dec: Decimal{Scale: 2}}}
+		if rest := decodeValues(key, out); len(rest) != 0 || out[0].Dec.Cmp(v.Dec) != 0 {
+			t.Errorf("Key %d: decoded %s, expected %s", i, out[0].Dec, s)
+		}
+		if out[0].Dec.Scale < 2 {
+			t.Errorf("Key %d: the scale is not restored: %s", i, out[0].Dec)
+		}
+	}
+	if !bytes.Equal(encodeValues(nil, []Value{{Type: TYPE_DECIMAL, Dec: dec("1.5")}}),
+		encodeValues(nil, []Value{{Type: TYPE_DECIMAL, Dec: dec("1.500")}})) {
+		t.Errorf("1.5 and 1.500 are different keys")
+	}
+
+	// Rows are rounded to the column scale
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:     "prices",
+		Cols:     []string{"amount", "note"},
+		Types:    []uint32{TYPE_DECIMAL, TYPE_BYTES},
+		PKeys:    1,
+		Decimals: map[string]DecimalType{"amount": {Precision: 5, Scale: 2}},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	rec := (&Record{}).AddDecimal("amount", dec("12.345")).AddStr("note", []byte("a"))
+	if _, err := TableSet(kv, tdef, *rec, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	got, err := TableGet(kv, tdef, *(&Record{}).AddDecimal("amount", dec("12.35")))
+	if err != nil || got == nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if s := valueToString(*got.Get("amount")); s != "12.35" {
+		t.Errorf("Unexpected amount: %s", s)
+	}
+	// the key is looked up by the number, not the scale
+	got, _ = TableGet(kv, tdef, *(&Record{}).AddDecimal("amount", dec("12.3500")))
+	if got == nil || got.Get("amount").Dec.String() != "12.35" {
+		t.Errorf("Unexpected row by a key of another scale: %+v", got)
+	}
+	rec = (&Record{}).AddDecimal("amount", dec("1000")).AddStr("note", []byte("b"))
+	if _, err := TableSet(kv, tdef, *rec, MODE_INSERT_ONLY); err == nil {
+		t.Errorf("Expected an error for a number out of range")
+	}
+
+	bad := *tdef
+	bad.Name = "bad"
+	bad.Decimals = map[string]DecimalType{"amount": {Precision: 2, Scale: 3}}
+	if err := CatalogCreate(kv, &bad); err == nil {
+		t.Errorf("Expected an error for a scale larger than the precision")
+	}
+
+	fmt.Println("Decimal tests passed!")
+}
+
+func TestJSON(t *testing.T) {
+	fmt.Println("Testing JSON...")
+
+	// Paths are parsed and formatted canonically
+	for in, want := range map[string]string{
+		"$":              "$",
+		"$.a.b[2]":       "$.a.b[2]",
+		`$."a"[0]."x y"`: `$.a[0]."x y"`,
+	} {
+		path, err := ParseJSONPath(in)
+		if err != nil || path.String() != want {
+			t.Errorf("Path %s: got %s, %v", in, path, err)
+		}
+	}
+	for _, in := range []string{"", "a", "$.", "$[x]", "$[-1]", `$."a`} {
+		if _, err := ParseJSONPath(in); err == nil {
+			t.Errorf("Expected an error for the path %q", in)
+		}
+	}
+	if elem, ok := JSONExtract([]byte(`{"a": [1, {"b": "x"}]}`), JSONPath{{Key: "a"}, {Index: 1, IsIndex: true}}); !ok || string(elem) != `{"b":"x"}` {
+		t.Errorf("Unexpected element: %s", elem)
+	}
+	if v := JSONValue([]byte("1.50")); v.Type != TYPE_DECIMAL || v.Dec.String() != "1.50" {
+		t.Errorf("Unexpected value of a number: %+v", v)
+	}
+
+	// Documents are validated and stored compact
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:  "docs",
+		Cols:  []string{"id", "doc"},
+		Types: []uint32{TYPE_INT64, TYPE_JSON},
+		PKeys: 1,
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	doc := func(id int64, text string) Record {
+		return *(&Record{}).AddInt64("id", id).AddJSON("doc", []byte(text))
+	}
+	for id, text := range []string{
+		`{"kind": "book", "n": 3}`, `{"kind": "pen", "n": 10}`, `{"n": 1.50}`,
+		`{"kind": "book", "n": 7}`, `{"kind": null}`, `{"kind": 5}`,
+	} {
+		if _, err := TableSet(kv, tdef, doc(int64(id), text), MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if _, err := TableSet(kv, tdef, doc(9, `{"a":`), MODE_INSERT_ONLY); err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+	got, err := TableGet(kv, tdef, *(&Record{}).AddInt64("id", 0))
+	if err != nil || got == nil || string(got.Get("doc").Str) != `{"kind":"book","n":3}` {
+		t.Errorf("Unexpected document: %+v, %v", got, err)
+	}
+
+	// An index over a path, a missing element or a JSON null is NULL
+	kind := JSONIndexColumn("doc", JSONPath{{Key: "kind"}})
+	if kind != "doc->>'$.kind'" {
+		t.Errorf("Unexpected index column: %s", kind)
+	}
+	tdef, err = CatalogAddIndex(kv, "docs", "docs_kind_idx", []string{kind}, false)
+	if err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	if err := IndexBuild(kv, tdef, 0); err != nil {
+		t.Fatalf("Failed to build index: %v", err)
+	}
+	if tdef, err = CatalogIndexReady(kv, "docs_kind_idx"); err != nil {
+		t.Fatalf("Failed to complete index: %v", err)
+	}
+	if _, err := TableSet(kv, tdef, doc(6, `{"kind": "book"}`), MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	book, _ := JSONFromValue(Value{Type: TYPE_BYTES, Str: []byte("book")})
+	sc := Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: Record{Cols: []string{kind}, Vals: []Value{book}},
+		Key2: Record{Cols: []string{kind}, Vals: []Value{book}},
+	}
+	if err := TableScan(kv, tdef, &sc); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	ids := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		ids = append(ids, rec.Get("id").I64)
+	}
+	if fmt.Sprint(ids) != "[0 3 6]" {
+		t.Errorf("Unexpected rows of the index: %v", ids)
+	}
+	null := Value{Type: TYPE_JSON, Null: true}
+	sc = Scanner{
+		Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: Record{Cols: []string{kind}, Vals: []Value{null}},
+		Key2: Record{Cols: []string{kind}, Vals: []Value{null}},
+	}
+	if err := TableScan(kv, tdef, &sc); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 rows without a kind, got %d", n)
+	}
+
+	// JSON values sort by the kind, then the value
+	var prev []byte
+	for i, text := range []string{"null", "false", "true", "-1.5", "2", "10", `""`, `"a"`, `"b"`, "[1]", `{"a":1}`} {
+		key := encodeValues(nil, []Value{{Type: TYPE_JSON, Str: []byte(text)}})
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("Key %d (%s) is not ordered", i, text)
+		}
+		prev = key
+		out := []Value{{Type: TYPE_JSON}}
+		if decodeValues(key, out); string(out[0].Str) != text {
+			t.Errorf("Key %d: decoded %s, expected %s", i, out[0].Str, text)
+		}
+	}
+
+	fmt.Println("JSON tests passed!")
+}
+
+func TestSequences(t *testing.T) {
+	fmt.Println("Testing Sequences...")
+
+	kv := NewMemKV()
+	seq := &Sequence{Name: "ids", Start: 10, Increment: 5, Cache: 3}
+	if err := SequenceCreate(kv, seq); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+	if err := SequenceCreate(kv, &Sequence{Name: "ids", Increment: 1, Cache: 1}); err == nil {
+		t.Errorf("Expected an error for a duplicate sequence")
+	}
+	for _, bad := range []*Sequence{
+		{Name: "a b", Increment: 1, Cache: 1},
+		{Name: "neg", Increment: 0, Cache: 1},
+		{Name: "nocache", Increment: 1, Cache: 0},
+	} {
+		if err := SequenceCreate(kv, bad); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+
+	// @meta is updated once per block
+	cache := NewSequenceCache()
+	next := func() int64 {
+		v, err := cache.NextVal(kv, "ids")
+		if err != nil {
+			t.Fatalf("NextVal failed: %v", err)
+		}
+		return v
+	}
+	got := []int64{}
+	for i := 0; i < 4; i++ {
+		got = append(got, next())
+	}
+	if fmt.Sprint(got) != "[10 15 20 25]" {
+		t.Errorf("Unexpected values: %v", got)
+	}
+	stored, err := SequenceGet(kv, "ids")
+	if err != nil || stored == nil || stored.Next != 40 {
+		t.Fatalf("Expected the next block at 40, got %+v %v", stored, err)
+	}
+
+	// Another cache takes the next block
+	other := NewSequenceCache()
+	if v, err := other.NextVal(kv, "ids"); err != nil || v != 40 {
+		t.Errorf("Expected 40 from another cache, got %d %v", v, err)
+	}
+
+	// A block whose allocation is rolled back is not handed out again
+	stored.Next = 25
+	if err := sequencePut(kv, stored, MODE_UPDATE_ONLY); err != nil {
+		t.Fatalf("Failed to reset the sequence: %v", err)
+	}
+	if v := next(); v != 30 {
+		t.Errorf("Expected 30, got %d", v)
+	}
+	stored, _ = SequenceGet(kv, "ids")
+	if stored.Next != 40 {
+		t.Errorf("Expected the block to be stored again, got %+v", stored)
+	}
+
+	if _, err := cache.NextVal(kv, "missing"); err == nil {
+		t.Errorf("Expected an error for a missing sequence")
+	}
+	if ok, err := SequenceDrop(kv, "ids"); !ok || err != nil {
+		t.Errorf("Failed to drop sequence: %v %v", ok, err)
+	}
+	if seq, _ := SequenceGet(kv, "ids"); seq != nil {
+		t.Errorf("Expected the sequence to be dropped")
+	}
+
+	fmt.Println("Sequences tests passed!")
+}
+
+func TestTableRewrite(t *testing.T) {
+	fmt.Println("Testing Table Rewrite...")
+
+	// Values are converted exactly, or not at all
+	dec, _ := ParseDecimal("12.50")
+	for _, c := range []struct {
+		v    Value
+		typ  uint32
+		want string
+	}{
+		{Value{Type: TYPE_BYTES, Str: []byte(" 42 ")}, TYPE_INT64, "42"},
+		{Value{Type: TYPE_INT64, I64: 7}, TYPE_BYTES, "7"},
+		{Value{Type: TYPE_FLOAT64, F64: 3}, TYPE_INT64, "3"},
+		{Value{Type: TYPE_DECIMAL, Dec: dec}, TYPE_FLOAT64, "12.5"},
+		{Value{Type: TYPE_INT64, I64: 1}, TYPE_BOOL, "true"},
+		{Value{Type: TYPE_BYTES, Str: []byte("1.25")}, TYPE_DECIMAL, "1.25"},
+		{Value{Type: TYPE_BYTES, Str: []byte(`{"a": 1}`)}, TYPE_JSON, `{"a": 1}`},
+		{Value{Type: TYPE_INT64, Null: true}, TYPE_BOOL, "NULL"},
+	} {
+		got, err := ConvertValue(c.v, c.typ)
+		if err != nil || got.Type != c.typ || valueToString(got) != c.want {
+			t.Errorf("Convert %+v to %d: got %s, %v", c.v, c.typ, valueToString(got), err)
+		}
+	}
+	for _, c := range []struct {
+		v   Value
+		typ uint32
+	}{
+		{Value{Type: TYPE_BYTES, Str: []byte("abc")}, TYPE_INT64},
+		{Value{Type: TYPE_FLOAT64, F64: 1.5}, TYPE_INT64},
+		{Value{Type: TYPE_DECIMAL, Dec: dec}, TYPE_INT64},
+		{Value{Type: TYPE_INT64, I64: 2}, TYPE_BOOL},
+		{Value{Type: TYPE_BYTES, Str: []byte("{")}, TYPE_JSON},
+		{Value{Type: TYPE_BOOL, I64: 1}, TYPE_TIMESTAMP},
+	} {
+		if _, err := ConvertValue(c.v, c.typ); err == nil {
+			t.Errorf("Expected an error for converting %+v to %d", c.v, c.typ)
+		}
+	}
+
+	// The rows are rewritten in batches, with the index entries
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name:  "items",
+		Cols:  []string{"id", "code"},
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		PKeys: 1,
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	tdef, err := CatalogAddIndex(kv, "items", "items_code_idx", []string{"code"}, false)
+	if err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	tdef.Building = nil
+	n := 2*TABLE_REWRITE_BATCH + 10
+	for i := 0; i < n; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddStr("code", []byte(fmt.Sprint(i%100)))
+		if _, err := TableSet(kv, tdef, *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	newDef := &TableDef{
+		Name:       "items",
+		Cols:       []string{"id", "code", "note"},
+		Types:      []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		PKeys:      1,
+		Indexes:    tdef.Indexes,
+		IndexNames: tdef.IndexNames,
+	}
+	convert := func(row Record) (Record, error) {
+		code, err := ConvertValue(*row.Get("code"), TYPE_INT64)
+		if err != nil {
+			return Record{}, err
+		}
+		rec := (&Record{}).AddInt64("id", row.Get("id").I64).AddInt64("code", code.I64).AddNull("note")
+		return *rec, nil
+	}
+	if err := TableRewrite(kv, tdef, newDef, convert); err != nil {
+		t.Fatalf("Failed to rewrite: %v", err)
+	}
+	if newDef.Prefix == tdef.Prefix || len(newDef.IndexPrefixes) != 1 {
+		t.Errorf("Expected new prefixes, got %d %v", newDef.Prefix, newDef.IndexPrefixes)
+	}
+	rows, err := TableFind(kv, newDef, *(&Record{}).AddInt64("code", 7), 0)
+	if err != nil || len(rows) != n/100+1 {
+		t.Errorf("Expected %d rows by the index, got %d, %v", n/100+1, len(rows), err)
+	}
+	if got, _ := TableGet(kv, newDef, *(&Record{}).AddInt64("id", 2009)); got == nil || !got.Get("note").Null || got.Get("code").I64 != 9 {
+		t.Errorf("Unexpected row: %+v", got)
+	}
+	if rows, _ := TableFind(kv, tdef, Record{}, 0); len(rows) != 0 {
+		t.Errorf("Expected no rows under the old prefix, got %d", len(rows))
+	}
+
+	// A failed conversion keeps the old rows
+	badDef := &TableDef{Name: "items", Cols: []string{"id", "code"}, Types: []uint32{TYPE_INT64, TYPE_BOOL}, PKeys: 1}
+	err = TableRewrite(kv, newDef, badDef, func(row Record) (Record, error) {
+		code, err := ConvertValue(*row.Get("code"), TYPE_BOOL)
+		if err != nil {
+			return Record{}, err
+		}
+		return *(&Record{}).AddInt64("id", row.Get("id").I64).AddBool("code", code.I64 == 1), nil
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a failed conversion")
+	}
+	if rows, _ := TableFind(kv, newDef, Record{}, 0); len(rows) != n {
+		t.Errorf("Expected %d rows after a failed rewrite, got %d", n, len(rows))
+	}
+	if rows, _ := TableFind(kv, badDef, Record{}, 0); len(rows) != 0 {
+		t.Errorf("Expected the new rows to be removed, got %d", len(rows))
+	}
+
+	fmt.Println("Table Rewrite tests passed!")
+}
+
+func TestViews(t *testing.T) {
+	fmt.Println("Testing Views...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{Name: "users", Cols: []string{"id"}, Types: []uint32{TYPE_INT64}, PKeys: 1}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, name := range []string{"b_view", "a_view"} {
+		view := &View{Name: name, Query: "SELECT id FROM users", Cols: []string{"id"}, Table: "users"}
+		if err := ViewCreate(kv, view); err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+	}
+	// a sequence is also stored in @meta, it is not a view
+	if err := SequenceCreate(kv, &Sequence{Name: "vseq", Increment: 1, Cache: 1}); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+
+	// The names are shared by the tables and the views
+	bad := []*View{
+		{Name: "a_view", Cols: []string{"id"}},
+		{Name: "users", Cols: []string{"id"}},
+		{Name: "no_cols"},
+	}
+	for _, view := range bad {
+		if err := ViewCreate(kv, view); err == nil {
+			t.Errorf("Expected an error for view %+v", view)
+		}
+	}
+	if err := CatalogCreate(kv, &TableDef{Name: "a_view", Cols: []string{"id"}, Types: []uint32{TYPE_INT64}, PKeys: 1}); err == nil {
+		t.Errorf("Expected an error for a table with the name of a view")
+	}
+	names, err := CatalogNames(kv)
+	if err != nil || fmt.Sprint(names) != "[a_view b_view users]" {
+		t.Errorf("Unexpected names: %v, %v", names, err)
+	}
+	if users, _ := ViewUsers(kv, "users"); len(users) != 2 {
+		t.Errorf("Expected 2 views of users, got %v", users)
+	}
+
+	if dropped, err := ViewDrop(kv, "a_view"); !dropped || err != nil {
+		t.Errorf("Failed to drop view: %v", err)
+	}
+	if view, _ := ViewGet(kv, "a_view"); view != nil {
+		t.Errorf("Expected the view to be dropped")
+	}
+	if names, _ := ViewList(kv); fmt.Sprint(names) != "[b_view]" {
+		t.Errorf("Unexpected views: %v", names)
+	}
+
+	fmt.Println("Views tests passed!")
+}
+
+func TestMatViewRefresh(t *testing.T) {
+	fmt.Println("Testing Materialized View Refresh...")
+
+	kv := NewMemKV()
+	base := &TableDef{
+		Name: "items", Cols: []string{"id", "qty"}, Types: []uint32{TYPE_INT64, TYPE_INT64}, PKeys: 1,
+	}
+	view := &TableDef{
+		Name: "big_items", Cols: []string{"item", "double"}, Types: []uint32{TYPE_INT64, TYPE_INT64}, PKeys: 1,
+		MatView: &MatView{
+			Query: "SELECT id AS item, qty * 2 AS double FROM items WHERE qty > 10",
+			Table: "items", Cols: []string{"item", "double"}, Keys: []string{"id"},
+		},
+	}
+	for _, tdef := range []*TableDef{base, view} {
+		if err := CatalogCreate(kv, tdef); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	// more rows than a batch
+	n := TABLE_REWRITE_BATCH + 10
+	for i := 0; i < n; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddInt64("qty", int64(i%20))
+		if _, err := TableSet(kv, base, *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	// a stale row, which is removed
+	stale := (&Record{}).AddInt64("item", -1).AddInt64("double", 0)
+	if _, err := TableSet(kv, view, *stale, MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	viewRow := func(row Record) (*Record, error) {
+		qty := row.Get("qty").I64
+		if qty <= 10 {
+			return nil, nil
+		}
+		return (&Record{}).AddInt64("item", row.Get("id").I64).AddInt64("double", qty*2), nil
+	}
+	if err := MatViewRefresh(kv, view, base, viewRow); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	count := 0
+	scanRows(kv, view, func(rec Record) bool {
+		if id, double := rec.Get("item").I64, rec.Get("double").I64; id%20 <= 10 || double != id%20*2 {
+			t.Errorf("Unexpected view row: %v", rec)
+		}
+		count++
+		return true
+	})
+	if want := n / 20 * 9; count != want {
+		t.Errorf("Expected %d view rows, got %d", want, count)
+	}
+
+	// The key of the view row of a table row
+	row := (&Record{}).AddInt64("id", 15).AddInt64("qty", 15)
+	if key := MatViewKey(view, *row); fmt.Sprint(key.Cols) != "[item]" || key.Vals[0].I64 != 15 {
+		t.Errorf("Unexpected key: %v", key)
+	}
+	if found, err := TableGet(kv, view, MatViewKey(view, *row)); err != nil || found == nil {
+		t.Errorf("Expected the view row of id 15, got %v, %v", found, err)
+	}
+	if views, _ := MatViewList(kv, "items"); len(views) != 1 || views[0].Name != "big_items" {
+		t.Errorf("Unexpected materialized views: %v", views)
+	}
+	if users, _ := ViewUsers(kv, "items"); fmt.Sprint(users) != "[big_items]" {
+		t.Errorf("Unexpected view users: %v", users)
+	}
+
+	fmt.Println("Materialized View Refresh tests passed!")
+}
+
+func TestTriggers(t *testing.T) {
+	fmt.Println("Testing Triggers...")
+
+	kv := NewMemKV()
+	for _, trig := range []*Trigger{
+		{Name: "b_trig", Table: "users", Timing: "AFTER", Event: "INSERT", Body: "DELETE FROM logs"},
+		{Name: "a_trig", Table: "users", Timing: "BEFORE", Event: "UPDATE", Body: "SET NEW.x = 1"},
+		{Name: "c_trig", Table: "logs", Timing: "AFTER", Event: "DELETE", Body: "DELETE FROM users"},
+	} {
+		if err := TriggerCreate(kv, trig, false); err != nil {
+			t.Fatalf("Failed to create trigger: %v", err)
+		}
+	}
+	// a view is also stored in @meta, it is not a trigger
+	if err := ViewCreate(kv, &View{Name: "v", Cols: []string{"id"}}); err != nil {
+		t.Fatalf("Failed to create view: %v", err)
+	}
+	if err := TriggerCreate(kv, &Trigger{Name: "a_trig", Table: "logs"}, false); err == nil {
+		t.Errorf("Expected an error for a duplicate trigger")
+	}
+
+	// The triggers of a table are in the order of the names
+	triggers, err := TriggerList(kv, "users")
+	if err != nil || len(triggers) != 2 || triggers[0].Name != "a_trig" || triggers[1].Body != "DELETE FROM logs" {
+		t.Errorf("Unexpected triggers: %+v, %v", triggers, err)
+	}
+	trig := &Trigger{Name: "a_trig", Table: "logs", Timing: "BEFORE", Event: "UPDATE", Body: "SET NEW.x = 2"}
+	if err := TriggerCreate(kv, trig, true); err != nil {
+		t.Fatalf("Failed to replace trigger: %v", err)
+	}
+	if triggers, _ := TriggerList(kv, "logs"); len(triggers) != 2 {
+		t.Errorf("Expected 2 triggers of logs, got %+v", triggers)
+	}
+
+	if dropped, err := TriggerDrop(kv, "a_trig"); !dropped || err != nil {
+		t.Errorf("Failed to drop trigger: %v", err)
+	}
+	if trig, _ := TriggerGet(kv, "a_trig"); trig != nil {
+		t.Errorf("Expected the trigger to be dropped")
+	}
+	if names, _ := ViewList(kv); fmt.Sprint(names) != "[v]" {
+		t.Errorf("Unexpected views: %v", names)
+	}
+
+	fmt.Println("Triggers tests passed!")
+}
+
+func TestVirtualColumns(t *testing.T) {
+	fmt.Println("Testing Virtual Columns...")
+
+	kv := NewMemKV()
+	tdef := &TableDef{
+		Name: "items", Cols: []string{"id", "qty", "double"},
+		Types: []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64}, PKeys: 1,
+		Indexes: [][]string{{"double"}}, IndexNames: []string{"items_double"},
+		Generated: map[string]string{"double": "qty * 2"}, Virtual: []string{"double"},
+	}
+	if err := CatalogCreate(kv, tdef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	row := func(id int64, qty int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddInt64("qty", qty).AddInt64("double", 0)
+	}
+
+	// Without the function, the table cannot be written
+	if _, err := TableSet(kv, tdef, row(1, 3), MODE_UPSERT); err == nil {
+		t.Errorf("Expected an error without the virtual function")
+	}
+	tdef.VirtualFunc = func(values []Value) error {
+		values[2] = Value{Type: TYPE_INT64, I64: values[1].I64 * 2}
+		return nil
+	}
+	for _, rec := range []Record{row(1, 3), row(2, 4), row(1, 5)} {
+		if _, err := TableSet(kv, tdef, rec, MODE_UPSERT); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	// The value is computed on read, and indexed
+	rec, err := TableGet(kv, tdef, *(&Record{}).AddInt64("id", 1))
+	if err != nil || rec == nil || rec.Get("double").I64 != 10 {
+		t.Errorf("Unexpected row: %v, %v", rec, err)
+	}
+	indexed := func(id int64, double int64) bool {
+		vals := []Value{{Type: TYPE_INT64, I64: id}, {}, {Type: TYPE_INT64, I64: double}}
+		_, ok := kv.Get(indexKey(tdef, 0, vals))
+		return ok
+	}
+	if indexed(1, 6) || !indexed(1, 10) || !indexed(2, 8) {
+		t.Errorf("Unexpected index entries")
+	}
+
+	// The value is not stored
+	plain := *tdef
+	plain.VirtualFunc = nil
+	rec, err = TableGet(kv, &plain, *(&Record{}).AddInt64("id", 2))
+	if err != nil || rec == nil || !rec.Get("double").Null {
+		t.Errorf("Expected a NULL stored value, got %v, %v", rec, err)
+	}
+
+	// An error of the function fails the reads
+	failing := *tdef
+	failing.VirtualFunc = func(values []Value) error { return fmt.Errorf("division by zero") }
+	if _, err := TableGet(kv, &failing, *(&Record{}).AddInt64("id", 2)); err == nil ||
+		!strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("Expected the error of the virtual function, got %v", err)
+	}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddInt64("id", 1),
+		Key2: *(&Record{}).AddInt64("id", 2)}
+	if err := TableScan(kv, &failing, &sc); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	var scanned Record
+	if sc.Deref(&scanned); sc.Err() == nil || scanned.Cols != nil {
+		t.Errorf("Expected a scan error, got %v", scanned)
+	}
+
+	if deleted, err := TableDelete(kv, tdef, *(&Record{}).AddInt64("id", 2)); !deleted || err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if indexed(2, 8) {
+		t.Errorf("Expected the index entry to be deleted")
+	}
+
+	fmt.Println("Virtual Columns tests passed!")
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is the exact number Coef * 10^-Scale.
+// The values are immutable, the operations return new values.
+type Decimal struct {
+	Coef  *big.Int // nil is 0
+	Scale int
+}
+
+// DecimalType is the precision and the scale of a DECIMAL(p,s) column
+type DecimalType struct {
+	Precision int // the number of digits
+	Scale     int // the number of digits after the point
+}
+
+const (
+	DECIMAL_MAX_PRECISION = 1000
+	// the digits added to the scale of the dividend for a quotient
+	DECIMAL_DIV_SCALE = 6
+)
+
+var bigTen = big.NewInt(10)
+
+// ParseDecimal parses `[+-]digits[.digits][e[+-]digits]`, the scale is
+// the number of digits after the point minus the exponent.
+func ParseDecimal(s string) (Decimal, error) {
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 {
+		return Decimal{}, fmt.Errorf("bad decimal: %q", s)
+	}
+	scale := 0
+	if e := strings.IndexAny(digits, "eE"); e >= 0 {
+		exp, err := strconv.Atoi(digits[e+1:])
+		if err != nil || exp < -DECIMAL_MAX_PRECISION || exp > DECIMAL_MAX_PRECISION {
+			return Decimal{}, fmt.Errorf("bad decimal: %q", s)
+		}
+		scale, digits = -exp, digits[:e]
+	}
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		scale += len(digits) - dot - 1
+		digits = digits[:dot] + digits[dot+1:]
+	}
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("bad decimal: %q", s)
+	}
+	coef, _ := new(big.Int).SetString(digits, 10)
+	if strings.HasPrefix(s, "-") {
+		coef.Neg(coef)
+	}
+	return Decimal{Coef: coef, Scale: scale}, nil
+}
+
+// DecimalFromInt64 converts an integer exactly
+func DecimalFromInt64(n int64) Decimal {
+	return Decimal{Coef: big.NewInt(n)}
+}
+
+// DecimalFromFloat64 converts a float to its shortest decimal representation,
+// so the literal `0.1` is 0.1 and not the closest binary fraction.
+func DecimalFromFloat64(f float64) (Decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Decimal{}, fmt.Errorf("%v is not a decimal", f)
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func (d Decimal) coef() *big.Int {
+	if d.Coef == nil {
+		return new(big.Int)
+	}
+	return d.Coef
+}
+
+// String formats the number with exactly Scale digits after the point
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.coef()).String()
+	sign := ""
+	if d.Sign() < 0 {
+		sign = "-"
+	}
+	if d.Scale <= 0 {
+		return sign + digits + strings.Repeat("0", -d.Scale)
+	}
+	if len(digits) <= d.Scale {
+		digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+	}
+	point := len(digits) - d.Scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// Float64 returns the closest float
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+func (d Decimal) Sign() int {
+	return d.coef().Sign()
+}
+
+// the coefficient at a larger scale
+func (d Decimal) scaleUp(scale int) *big.Int {
+	if scale <= d.Scale {
+		return d.coef()
+	}
+	mul := new(big.Int).Exp(bigTen, big.NewInt(int64(scale-d.Scale)), nil)
+	return mul.Mul(mul, d.coef())
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	return Decimal{Coef: new(big.Int).Neg(d.coef()), Scale: d.Scale}
+}
+
+// Cmp returns -1, 0 or 1, the scales do not matter
+func (d Decimal) Cmp(e Decimal) int {
+	scale := max(d.Scale, e.Scale)
+	return d.scaleUp(scale).Cmp(e.scaleUp(scale))
+}
+
+// Add returns d + e, with the larger scale
+func (d Decimal) Add(e Decimal) Decimal {
+	scale := max(d.Scale, e.Scale)
+	return Decimal{Coef: new(big.Int).Add(d.scaleUp(scale), e.scaleUp(scale)), Scale: scale}
+}
+
+// Sub returns d - e, with the larger scale
+func (d Decimal) Sub(e Decimal) Decimal {
+	scale := max(d.Scale, e.Scale)
+	return Decimal{Coef: new(big.Int).Sub(d.scaleUp(scale), e.scaleUp(scale)), Scale: scale}
+}
+
+// Mul returns d * e, the scale is the sum of the scales
+func (d Decimal) Mul(e Decimal) Decimal {
+	return Decimal{Coef: new(big.Int).Mul(d.coef(), e.coef()), Scale: d.Scale + e.Scale}
+}
+
+// Div returns d / e rounded half away from zero to
+// DECIMAL_DIV_SCALE more digits than the larger scale.
+// e must not be 0.
+func (d Decimal) Div(e Decimal) Decimal {
+	scale := max(d.Scale, e.Scale) + DECIMAL_DIV_SCALE
+	// d / e = (d.Coef * 10^(scale + e.Scale - d.Scale) / e.Coef) * 10^-scale,
+	// with one more digit for the rounding
+	num := Decimal{Coef: d.coef(), Scale: d.Scale - e.Scale}.scaleUp(scale + 1)
+	quo := new(big.Int).Quo(num, e.coef())
+	return Decimal{Coef: quo, Scale: scale + 1}.Round(scale)
+}
+
+// Mod returns the remainder of the truncated division, with the sign of d.
+// e must not be 0.
+func (d Decimal) Mod(e Decimal) Decimal {
+	scale := max(d.Scale, e.Scale)
+	return Decimal{Coef: new(big.Int).Rem(d.scaleUp(scale), e.scaleUp(scale)), Scale: scale}
+}
+
+// Round returns the number with the scale, rounded half away from zero
+func (d Decimal) Round(scale int) Decimal {
+	if scale >= d.Scale {
+		return Decimal{Coef: d.scaleUp(scale), Scale: scale}
+	}
+	div := new(big.Int).Exp(bigTen, big.NewInt(int64(d.Scale-scale)), nil)
+	quo, rem := new(big.Int).QuoRem(d.coef(), div, new(big.Int))
+	// |rem| >= div/2
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(div) >= 0 {
+		quo.Add(quo, big.NewInt(int64(d.Sign())))
+	}
+	return Decimal{Coef: quo, Scale: scale}
+}
+
+// Precision returns the number of digits of the coefficient, 0 for 0
+func (d Decimal) Precision() int {
+	if d.Sign() == 0 {
+		return 0
+	}
+	return len(new(big.Int).Abs(d.coef()).String())
+}
+
+// Fit rounds the number to the column type. It fails if the
+// integer part has more than Precision - Scale digits.
+func (t DecimalType) Fit(d Decimal) (Decimal, error) {
+	r := d.Round(t.Scale)
+	if r.Precision() > t.Precision {
+		return Decimal{}, fmt.Errorf("%s is out of range for DECIMAL(%d,%d)",
+			d.String(), t.Precision, t.Scale)
+	}
+	return r, nil
+}
+
+// the smallest coefficient, without trailing zeros
+func (d Decimal) normalize() Decimal {
+	coef, scale := new(big.Int).Set(d.coef()), d.Scale
+	if coef.Sign() == 0 {
+		return Decimal{Coef: coef}
+	}
+	rem := new(big.Int)
+	for {
+		quo, _ := new(big.Int).QuoRem(coef, bigTen, rem)
+		if rem.Sign() != 0 {
+			break
+		}
+		coef, scale = quo, scale-1
+	}
+	return Decimal{Coef: coef, Scale: scale}
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+)
+
+// Each value starts with a flag byte, so NULLs sort before the other values
+// and the scan range `col > NULL` starts at the first non-NULL value.
+const (
+	VALUE_NULL     = 0x00
+	VALUE_NOT_NULL = 0x01
+)
+
+// order-preserving encoding
+func encodeValues(out []byte, vals []Value) []byte {
+	for _, v := range vals {
+		if v.Null {
+			out = append(out, VALUE_NULL)
+			continue
+		}
+		out = append(out, VALUE_NOT_NULL)
+		switch v.Type {
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			var buf [8]byte
+			u := uint64(v.I64) + (1 << 63)
+			binary.BigEndian.PutUint64(buf[:], u)
+			out = append(out, buf[:]...)
+		case TYPE_FLOAT64:
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], encodeFloat(v.F64))
+			out = append(out, buf[:]...)
+		case TYPE_BOOL:
+			out = append(out, byte(v.I64))
+		case TYPE_DECIMAL:
+			out = encodeDecimal(out, v.Dec)
+		case TYPE_JSON:
+			out = encodeJSON(out, v.Str)
+		case TYPE_BYTES:
+			out = append(out, escapeString(v.Str)...)
+			out = append(out, 0) // null-terminated
+		default:
+			panic("what?")
+		}
+	}
+	return out
+}
+
+// order-preserving encoding.
+// the types of the output values are set by the caller,
+// and the scales of the decimals, which are not in the encoding.
+// it returns the remaining input.
+func decodeValues(in []byte, out []Value) []byte {
+	for i := range out {
+		out[i].Null = in[0] == VALUE_NULL
+		in = in[1:]
+		if out[i].Null {
+			continue
+		}
+		switch out[i].Type {
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			u := binary.BigEndian.Uint64(in[:8])
+			out[i].I64 = int64(u - (1 << 63))
+			in = in[8:]
+		case TYPE_FLOAT64:
+			out[i].F64 = decodeFloat(binary.BigEndian.Uint64(in[:8]))
+			in = in[8:]
+		case TYPE_BOOL:
+			out[i].I64 = int64(in[0])
+			in = in[1:]
+		case TYPE_DECIMAL:
+			scale := out[i].Dec.Scale
+			out[i].Dec, in = decodeDecimal(in)
+			if out[i].Dec.Scale < scale {
+				out[i].Dec = out[i].Dec.Round(scale)
+			}
+		case TYPE_JSON:
+			out[i].Str, in = decodeJSON(in)
+		case TYPE_BYTES:
+			idx := bytes.IndexByte(in, 0)
+			if idx < 0 {
+				panic("what?")
+			}
+			out[i].Str = unescapeString(in[:idx])
+			in = in[idx+1:]
+		default:
+			panic("what?")
+		}
+	}
+	return in
+}
+
+// The IEEE 754 bits sort like the numbers after flipping the sign bit
+// of the positive numbers and all bits of the negative numbers.
+// -0 is stored as 0, and NaN is rejected by checkRecord().
+func encodeFloat(f float64) uint64 {
+	if f == 0 {
+		f = 0
+	}
+	u := math.Float64bits(f)
+	if u>>63 == 0 {
+		return u | (1 << 63)
+	}
+	return ^u
+}
+
+func decodeFloat(u uint64) float64 {
+	if u>>63 == 1 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+// A decimal is encoded by its sign, then the position of the point before
+// the first digit and the digits without the trailing zeros, so the order
+// and the equality do not depend on the scale (1.5 == 1.50).
+// The digits end with 0x00, which sorts a prefix first (0.15 < 0.151).
+// The exponent and the digits of a negative number are inverted.
+const (
+	DECIMAL_NEG  = 0x00
+	DECIMAL_ZERO = 0x01
+	DECIMAL_POS  = 0x02
+)
+
+func encodeDecimal(out []byte, d Decimal) []byte {
+	d = d.normalize()
+	if d.Sign() == 0 {
+		return append(out, DECIMAL_ZERO)
+	}
+	digits := []byte(new(big.Int).Abs(d.Coef).String())
+	var exp [4]byte
+	binary.BigEndian.PutUint32(exp[:], uint32(len(digits)-d.Scale)+(1<<31))
+	digits = append(digits, 0)
+	if d.Sign() > 0 {
+		out = append(out, DECIMAL_POS)
+	} else {
+		out = append(out, DECIMAL_NEG)
+		for i := range exp {
+			exp[i] = ^exp[i]
+		}
+		for i := range digits {
+			digits[i] = ^digits[i]
+		}
+	}
+	out = append(out, exp[:]...)
+	return append(out, digits...)
+}
+
+// the reverse of encodeDecimal(), the scale is the number of digits after the point
+func decodeDecimal(in []byte) (Decimal, []byte) {
+	sign := in[0]
+	if sign == DECIMAL_ZERO {
+		return Decimal{Coef: new(big.Int)}, in[1:]
+	}
+	exp := binary.BigEndian.Uint32(in[1:5])
+	end := byte(0)
+	if sign == DECIMAL_NEG {
+		exp, end = ^exp, 0xff
+	}
+	in = in[5:]
+	idx := bytes.IndexByte(in, end)
+	if idx < 0 {
+		panic("what?")
+	}
+	digits := append([]byte{}, in[:idx]...)
+	if sign == DECIMAL_NEG {
+		for i := range digits {
+			digits[i] = ^digits[i]
+		}
+	}
+	coef, _ := new(big.Int).SetString(string(digits), 10)
+	if sign == DECIMAL_NEG {
+		coef.Neg(coef)
+	}
+	scale := len(digits) - int(int32(exp-(1<<31)))
+	return Decimal{Coef: coef, Scale: scale}, in[idx+1:]
+}
+
+// Strings are encoded as nul terminated strings,
+// escape the nul byte so that strings contain no nul byte.
+func escapeString(in []byte) []byte {
+	zeros := bytes.Count(in, []byte{0})
+	ones := bytes.Count(in, []byte{1})
+	if zeros+ones == 0 {
+		return in
+	}
+	out := make([]byte, len(in)+zeros+ones)
+	pos := 0
+	for _, ch := range in {
+		if ch <= 1 {
+			out[pos+0] = 0x01
+			out[pos+1] = ch + 1
+			pos += 2
+		} else {
+			out[pos] = ch
+			pos += 1
+		}
+	}
+	return out
+}
+
+// the reverse of escapeString(), the output never shares memory with the input
+func unescapeString(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == 0x01 && i+1 < len(in) {
+			i++
+			out = append(out, in[i]-1)
+		} else {
+			out = append(out, in[i])
+		}
+	}
+	return out
+}
+
+// for primary keys
+func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], prefix)
+	out = append(out, buf[:]...)
+	out = encodeValues(out, vals)
+	return out
+}
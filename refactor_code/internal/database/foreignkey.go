@@ -0,0 +1,143 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ForeignKey references the primary key or a unique index of a table.
+// A row whose columns are all non-NULL must match a row of the
+// referenced table. The checks and the actions are done by the
+// transactions, see transaction.DBTX.
+type ForeignKey struct {
+	Name    string
+	Cols    []string // the columns of this table
+	Table   string   // the referenced table
+	RefCols []string // its primary key or the columns of a unique index
+	// FK_RESTRICT, FK_CASCADE or FK_SET_NULL, for the referenced rows
+	OnDelete int
+	OnUpdate int
+	// the check is done at the commit instead of each write
+	Deferred bool
+}
+
+// the actions of a foreign key
+const (
+	FK_RESTRICT = 0 // the referenced row cannot be deleted or changed
+	FK_CASCADE  = 1 // delete or update the rows with the referenced row
+	FK_SET_NULL = 2 // set the columns of the rows to NULL
+)
+
+// ForeignKeyError is returned when a write violates a foreign key
+type ForeignKeyError struct {
+	Table      string // the table of the foreign key
+	ForeignKey string
+	Key        Record // the values of the foreign key columns
+	// whether the referenced row is deleted or changed, instead
+	// of a row without a referenced row
+	Referenced bool
+}
+
+func (e *ForeignKeyError) Error() string {
+	vals := make([]string, len(e.Key.Vals))
+	for i, v := range e.Key.Vals {
+		vals[i] = fmt.Sprintf("%s=%s", e.Key.Cols[i], valueToString(v))
+	}
+	if e.Referenced {
+		return fmt.Sprintf("key (%s) is still referenced by foreign key %s of table %s",
+			strings.Join(vals, ", "), e.ForeignKey, e.Table)
+	}
+	return fmt.Sprintf("key (%s) is not present for foreign key %s of table %s",
+		strings.Join(vals, ", "), e.ForeignKey, e.Table)
+}
+
+// validate the foreign keys within the table, the referenced tables
+// are checked by the transactions
+func validateForeignKeys(def *TableDef) error {
+	names := map[string]bool{}
+	for _, fk := range def.ForeignKeys {
+		if !isValidIdentifier(fk.Name) || names[fk.Name] {
+			return fmt.Errorf("bad foreign key name: %s", fk.Name)
+		}
+		names[fk.Name] = true
+		if len(fk.Cols) == 0 || len(fk.Cols) != len(fk.RefCols) {
+			return fmt.Errorf("foreign key %s: column count mismatch", fk.Name)
+		}
+		for _, c := range fk.Cols {
+			i := colIndex(def, c)
+			if i < 0 {
+				return fmt.Errorf("foreign key %s: unknown column %s", fk.Name, c)
+			}
+			if fk.OnDelete == FK_SET_NULL || fk.OnUpdate == FK_SET_NULL {
+				if i < def.PKeys || isNotNull(def, c) {
+					return fmt.Errorf("foreign key %s: SET NULL on NOT NULL column %s", fk.Name, c)
+				}
+			}
+		}
+		for _, action := range []int{fk.OnDelete, fk.OnUpdate} {
+			if action != FK_RESTRICT && action != FK_CASCADE && action != FK_SET_NULL {
+				return fmt.Errorf("foreign key %s: bad action %d", fk.Name, action)
+			}
+		}
+	}
+	return nil
+}
+
+// RefIndex returns the unique key over exactly the columns: "" for
+// the primary key or the name of a unique index. It returns false if
+// the columns are not a unique key.
+func RefIndex(tdef *TableDef, cols []string) (string, bool) {
+	if equalCols(tdef.Cols[:tdef.PKeys], cols) {
+		return "", true
+	}
+	for i, index := range tdef.Indexes {
+		n := uniqueCols(tdef, i)
+		if n > 0 && equalCols(index[:n], cols) && !isBuilding(tdef, i) {
+			return tdef.IndexNames[i], true
+		}
+	}
+	return "", false
+}
+
+func equalCols(a []string, b []string) bool {
+	return len(a) == len(b) && isPrefix(a, b)
+}
+
+// EqualValues reports whether the values are the same, as keys
+func EqualValues(a []Value, b []Value) bool {
+	return bytes.Equal(encodeValues(nil, a), encodeValues(nil, b))
+}
+
+// TableFind returns up to `limit` rows (0 for no limit) whose columns
+// have the values. It scans the primary key or an index that starts
+// with the columns, or all rows if there is no such index.
+func TableFind(kv KVReader, tdef *TableDef, key Record, limit int) ([]Record, error) {
+	if err := checkKeyTypes(tdef, key); err != nil {
+		return nil, err
+	}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if _, err := findIndex(tdef, key.Cols); err != nil {
+		sc.Key1, sc.Key2 = Record{}, Record{} // a full scan
+	}
+	if err := TableScan(kv, tdef, &sc); err != nil {
+		return nil, err
+	}
+	want := encodeValues(nil, key.Vals)
+	out := []Record{}
+	for ; sc.Valid() && (limit == 0 || len(out) < limit); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		vals := make([]Value, len(key.Cols))
+		for i, c := range key.Cols {
+			vals[i] = *rec.Get(c)
+		}
+		if bytes.Equal(encodeValues(nil, vals), want) {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import "fmt"
+
+// The generated columns are computed from the other columns of a row
+// by the query executor. A STORED one is computed on each write and
+// stored like any column. A VIRTUAL one is stored as NULL and computed
+// on read by TableDef.VirtualFunc, which is also used to maintain the
+// index entries of the row, so both kinds can be indexed.
+
+// fill the virtual columns of a row in the table order. the computed
+// values are checked like the written ones, so a row reads the values
+// of its index entries. the other columns are not checked again.
+func virtualValues(tdef *TableDef, values []Value) error {
+	if len(tdef.Virtual) == 0 {
+		return nil
+	}
+	if tdef.VirtualFunc == nil {
+		return fmt.Errorf("the virtual columns of %s cannot be computed by this database", tdef.Name)
+	}
+	if err := tdef.VirtualFunc(values); err != nil {
+		return err
+	}
+	for _, col := range tdef.Virtual {
+		i := colIndex(tdef, col)
+		v, err := checkValue(tdef, i, values[i], true)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	return nil
+}
+
+// the KV value of a row, without the values of the virtual columns
+func encodeRowValue(tdef *TableDef, values []Value) []byte {
+	stored := values[tdef.PKeys:]
+	if len(tdef.Virtual) != 0 {
+		stored = append([]Value(nil), stored...)
+		for _, col := range tdef.Virtual {
+			i := colIndex(tdef, col) - tdef.PKeys
+			stored[i] = Value{Type: stored[i].Type, Null: true}
+		}
+	}
+	return encodeValues(nil, stored)
+}
+
+// whether an index has a virtual column, or a path of a virtual JSON column
+func indexUsesVirtual(tdef *TableDef, i int) bool {
+	for _, name := range tdef.Indexes[i] {
+		if colIndex(tdef, name) < 0 {
+			name, _, _ = parseJSONIndexColumn(name)
+		}
+		for _, col := range tdef.Virtual {
+			if col == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,137 +2,87 @@ package database
 
 import (
 	"fmt"
-	"sync"
+	"govetachun/go-mini-db/refactor_code/internal/storage"
 )
 
-// SimpleDB represents a simple in-memory database implementation
+// SimpleDB represents a database whose catalog is stored in a KV store.
+// Each schema change is a transaction on its own.
 type SimpleDB struct {
-	tables map[string]*TableDef
-	mu     sync.RWMutex
+	store  storage.KVStore
+	seqs   *SequenceCache
+	schema *SchemaManager
 }
 
-// NewSimpleDB creates a new simple database instance
-func NewSimpleDB() *SimpleDB {
-	return &SimpleDB{
-		tables: make(map[string]*TableDef),
-	}
+// NewSimpleDB creates a database instance on an opened KV store
+func NewSimpleDB(store storage.KVStore) *SimpleDB {
+	return &SimpleDB{store: store, seqs: NewSequenceCache(), schema: NewKVSchemaManager(store)}
+}
+
+// GetStore returns the underlying KV store
+func (db *SimpleDB) GetStore() storage.KVStore {
+	return db.store
+}
+
+// Sequences returns the cached blocks of the sequences,
+// which are shared by the transactions on the database
+func (db *SimpleDB) Sequences() *SequenceCache {
+	return db.seqs
 }
 
-// GetTableDef returns a table definition by name
+// GetTableDef returns a committed table definition by name
 func (db *SimpleDB) GetTableDef(name string) *TableDef {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return db.tables[name]
+	tdef, err := CatalogGet(db.store, name)
+	if err != nil {
+		return nil
+	}
+	return tdef
 }
 
-// ListTables returns a list of all table names
+// ListTables returns a list of all table and view names
 func (db *SimpleDB) ListTables() ([]string, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	return CatalogNames(db.store)
+}
 
-	tables := make([]string, 0, len(db.tables))
-	for name := range db.tables {
-		tables = append(tables, name)
-	}
-	return tables, nil
+// Schema returns the schema manager of the database
+func (db *SimpleDB) Schema() *SchemaManager {
+	return db.schema
 }
 
 // CreateTable creates a new table
 func (db *SimpleDB) CreateTable(def *TableDef) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if def == nil {
-		return fmt.Errorf("table definition cannot be nil")
-	}
-
-	if def.Name == "" {
-		return fmt.Errorf("table name cannot be empty")
-	}
-
-	if _, exists := db.tables[def.Name]; exists {
-		return fmt.Errorf("table %s already exists", def.Name)
-	}
-
-	// Validate table definition
-	if err := validateTableDef(def); err != nil {
-		return fmt.Errorf("invalid table definition: %w", err)
-	}
-
-	db.tables[def.Name] = def
-	return nil
+	return db.schema.CreateTable(def)
 }
 
 // DropTable drops a table
 func (db *SimpleDB) DropTable(name string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if _, exists := db.tables[name]; !exists {
-		return fmt.Errorf("table %s does not exist", name)
-	}
-
-	delete(db.tables, name)
-	return nil
+	return db.schema.DropTable(name)
 }
 
-// AlterTable alters a table definition
+// AlterTable alters a table definition, keeping the original name
 func (db *SimpleDB) AlterTable(name string, newDef *TableDef) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if _, exists := db.tables[name]; !exists {
-		return fmt.Errorf("table %s does not exist", name)
-	}
-
 	if newDef == nil {
 		return fmt.Errorf("new table definition cannot be nil")
 	}
-
-	// Validate new table definition
-	if err := validateTableDef(newDef); err != nil {
-		return fmt.Errorf("invalid table definition: %w", err)
-	}
-
-	// Preserve the original name
 	newDef.Name = name
-	db.tables[name] = newDef
-	return nil
+	return db.schema.AlterTable(name, newDef)
 }
 
 // RenameTable renames a table
 func (db *SimpleDB) RenameTable(oldName, newName string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if _, exists := db.tables[oldName]; !exists {
-		return fmt.Errorf("table %s does not exist", oldName)
-	}
-
-	if _, exists := db.tables[newName]; exists {
-		return fmt.Errorf("table %s already exists", newName)
-	}
+	return db.schema.RenameTable(oldName, newName)
+}
 
-	if oldName == newName {
-		return nil // No-op
+// run `fn` in a KV transaction, commit it if there is no error
+func (db *SimpleDB) update(fn func(tx *storage.KVTX) error) error {
+	tx, err := db.store.Begin()
+	if err != nil {
+		return err
 	}
-
-	// Get the table definition
-	tdef := db.tables[oldName]
-
-	// Create new table definition with new name
-	newDef := &TableDef{
-		Name:  newName,
-		Cols:  tdef.Cols,
-		Types: tdef.Types,
-		PKeys: tdef.PKeys,
+	if err := fn(tx); err != nil {
+		tx.Abort()
+		return err
 	}
-
-	// Add new table and remove old one
-	db.tables[newName] = newDef
-	delete(db.tables, oldName)
-
-	return nil
+	return tx.Commit()
 }
 
 // validateTableDef validates a table definition
@@ -180,12 +130,89 @@ func validateTableDef(def *TableDef) error {
 
 	// Validate data types
 	for i, colType := range def.Types {
-		if colType != TYPE_INT64 && colType != TYPE_BYTES {
+		if !validType(colType) {
 			return fmt.Errorf("invalid data type for column %s: %d", def.Cols[i], colType)
 		}
 	}
 
-	return nil
+	// Validate NOT NULL columns
+	for _, col := range def.NotNull {
+		if !colSet[col] {
+			return fmt.Errorf("unknown NOT NULL column: %s", col)
+		}
+	}
+
+	// Validate the precision and the scale of DECIMAL columns
+	for i, col := range def.Cols {
+		dt, ok := def.Decimals[col]
+		if def.Types[i] != TYPE_DECIMAL {
+			if ok {
+				return fmt.Errorf("column %s is not DECIMAL", col)
+			}
+			continue
+		}
+		if dt.Precision < 1 || dt.Precision > DECIMAL_MAX_PRECISION {
+			return fmt.Errorf("bad DECIMAL precision for column %s: %d", col, dt.Precision)
+		}
+		if dt.Scale < 0 || dt.Scale > dt.Precision {
+			return fmt.Errorf("bad DECIMAL scale for column %s: %d", col, dt.Scale)
+		}
+	}
+	for col := range def.Decimals {
+		if !colSet[col] {
+			return fmt.Errorf("unknown DECIMAL column: %s", col)
+		}
+	}
+
+	// Validate DEFAULT columns and CHECK names, the expressions are
+	// validated by the query executor
+	for col := range def.Defaults {
+		if !colSet[col] {
+			return fmt.Errorf("unknown DEFAULT column: %s", col)
+		}
+	}
+
+	// The generated columns are not in the primary key, which is not
+	// computed on read, and have no DEFAULT
+	for col := range def.Generated {
+		i := colIndex(def, col)
+		if i < 0 {
+			return fmt.Errorf("unknown generated column: %s", col)
+		}
+		if i < def.PKeys {
+			return fmt.Errorf("primary key column %s cannot be generated", col)
+		}
+		if _, ok := def.Defaults[col]; ok {
+			return fmt.Errorf("generated column %s cannot have a DEFAULT", col)
+		}
+	}
+	for _, col := range def.Virtual {
+		if _, ok := def.Generated[col]; !ok {
+			return fmt.Errorf("virtual column %s is not generated", col)
+		}
+	}
+	if len(def.CheckNames) != len(def.Checks) {
+		return fmt.Errorf("CHECK constraint names mismatch")
+	}
+	checkSet := map[string]bool{}
+	for _, name := range def.CheckNames {
+		if !isValidIdentifier(name) || checkSet[name] {
+			return fmt.Errorf("bad CHECK constraint name: %s", name)
+		}
+		checkSet[name] = true
+	}
+
+	// The AUTO_INCREMENT primary key is a single INT64 column
+	if def.AutoIncrement != "" {
+		if !isValidIdentifier(def.AutoIncrement) {
+			return fmt.Errorf("invalid sequence name: %s", def.AutoIncrement)
+		}
+		if def.PKeys != 1 || def.Types[0] != TYPE_INT64 {
+			return fmt.Errorf("AUTO_INCREMENT requires a single INT64 primary key")
+		}
+	}
+
+	return validateForeignKeys(def)
 }
 
 // isValidIdentifier checks if a string is a valid identifier
@@ -253,7 +280,7 @@ func validateRecord(record Record, tdef *TableDef) error {
 
 		// Validate type
 		value := record.Get(colName)
-		if value != nil && value.Type != colType {
+		if value != nil && !value.Null && value.Type != colType {
 			return fmt.Errorf("type mismatch for column %s: expected %d, got %d",
 				colName, colType, value.Type)
 		}
@@ -1,9 +1,9 @@
 package database
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"sort"
-	"strings"
 	"sync"
 )
 
@@ -13,22 +13,19 @@ type IndexManager struct {
 	mu      sync.RWMutex
 }
 
-// Index represents a database index
+// Index represents a standalone index of records.
+// The entries are stored in an in-memory B-tree, ordered by the
+// encoded index columns followed by the encoded record.
 type Index struct {
 	Name        string
 	TableName   string
 	Columns     []string
 	ColumnTypes []uint32
-	Data        map[string][]*Record // Index key -> Records mapping
+	Unique      bool     // no two records have the same index key
+	kv          KVWriter // index key + record -> JSON record
 	mu          sync.RWMutex
 }
 
-// IndexEntry represents an entry in an index
-type IndexEntry struct {
-	Key     string
-	Records []*Record
-}
-
 // NewIndexManager creates a new index manager
 func NewIndexManager() *IndexManager {
 	return &IndexManager{
@@ -38,6 +35,15 @@ func NewIndexManager() *IndexManager {
 
 // CreateIndex creates a new index
 func (im *IndexManager) CreateIndex(name string, tableName string, columns []string, columnTypes []uint32) error {
+	return im.createIndex(name, tableName, columns, columnTypes, false)
+}
+
+// CreateUniqueIndex creates a new index that rejects duplicate keys
+func (im *IndexManager) CreateUniqueIndex(name string, tableName string, columns []string, columnTypes []uint32) error {
+	return im.createIndex(name, tableName, columns, columnTypes, true)
+}
+
+func (im *IndexManager) createIndex(name string, tableName string, columns []string, columnTypes []uint32, unique bool) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
@@ -69,7 +75,7 @@ func (im *IndexManager) CreateIndex(name string, tableName string, columns []str
 
 	// Validate column types
 	for i, colType := range columnTypes {
-		if colType != TYPE_INT64 && colType != TYPE_BYTES {
+		if !validType(colType) {
 			return fmt.Errorf("invalid data type for column %s: %d", columns[i], colType)
 		}
 	}
@@ -80,7 +86,8 @@ func (im *IndexManager) CreateIndex(name string, tableName string, columns []str
 		TableName:   tableName,
 		Columns:     make([]string, len(columns)),
 		ColumnTypes: make([]uint32, len(columnTypes)),
-		Data:        make(map[string][]*Record),
+		Unique:      unique,
+		kv:          NewMemKV(),
 	}
 
 	copy(index.Columns, columns)
@@ -143,23 +150,25 @@ func (idx *Index) Add(record *Record) error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	key, err := idx.generateIndexKey(record)
+	key, err := idx.entryKey(record)
 	if err != nil {
 		return fmt.Errorf("failed to generate index key: %w", err)
 	}
+	val, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
 
-	// Check if record already exists in this index key
-	records := idx.Data[key]
-	for _, existingRecord := range records {
-		if idx.recordsEqual(existingRecord, record) {
-			// Record already exists, no need to add
-			return nil
+	if idx.Unique && !idx.hasNull(record) {
+		// NULLs are distinct from each other
+		if err := idx.checkUnique(record, key); err != nil {
+			return err
 		}
 	}
 
-	// Add record to index
-	idx.Data[key] = append(records, record)
-	return nil
+	// Nothing is added if the record already exists
+	_, err = idx.kv.Update(key, val, MODE_INSERT_ONLY)
+	return err
 }
 
 // Remove removes a record from the index
@@ -167,91 +176,62 @@ func (idx *Index) Remove(record *Record) error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	key, err := idx.generateIndexKey(record)
+	key, err := idx.entryKey(record)
 	if err != nil {
 		return fmt.Errorf("failed to generate index key: %w", err)
 	}
 
-	records := idx.Data[key]
-	for i, existingRecord := range records {
-		if idx.recordsEqual(existingRecord, record) {
-			// Remove record from slice
-			idx.Data[key] = append(records[:i], records[i+1:]...)
-
-			// If no records left for this key, remove the key
-			if len(idx.Data[key]) == 0 {
-				delete(idx.Data, key)
-			}
-			return nil
-		}
-	}
-
-	// Record not found in index
-	return nil
+	// Record not found in index is not an error
+	_, err = idx.kv.Del(key)
+	return err
 }
 
-// Lookup looks up records by index key
+// Lookup looks up records by index key, which can be a prefix of the columns
 func (idx *Index) Lookup(key Record) ([]*Record, error) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	indexKey, err := idx.generateIndexKey(&key)
+	prefix, err := idx.generateIndexKey(&key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate index key: %w", err)
 	}
 
-	records := idx.Data[indexKey]
-	if len(records) == 0 {
-		return nil, nil
-	}
-
-	// Return copies of records
-	result := make([]*Record, len(records))
-	for i, record := range records {
-		copy := idx.copyRecord(*record)
-		result[i] = &copy
-	}
-
-	return result, nil
+	var result []*Record
+	err = idx.scan(prefix, func(key []byte, rec *Record) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		result = append(result, rec)
+		return true
+	})
+	return result, err
 }
 
-// RangeLookup performs a range lookup on the index
+// RangeLookup returns the records from startKey to endKey, both inclusive,
+// in the index order
 func (idx *Index) RangeLookup(startKey, endKey Record) ([]*Record, error) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	var result []*Record
-
-	// Get all index keys and sort them
-	var keys []string
-	for key := range idx.Data {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-
-	// Find range
-	startKeyStr, err := idx.generateIndexKey(&startKey)
+	start, err := idx.generateIndexKey(&startKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate start key: %w", err)
 	}
-
-	endKeyStr, err := idx.generateIndexKey(&endKey)
+	end, err := idx.generateIndexKey(&endKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate end key: %w", err)
 	}
 
-	// Find records in range
-	for _, key := range keys {
-		if key >= startKeyStr && key <= endKeyStr {
-			records := idx.Data[key]
-			for _, record := range records {
-				copy := idx.copyRecord(*record)
-				result = append(result, &copy)
-			}
+	var result []*Record
+	err = idx.scan(start, func(key []byte, rec *Record) bool {
+		// the end key is inclusive for all records that have it
+		if bytes.Compare(key, end) > 0 && !bytes.HasPrefix(key, end) {
+			return false
 		}
-	}
-
-	return result, nil
+		result = append(result, rec)
+		return true
+	})
+	return result, err
 }
 
 // Clear clears all data from the index
@@ -259,7 +239,7 @@ func (idx *Index) Clear() error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	idx.Data = make(map[string][]*Record)
+	idx.kv = NewMemKV()
 	return nil
 }
 
@@ -268,27 +248,21 @@ func (idx *Index) Validate() error {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	// Check that all index entries have valid keys
-	for key, records := range idx.Data {
-		if key == "" {
-			return fmt.Errorf("empty index key found")
-		}
-
-		for _, record := range records {
-			if record == nil {
-				return fmt.Errorf("nil record found in index")
-			}
-
-			// Validate that record has all required columns
-			for _, colName := range idx.Columns {
-				if record.Get(colName) == nil {
-					return fmt.Errorf("record missing required column %s", colName)
-				}
-			}
+	// Check that every entry matches its record
+	var err error
+	serr := idx.scan(nil, func(key []byte, record *Record) bool {
+		expected, kerr := idx.entryKey(record)
+		if kerr != nil {
+			err = fmt.Errorf("record missing required column: %w", kerr)
+		} else if !bytes.Equal(key, expected) {
+			err = fmt.Errorf("index entry does not match the record")
 		}
+		return err == nil
+	})
+	if serr != nil {
+		return serr
 	}
-
-	return nil
+	return err
 }
 
 // GetIndexInfo returns information about the index
@@ -301,108 +275,126 @@ func (idx *Index) GetIndexInfo() *IndexInfo {
 		TableName:   idx.TableName,
 		Columns:     make([]string, len(idx.Columns)),
 		ColumnTypes: make([]uint32, len(idx.ColumnTypes)),
-		EntryCount:  len(idx.Data),
 	}
 
 	copy(info.Columns, idx.Columns)
 	copy(info.ColumnTypes, idx.ColumnTypes)
 
-	// Count total records
-	totalRecords := 0
-	for _, records := range idx.Data {
-		totalRecords += len(records)
+	// Count the distinct keys and the records
+	for _, count := range idx.keyCounts() {
+		info.EntryCount++
+		info.RecordCount += count
 	}
-	info.RecordCount = totalRecords
-
 	return info
 }
 
 // Helper Methods
 
-// generateIndexKey generates a string key from index column values
-func (idx *Index) generateIndexKey(record *Record) (string, error) {
+// generateIndexKey encodes the index column values, in the index order.
+// The record can contain a prefix of the index columns.
+func (idx *Index) generateIndexKey(record *Record) ([]byte, error) {
 	if record == nil {
-		return "", fmt.Errorf("record cannot be nil")
+		return nil, fmt.Errorf("record cannot be nil")
 	}
 
-	var keyParts []string
+	vals := []Value{}
 	for i, colName := range idx.Columns {
 		value := record.Get(colName)
 		if value == nil {
-			return "", fmt.Errorf("missing column %s", colName)
+			if i > 0 && len(record.Cols) == i {
+				break // a prefix of the index
+			}
+			return nil, fmt.Errorf("missing column %s", colName)
 		}
 
 		// Validate type
-		if value.Type != idx.ColumnTypes[i] {
-			return "", fmt.Errorf("type mismatch for column %s: expected %d, got %d",
+		if !value.Null && value.Type != idx.ColumnTypes[i] {
+			return nil, fmt.Errorf("type mismatch for column %s: expected %d, got %d",
 				colName, idx.ColumnTypes[i], value.Type)
 		}
-
-		keyParts = append(keyParts, valueToString(*value))
+		vals = append(vals, *value)
 	}
-
-	// Join with separator
-	return strings.Join(keyParts, "|"), nil
+	return encodeValues(nil, vals), nil
 }
 
-// recordsEqual checks if two records are equal
-func (idx *Index) recordsEqual(r1, r2 *Record) bool {
-	if r1 == nil || r2 == nil {
-		return r1 == r2
+// the B-tree key of a record, the index key followed by the record
+// values, so that different records with the same index key are kept.
+func (idx *Index) entryKey(record *Record) ([]byte, error) {
+	key, err := idx.generateIndexKey(record)
+	if err != nil {
+		return nil, err
 	}
-
-	// Compare primary key values
-	for i := 0; i < len(idx.Columns) && i < len(r1.Cols) && i < len(r2.Cols); i++ {
-		colName := idx.Columns[i]
-		v1 := r1.Get(colName)
-		v2 := r2.Get(colName)
-
-		if v1 == nil || v2 == nil {
-			return v1 == v2
-		}
-
-		if !valuesEqual(*v1, *v2) {
-			return false
-		}
+	if len(record.Cols) < len(idx.Columns) {
+		return nil, fmt.Errorf("missing index columns")
 	}
-
-	return true
+	return encodeValues(key, record.Vals), nil
 }
 
-// copyRecord creates a deep copy of a record
-func (idx *Index) copyRecord(record Record) Record {
-	recordCopy := Record{
-		Cols: make([]string, len(record.Cols)),
-		Vals: make([]Value, len(record.Vals)),
+// a unique index only has the entry `key` for the index key of a record
+func (idx *Index) checkUnique(record *Record, key []byte) error {
+	prefix, err := idx.generateIndexKey(record)
+	if err != nil {
+		return err
 	}
+	conflict := false
+	idx.kv.Scan(prefix, func(ikey []byte, val []byte) bool {
+		if !bytes.HasPrefix(ikey, prefix) {
+			return false
+		}
+		conflict = !bytes.Equal(ikey, key)
+		return !conflict
+	})
+	if !conflict {
+		return nil
+	}
+	ikey := Record{}
+	for _, c := range idx.Columns {
+		ikey.Cols = append(ikey.Cols, c)
+		ikey.Vals = append(ikey.Vals, *record.Get(c))
+	}
+	return &ConstraintError{Table: idx.TableName, Index: idx.Name, Key: ikey}
+}
 
-	copy(recordCopy.Cols, record.Cols)
-	for i, val := range record.Vals {
-		recordCopy.Vals[i] = Value{
-			Type: val.Type,
-			I64:  val.I64,
-			Str:  make([]byte, len(val.Str)),
+// whether an indexed column of the record is NULL
+func (idx *Index) hasNull(record *Record) bool {
+	for _, c := range idx.Columns {
+		if v := record.Get(c); v != nil && v.Null {
+			return true
 		}
-		copy(recordCopy.Vals[i].Str, val.Str)
 	}
-
-	return recordCopy
+	return false
 }
 
-// valuesEqual checks if two values are equal
-func valuesEqual(v1, v2 Value) bool {
-	if v1.Type != v2.Type {
-		return false
-	}
+// visit the entries from `start` until `fn` returns false
+func (idx *Index) scan(start []byte, fn func(key []byte, rec *Record) bool) error {
+	var err error
+	idx.kv.Scan(start, func(key []byte, val []byte) bool {
+		if len(key) == 0 {
+			return true // the dummy key of the B-tree
+		}
+		rec := &Record{}
+		if err = json.Unmarshal(val, rec); err != nil {
+			err = fmt.Errorf("bad index entry: %w", err)
+			return false
+		}
+		return fn(key, rec)
+	})
+	return err
+}
 
-	switch v1.Type {
-	case TYPE_INT64:
-		return v1.I64 == v2.I64
-	case TYPE_BYTES:
-		return string(v1.Str) == string(v2.Str)
-	default:
-		return false
-	}
+// the number of records of each distinct index key
+func (idx *Index) keyCounts() map[string]int {
+	counts := map[string]int{}
+	vals := make([]Value, len(idx.Columns))
+	idx.scan(nil, func(key []byte, rec *Record) bool {
+		for i := range vals {
+			vals[i] = Value{Type: idx.ColumnTypes[i]}
+		}
+		rest := decodeValues(key, vals)
+		counts[string(key[:len(key)-len(rest)])]++
+		return true
+	})
+	return counts
 }
 
 // IndexInfo represents index metadata
@@ -420,23 +412,19 @@ func (idx *Index) GetIndexStatistics() *IndexStatistics {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
+	counts := idx.keyCounts()
 	stats := &IndexStatistics{
-		Name:           idx.Name,
-		TableName:      idx.TableName,
-		TotalKeys:      len(idx.Data),
-		TotalRecords:   0,
-		AverageRecords: 0,
-		MaxRecords:     0,
-		MinRecords:     0,
+		Name:      idx.Name,
+		TableName: idx.TableName,
+		TotalKeys: len(counts),
 	}
 
-	if len(idx.Data) == 0 {
+	if len(counts) == 0 {
 		return stats
 	}
 
 	// Calculate statistics
-	for _, records := range idx.Data {
-		count := len(records)
+	for _, count := range counts {
 		stats.TotalRecords += count
 
 		if count > stats.MaxRecords {
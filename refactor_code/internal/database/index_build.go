@@ -0,0 +1,187 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage"
+)
+
+// IndexBuildProgress reports the backfill of a new index
+type IndexBuildProgress struct {
+	Table string
+	Index string
+	Rows  int // the rows indexed so far
+	Total int // the estimated number of rows, 0 if unknown
+}
+
+// IndexBuildOptions configures SimpleDB.CreateIndex()
+type IndexBuildOptions struct {
+	Unique    bool
+	BatchSize int // rows per transaction, defaults to INDEX_BUILD_BATCH
+	// called after each batch
+	Progress func(IndexBuildProgress)
+}
+
+// the default number of rows backfilled in a transaction
+const INDEX_BUILD_BATCH = 1000
+
+// IndexBuild adds the entries of the index `i` for all existing rows.
+// It fails with a ConstraintError if a unique index has duplicates.
+func IndexBuild(kv KVWriter, tdef *TableDef, i int) error {
+	_, _, err := IndexBackfill(kv, tdef, i, nil, 0)
+	return err
+}
+
+// IndexBackfill adds the entries of the index `i` for up to `limit` rows
+// (0 for no limit), from the primary key `start` (nil for the first row).
+// It returns where to continue, which is nil after the last row,
+// and the number of rows.
+// The rows updated by other transactions between the batches already
+// have their entries, since the index is maintained while it is built.
+func IndexBackfill(kv KVWriter, tdef *TableDef, i int, start []byte, limit int) ([]byte, int, error) {
+	if tdef.VirtualFunc == nil && indexUsesVirtual(tdef, i) {
+		return nil, 0, fmt.Errorf("index %s: the virtual columns of %s cannot be computed by this database",
+			tdef.IndexNames[i], tdef.Name)
+	}
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	if start == nil {
+		start = prefix
+	}
+
+	// collect the rows first, the KV cannot be updated while scanning
+	rows := [][]Value{}
+	var next []byte
+	var err error
+	kv.Scan(start, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		if limit > 0 && len(rows) == limit {
+			next = append([]byte{}, key...)
+			return false
+		}
+		var row Record
+		if row, err = decodeRow(tdef, key[len(prefix):], val); err != nil {
+			return false
+		}
+		rows = append(rows, row.Vals)
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// a sorted bulk insert, in the index order
+	keys := make([][]byte, len(rows))
+	for j, values := range rows {
+		keys[j] = indexKey(tdef, i, values)
+	}
+	order := make([]int, len(rows))
+	for j := range order {
+		order[j] = j
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(keys[order[a]], keys[order[b]]) < 0
+	})
+	for _, j := range order {
+		// the entry can exist if the row was updated during the build
+		if err := checkUniqueIndex(kv, tdef, i, rows[j], rows[j]); err != nil {
+			return nil, 0, err
+		}
+		if _, err := kv.Update(keys[j], nil, MODE_UPSERT); err != nil {
+			return nil, 0, err
+		}
+	}
+	return next, len(rows), nil
+}
+
+// IndexClear deletes all entries of the index `i`
+func IndexClear(kv KVWriter, tdef *TableDef, i int) error {
+	return deletePrefix(kv, tdef.IndexPrefixes[i])
+}
+
+// CreateIndex adds an index to a table and backfills it online.
+// The rows are indexed in batches, each in its own transaction, so
+// other transactions can update the table between the batches.
+// The index is used by scans once all rows are indexed, and it is
+// dropped if the build fails.
+func (db *SimpleDB) CreateIndex(table string, name string, cols []string, opts IndexBuildOptions) error {
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = INDEX_BUILD_BATCH
+	}
+
+	// the index is maintained by the writers from now on
+	var tdef *TableDef
+	err := db.update(func(tx *storage.KVTX) (err error) {
+		tdef, err = CatalogAddIndex(tx, table, name, cols, opts.Unique)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	progress := IndexBuildProgress{Table: table, Index: name, Total: db.estimateRows(tdef)}
+	var start []byte
+	for done := false; !done; {
+		err = db.update(func(tx *storage.KVTX) error {
+			// the definition can be changed between the batches
+			tdef, i, err := CatalogFindIndex(tx, name)
+			if err != nil {
+				return err
+			}
+			if tdef == nil {
+				return fmt.Errorf("index %s was dropped during the build", name)
+			}
+			next, n, err := IndexBackfill(tx, tdef, i, start, batch)
+			if err != nil {
+				return err
+			}
+			start, done = next, next == nil
+			progress.Rows += n
+			return nil
+		})
+		if err != nil {
+			break
+		}
+		if opts.Progress != nil {
+			progress.Total = max(progress.Total, progress.Rows)
+			opts.Progress(progress)
+		}
+	}
+
+	if err != nil {
+		// remove the incomplete index
+		db.update(func(tx *storage.KVTX) error {
+			owner, i, ferr := CatalogFindIndex(tx, name)
+			if ferr != nil || owner == nil {
+				return ferr
+			}
+			if ferr := IndexClear(tx, owner, i); ferr != nil {
+				return ferr
+			}
+			_, ferr = CatalogDropIndex(tx, name)
+			return ferr
+		})
+		return err
+	}
+	return db.update(func(tx *storage.KVTX) error {
+		_, err := CatalogIndexReady(tx, name)
+		return err
+	})
+}
+
+// the approximate number of rows of a table
+func (db *SimpleDB) estimateRows(tdef *TableDef) int {
+	estimator, ok := db.store.(interface {
+		EstimateRange(start []byte, end []byte) storage.RangeEstimate
+	})
+	if !ok {
+		return 0
+	}
+	start := encodeKey(nil, tdef.Prefix, nil)
+	end := encodeKey(nil, tdef.Prefix+1, nil)
+	return int(estimator.EstimateRange(start, end).Keys)
+}
@@ -0,0 +1,338 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON values are stored as the compact text in Value.Str.
+// The top-level scalars are normalized, e.g. 1.50 is stored as 1.5,
+// so that the text is the same after the key encoding.
+//
+// An index column can be a path of a JSON column, written as
+// `col->>'$.path'`. The index stores the element at the path as a
+// JSON value, and a missing element or a JSON null as NULL.
+
+// JSONStep is an object key or an array index of a JSON path
+type JSONStep struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// JSONPath is a list of steps from the document root
+type JSONPath []JSONStep
+
+// ParseJSONPath parses `$`, `$.key`, `$."any key"` and `$[0]`, and their combinations
+func ParseJSONPath(s string) (JSONPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("bad JSON path: %q", s)
+	}
+	path := JSONPath{}
+	for rest := s[1:]; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, `."`):
+			// the JSON string ends at the first unescaped quote
+			end := 2
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("bad JSON path: %q", s)
+			}
+			key := ""
+			if err := json.Unmarshal([]byte(rest[1:end+1]), &key); err != nil {
+				return nil, fmt.Errorf("bad JSON path: %q", s)
+			}
+			path = append(path, JSONStep{Key: key})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("bad JSON path: %q", s)
+			}
+			path = append(path, JSONStep{Key: rest[1:end]})
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("bad JSON path: %q", s)
+			}
+			idx, err := strconv.Atoi(rest[1:end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("bad JSON path: %q", s)
+			}
+			path = append(path, JSONStep{Index: idx, IsIndex: true})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("bad JSON path: %q", s)
+		}
+	}
+	return path, nil
+}
+
+// String formats the path in the canonical form of ParseJSONPath()
+func (path JSONPath) String() string {
+	out := "$"
+	for _, step := range path {
+		switch {
+		case step.IsIndex:
+			out += "[" + strconv.Itoa(step.Index) + "]"
+		case isValidIdentifier(step.Key):
+			out += "." + step.Key
+		default:
+			out += "." + string(jsonQuote(step.Key))
+		}
+	}
+	return out
+}
+
+// JSONIndexColumn is the index column of a path of a JSON column
+func JSONIndexColumn(col string, path JSONPath) string {
+	return col + "->>'" + path.String() + "'"
+}
+
+// parse an index column of JSONIndexColumn()
+func parseJSONIndexColumn(name string) (string, JSONPath, bool) {
+	col, path, ok := strings.Cut(name, "->>'")
+	if !ok || !strings.HasSuffix(path, "'") {
+		return "", nil, false
+	}
+	p, err := ParseJSONPath(strings.TrimSuffix(path, "'"))
+	if err != nil {
+		return "", nil, false
+	}
+	return col, p, true
+}
+
+// IndexColType returns the type of an index column,
+// or TYPE_ERROR if it is neither a column nor a path of a JSON column
+func IndexColType(tdef *TableDef, name string) uint32 {
+	if i := colIndex(tdef, name); i >= 0 {
+		return tdef.Types[i]
+	}
+	col, _, ok := parseJSONIndexColumn(name)
+	if i := colIndex(tdef, col); ok && i >= 0 && tdef.Types[i] == TYPE_JSON {
+		return TYPE_JSON
+	}
+	return TYPE_ERROR
+}
+
+// the value of an index column of a row in the table order
+func indexValue(tdef *TableDef, values []Value, name string) Value {
+	if i := colIndex(tdef, name); i >= 0 {
+		return values[i]
+	}
+	col, path, _ := parseJSONIndexColumn(name)
+	doc := values[colIndex(tdef, col)]
+	if doc.Null {
+		return Value{Type: TYPE_JSON, Null: true}
+	}
+	elem, ok := JSONExtract(doc.Str, path)
+	if !ok || string(elem) == "null" {
+		return Value{Type: TYPE_JSON, Null: true}
+	}
+	elem, err := normalizeJSON(elem)
+	if err != nil {
+		panic("what?") // the document is validated when it is stored
+	}
+	return Value{Type: TYPE_JSON, Str: elem}
+}
+
+// JSONExtract returns the compact text of the element at the path,
+// or false if there is no such element
+func JSONExtract(doc []byte, path JSONPath) ([]byte, bool) {
+	raw := json.RawMessage(bytes.TrimSpace(doc))
+	for _, step := range path {
+		if step.IsIndex {
+			arr := []json.RawMessage{}
+			if json.Unmarshal(raw, &arr) != nil || step.Index >= len(arr) {
+				return nil, false
+			}
+			raw = arr[step.Index]
+		} else {
+			obj := map[string]json.RawMessage{}
+			if json.Unmarshal(raw, &obj) != nil {
+				return nil, false
+			}
+			elem, ok := obj[step.Key]
+			if !ok {
+				return nil, false
+			}
+			raw = elem
+		}
+	}
+	out := bytes.Buffer{}
+	if json.Compact(&out, raw) != nil {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
+// JSONValue converts a JSON element to an SQL value: a string to bytes,
+// a number to an int64 or a decimal, true and false to a bool, and null
+// to NULL. An object or an array stays a JSON value.
+func JSONValue(elem []byte) Value {
+	switch elem[0] {
+	case 'n':
+		return Value{Null: true}
+	case 't', 'f':
+		v := Value{Type: TYPE_BOOL}
+		if elem[0] == 't' {
+			v.I64 = 1
+		}
+		return v
+	case '"':
+		s := ""
+		json.Unmarshal(elem, &s)
+		return Value{Type: TYPE_BYTES, Str: []byte(s)}
+	case '{', '[':
+		return Value{Type: TYPE_JSON, Str: elem}
+	}
+	d, err := ParseDecimal(string(elem))
+	if err != nil {
+		f, _ := strconv.ParseFloat(string(elem), 64)
+		return Value{Type: TYPE_FLOAT64, F64: f}
+	}
+	if d.Scale <= 0 {
+		if n := d.Round(0).coef(); n.IsInt64() {
+			return Value{Type: TYPE_INT64, I64: n.Int64()}
+		}
+	}
+	return Value{Type: TYPE_DECIMAL, Dec: d}
+}
+
+// JSONFromValue converts an SQL value to JSON, the reverse of JSONValue()
+func JSONFromValue(v Value) (Value, error) {
+	out := Value{Type: TYPE_JSON, Null: v.Null}
+	if v.Null {
+		return out, nil
+	}
+	switch v.Type {
+	case TYPE_JSON:
+		return v, nil
+	case TYPE_BYTES:
+		out.Str = jsonQuote(string(v.Str))
+	case TYPE_INT64:
+		out.Str = []byte(strconv.FormatInt(v.I64, 10))
+	case TYPE_DECIMAL:
+		out.Str = []byte(v.Dec.String())
+	case TYPE_FLOAT64:
+		d, err := DecimalFromFloat64(v.F64)
+		if err != nil {
+			return Value{}, err
+		}
+		out.Str = []byte(d.String())
+	case TYPE_BOOL:
+		out.Str = []byte(strconv.FormatBool(v.I64 != 0))
+	default:
+		return Value{}, fmt.Errorf("cannot convert type %d to JSON", v.Type)
+	}
+	elem, err := normalizeJSON(out.Str)
+	out.Str = elem
+	return out, err
+}
+
+// CompareJSON compares two JSON values in the index order:
+// null < false < true < numbers < strings < objects and arrays
+func CompareJSON(a, b []byte) int {
+	return bytes.Compare(encodeJSON(nil, a), encodeJSON(nil, b))
+}
+
+// validate and compact a JSON text, and normalize a top-level scalar
+func normalizeJSON(text []byte) ([]byte, error) {
+	out := bytes.Buffer{}
+	if err := json.Compact(&out, text); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	elem := out.Bytes()
+	if elem[0] == '{' || elem[0] == '[' {
+		return elem, nil
+	}
+	elem, _ = decodeJSON(encodeJSON(nil, elem))
+	return elem, nil
+}
+
+// a JSON string without the HTML escaping of json.Marshal()
+func jsonQuote(s string) []byte {
+	out := bytes.Buffer{}
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// The key encoding of JSON values starts with the kind of the value.
+// The numbers are encoded as decimals, the strings as the unquoted
+// bytes, and the objects and arrays as the text.
+const (
+	JSON_NULL   = 0x01
+	JSON_FALSE  = 0x02
+	JSON_TRUE   = 0x03
+	JSON_NUMBER = 0x04
+	JSON_STRING = 0x05
+	JSON_OTHER  = 0x06
+)
+
+// encode a compact JSON text
+func encodeJSON(out []byte, elem []byte) []byte {
+	switch elem[0] {
+	case 'n':
+		return append(out, JSON_NULL)
+	case 'f':
+		return append(out, JSON_FALSE)
+	case 't':
+		return append(out, JSON_TRUE)
+	case '"':
+		s := ""
+		json.Unmarshal(elem, &s)
+		out = append(out, JSON_STRING)
+		out = append(out, escapeString([]byte(s))...)
+		return append(out, 0)
+	case '{', '[':
+	default:
+		if d, err := ParseDecimal(string(elem)); err == nil {
+			return encodeDecimal(append(out, JSON_NUMBER), d)
+		}
+		// a number beyond the decimals is kept as the text
+	}
+	out = append(out, JSON_OTHER)
+	out = append(out, escapeString(elem)...)
+	return append(out, 0)
+}
+
+// the reverse of encodeJSON(), it returns the remaining input
+func decodeJSON(in []byte) ([]byte, []byte) {
+	switch in[0] {
+	case JSON_NULL:
+		return []byte("null"), in[1:]
+	case JSON_FALSE:
+		return []byte("false"), in[1:]
+	case JSON_TRUE:
+		return []byte("true"), in[1:]
+	case JSON_NUMBER:
+		d, rest := decodeDecimal(in[1:])
+		if d.Scale < 0 {
+			d = d.Round(0)
+		}
+		return []byte(d.String()), rest
+	}
+	idx := bytes.IndexByte(in, 0)
+	if idx < 0 {
+		panic("what?")
+	}
+	text := unescapeString(in[1:idx])
+	if in[0] == JSON_STRING {
+		text = jsonQuote(string(text))
+	}
+	return text, in[idx+1:]
+}
@@ -0,0 +1,398 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage"
+)
+
+// KVReader reads the committed data or the data of a KV transaction.
+// Both storage.KVStore and storage.KVTX implement it.
+type KVReader interface {
+	Get(key []byte) ([]byte, bool)
+	// visit the keys >= start in order until `fn` returns false
+	Scan(start []byte, fn func(key []byte, val []byte) bool)
+}
+
+// KVWriter updates the data within a KV transaction
+type KVWriter interface {
+	KVReader
+	Update(key []byte, val []byte, mode int) (bool, error)
+	Del(key []byte) (bool, error)
+}
+
+// reorder a record and check for missing columns.
+// n == tdef.PKeys: record is exactly a primary key
+// n == len(tdef.Cols): record contains all columns,
+// the decimals are rounded to the scale of their columns
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("column count mismatch in record")
+	}
+	if len(rec.Cols) != n {
+		return nil, fmt.Errorf("expect %d columns, got %d", n, len(rec.Cols))
+	}
+	values := make([]Value, len(tdef.Cols))
+	for i, c := range tdef.Cols[:n] {
+		v := rec.Get(c)
+		if v == nil {
+			return nil, fmt.Errorf("missing column: %s", c)
+		}
+		val, err := checkValue(tdef, i, *v, n == len(tdef.Cols))
+		if err != nil {
+			return nil, err
+		}
+		values[i] = val
+	}
+	return values, nil
+}
+
+// check a value of the i-th column. the JSON text is normalized, and
+// with `fit`, the decimal is rounded to the scale of its column.
+func checkValue(tdef *TableDef, i int, v Value, fit bool) (Value, error) {
+	c := tdef.Cols[i]
+	if v.Null {
+		if i < tdef.PKeys || isNotNull(tdef, c) {
+			return Value{}, fmt.Errorf("column %s cannot be NULL", c)
+		}
+		return Value{Type: tdef.Types[i], Null: true}, nil
+	}
+	if v.Type != tdef.Types[i] {
+		return Value{}, fmt.Errorf("type mismatch for column %s: expected %d, got %d",
+			c, tdef.Types[i], v.Type)
+	}
+	if v.Type == TYPE_FLOAT64 && math.IsNaN(v.F64) {
+		return Value{}, fmt.Errorf("NaN is not allowed in column %s", c)
+	}
+	if v.Type == TYPE_BOOL && v.I64 != 0 && v.I64 != 1 {
+		return Value{}, fmt.Errorf("bad bool value for column %s: %d", c, v.I64)
+	}
+	if v.Type == TYPE_JSON {
+		text, err := normalizeJSON(v.Str)
+		if err != nil {
+			return Value{}, fmt.Errorf("column %s: %w", c, err)
+		}
+		v.Str = text
+	}
+	if v.Type == TYPE_DECIMAL && fit {
+		dec, err := tdef.Decimals[c].Fit(v.Dec)
+		if err != nil {
+			return Value{}, fmt.Errorf("column %s: %w", c, err)
+		}
+		v.Dec = dec
+	}
+	return v, nil
+}
+
+// get a single row by the primary key
+func dbGet(kv KVReader, tdef *TableDef, rec *Record) (bool, error) {
+	values, err := checkRecord(tdef, *rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	val, ok := kv.Get(key)
+	if !ok {
+		return false, nil
+	}
+	// the stored key, whose decimals can differ in the scale
+	row, err := decodeRow(tdef, key[4:], val)
+	if err != nil {
+		return false, err
+	}
+	*rec = row
+	return true, nil
+}
+
+// add a row to the table, and maintain the secondary indexes
+func dbUpdate(kv KVWriter, tdef *TableDef, rec Record, mode int) (bool, error) {
+	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+	if err := virtualValues(tdef, values); err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	val := encodeRowValue(tdef, values)
+	if len(tdef.Indexes) == 0 {
+		return kv.Update(key, val, mode)
+	}
+
+	// the old row, whose index entries are to be replaced
+	var old []Value
+	if oldVal, ok := kv.Get(key); ok {
+		if old, err = decodeRowValues(tdef, values[:tdef.PKeys], oldVal); err != nil {
+			return false, err
+		}
+	}
+	if (mode == MODE_INSERT_ONLY && old != nil) || (mode == MODE_UPDATE_ONLY && old == nil) {
+		return false, nil
+	}
+	// check the constraints before any update
+	if err := checkUnique(kv, tdef, values, old); err != nil {
+		return false, err
+	}
+	updated, err := kv.Update(key, val, mode)
+	if err != nil || !updated {
+		return updated, err
+	}
+	if old != nil {
+		if err := indexOp(kv, tdef, old, INDEX_DEL); err != nil {
+			return false, err
+		}
+	}
+	if err := indexOp(kv, tdef, values, INDEX_ADD); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// delete a row by its primary key, and its index entries
+func dbDelete(kv KVWriter, tdef *TableDef, rec Record) (bool, error) {
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	if len(tdef.Indexes) == 0 {
+		return kv.Del(key)
+	}
+
+	oldVal, ok := kv.Get(key)
+	if !ok {
+		return false, nil
+	}
+	old, err := decodeRowValues(tdef, values[:tdef.PKeys], oldVal)
+	if err != nil {
+		return false, err
+	}
+	if _, err := kv.Del(key); err != nil {
+		return false, err
+	}
+	if err := indexOp(kv, tdef, old, INDEX_DEL); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// the operations of indexOp()
+const (
+	INDEX_ADD = 1
+	INDEX_DEL = 2
+)
+
+// maintain the index entries of a row, `values` are in the table order.
+// an index key is the index prefix + the indexed columns,
+// which end with the primary key, so every row has a distinct entry.
+func indexOp(kv KVWriter, tdef *TableDef, values []Value, op int) error {
+	for i := range tdef.Indexes {
+		key := indexKey(tdef, i, values)
+		var done bool
+		var err error
+		switch op {
+		case INDEX_ADD:
+			done, err = kv.Update(key, nil, MODE_INSERT_ONLY)
+		case INDEX_DEL:
+			done, err = kv.Del(key)
+		default:
+			panic("what?")
+		}
+		if err != nil {
+			return err
+		}
+		// the rows that are not backfilled yet have no entries
+		if !done && !isBuilding(tdef, i) {
+			return fmt.Errorf("index %s is out of sync with the rows", tdef.IndexNames[i])
+		}
+	}
+	return nil
+}
+
+// the B-tree key of the index entry of a row
+func indexKey(tdef *TableDef, i int, values []Value) []byte {
+	index := tdef.Indexes[i]
+	ivals := make([]Value, len(index))
+	for j, c := range index {
+		ivals[j] = indexValue(tdef, values, c)
+	}
+	return encodeKey(nil, tdef.IndexPrefixes[i], ivals)
+}
+
+// the values of a row in the table order, from its primary key and KV value.
+// the virtual columns stay NULL without a TableDef.VirtualFunc.
+func decodeRowValues(tdef *TableDef, pk []Value, val []byte) ([]Value, error) {
+	values := make([]Value, len(tdef.Cols))
+	copy(values, pk)
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		values[i] = colValue(tdef, i)
+	}
+	decodeValues(val, values[tdef.PKeys:])
+	if tdef.VirtualFunc == nil {
+		return values, nil
+	}
+	if err := virtualValues(tdef, values); err != nil {
+		return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	return values, nil
+}
+
+// the empty value of a column for decodeValues(), with the type and the decimal scale
+func colValue(tdef *TableDef, i int) Value {
+	v := Value{Type: tdef.Types[i]}
+	if v.Type == TYPE_DECIMAL {
+		v.Dec.Scale = tdef.Decimals[tdef.Cols[i]].Scale
+	}
+	return v
+}
+
+// extract the primary key columns of a record in the table order
+func primaryKey(tdef *TableDef, rec Record) (Record, error) {
+	key := Record{}
+	for _, c := range tdef.Cols[:tdef.PKeys] {
+		v := rec.Get(c)
+		if v == nil {
+			return Record{}, fmt.Errorf("invalid primary key: missing column %s", c)
+		}
+		key.Cols = append(key.Cols, c)
+		key.Vals = append(key.Vals, *v)
+	}
+	return key, nil
+}
+
+// TableGet reads a row by the primary key columns of `key`.
+// The row is in the table order, or nil if it does not exist.
+func TableGet(kv KVReader, tdef *TableDef, key Record) (*Record, error) {
+	rec, err := primaryKey(tdef, key)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := dbGet(kv, tdef, &rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// TableSet adds or updates a row, see the MODE_* constants
+func TableSet(kv KVWriter, tdef *TableDef, rec Record, mode int) (bool, error) {
+	return dbUpdate(kv, tdef, rec, mode)
+}
+
+// TableDelete deletes a row by the primary key columns of `key`
+func TableDelete(kv KVWriter, tdef *TableDef, key Record) (bool, error) {
+	rec, err := primaryKey(tdef, key)
+	if err != nil {
+		return false, err
+	}
+	return dbDelete(kv, tdef, rec)
+}
+
+// TableReplace replaces the row identified by `key` with `rec`,
+// which can have a different primary key.
+// It returns false if the old row does not exist.
+func TableReplace(kv KVWriter, tdef *TableDef, key Record, rec Record) (bool, error) {
+	old, err := TableGet(kv, tdef, key)
+	if err != nil || old == nil {
+		return false, err
+	}
+	oldKey, _ := primaryKey(tdef, *old)
+	newKey, err := primaryKey(tdef, rec)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(encodeKey(nil, 0, oldKey.Vals), encodeKey(nil, 0, newKey.Vals)) {
+		return dbUpdate(kv, tdef, rec, MODE_UPDATE_ONLY)
+	}
+	// the primary key is changed
+	if exists, err := TableGet(kv, tdef, newKey); err != nil || exists != nil {
+		if err == nil {
+			err = fmt.Errorf("record with primary key already exists")
+		}
+		return false, err
+	}
+	// delete the old row first, the new row can reuse its unique keys
+	if _, err := dbDelete(kv, tdef, oldKey); err != nil {
+		return false, err
+	}
+	if _, err := dbUpdate(kv, tdef, rec, MODE_INSERT_ONLY); err != nil {
+		// put back the old row
+		if _, rerr := dbUpdate(kv, tdef, *old, MODE_INSERT_ONLY); rerr != nil {
+			return false, fmt.Errorf("%w (restoring the old row: %v)", err, rerr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// TableTruncate deletes all rows of a table and their index entries
+func TableTruncate(kv KVWriter, tdef *TableDef) error {
+	prefixes := append([]uint32{tdef.Prefix}, tdef.IndexPrefixes...)
+	for _, prefix := range prefixes {
+		if err := deletePrefix(kv, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete all keys of a table or an index
+func deletePrefix(kv KVWriter, prefix uint32) error {
+	start := encodeKey(nil, prefix, nil)
+	// collect the keys first, the KV cannot be updated while scanning
+	keys := [][]byte{}
+	kv.Scan(start, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, start) {
+			return false
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	for _, key := range keys {
+		if _, err := kv.Del(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan all rows of a table in the primary key order until `fn` returns
+// false or a row cannot be decoded
+func scanRows(kv KVReader, tdef *TableDef, fn func(rec Record) bool) error {
+	var err error
+	start := encodeKey(nil, tdef.Prefix, nil)
+	kv.Scan(start, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, start) {
+			return false
+		}
+		var rec Record
+		if rec, err = decodeRow(tdef, key[len(start):], val); err != nil {
+			return false
+		}
+		return fn(rec)
+	})
+	return err
+}
+
+// decode a KV pair of the table, the prefix is already removed from the key
+func decodeRow(tdef *TableDef, key []byte, val []byte) (Record, error) {
+	pk := make([]Value, tdef.PKeys)
+	for i := range pk {
+		pk[i] = colValue(tdef, i)
+	}
+	decodeValues(key, pk)
+	values, err := decodeRowValues(tdef, pk, val)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Cols: append([]string{}, tdef.Cols...), Vals: values}, nil
+}
+
+// the modes of dbUpdate()
+const (
+	MODE_UPSERT      = storage.MODE_UPSERT
+	MODE_UPDATE_ONLY = storage.MODE_UPDATE_ONLY
+	MODE_INSERT_ONLY = storage.MODE_INSERT_ONLY
+)
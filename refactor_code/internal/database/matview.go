@@ -0,0 +1,62 @@
+package database
+
+// MatView is the query of a materialized view. Its rows are stored in
+// a table of their own, one row for each row of the table in FROM that
+// passes the filter. The primary key of the view is the primary key of
+// that table, so the view row of a changed row can be found.
+type MatView struct {
+	Query string   // the SQL text of the SELECT
+	Table string   // the table in FROM
+	Cols  []string // the view column of each output of the SELECT
+	Uses  []string // the columns of Table in the query
+	// the column of the table in FROM for each primary key column of the view
+	Keys []string
+}
+
+// MatViewKey returns the primary key of the view row of a table row
+func MatViewKey(view *TableDef, row Record) Record {
+	key := Record{}
+	for i, c := range view.MatView.Keys {
+		if v := row.Get(c); v != nil {
+			key.Cols = append(key.Cols, view.Cols[i])
+			key.Vals = append(key.Vals, *v)
+		}
+	}
+	return key
+}
+
+// MatViewRefresh replaces the rows of a materialized view with the
+// rows computed from the table `base` by `viewRow`, which returns nil
+// for a row that does not pass the filter
+func MatViewRefresh(kv KVWriter, view *TableDef, base *TableDef, viewRow func(Record) (*Record, error)) error {
+	if err := TableTruncate(kv, view); err != nil {
+		return err
+	}
+	return scanRowBatches(kv, base, func(row Record) error {
+		rec, err := viewRow(row)
+		if err != nil || rec == nil {
+			return err
+		}
+		_, err = dbUpdate(kv, view, *rec, MODE_UPSERT)
+		return err
+	})
+}
+
+// MatViewList returns the materialized views whose FROM is a table
+func MatViewList(kv KVReader, table string) ([]*TableDef, error) {
+	names, err := CatalogList(kv)
+	if err != nil {
+		return nil, err
+	}
+	views := []*TableDef{}
+	for _, name := range names {
+		tdef, err := CatalogGet(kv, name)
+		if err != nil {
+			return nil, err
+		}
+		if tdef != nil && tdef.MatView != nil && tdef.MatView.Table == table {
+			views = append(views, tdef)
+		}
+	}
+	return views, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"bytes"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+)
+
+// memKV is an in-memory KV for databases that are not stored
+// in a KV store. Nothing is persisted.
+// It is a B-tree whose pages live in a map, so it can be seeked like a KVTX.
+type memKV struct {
+	tree  btree.BTree
+	pages map[uint64]btree.BNode
+	next  uint64 // the next page pointer, 0 is the nil pointer
+}
+
+// NewMemKV creates an empty in-memory KV
+func NewMemKV() KVWriter {
+	kv := &memKV{pages: make(map[uint64]btree.BNode), next: 1}
+	kv.tree.SetGet(func(ptr uint64) btree.BNode {
+		node, ok := kv.pages[ptr]
+		if !ok {
+			panic("bad ptr")
+		}
+		return node
+	})
+	kv.tree.SetNew(func(node btree.BNode) uint64 {
+		ptr := kv.next
+		kv.next++
+		kv.pages[ptr] = node
+		return ptr
+	})
+	kv.tree.SetDel(func(ptr uint64) {
+		delete(kv.pages, ptr)
+	})
+	return kv
+}
+
+func (kv *memKV) Get(key []byte) ([]byte, bool) {
+	return kv.tree.Get(key)
+}
+
+func (kv *memKV) Seek(key []byte) *btree.BIter {
+	return kv.tree.SeekLE(key)
+}
+
+func (kv *memKV) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	for iter := kv.tree.SeekLE(start); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if bytes.Compare(key, start) < 0 {
+			continue // SeekLE() can stop before the start
+		}
+		if !fn(key, val) {
+			return
+		}
+	}
+}
+
+func (kv *memKV) Update(key []byte, val []byte, mode int) (bool, error) {
+	return kv.tree.Update(key, val, mode)
+}
+
+func (kv *memKV) Del(key []byte) (bool, error) {
+	return kv.tree.Delete(key), nil
+}
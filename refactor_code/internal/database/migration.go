@@ -0,0 +1,66 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaMigration is a migration applied by the migration runner, see
+// the migration package. The history is stored in @meta under the key
+// "migration:" + the version in 20 digits, so it is listed in the
+// order of the versions.
+type SchemaMigration struct {
+	Version   int64
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func migrationKey(version int64) *Record {
+	return (&Record{}).AddStr("key", []byte(fmt.Sprintf("migration:%020d", version)))
+}
+
+// MigrationList returns the applied migrations in the order of the versions
+func MigrationList(kv KVReader) ([]SchemaMigration, error) {
+	applied := []SchemaMigration{}
+	for _, name := range metaNames(kv, "migration:") {
+		rec := (&Record{}).AddStr("key", []byte("migration:"+name))
+		ok, err := dbGet(kv, TDEF_META, rec)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		m := SchemaMigration{}
+		if err := json.Unmarshal(rec.Get("val").Str, &m); err != nil {
+			return nil, fmt.Errorf("bad record of migration %s: %w", name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrationRecord adds an applied migration to the history
+func MigrationRecord(kv KVWriter, m *SchemaMigration) error {
+	if m.Version <= 0 {
+		return fmt.Errorf("bad migration version: %d", m.Version)
+	}
+	val, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	rec := migrationKey(m.Version).AddStr("val", val)
+	ok, err := dbUpdate(kv, TDEF_META, *rec, MODE_INSERT_ONLY)
+	if err == nil && !ok {
+		err = fmt.Errorf("migration %d is already applied", m.Version)
+	}
+	return err
+}
+
+// MigrationForget removes a reverted migration from the history,
+// it returns false if it is not applied
+func MigrationForget(kv KVWriter, version int64) (bool, error) {
+	return dbDelete(kv, TDEF_META, *migrationKey(version))
+}
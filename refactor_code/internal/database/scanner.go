@@ -0,0 +1,315 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+)
+
+// KVSeeker is a KVReader that can be iterated from any position.
+// Both storage.KVTX and the in-memory KV implement it.
+type KVSeeker interface {
+	KVReader
+	// find the closest position that is less or equal to the key
+	Seek(key []byte) *btree.BIter
+}
+
+// Scanner is the iterator for range queries, from Key1 to Key2.
+// The range is ascending if Cmp1 is CMP_GE or CMP_GT and Cmp2 is
+// CMP_LT or CMP_LE, or descending for the reverse.
+// The key columns must be a prefix of the primary key or of an index.
+type Scanner struct {
+	// the range, from Key1 to Key2
+	Key1, Key2 Record
+	Cmp1, Cmp2 int // CMP_??
+	// the name of the index to scan, optional.
+	// selected by the columns of Key1 if empty.
+	Index string
+	// internal
+	kv      KVReader
+	tdef    *TableDef
+	indexNo int          // -1: use the primary key; >= 0: use an index
+	iter    *btree.BIter // the underlying B-tree iterator
+	keyEnd  []byte       // the encoded Key2
+	cmpEnd  int          // Cmp2 for keyEnd, see encodeKeyPartial()
+	// the rows set by SetRecords(), when not backed by a B-tree
+	records  []Record
+	position int
+	err      error // see Err()
+}
+
+// Valid reports whether the scanner is within the range
+func (sc *Scanner) Valid() bool {
+	if sc.iter == nil {
+		return sc.position < len(sc.records)
+	}
+	if !sc.iter.Valid() {
+		return false
+	}
+	key, _ := sc.iter.Deref()
+	return cmpOK(key, sc.cmpEnd, sc.keyEnd)
+}
+
+// Next moves the underlying B-tree iterator in the range direction
+func (sc *Scanner) Next() {
+	switch {
+	case sc.iter == nil:
+		sc.position++
+	case isAscending(sc.Cmp1):
+		sc.iter.Next()
+	default:
+		sc.iter.Prev()
+	}
+}
+
+// Deref fetches the current row in the table order.
+// The row is not changed if it cannot be decoded, see Err().
+func (sc *Scanner) Deref(rec *Record) {
+	sc.err = nil
+	if !sc.Valid() {
+		return
+	}
+	if sc.iter == nil {
+		*rec = sc.records[sc.position]
+		return
+	}
+
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	if sc.indexNo < 0 {
+		// primary key, decode the KV pair
+		row, err := decodeRow(tdef, key[4:], val)
+		if err != nil {
+			sc.err = err
+			return
+		}
+		*rec = row
+		return
+	}
+
+	// secondary index, the index key contains the primary key
+	index := tdef.Indexes[sc.indexNo]
+	ival := make([]Value, len(index))
+	for i, c := range index {
+		ival[i].Type = IndexColType(tdef, c)
+	}
+	decodeValues(key[4:], ival)
+	icol := Record{Cols: index, Vals: ival}
+	// fetch the row by the primary key
+	pk, _ := primaryKey(tdef, icol)
+	row, err := TableGet(sc.kv, tdef, pk)
+	if err != nil {
+		sc.err = err
+		return
+	}
+	if row == nil {
+		// the index is corrupted
+		sc.err = fmt.Errorf("dangling index entry in %s", tdef.IndexNames[sc.indexNo])
+		return
+	}
+	*rec = *row
+}
+
+// Err returns the error of the last Deref(), such as a virtual column
+// that cannot be computed or an index entry without its row
+func (sc *Scanner) Err() error {
+	return sc.err
+}
+
+// SetRecords makes the scanner iterate over a list of rows instead of a B-tree
+func (sc *Scanner) SetRecords(records []Record) {
+	sc.iter = nil
+	sc.records = records
+	sc.position = 0
+}
+
+// TableScan positions the scanner at the start of its range.
+// The KV must be a KVSeeker.
+func TableScan(kv KVReader, tdef *TableDef, sc *Scanner) error {
+	seeker, ok := kv.(KVSeeker)
+	if !ok {
+		return fmt.Errorf("range scans are not supported by the KV")
+	}
+
+	// sanity checks
+	switch {
+	case isAscending(sc.Cmp1) && isDescending(sc.Cmp2):
+	case isDescending(sc.Cmp1) && isAscending(sc.Cmp2):
+	default:
+		return fmt.Errorf("bad range")
+	}
+
+	// select an index
+	var indexNo int
+	var err error
+	if sc.Index != "" {
+		indexNo, err = findIndexByName(tdef, sc.Index)
+	} else {
+		indexNo, err = findIndex(tdef, sc.Key1.Cols)
+	}
+	if err != nil {
+		return err
+	}
+	index, prefix := tdef.Cols[:tdef.PKeys], tdef.Prefix
+	if indexNo >= 0 {
+		index, prefix = tdef.Indexes[indexNo], tdef.IndexPrefixes[indexNo]
+	}
+	if !isPrefix(index, sc.Key1.Cols) || !isPrefix(index, sc.Key2.Cols) {
+		return fmt.Errorf("the range keys use different columns")
+	}
+	for _, key := range []Record{sc.Key1, sc.Key2} {
+		if err := checkKeyTypes(tdef, key); err != nil {
+			return err
+		}
+	}
+
+	sc.kv = kv
+	sc.tdef = tdef
+	sc.indexNo = indexNo
+	sc.records = nil
+
+	// seek to the start key
+	keyStart, cmpStart := encodeKeyPartial(nil, prefix, sc.Key1.Vals, sc.Cmp1)
+	sc.keyEnd, sc.cmpEnd = encodeKeyPartial(nil, prefix, sc.Key2.Vals, sc.Cmp2)
+	sc.iter = seek(seeker, keyStart, cmpStart)
+	return nil
+}
+
+// find the closest position to a key with respect to the `cmp` relation
+func seek(kv KVSeeker, key []byte, cmp int) *btree.BIter {
+	iter := kv.Seek(key)
+	if cmp != CMP_LE && iter.Valid() {
+		cur, _ := iter.Deref()
+		if !cmpOK(cur, cmp, key) {
+			// off by one
+			if isAscending(cmp) {
+				iter.Next()
+			} else {
+				iter.Prev()
+			}
+		}
+	}
+	return iter
+}
+
+// key cmp ref
+func cmpOK(key []byte, cmp int, ref []byte) bool {
+	r := bytes.Compare(key, ref)
+	switch cmp {
+	case CMP_GE:
+		return r >= 0
+	case CMP_GT:
+		return r > 0
+	case CMP_LT:
+		return r < 0
+	case CMP_LE:
+		return r <= 0
+	default:
+		panic("what?")
+	}
+}
+
+func isAscending(cmp int) bool {
+	return cmp == CMP_GE || cmp == CMP_GT
+}
+
+func isDescending(cmp int) bool {
+	return cmp == CMP_LT || cmp == CMP_LE
+}
+
+// The range key can be a prefix of the index key.
+// The encoded values are self-delimiting, so the index keys matching a
+// partial key are exactly the keys prefixed by its encoding.
+// Comparisons that include the whole prefix (> and <=) are therefore
+// converted to the successor of the prefix:
+//
+//	key > K  ==> key >= succ(K)
+//	key <= K ==> key < succ(K)
+func encodeKeyPartial(out []byte, prefix uint32, vals []Value, cmp int) ([]byte, int) {
+	out = encodeKey(out, prefix, vals)
+	switch cmp {
+	case CMP_GT:
+		return prefixSuccessor(out), CMP_GE
+	case CMP_LE:
+		return prefixSuccessor(out), CMP_LT
+	default:
+		return out, cmp
+	}
+}
+
+// the smallest key that is larger than all keys prefixed by `key`.
+// the key always starts with a table prefix, which is not all 0xff.
+func prefixSuccessor(key []byte) []byte {
+	for len(key) > 0 && key[len(key)-1] == 0xff {
+		key = key[:len(key)-1]
+	}
+	if len(key) == 0 {
+		panic("what?")
+	}
+	key[len(key)-1]++
+	return key
+}
+
+// select the primary key or the shortest index starting with the columns
+func findIndex(tdef *TableDef, keys []string) (int, error) {
+	pk := tdef.Cols[:tdef.PKeys]
+	if isPrefix(pk, keys) {
+		// use the primary key.
+		// also works for full table scans without a key.
+		return -1, nil
+	}
+	// find a suitable index
+	winner := -2
+	for i, index := range tdef.Indexes {
+		if !isPrefix(index, keys) || isBuilding(tdef, i) {
+			continue
+		}
+		if winner == -2 || len(index) < len(tdef.Indexes[winner]) {
+			winner = i
+		}
+	}
+	if winner == -2 {
+		return -2, fmt.Errorf("no index found for %v", keys)
+	}
+	return winner, nil
+}
+
+func findIndexByName(tdef *TableDef, name string) (int, error) {
+	for i, iname := range tdef.IndexNames {
+		if iname != name {
+			continue
+		}
+		if isBuilding(tdef, i) {
+			return -2, fmt.Errorf("index %s is not ready", name)
+		}
+		return i, nil
+	}
+	return -2, fmt.Errorf("index %s not found in table %s", name, tdef.Name)
+}
+
+func isPrefix(long []string, short []string) bool {
+	if len(long) < len(short) {
+		return false
+	}
+	for i, c := range short {
+		if long[i] != c {
+			return false
+		}
+	}
+	return true
+}
+
+// the range keys are encoded without checkRecord(), check the types here
+func checkKeyTypes(tdef *TableDef, key Record) error {
+	if len(key.Cols) != len(key.Vals) {
+		return fmt.Errorf("column count mismatch in range key")
+	}
+	for i, c := range key.Cols {
+		if typ := IndexColType(tdef, c); key.Vals[i].Type != typ {
+			return fmt.Errorf("type mismatch for column %s: expected %d, got %d",
+				c, typ, key.Vals[i].Type)
+		}
+	}
+	return nil
+}
@@ -1,28 +1,35 @@
 package database
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
+
+	"govetachun/go-mini-db/refactor_code/internal/storage"
 )
 
-// SchemaManager handles schema operations
+// SchemaManager handles schema operations.
+// The table definitions are read from and written to the catalog of a KV,
+// see CatalogGet(), so they are never out of date with the stored tables.
+// On a storage.KVStore each operation is a transaction on its own, on
+// another KV, such as a storage.KVTX, it is part of the caller's updates.
 type SchemaManager struct {
-	tables map[string]*TableDef
-	mu     sync.RWMutex
+	kv KVWriter
+	mu sync.Mutex // serializes the operations
 }
 
-// NewSchemaManager creates a new schema manager
+// NewSchemaManager creates a new schema manager on an in-memory KV
 func NewSchemaManager() *SchemaManager {
-	return &SchemaManager{
-		tables: make(map[string]*TableDef),
-	}
+	return NewKVSchemaManager(NewMemKV())
+}
+
+// NewKVSchemaManager creates a new schema manager on the catalog of a KV
+func NewKVSchemaManager(kv KVWriter) *SchemaManager {
+	return &SchemaManager{kv: kv}
 }
 
 // CreateTable creates a new table schema
 func (sm *SchemaManager) CreateTable(def *TableDef) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
 	if def == nil {
 		return fmt.Errorf("table definition cannot be nil")
 	}
@@ -31,189 +38,95 @@ func (sm *SchemaManager) CreateTable(def *TableDef) error {
 		return fmt.Errorf("table name cannot be empty")
 	}
 
-	if _, exists := sm.tables[def.Name]; exists {
-		return fmt.Errorf("table %s already exists", def.Name)
-	}
-
 	// Validate table definition
 	if err := validateTableDef(def); err != nil {
 		return fmt.Errorf("invalid table definition: %w", err)
 	}
 
-	// Create a copy of the definition
-	tableDef := &TableDef{
-		Name:  def.Name,
-		Cols:  make([]string, len(def.Cols)),
-		Types: make([]uint32, len(def.Types)),
-		PKeys: def.PKeys,
-	}
-
-	copy(tableDef.Cols, def.Cols)
-	copy(tableDef.Types, def.Types)
-
-	sm.tables[def.Name] = tableDef
-	return nil
+	return sm.update(func(kv KVWriter) error {
+		return CatalogCreate(kv, def)
+	})
 }
 
-// DropTable drops a table schema
+// DropTable drops a table schema and its rows
 func (sm *SchemaManager) DropTable(name string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if _, exists := sm.tables[name]; !exists {
-		return fmt.Errorf("table %s does not exist", name)
-	}
-
-	delete(sm.tables, name)
-	return nil
+	return sm.update(func(kv KVWriter) error {
+		def, err := sm.get(kv, name)
+		if err != nil {
+			return err
+		}
+		if err := TableTruncate(kv, def); err != nil {
+			return err
+		}
+		_, err = CatalogDrop(kv, name)
+		return err
+	})
 }
 
 // GetTableDef returns a table definition by name
 func (sm *SchemaManager) GetTableDef(name string) *TableDef {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	def, exists := sm.tables[name]
-	if !exists {
+	def, err := CatalogGet(sm.kv, name)
+	if err != nil {
 		return nil
 	}
-
-	// Return a copy
-	tableDef := &TableDef{
-		Name:  def.Name,
-		Cols:  make([]string, len(def.Cols)),
-		Types: make([]uint32, len(def.Types)),
-		PKeys: def.PKeys,
-	}
-
-	copy(tableDef.Cols, def.Cols)
-	copy(tableDef.Types, def.Types)
-
-	return tableDef
+	return def
 }
 
 // ListTables returns all table names
 func (sm *SchemaManager) ListTables() []string {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	tables := make([]string, 0, len(sm.tables))
-	for name := range sm.tables {
-		tables = append(tables, name)
+	tables, err := CatalogList(sm.kv)
+	if err != nil {
+		return []string{}
 	}
 	return tables
 }
 
-// AlterTable alters a table schema
+// AlterTable alters a table schema and converts its rows by column name.
+// The indexes on the remaining columns are kept.
 func (sm *SchemaManager) AlterTable(name string, newDef *TableDef) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if table exists
-	oldDef, exists := sm.tables[name]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", name)
-	}
-
 	if newDef == nil {
 		return fmt.Errorf("new table definition cannot be nil")
 	}
 
-	// Validate new table definition
-	if err := validateTableDef(newDef); err != nil {
-		return fmt.Errorf("invalid table definition: %w", err)
-	}
-
 	// Ensure the name matches
 	if newDef.Name != name {
 		return fmt.Errorf("table name mismatch: expected %s, got %s", name, newDef.Name)
 	}
 
-	// Validate schema compatibility
-	if err := sm.validateSchemaCompatibility(oldDef, newDef); err != nil {
-		return fmt.Errorf("schema compatibility check failed: %w", err)
-	}
-
-	// Create a copy of the new definition
-	tableDef := &TableDef{
-		Name:  newDef.Name,
-		Cols:  make([]string, len(newDef.Cols)),
-		Types: make([]uint32, len(newDef.Types)),
-		PKeys: newDef.PKeys,
-	}
-
-	copy(tableDef.Cols, newDef.Cols)
-	copy(tableDef.Types, newDef.Types)
-
-	sm.tables[name] = tableDef
-	return nil
+	return sm.update(func(kv KVWriter) error {
+		oldDef, err := sm.get(kv, name)
+		if err != nil {
+			return err
+		}
+		KeepIndexes(oldDef, newDef)
+		return sm.alter(kv, oldDef, newDef, nil)
+	})
 }
 
 // RenameTable renames a table
 func (sm *SchemaManager) RenameTable(oldName, newName string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
 	if oldName == newName {
 		return nil // No-op
 	}
 
-	// Check if old table exists
-	def, exists := sm.tables[oldName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", oldName)
-	}
-
-	// Check if new table name already exists
-	if _, exists := sm.tables[newName]; exists {
-		return fmt.Errorf("table %s already exists", newName)
-	}
-
 	// Validate new table name
 	if newName == "" {
 		return fmt.Errorf("new table name cannot be empty")
 	}
 
-	if !isValidIdentifier(newName) {
-		return fmt.Errorf("invalid table name: %s", newName)
-	}
-
-	// Create new definition with new name
-	newDef := &TableDef{
-		Name:  newName,
-		Cols:  make([]string, len(def.Cols)),
-		Types: make([]uint32, len(def.Types)),
-		PKeys: def.PKeys,
-	}
-
-	copy(newDef.Cols, def.Cols)
-	copy(newDef.Types, def.Types)
-
-	// Add new table and remove old one
-	sm.tables[newName] = newDef
-	delete(sm.tables, oldName)
-
-	return nil
+	return sm.update(func(kv KVWriter) error {
+		return CatalogRename(kv, oldName, newName)
+	})
 }
 
-// AddColumn adds a column to a table
+// AddColumn adds a column to a table, which is NULL in the existing rows
 func (sm *SchemaManager) AddColumn(tableName string, columnName string, columnType uint32) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if table exists
-	def, exists := sm.tables[tableName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", tableName)
-	}
-
-	// Check if column already exists
-	for _, col := range def.Cols {
-		if col == columnName {
-			return fmt.Errorf("column %s already exists in table %s", columnName, tableName)
-		}
-	}
-
 	// Validate column name
 	if columnName == "" {
 		return fmt.Errorf("column name cannot be empty")
@@ -224,149 +137,81 @@ func (sm *SchemaManager) AddColumn(tableName string, columnName string, columnTy
 	}
 
 	// Validate column type
-	if columnType != TYPE_INT64 && columnType != TYPE_BYTES {
+	if !validType(columnType) {
 		return fmt.Errorf("invalid data type: %d", columnType)
 	}
 
-	// Create new table definition with added column
-	newDef := &TableDef{
-		Name:  def.Name,
-		Cols:  append(def.Cols, columnName),
-		Types: append(def.Types, columnType),
-		PKeys: def.PKeys, // Primary keys remain the same
-	}
+	return sm.update(func(kv KVWriter) error {
+		def, newDef, err := sm.getForAlter(kv, tableName)
+		if err != nil {
+			return err
+		}
 
-	sm.tables[tableName] = newDef
-	return nil
+		// Check if column already exists
+		if colIndex(def, columnName) >= 0 {
+			return fmt.Errorf("column %s already exists in table %s", columnName, tableName)
+		}
+
+		newDef.Cols = append(newDef.Cols, columnName)
+		newDef.Types = append(newDef.Types, columnType)
+		KeepIndexes(def, newDef)
+		return sm.alter(kv, def, newDef, nil)
+	})
 }
 
-// DropColumn drops a column from a table
+// DropColumn drops a column from a table, with the indexes that use it
 func (sm *SchemaManager) DropColumn(tableName string, columnName string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if table exists
-	def, exists := sm.tables[tableName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", tableName)
-	}
-
-	// Find column index
-	colIndex := -1
-	for i, col := range def.Cols {
-		if col == columnName {
-			colIndex = i
-			break
+	return sm.update(func(kv KVWriter) error {
+		def, newDef, err := sm.getForAlter(kv, tableName)
+		if err != nil {
+			return err
 		}
-	}
-
-	if colIndex == -1 {
-		return fmt.Errorf("column %s does not exist in table %s", columnName, tableName)
-	}
 
-	// Check if column is part of primary key
-	if colIndex < def.PKeys {
-		return fmt.Errorf("cannot drop primary key column %s", columnName)
-	}
-
-	// Create new table definition without the column
-	newCols := make([]string, 0, len(def.Cols)-1)
-	newTypes := make([]uint32, 0, len(def.Types)-1)
-
-	for i, col := range def.Cols {
-		if i != colIndex {
-			newCols = append(newCols, col)
-			newTypes = append(newTypes, def.Types[i])
+		i := colIndex(def, columnName)
+		if i < 0 {
+			return fmt.Errorf("column %s does not exist in table %s", columnName, tableName)
 		}
-	}
 
-	newDef := &TableDef{
-		Name:  def.Name,
-		Cols:  newCols,
-		Types: newTypes,
-		PKeys: def.PKeys,
-	}
+		// Check if column is part of primary key
+		if i < def.PKeys {
+			return fmt.Errorf("cannot drop primary key column %s", columnName)
+		}
 
-	sm.tables[tableName] = newDef
-	return nil
+		newDef.Cols = append(newDef.Cols[:i:i], newDef.Cols[i+1:]...)
+		newDef.Types = append(newDef.Types[:i:i], newDef.Types[i+1:]...)
+		newDef.NotNull = removeName(newDef.NotNull, columnName)
+		KeepIndexes(def, newDef)
+		return sm.alter(kv, def, newDef, nil)
+	})
 }
 
-// ModifyColumn modifies a column type
+// ModifyColumn modifies a column type and converts its values,
+// see ConvertValue()
 func (sm *SchemaManager) ModifyColumn(tableName string, columnName string, newType uint32) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if table exists
-	def, exists := sm.tables[tableName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", tableName)
-	}
-
-	// Find column index
-	colIndex := -1
-	for i, col := range def.Cols {
-		if col == columnName {
-			colIndex = i
-			break
-		}
-	}
-
-	if colIndex == -1 {
-		return fmt.Errorf("column %s does not exist in table %s", columnName, tableName)
-	}
-
 	// Validate new type
-	if newType != TYPE_INT64 && newType != TYPE_BYTES {
+	if !validType(newType) {
 		return fmt.Errorf("invalid data type: %d", newType)
 	}
 
-	// Create new table definition with modified column type
-	newTypes := make([]uint32, len(def.Types))
-	copy(newTypes, def.Types)
-	newTypes[colIndex] = newType
+	return sm.update(func(kv KVWriter) error {
+		def, newDef, err := sm.getForAlter(kv, tableName)
+		if err != nil {
+			return err
+		}
 
-	newDef := &TableDef{
-		Name:  def.Name,
-		Cols:  def.Cols,
-		Types: newTypes,
-		PKeys: def.PKeys,
-	}
+		i := colIndex(def, columnName)
+		if i < 0 {
+			return fmt.Errorf("column %s does not exist in table %s", columnName, tableName)
+		}
 
-	sm.tables[tableName] = newDef
-	return nil
+		newDef.Types[i] = newType
+		KeepIndexes(def, newDef)
+		return sm.alter(kv, def, newDef, nil)
+	})
 }
 
-// RenameColumn renames a column
+// RenameColumn renames a column, in the rows and in the indexes
 func (sm *SchemaManager) RenameColumn(tableName string, oldName string, newName string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if table exists
-	def, exists := sm.tables[tableName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", tableName)
-	}
-
-	// Find old column index
-	oldIndex := -1
-	for i, col := range def.Cols {
-		if col == oldName {
-			oldIndex = i
-			break
-		}
-	}
-
-	if oldIndex == -1 {
-		return fmt.Errorf("column %s does not exist in table %s", oldName, tableName)
-	}
-
-	// Check if new column name already exists
-	for _, col := range def.Cols {
-		if col == newName {
-			return fmt.Errorf("column %s already exists in table %s", newName, tableName)
-		}
-	}
-
 	// Validate new column name
 	if newName == "" {
 		return fmt.Errorf("new column name cannot be empty")
@@ -376,37 +221,72 @@ func (sm *SchemaManager) RenameColumn(tableName string, oldName string, newName
 		return fmt.Errorf("invalid column name: %s", newName)
 	}
 
-	// Create new table definition with renamed column
-	newCols := make([]string, len(def.Cols))
-	copy(newCols, def.Cols)
-	newCols[oldIndex] = newName
+	return sm.update(func(kv KVWriter) error {
+		def, newDef, err := sm.getForAlter(kv, tableName)
+		if err != nil {
+			return err
+		}
 
-	newDef := &TableDef{
-		Name:  def.Name,
-		Cols:  newCols,
-		Types: def.Types,
-		PKeys: def.PKeys,
-	}
+		i := colIndex(def, oldName)
+		if i < 0 {
+			return fmt.Errorf("column %s does not exist in table %s", oldName, tableName)
+		}
 
-	sm.tables[tableName] = newDef
-	return nil
+		// Check if new column name already exists
+		if colIndex(def, newName) >= 0 {
+			return fmt.Errorf("column %s already exists in table %s", newName, tableName)
+		}
+
+		rename := func(names []string) {
+			for j := range names {
+				if names[j] == oldName {
+					names[j] = newName
+				}
+			}
+		}
+		rename(newDef.Cols)
+		rename(newDef.NotNull)
+		rename(newDef.Virtual)
+		for _, index := range newDef.Indexes {
+			rename(index)
+		}
+		for _, exprs := range []map[string]string{newDef.Defaults, newDef.Generated} {
+			if expr, ok := exprs[oldName]; ok {
+				delete(exprs, oldName)
+				exprs[newName] = expr
+			}
+		}
+		if dec, ok := newDef.Decimals[oldName]; ok {
+			delete(newDef.Decimals, oldName)
+			newDef.Decimals[newName] = dec
+		}
+		convert := func(row Record) (Record, error) {
+			row.Cols = append([]string{}, row.Cols...)
+			rename(row.Cols)
+			return ConvertRow(newDef, row)
+		}
+		return sm.alter(kv, def, newDef, convert)
+	})
 }
 
-// GetSchemaInfo returns information about the schema
-func (sm *SchemaManager) GetSchemaInfo() *SchemaInfo {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+// Migrations returns the history of the applied migrations,
+// see MigrationList()
+func (sm *SchemaManager) Migrations() ([]SchemaMigration, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	info := &SchemaInfo{
-		TableCount: len(sm.tables),
-		Tables:     make([]TableInfo, 0, len(sm.tables)),
-	}
+	return MigrationList(sm.kv)
+}
 
-	for _, def := range sm.tables {
+// GetSchemaInfo returns information about the schema
+func (sm *SchemaManager) GetSchemaInfo() *SchemaInfo {
+	info := &SchemaInfo{Tables: []TableInfo{}}
+	for _, def := range sm.tableDefs() {
 		tableInfo := TableInfo{
 			Name:        def.Name,
 			Columns:     make([]ColumnInfo, len(def.Cols)),
 			PrimaryKeys: def.PKeys,
+			IndexCount:  len(def.Indexes),
 		}
 
 		for i, col := range def.Cols {
@@ -419,18 +299,16 @@ func (sm *SchemaManager) GetSchemaInfo() *SchemaInfo {
 
 		info.Tables = append(info.Tables, tableInfo)
 	}
+	info.TableCount = len(info.Tables)
 
 	return info
 }
 
 // ValidateSchema validates the entire schema
 func (sm *SchemaManager) ValidateSchema() error {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	for name, def := range sm.tables {
+	for _, def := range sm.tableDefs() {
 		if err := validateTableDef(def); err != nil {
-			return fmt.Errorf("table %s validation failed: %w", name, err)
+			return fmt.Errorf("table %s validation failed: %w", def.Name, err)
 		}
 	}
 
@@ -439,6 +317,87 @@ func (sm *SchemaManager) ValidateSchema() error {
 
 // Helper Methods
 
+// run `fn` on the KV, in a transaction of its own for a KV store
+func (sm *SchemaManager) update(fn func(kv KVWriter) error) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	store, ok := sm.kv.(storage.KVStore)
+	if !ok {
+		return fn(sm.kv)
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// the definition of an existing table
+func (sm *SchemaManager) get(kv KVReader, name string) (*TableDef, error) {
+	def, err := CatalogGet(kv, name)
+	if err != nil {
+		return nil, err
+	}
+	if def == nil {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+	return def, nil
+}
+
+// the definition of an existing table, and a copy of it to be altered
+func (sm *SchemaManager) getForAlter(kv KVReader, name string) (*TableDef, *TableDef, error) {
+	def, err := sm.get(kv, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	newDef, err := sm.get(kv, name)
+	return def, newDef, err
+}
+
+// replace the definition of a table and rewrite its rows, see TableRewrite()
+func (sm *SchemaManager) alter(kv KVWriter, oldDef *TableDef, newDef *TableDef, convert func(Record) (Record, error)) error {
+	// Validate new table definition
+	if err := validateTableDef(newDef); err != nil {
+		return fmt.Errorf("invalid table definition: %w", err)
+	}
+
+	// Validate schema compatibility
+	if err := sm.validateSchemaCompatibility(oldDef, newDef); err != nil {
+		return fmt.Errorf("schema compatibility check failed: %w", err)
+	}
+	if err := ViewColumnsCheck(kv, oldDef, newDef); err != nil {
+		return err
+	}
+
+	if err := TableRewrite(kv, oldDef, newDef, convert); err != nil {
+		return err
+	}
+	return CatalogUpdate(kv, newDef)
+}
+
+// the definitions of all tables in the order of the names
+func (sm *SchemaManager) tableDefs() []*TableDef {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	defs := []*TableDef{}
+	tables, err := CatalogList(sm.kv)
+	if err != nil {
+		return defs
+	}
+	for _, name := range tables {
+		if def, err := CatalogGet(sm.kv, name); err == nil && def != nil {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
 // validateSchemaCompatibility validates compatibility between old and new schemas
 func (sm *SchemaManager) validateSchemaCompatibility(oldDef, newDef *TableDef) error {
 	// Check that primary key columns haven't changed
@@ -471,60 +430,44 @@ type SchemaInfo struct {
 	Tables     []TableInfo
 }
 
-// ExportSchema exports the schema to a portable format
+// ExportSchema exports the table definitions as JSON, in the order of
+// the names. The key prefixes are not part of the schema.
 func (sm *SchemaManager) ExportSchema() ([]byte, error) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	// In a real implementation, this would serialize to JSON or another format
-	// For now, we'll return a simple representation
-	schema := make(map[string]*TableDef)
-	for name, def := range sm.tables {
-		schema[name] = def
+	defs := sm.tableDefs()
+	for _, def := range defs {
+		def.Prefix, def.IndexPrefixes = 0, nil
 	}
-
-	// This is a placeholder - in a real implementation, you'd use JSON or similar
-	return []byte(fmt.Sprintf("%+v", schema)), nil
+	return json.Marshal(defs)
 }
 
-// ImportSchema imports a schema from a portable format
+// ImportSchema creates the tables of ExportSchema(), which must not exist
 func (sm *SchemaManager) ImportSchema(data []byte) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// This is a placeholder - in a real implementation, you'd parse JSON or similar
-	// For now, we'll just validate that the data is not empty
 	if len(data) == 0 {
 		return fmt.Errorf("empty schema data")
 	}
 
-	// In a real implementation, you would:
-	// 1. Parse the data format (JSON, YAML, etc.)
-	// 2. Validate the schema
-	// 3. Replace the current schema
-
-	return fmt.Errorf("schema import not implemented")
+	defs := []*TableDef{}
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("bad schema data: %w", err)
+	}
+	return sm.update(func(kv KVWriter) error {
+		for _, def := range defs {
+			// the indexes are added by CatalogCreate() with their names
+			def.Building = nil
+			if err := CatalogCreate(kv, def); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// CloneSchema creates a copy of the current schema
+// CloneSchema creates a schema manager on an in-memory KV with a copy
+// of the current schema, without the rows
 func (sm *SchemaManager) CloneSchema() *SchemaManager {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
 	newSM := NewSchemaManager()
-	for name, def := range sm.tables {
-		newDef := &TableDef{
-			Name:  def.Name,
-			Cols:  make([]string, len(def.Cols)),
-			Types: make([]uint32, len(def.Types)),
-			PKeys: def.PKeys,
-		}
-
-		copy(newDef.Cols, def.Cols)
-		copy(newDef.Types, def.Types)
-
-		newSM.tables[name] = newDef
+	if data, err := sm.ExportSchema(); err == nil {
+		_ = newSM.ImportSchema(data)
 	}
-
 	return newSM
 }
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Sequence generates INT64 values, for CREATE SEQUENCE and for the
+// AUTO_INCREMENT primary keys. Its state is stored in @meta under the
+// key "seq:" + Name. The values are allocated in blocks of Cache values,
+// see SequenceCache, so the transactions do not update @meta for each
+// value. Like in other databases, the values are not transactional:
+// an aborted transaction leaves gaps.
+type Sequence struct {
+	Name      string
+	Start     int64
+	Increment int64 // positive
+	Cache     int64 // the number of values allocated at once
+	Next      int64 // the first value that is not allocated
+}
+
+// the block size of a sequence by default
+const SEQ_CACHE_DEFAULT = 32
+
+func sequenceKey(name string) *Record {
+	return (&Record{}).AddStr("key", []byte("seq:"+name))
+}
+
+// SequenceGet returns a sequence, or nil if it does not exist
+func SequenceGet(kv KVReader, name string) (*Sequence, error) {
+	rec := sequenceKey(name)
+	ok, err := dbGet(kv, TDEF_META, rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	seq := &Sequence{}
+	if err := json.Unmarshal(rec.Get("val").Str, seq); err != nil {
+		return nil, fmt.Errorf("bad state of sequence %s: %w", name, err)
+	}
+	return seq, nil
+}
+
+// SequenceCreate adds a new sequence, its first value is Start
+func SequenceCreate(kv KVWriter, seq *Sequence) error {
+	if !isValidIdentifier(seq.Name) {
+		return fmt.Errorf("invalid sequence name: %s", seq.Name)
+	}
+	if seq.Increment <= 0 {
+		return fmt.Errorf("sequence %s: INCREMENT must be positive", seq.Name)
+	}
+	if seq.Cache <= 0 || seq.Increment > math.MaxInt64/seq.Cache {
+		return fmt.Errorf("sequence %s: bad CACHE %d", seq.Name, seq.Cache)
+	}
+	seq.Next = seq.Start
+	if err := sequencePut(kv, seq, MODE_INSERT_ONLY); err != nil {
+		return fmt.Errorf("sequence %s already exists", seq.Name)
+	}
+	return nil
+}
+
+// SequenceDrop removes a sequence, it returns false if it does not exist
+func SequenceDrop(kv KVWriter, name string) (bool, error) {
+	return dbDelete(kv, TDEF_META, *sequenceKey(name))
+}
+
+func sequencePut(kv KVWriter, seq *Sequence, mode int) error {
+	val, err := json.Marshal(seq)
+	if err != nil {
+		return err
+	}
+	rec := sequenceKey(seq.Name).AddStr("val", val)
+	ok, err := dbUpdate(kv, TDEF_META, *rec, mode)
+	if err == nil && !ok && mode == MODE_INSERT_ONLY {
+		err = fmt.Errorf("key exists")
+	}
+	return err
+}
+
+// SequenceCache hands out the values of the sequences of a database
+// from blocks, which are shared by its transactions. A new block is
+// allocated in @meta when the cached one is used up, so the writes of
+// the counter are amortized over Sequence.Cache values.
+type SequenceCache struct {
+	mu     sync.Mutex
+	blocks map[string]*seqBlock
+}
+
+// the values next, next + Increment, ... below limit
+type seqBlock struct {
+	next  int64
+	limit int64
+}
+
+// NewSequenceCache creates an empty cache
+func NewSequenceCache() *SequenceCache {
+	return &SequenceCache{blocks: map[string]*seqBlock{}}
+}
+
+// NextVal returns the next value of a sequence. `kv` is the transaction
+// that uses the value, which also stores the allocated blocks.
+func (c *SequenceCache) NextVal(kv KVWriter, name string) (int64, error) {
+	seq, err := SequenceGet(kv, name)
+	if err != nil {
+		return 0, err
+	}
+	if seq == nil {
+		return 0, fmt.Errorf("sequence %s does not exist", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.blocks[name]
+	if b == nil || b.next >= b.limit {
+		// a new block, after the values handed out before
+		start := seq.Next
+		if b != nil && b.limit > start {
+			start = b.limit
+		}
+		if start > math.MaxInt64-seq.Cache*seq.Increment {
+			return 0, fmt.Errorf("sequence %s is exhausted", name)
+		}
+		b = &seqBlock{next: start, limit: start + seq.Cache*seq.Increment}
+		c.blocks[name] = b
+	}
+	if seq.Next < b.limit {
+		// a new block, or the transaction that allocated it was aborted
+		seq.Next = b.limit
+		if err := sequencePut(kv, seq, MODE_UPDATE_ONLY); err != nil {
+			return 0, err
+		}
+	}
+	v := b.next
+	b.next += seq.Increment
+	return v, nil
+}
+
+// Forget discards the cached block of a dropped sequence
+func (c *SequenceCache) Forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blocks, name)
+}
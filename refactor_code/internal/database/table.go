@@ -1,27 +1,41 @@
 package database
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 )
 
-// TableManager handles table operations
+// TableManager handles table operations.
+// The tables and their rows are stored in a KV, keyed by the table prefix
+// and the encoded primary key.
 type TableManager struct {
-	tables map[string]*Table
+	kv     KVWriter
+	tables map[string]*Table // opened tables
 	mu     sync.RWMutex
 }
 
-// Table represents a database table
+// Table represents a database table.
+// The secondary indexes in Def are stored in the same KV and are
+// updated with the rows.
 type Table struct {
-	Def     *TableDef
-	Data    map[string]*Record // Primary key -> Record mapping
-	Indexes map[string]*Index  // Index name -> Index mapping
-	mu      sync.RWMutex
+	Def *TableDef
+	kv  KVWriter
+	mu  sync.RWMutex
 }
 
-// NewTableManager creates a new table manager
+// NewTableManager creates a new table manager on an in-memory KV
 func NewTableManager() *TableManager {
+	return NewKVTableManager(NewMemKV())
+}
+
+// NewKVTableManager creates a new table manager on a KV,
+// which is usually a storage.KVStore or a storage.KVTX
+func NewKVTableManager(kv KVWriter) *TableManager {
 	return &TableManager{
+		kv:     kv,
 		tables: make(map[string]*Table),
 	}
 }
@@ -39,44 +53,69 @@ func (tm *TableManager) CreateTable(def *TableDef) error {
 		return fmt.Errorf("table name cannot be empty")
 	}
 
-	if _, exists := tm.tables[def.Name]; exists {
-		return fmt.Errorf("table %s already exists", def.Name)
-	}
-
 	// Validate table definition
 	if err := validateTableDef(def); err != nil {
 		return fmt.Errorf("invalid table definition: %w", err)
 	}
 
-	// Create new table
-	table := &Table{
-		Def:     def,
-		Data:    make(map[string]*Record),
-		Indexes: make(map[string]*Index),
+	// Add to the catalog, which assigns the prefix
+	if err := CatalogCreate(tm.kv, def); err != nil {
+		return err
 	}
 
-	tm.tables[def.Name] = table
+	tm.tables[def.Name] = tm.newTable(def)
 	return nil
 }
 
+func (tm *TableManager) newTable(def *TableDef) *Table {
+	return &Table{
+		Def: def,
+		kv:  tm.kv,
+	}
+}
+
 // DropTable drops a table
 func (tm *TableManager) DropTable(name string) error {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	if _, exists := tm.tables[name]; !exists {
+	def, err := CatalogGet(tm.kv, name)
+	if err != nil {
+		return err
+	}
+	if def == nil {
 		return fmt.Errorf("table %s does not exist", name)
 	}
 
+	// Remove the rows and the definition
+	if err := TableTruncate(tm.kv, def); err != nil {
+		return err
+	}
+	if _, err := CatalogDrop(tm.kv, name); err != nil {
+		return err
+	}
+
 	delete(tm.tables, name)
 	return nil
 }
 
 // GetTable returns a table by name
 func (tm *TableManager) GetTable(name string) *Table {
-	tm.mu.RLock()
-	defer tm.mu.RUnlock()
-	return tm.tables[name]
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if table, exists := tm.tables[name]; exists {
+		return table
+	}
+
+	// Open a table created earlier
+	def, err := CatalogGet(tm.kv, name)
+	if err != nil || def == nil {
+		return nil
+	}
+	table := tm.newTable(def)
+	tm.tables[name] = table
+	return table
 }
 
 // ListTables returns all table names
@@ -84,9 +123,9 @@ func (tm *TableManager) ListTables() []string {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
 
-	tables := make([]string, 0, len(tm.tables))
-	for name := range tm.tables {
-		tables = append(tables, name)
+	tables, err := CatalogList(tm.kv)
+	if err != nil {
+		return []string{}
 	}
 	return tables
 }
@@ -103,28 +142,14 @@ func (t *Table) Insert(record Record) error {
 		return fmt.Errorf("record validation failed: %w", err)
 	}
 
-	// Generate primary key
-	key := t.generatePrimaryKey(record)
-	if key == "" {
-		return fmt.Errorf("failed to generate primary key")
+	// Add the row and its index entries, unless the primary key exists
+	added, err := TableSet(t.kv, t.Def, record, MODE_INSERT_ONLY)
+	if err != nil {
+		return err
 	}
-
-	// Check if record already exists
-	if _, exists := t.Data[key]; exists {
+	if !added {
 		return fmt.Errorf("record with primary key already exists")
 	}
-
-	// Create a copy of the record
-	recordCopy := t.copyRecord(record)
-	t.Data[key] = &recordCopy
-
-	// Update indexes
-	if err := t.updateIndexes(&recordCopy, true); err != nil {
-		// Rollback the insert
-		delete(t.Data, key)
-		return fmt.Errorf("index update failed: %w", err)
-	}
-
 	return nil
 }
 
@@ -133,19 +158,7 @@ func (t *Table) Get(key Record) (*Record, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	keyStr := t.generatePrimaryKey(key)
-	if keyStr == "" {
-		return nil, fmt.Errorf("invalid primary key")
-	}
-
-	record, exists := t.Data[keyStr]
-	if !exists {
-		return nil, nil
-	}
-
-	// Return a copy
-	result := t.copyRecord(*record)
-	return &result, nil
+	return TableGet(t.kv, t.Def, key)
 }
 
 // Update updates a record
@@ -153,14 +166,12 @@ func (t *Table) Update(key Record, newRecord Record) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	keyStr := t.generatePrimaryKey(key)
-	if keyStr == "" {
-		return fmt.Errorf("invalid primary key")
-	}
-
 	// Check if record exists
-	oldRecord, exists := t.Data[keyStr]
-	if !exists {
+	oldRecord, err := TableGet(t.kv, t.Def, key)
+	if err != nil {
+		return err
+	}
+	if oldRecord == nil {
 		return fmt.Errorf("record not found")
 	}
 
@@ -169,24 +180,9 @@ func (t *Table) Update(key Record, newRecord Record) error {
 		return fmt.Errorf("record validation failed: %w", err)
 	}
 
-	// Update indexes (remove old, add new)
-	if err := t.updateIndexes(oldRecord, false); err != nil {
-		return fmt.Errorf("index update failed: %w", err)
-	}
-
-	// Create a copy of the new record
-	recordCopy := t.copyRecord(newRecord)
-	t.Data[keyStr] = &recordCopy
-
-	// Update indexes with new record
-	if err := t.updateIndexes(&recordCopy, true); err != nil {
-		// Rollback the update
-		t.Data[keyStr] = oldRecord
-		t.updateIndexes(oldRecord, true)
-		return fmt.Errorf("index update failed: %w", err)
-	}
-
-	return nil
+	// Replace the row, the primary key can be changed
+	_, err = TableReplace(t.kv, t.Def, key, newRecord)
+	return err
 }
 
 // Delete deletes a record by primary key
@@ -194,23 +190,7 @@ func (t *Table) Delete(key Record) (bool, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	keyStr := t.generatePrimaryKey(key)
-	if keyStr == "" {
-		return false, fmt.Errorf("invalid primary key")
-	}
-
-	record, exists := t.Data[keyStr]
-	if !exists {
-		return false, nil
-	}
-
-	// Update indexes (remove)
-	if err := t.updateIndexes(record, false); err != nil {
-		return false, fmt.Errorf("index update failed: %w", err)
-	}
-
-	delete(t.Data, keyStr)
-	return true, nil
+	return TableDelete(t.kv, t.Def, key)
 }
 
 // Scan performs a table scan
@@ -218,10 +198,14 @@ func (t *Table) Scan(scanner *Scanner) error {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	// Convert table data to records for scanning
+	// Read the rows in the primary key order
 	var records []Record
-	for _, record := range t.Data {
-		records = append(records, *record)
+	err := scanRows(t.kv, t.Def, func(record Record) bool {
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		return err
 	}
 
 	// Set records in scanner
@@ -229,79 +213,26 @@ func (t *Table) Scan(scanner *Scanner) error {
 	return nil
 }
 
-// Helper Methods
-
-// generatePrimaryKey generates a string key from primary key values
-func (t *Table) generatePrimaryKey(record Record) string {
-	if len(record.Cols) == 0 || len(record.Vals) == 0 {
-		return ""
-	}
-
-	// Find primary key values
-	var keyParts []string
-	for i := 0; i < t.Def.PKeys && i < len(record.Cols); i++ {
-		colName := t.Def.Cols[i]
-		value := record.Get(colName)
-		if value == nil {
-			return ""
-		}
-		keyParts = append(keyParts, valueToString(*value))
-	}
-
-	// Join with separator
-	key := ""
-	for i, part := range keyParts {
-		if i > 0 {
-			key += "|"
-		}
-		key += part
-	}
-	return key
-}
-
-// copyRecord creates a deep copy of a record
-func (t *Table) copyRecord(record Record) Record {
-	recordCopy := Record{
-		Cols: make([]string, len(record.Cols)),
-		Vals: make([]Value, len(record.Vals)),
-	}
-
-	copy(recordCopy.Cols, record.Cols)
-	for i, val := range record.Vals {
-		recordCopy.Vals[i] = Value{
-			Type: val.Type,
-			I64:  val.I64,
-			Str:  make([]byte, len(val.Str)),
-		}
-		copy(recordCopy.Vals[i].Str, val.Str)
-	}
-
-	return recordCopy
-}
-
-// updateIndexes updates all indexes for a record
-func (t *Table) updateIndexes(record *Record, add bool) error {
-	for _, index := range t.Indexes {
-		if add {
-			if err := index.Add(record); err != nil {
-				return err
-			}
-		} else {
-			if err := index.Remove(record); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
 // valueToString converts a Value to string representation
 func valueToString(value Value) string {
+	if value.Null {
+		return "NULL"
+	}
 	switch value.Type {
 	case TYPE_INT64:
 		return fmt.Sprintf("%d", value.I64)
 	case TYPE_BYTES:
 		return string(value.Str)
+	case TYPE_FLOAT64:
+		return strconv.FormatFloat(value.F64, 'g', -1, 64)
+	case TYPE_BOOL:
+		return strconv.FormatBool(value.I64 != 0)
+	case TYPE_TIMESTAMP:
+		return time.UnixMicro(value.I64).UTC().Format(time.RFC3339Nano)
+	case TYPE_DECIMAL:
+		return value.Dec.String()
+	case TYPE_JSON:
+		return string(value.Str)
 	default:
 		return ""
 	}
@@ -316,8 +247,8 @@ func (t *Table) GetTableInfo() *TableInfo {
 		Name:        t.Def.Name,
 		Columns:     make([]ColumnInfo, len(t.Def.Cols)),
 		PrimaryKeys: t.Def.PKeys,
-		RecordCount: len(t.Data),
-		IndexCount:  len(t.Indexes),
+		RecordCount: t.countRecords(),
+		IndexCount:  len(t.Def.Indexes),
 	}
 
 	for i, col := range t.Def.Cols {
@@ -335,7 +266,21 @@ func (t *Table) GetTableInfo() *TableInfo {
 func (t *Table) GetRecordCount() int {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	return len(t.Data)
+	return t.countRecords()
+}
+
+// count the KV pairs of the rows, which are not decoded
+func (t *Table) countRecords() int {
+	count := 0
+	start := encodeKey(nil, t.Def.Prefix, nil)
+	t.kv.Scan(start, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, start) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count
 }
 
 // Clear removes all records from the table
@@ -343,14 +288,8 @@ func (t *Table) Clear() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	// Clear all indexes
-	for _, index := range t.Indexes {
-		index.Clear()
-	}
-
-	// Clear data
-	t.Data = make(map[string]*Record)
-	return nil
+	// Delete the rows and the index entries
+	return TableTruncate(t.kv, t.Def)
 }
 
 // ValidateTableIntegrity checks table integrity
@@ -358,19 +297,52 @@ func (t *Table) ValidateTableIntegrity() error {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	// Check that all records have valid primary keys
-	for key, record := range t.Data {
-		if err := validateRecord(*record, t.Def); err != nil {
-			return fmt.Errorf("invalid record with key %s: %w", key, err)
+	// Check that all records are valid
+	var err error
+	rows := 0
+	ikeys := [][]byte{} // the expected index entries
+	serr := scanRows(t.kv, t.Def, func(record Record) bool {
+		if verr := validateRecord(record, t.Def); verr != nil {
+			err = fmt.Errorf("invalid record %v: %w", record.Vals[:t.Def.PKeys], verr)
 		}
+		rows++
+		for i := range t.Def.Indexes {
+			if !isBuilding(t.Def, i) {
+				ikeys = append(ikeys, indexKey(t.Def, i, record.Vals))
+			}
+		}
+		return err == nil
+	})
+	if serr != nil {
+		return serr
+	}
+	if err != nil {
+		return err
 	}
 
-	// Validate indexes
-	for name, index := range t.Indexes {
-		if err := index.Validate(); err != nil {
-			return fmt.Errorf("index %s validation failed: %w", name, err)
+	// Check that the indexes contain exactly the rows
+	for _, key := range ikeys {
+		if _, ok := t.kv.Get(key); !ok {
+			return fmt.Errorf("index validation failed: missing entry %q", key)
+		}
+	}
+	for i, name := range t.Def.IndexNames {
+		if isBuilding(t.Def, i) {
+			continue // incomplete
+		}
+		entries := 0
+		start := encodeKey(nil, t.Def.IndexPrefixes[i], nil)
+		t.kv.Scan(start, func(key []byte, val []byte) bool {
+			if !bytes.HasPrefix(key, start) {
+				return false
+			}
+			entries++
+			return true
+		})
+		if entries != rows {
+			return fmt.Errorf("index %s validation failed: %d entries for %d rows",
+				name, entries, rows)
 		}
 	}
-
 	return nil
 }
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Trigger is a statement that the query executor runs for each row
+// written to a table, before or after the write. It is stored in @meta
+// under the key "trigger:" + Name.
+type Trigger struct {
+	Name   string
+	Table  string
+	Timing string // BEFORE or AFTER
+	Event  string // INSERT, UPDATE or DELETE
+	Body   string // the SQL text of the statement
+}
+
+func triggerKey(name string) *Record {
+	return (&Record{}).AddStr("key", []byte("trigger:"+name))
+}
+
+// TriggerGet returns a trigger, or nil if it does not exist
+func TriggerGet(kv KVReader, name string) (*Trigger, error) {
+	rec := triggerKey(name)
+	ok, err := dbGet(kv, TDEF_META, rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	trig := &Trigger{}
+	if err := json.Unmarshal(rec.Get("val").Str, trig); err != nil {
+		return nil, fmt.Errorf("bad definition of trigger %s: %w", name, err)
+	}
+	return trig, nil
+}
+
+// TriggerCreate adds a new trigger, or replaces it if `replace`
+func TriggerCreate(kv KVWriter, trig *Trigger, replace bool) error {
+	if !isValidIdentifier(trig.Name) {
+		return fmt.Errorf("invalid trigger name: %s", trig.Name)
+	}
+	val, err := json.Marshal(trig)
+	if err != nil {
+		return err
+	}
+	mode := MODE_INSERT_ONLY
+	if replace {
+		mode = MODE_UPSERT
+	}
+	rec := triggerKey(trig.Name).AddStr("val", val)
+	ok, err := dbUpdate(kv, TDEF_META, *rec, mode)
+	if err == nil && !ok && !replace {
+		err = fmt.Errorf("trigger %s already exists", trig.Name)
+	}
+	return err
+}
+
+// TriggerDrop removes a trigger, it returns false if it does not exist
+func TriggerDrop(kv KVWriter, name string) (bool, error) {
+	return dbDelete(kv, TDEF_META, *triggerKey(name))
+}
+
+// TriggerList returns the triggers of a table in the order of the names
+func TriggerList(kv KVReader, table string) ([]Trigger, error) {
+	triggers := []Trigger{}
+	for _, name := range metaNames(kv, "trigger:") {
+		trig, err := TriggerGet(kv, name)
+		if err != nil {
+			return nil, err
+		}
+		if trig != nil && trig.Table == table {
+			triggers = append(triggers, *trig)
+		}
+	}
+	return triggers, nil
+}
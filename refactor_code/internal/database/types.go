@@ -1,11 +1,48 @@
 package database
 
+import "time"
+
 // TableDef represents a table definition
 type TableDef struct {
-	Name  string
-	Cols  []string
-	Types []uint32
-	PKeys int // number of primary key columns
+	Name    string
+	Cols    []string
+	Types   []uint32
+	PKeys   int        // number of primary key columns
+	Indexes [][]string // secondary indexes, each ends with the primary key
+	// index names, in the same order as Indexes
+	IndexNames []string
+	// the number of leading columns of each index that are UNIQUE,
+	// 0 for a non-unique index. empty if no index is unique.
+	UniqueCols []int
+	// the columns that cannot be NULL, besides the primary key
+	NotNull []string
+	// the precision and the scale of the DECIMAL columns
+	Decimals map[string]DecimalType
+	// the DEFAULT expressions of the columns and the CHECK constraints,
+	// as the SQL text, which is evaluated by the query executor
+	Defaults   map[string]string
+	Checks     []string
+	CheckNames []string // in the same order as Checks
+	// the GENERATED ALWAYS AS expressions of the columns, as the SQL
+	// text. the values of the VIRTUAL ones are not stored but computed
+	// on read by VirtualFunc, which is set by the transaction.
+	Generated   map[string]string
+	Virtual     []string
+	VirtualFunc func(values []Value) error `json:"-"`
+	// the references to other tables
+	ForeignKeys []ForeignKey
+	// the sequence of the AUTO_INCREMENT primary key, which assigns
+	// the key of the new rows without one. empty if none.
+	AutoIncrement string
+	// the indexes being built, which are updated with the rows
+	// but not used by scans until they are complete
+	Building []string
+	// the query of a materialized view, whose rows are stored in this
+	// table. nil for a table.
+	MatView *MatView
+	// auto-assigned B-tree key prefixes for different tables/indexes
+	Prefix        uint32
+	IndexPrefixes []uint32
 }
 
 // Record represents a database record
@@ -14,20 +51,43 @@ type Record struct {
 	Vals []Value
 }
 
-// Value represents a database value
+// Value represents a database value.
+// BOOL is stored in I64 as 0 or 1, TIMESTAMP in I64 as the
+// microseconds since the Unix epoch, in UTC, DECIMAL in Dec, and JSON
+// in Str as the compact text.
 type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
+	F64  float64
+	Dec  Decimal
+	// SQL NULL, the other fields are unused except the Type.
+	// the type of a NULL literal is TYPE_ERROR until it is stored.
+	Null bool
 }
 
 // Data types
 const (
-	TYPE_ERROR = 0
-	TYPE_BYTES = 1
-	TYPE_INT64 = 2
+	TYPE_ERROR     = 0
+	TYPE_BYTES     = 1
+	TYPE_INT64     = 2
+	TYPE_FLOAT64   = 3
+	TYPE_BOOL      = 4
+	TYPE_TIMESTAMP = 5
+	TYPE_DECIMAL   = 6
+	TYPE_JSON      = 7
 )
 
+// whether the type can be stored in a column
+func validType(typ uint32) bool {
+	switch typ {
+	case TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_DECIMAL, TYPE_JSON:
+		return true
+	default:
+		return false
+	}
+}
+
 // Get retrieves a value from the record by column name
 func (r *Record) Get(col string) *Value {
 	for i, c := range r.Cols {
@@ -38,59 +98,76 @@ func (r *Record) Get(col string) *Value {
 	return nil
 }
 
-// Comparison operators
-const (
-	CMP_GE = 1 // >=
-	CMP_GT = 2 // >
-	CMP_LT = 3 // <
-	CMP_LE = 4 // <=
-	CMP_EQ = 5 // =
-	CMP_NE = 6 // !=
-)
+// AddStr appends a bytes column to the record
+func (r *Record) AddStr(col string, val []byte) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_BYTES, Str: val})
+	return r
+}
 
-// Scanner represents a table scanner for queries
-type Scanner struct {
-	// Key range for scanning
-	Key1, Key2 Record
-	Cmp1, Cmp2 int
-
-	// Internal state for iteration
-	currentRecord *Record
-	isValid       bool
-	position      int
-	totalRecords  int
+// AddInt64 appends an int64 column to the record
+func (r *Record) AddInt64(col string, val int64) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_INT64, I64: val})
+	return r
 }
 
-// Valid checks if scanner is in valid state
-func (sc *Scanner) Valid() bool {
-	return sc.isValid && sc.position < sc.totalRecords
+// AddFloat64 appends a float64 column to the record
+func (r *Record) AddFloat64(col string, val float64) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+	return r
 }
 
-// Next advances the scanner
-func (sc *Scanner) Next() {
-	sc.position++
-	if sc.position >= sc.totalRecords {
-		sc.isValid = false
+// AddBool appends a bool column to the record
+func (r *Record) AddBool(col string, val bool) *Record {
+	r.Cols = append(r.Cols, col)
+	v := Value{Type: TYPE_BOOL}
+	if val {
+		v.I64 = 1
 	}
+	r.Vals = append(r.Vals, v)
+	return r
 }
 
-// Deref gets current record from scanner
-func (sc *Scanner) Deref(rec *Record) {
-	if sc.currentRecord != nil {
-		*rec = *sc.currentRecord
-	}
+// AddTimestamp appends a timestamp column to the record
+func (r *Record) AddTimestamp(col string, val time.Time) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_TIMESTAMP, I64: val.UnixMicro()})
+	return r
 }
 
-// SetRecords sets the records to scan (for testing/simulation)
-func (sc *Scanner) SetRecords(records []Record) {
-	sc.totalRecords = len(records)
-	sc.position = 0
-	sc.isValid = len(records) > 0
-	if len(records) > 0 {
-		sc.currentRecord = &records[0]
-	}
+// AddDecimal appends a decimal column to the record
+func (r *Record) AddDecimal(col string, val Decimal) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_DECIMAL, Dec: val})
+	return r
+}
+
+// AddJSON appends a JSON column to the record, the text is validated when it is stored
+func (r *Record) AddJSON(col string, text []byte) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Type: TYPE_JSON, Str: text})
+	return r
+}
+
+// AddNull appends a NULL column to the record
+func (r *Record) AddNull(col string) *Record {
+	r.Cols = append(r.Cols, col)
+	r.Vals = append(r.Vals, Value{Null: true})
+	return r
 }
 
+// Comparison operators
+const (
+	CMP_GE = 1 // >=
+	CMP_GT = 2 // >
+	CMP_LT = 3 // <
+	CMP_LE = 4 // <=
+	CMP_EQ = 5 // =
+	CMP_NE = 6 // !=
+)
+
 // TableInfo represents table metadata
 type TableInfo struct {
 	Name        string
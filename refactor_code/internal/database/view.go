@@ -0,0 +1,181 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// View is a named SELECT, which is expanded by the query executor when
+// its name is in FROM. It is stored in @meta under the key
+// "view:" + Name, and shares the names of the tables.
+type View struct {
+	Name  string
+	Query string   // the SQL text of the SELECT
+	Cols  []string // the names of the output columns
+	Table string   // the table or view in FROM
+	Uses  []string // the columns of Table in the query
+}
+
+func viewKey(name string) *Record {
+	return (&Record{}).AddStr("key", []byte("view:"+name))
+}
+
+// ViewGet returns a view, or nil if it does not exist
+func ViewGet(kv KVReader, name string) (*View, error) {
+	rec := viewKey(name)
+	ok, err := dbGet(kv, TDEF_META, rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	view := &View{}
+	if err := json.Unmarshal(rec.Get("val").Str, view); err != nil {
+		return nil, fmt.Errorf("bad definition of view %s: %w", name, err)
+	}
+	return view, nil
+}
+
+// ViewCreate adds a new view, its name must not be used by a table
+func ViewCreate(kv KVWriter, view *View) error {
+	if !isValidIdentifier(view.Name) {
+		return fmt.Errorf("invalid view name: %s", view.Name)
+	}
+	if len(view.Cols) == 0 {
+		return fmt.Errorf("view %s must have at least one column", view.Name)
+	}
+	tdef, err := CatalogGet(kv, view.Name)
+	if err != nil {
+		return err
+	}
+	if tdef != nil {
+		return fmt.Errorf("table %s already exists", view.Name)
+	}
+	val, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	rec := viewKey(view.Name).AddStr("val", val)
+	ok, err := dbUpdate(kv, TDEF_META, *rec, MODE_INSERT_ONLY)
+	if err == nil && !ok {
+		err = fmt.Errorf("view %s already exists", view.Name)
+	}
+	return err
+}
+
+// a table cannot have the name of a view
+func checkNotView(kv KVReader, name string) error {
+	view, err := ViewGet(kv, name)
+	if err == nil && view != nil {
+		err = fmt.Errorf("view %s already exists", name)
+	}
+	return err
+}
+
+// ViewDrop removes a view, it returns false if it does not exist
+func ViewDrop(kv KVWriter, name string) (bool, error) {
+	return dbDelete(kv, TDEF_META, *viewKey(name))
+}
+
+// ViewList returns the names of all views in order
+func ViewList(kv KVReader) ([]string, error) {
+	return metaNames(kv, "view:"), nil
+}
+
+// the names of the @meta keys with a prefix, such as "view:", in order
+func metaNames(kv KVReader, kind string) []string {
+	prefix := encodeKey(nil, TDEF_META.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(kind)}})
+	// the encoded string ends with a terminator, which is not a prefix
+	prefix = prefix[:len(prefix)-1]
+	names := []string{}
+	kv.Scan(prefix, func(key []byte, val []byte) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		name := []Value{{Type: TYPE_BYTES}}
+		decodeValues(key[4:], name)
+		names = append(names, string(name[0].Str[len(kind):]))
+		return true
+	})
+	return names
+}
+
+// ViewUsers returns the views and the materialized views whose FROM is
+// a table or a view
+func ViewUsers(kv KVReader, name string) ([]string, error) {
+	names, err := ViewList(kv)
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for _, vname := range names {
+		view, err := ViewGet(kv, vname)
+		if err != nil {
+			return nil, err
+		}
+		if view != nil && view.Table == name {
+			users = append(users, vname)
+		}
+	}
+	matViews, err := MatViewList(kv, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, tdef := range matViews {
+		users = append(users, tdef.Name)
+	}
+	return users, nil
+}
+
+// ViewColumnsCheck fails if a view or a materialized view of a table
+// uses a column that is dropped or retyped by its new definition
+func ViewColumnsCheck(kv KVReader, oldDef *TableDef, newDef *TableDef) error {
+	check := func(view string, uses []string) error {
+		for _, col := range uses {
+			i, j := colIndex(oldDef, col), colIndex(newDef, col)
+			if j < 0 {
+				return fmt.Errorf("column %s is used by view %s", col, view)
+			}
+			if i >= 0 && oldDef.Types[i] != newDef.Types[j] {
+				return fmt.Errorf("cannot change the type of column %s used by view %s", col, view)
+			}
+		}
+		return nil
+	}
+	for _, vname := range metaNames(kv, "view:") {
+		view, err := ViewGet(kv, vname)
+		if err != nil {
+			return err
+		}
+		if view != nil && view.Table == oldDef.Name {
+			if err := check(vname, view.Uses); err != nil {
+				return err
+			}
+		}
+	}
+	matViews, err := MatViewList(kv, oldDef.Name)
+	if err != nil {
+		return err
+	}
+	for _, tdef := range matViews {
+		if err := check(tdef.Name, tdef.MatView.Uses); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CatalogNames returns the names of the tables and the views in order
+func CatalogNames(kv KVReader) ([]string, error) {
+	tables, err := CatalogList(kv)
+	if err != nil {
+		return nil, err
+	}
+	views, err := ViewList(kv)
+	if err != nil {
+		return nil, err
+	}
+	names := append(tables, views...)
+	sort.Strings(names)
+	return names, nil
+}
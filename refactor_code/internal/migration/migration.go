@@ -0,0 +1,100 @@
+package migration
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration is a schema change of SQL statements, loaded from the files
+//
+//	<version>_<name>.up.sql
+//	<version>_<name>.down.sql (optional)
+//
+// The migrations are applied in the order of the versions.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string // empty if it cannot be reverted
+	Checksum string // the SHA-256 of Up and Down, which is recorded when applied
+}
+
+// Load reads the migrations of a directory, sorted by the version
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	hasUp := map[int64]bool{}
+	for _, file := range files {
+		version, name, up, err := parseFileName(file)
+		if err != nil {
+			return nil, err
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if up {
+			m.Up = string(data)
+			hasUp[version] = true
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if !hasUp[m.Version] {
+			return nil, fmt.Errorf("migration %d (%s) has no up file", m.Version, m.Name)
+		}
+		m.Checksum = Checksum([]byte(m.Up), []byte(m.Down))
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Checksum is the hex SHA-256 of the up and the down files of a
+// migration, so a changed down file is also detected
+func Checksum(up []byte, down []byte) string {
+	h := sha256.New()
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(up)))
+	h.Write(size[:])
+	h.Write(up)
+	h.Write(down)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// split `<version>_<name>.up.sql` or `<version>_<name>.down.sql`
+func parseFileName(file string) (int64, string, bool, error) {
+	base := path.Base(file)
+	up := strings.HasSuffix(base, ".up.sql")
+	if !up && !strings.HasSuffix(base, ".down.sql") {
+		return 0, "", false, fmt.Errorf("bad migration file name: %s", file)
+	}
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".up.sql"), ".down.sql")
+	num, name, _ := strings.Cut(base, "_")
+	version, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, "", false, fmt.Errorf("bad migration version: %s", file)
+	}
+	return version, name, up, nil
+}
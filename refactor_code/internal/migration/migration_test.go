@@ -0,0 +1,199 @@
+package migration
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/query/executor"
+)
+
+// fakeTX keeps the history of the migrations in memory.
+// It cannot run statements, so the tests only use the runner
+// where it stops before executing one.
+type fakeTX struct {
+	executor.DBTX
+	history *[]database.SchemaMigration
+}
+
+func (tx *fakeTX) Migrations() ([]database.SchemaMigration, error) {
+	return append([]database.SchemaMigration{}, *tx.history...), nil
+}
+
+func (tx *fakeTX) RecordMigration(m *database.SchemaMigration) error {
+	*tx.history = append(*tx.history, *m)
+	return nil
+}
+
+func (tx *fakeTX) ForgetMigration(version int64) error {
+	return fmt.Errorf("migration %d cannot be reverted", version)
+}
+
+func (tx *fakeTX) Commit() error { return nil }
+func (tx *fakeTX) Abort() error  { return nil }
+
+func TestParseFileName(t *testing.T) {
+	fmt.Println("Testing migration file names...")
+
+	version, name, up, err := parseFileName("dir/0010_create_users.up.sql")
+	if err != nil || version != 10 || name != "create_users" || !up {
+		t.Errorf("Unexpected result: %d %q %v %v", version, name, up, err)
+	}
+	version, name, up, err = parseFileName("7_users.down.sql")
+	if err != nil || version != 7 || name != "users" || up {
+		t.Errorf("Unexpected result: %d %q %v %v", version, name, up, err)
+	}
+	for _, file := range []string{
+		"users.up.sql",     // no version
+		"0_users.up.sql",   // the versions start at 1
+		"-1_users.up.sql",  // negative
+		"x10_users.up.sql", // not a number
+		"0010_users.sql",   // neither up nor down
+		"0010_users.up.txt",
+	} {
+		if _, _, _, err := parseFileName(file); err == nil {
+			t.Errorf("Expected an error for %s", file)
+		}
+	}
+
+	fmt.Println("Migration file name tests passed!")
+}
+
+func TestLoad(t *testing.T) {
+	fmt.Println("Testing migration loading...")
+
+	files := fstest.MapFS{
+		"0100_tags.up.sql":    {Data: []byte("CREATE TABLE tags (id int64, PRIMARY KEY (id))")},
+		"0002_posts.up.sql":   {Data: []byte("CREATE TABLE posts (id int64, PRIMARY KEY (id))")},
+		"0002_posts.down.sql": {Data: []byte("DROP TABLE posts")},
+		"0010_users.up.sql":   {Data: []byte("CREATE TABLE users (id int64, PRIMARY KEY (id))")},
+		"README.md":           {Data: []byte("not a migration")},
+	}
+	migrations, err := Load(files)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	// in the order of the versions, not of the file names
+	got := []string{}
+	for _, m := range migrations {
+		got = append(got, fmt.Sprint(m.Version, m.Name))
+	}
+	if fmt.Sprint(got) != "[2posts 10users 100tags]" {
+		t.Errorf("Unexpected migrations: %v", got)
+	}
+	if migrations[0].Down != "DROP TABLE posts" || migrations[1].Down != "" {
+		t.Errorf("Unexpected down scripts: %q %q", migrations[0].Down, migrations[1].Down)
+	}
+
+	// the checksum covers both files
+	posts := migrations[0]
+	if posts.Checksum != Checksum([]byte(posts.Up), []byte(posts.Down)) {
+		t.Errorf("Unexpected checksum: %s", posts.Checksum)
+	}
+	if posts.Checksum == Checksum([]byte(posts.Up), nil) {
+		t.Errorf("Expected the down file to change the checksum")
+	}
+	if Checksum([]byte("ab"), []byte("c")) == Checksum([]byte("a"), []byte("bc")) {
+		t.Errorf("Expected the checksum to separate the up and the down files")
+	}
+
+	// bad sets of files
+	bad := map[string]fstest.MapFS{
+		"no up file": {"0010_users.down.sql": {}},
+		"two names":  {"0010_users.up.sql": {}, "0010_people.down.sql": {}},
+		"bad name":   {"users.up.sql": {}},
+	}
+	for what, files := range bad {
+		if _, err := Load(files); err == nil {
+			t.Errorf("Expected an error for %s", what)
+		}
+	}
+
+	fmt.Println("Migration loading tests passed!")
+}
+
+func TestRunnerVerify(t *testing.T) {
+	fmt.Println("Testing migration verification...")
+
+	files := fstest.MapFS{
+		"0010_users.up.sql":   {Data: []byte("CREATE TABLE users (id int64, PRIMARY KEY (id))")},
+		"0010_users.down.sql": {Data: []byte("DROP TABLE users")},
+		"0020_posts.up.sql":   {Data: []byte("CREATE TABLE posts (id int64, PRIMARY KEY (id))")},
+	}
+	history := []database.SchemaMigration{}
+	begin := func() (TX, error) {
+		return &fakeTX{history: &history}, nil
+	}
+	load := func() *Runner {
+		migrations, err := Load(files)
+		if err != nil {
+			t.Fatalf("Failed to load: %v", err)
+		}
+		return NewRunner(begin, migrations)
+	}
+	migrations, _ := Load(files)
+	for _, m := range migrations {
+		history = append(history, database.SchemaMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum})
+	}
+
+	// nothing is pending
+	if pending, err := load().Verify(); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no pending migration, got %v, %v", pending, err)
+	}
+	if n, err := load().Up(0); err != nil || n != 0 {
+		t.Errorf("Expected no migration applied, got %d, %v", n, err)
+	}
+
+	// a new migration is pending
+	files["0030_tags.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE tags (id int64, PRIMARY KEY (id))")}
+	if pending, err := load().Verify(); err != nil || len(pending) != 1 || pending[0].Version != 30 {
+		t.Errorf("Expected migration 30 pending, got %v, %v", pending, err)
+	}
+	delete(files, "0030_tags.up.sql")
+
+	// an edited up or down file is rejected
+	for _, file := range []string{"0010_users.up.sql", "0010_users.down.sql"} {
+		data := files[file].Data
+		files[file] = &fstest.MapFile{Data: append([]byte("-- edited\n"), data...)}
+		r := load()
+		if _, err := r.Verify(); err == nil || !strings.Contains(err.Error(), "checksum of migration 10") {
+			t.Errorf("Expected a checksum error for %s, got %v", file, err)
+		}
+		if _, err := r.Up(0); err == nil {
+			t.Errorf("Expected Up() to refuse an edited %s", file)
+		}
+		if _, err := r.Down(1); err == nil {
+			t.Errorf("Expected Down() to refuse an edited %s", file)
+		}
+		files[file] = &fstest.MapFile{Data: data}
+	}
+
+	// an added down file changes the checksum too
+	files["0020_posts.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE posts")}
+	if _, err := load().Verify(); err == nil || !strings.Contains(err.Error(), "checksum of migration 20") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	delete(files, "0020_posts.down.sql")
+
+	// the last migration has no down file
+	if n, err := load().Down(1); err == nil || n != 0 || !strings.Contains(err.Error(), "no down file") {
+		t.Errorf("Expected an error for a missing down file, got %d, %v", n, err)
+	}
+
+	// a missing file or an older pending migration is rejected
+	up, down := files["0010_users.up.sql"], files["0010_users.down.sql"]
+	delete(files, "0010_users.up.sql")
+	delete(files, "0010_users.down.sql")
+	if _, err := load().Verify(); err == nil || !strings.Contains(err.Error(), "has no file") {
+		t.Errorf("Expected an error for a missing file, got %v", err)
+	}
+	files["0010_users.up.sql"], files["0010_users.down.sql"] = up, down
+	files["0015_early.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE early (id int64, PRIMARY KEY (id))")}
+	if _, err := load().Verify(); err == nil || !strings.Contains(err.Error(), "older than") {
+		t.Errorf("Expected an error for an older pending migration, got %v", err)
+	}
+
+	fmt.Println("Migration verification tests passed!")
+}
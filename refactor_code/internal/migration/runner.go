@@ -0,0 +1,190 @@
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/query/executor"
+	"govetachun/go-mini-db/refactor_code/internal/query/parser"
+)
+
+// TX is a started transaction that runs the statements of a migration,
+// such as a transaction.DBTX behind an executor.DBTX. The history of
+// the applied migrations is in the catalog, see database.MigrationList().
+type TX interface {
+	executor.DBTX
+	Migrations() ([]database.SchemaMigration, error)
+	RecordMigration(m *database.SchemaMigration) error
+	ForgetMigration(version int64) error
+	Commit() error
+	Abort() error
+}
+
+// Applied is a migration recorded in the history
+type Applied = database.SchemaMigration
+
+// Runner applies the migrations to a database. Each migration runs in
+// a transaction of its own, with the update of the history, so a
+// failed migration leaves no change. The runner refuses to run if an
+// applied migration no longer matches the files, see Verify().
+type Runner struct {
+	begin      func() (TX, error)
+	migrations []Migration
+}
+
+// NewRunner creates a runner of the migrations loaded by Load().
+// `begin` starts a transaction on the database.
+func NewRunner(begin func() (TX, error), migrations []Migration) *Runner {
+	return &Runner{begin: begin, migrations: migrations}
+}
+
+// Applied returns the applied migrations, sorted by the version
+func (r *Runner) Applied() ([]Applied, error) {
+	var applied []Applied
+	err := r.run(func(tx TX) (err error) {
+		applied, err = tx.Migrations()
+		return err
+	})
+	return applied, err
+}
+
+// Verify checks the applied migrations against the files: each of them
+// must have a file with the recorded checksum, and the pending
+// migrations must be newer than them. It returns the pending migrations.
+func (r *Runner) Verify() ([]Migration, error) {
+	var pending []Migration
+	err := r.run(func(tx TX) (err error) {
+		_, pending, err = r.verify(tx)
+		return err
+	})
+	return pending, err
+}
+
+// Up applies the pending migrations up to the version `target`, or all
+// of them if it is 0, and returns the number of the applied migrations.
+func (r *Runner) Up(target int64) (int, error) {
+	for n := 0; ; n++ {
+		done := false
+		err := r.run(func(tx TX) error {
+			_, pending, err := r.verify(tx)
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 || (target > 0 && pending[0].Version > target) {
+				done = true
+				return nil
+			}
+			m := pending[0]
+			if err := execScript(tx, m, m.Up); err != nil {
+				return err
+			}
+			return tx.RecordMigration(&Applied{
+				Version:   m.Version,
+				Name:      m.Name,
+				Checksum:  m.Checksum,
+				AppliedAt: time.Now(),
+			})
+		})
+		if err != nil || done {
+			return n, err
+		}
+	}
+}
+
+// Down reverts the last `steps` applied migrations with their down
+// files, and returns the number of the reverted migrations.
+func (r *Runner) Down(steps int) (int, error) {
+	for n := 0; n < steps; n++ {
+		done := false
+		err := r.run(func(tx TX) error {
+			applied, _, err := r.verify(tx)
+			if err != nil {
+				return err
+			}
+			if len(applied) == 0 {
+				done = true
+				return nil
+			}
+			m := r.find(applied[len(applied)-1].Version)
+			if m.Down == "" {
+				return fmt.Errorf("migration %d (%s) has no down file", m.Version, m.Name)
+			}
+			if err := execScript(tx, *m, m.Down); err != nil {
+				return err
+			}
+			return tx.ForgetMigration(m.Version)
+		})
+		if err != nil || done {
+			return n, err
+		}
+	}
+	return steps, nil
+}
+
+// run `fn` in a transaction, commit it if there is no error
+func (r *Runner) run(fn func(tx TX) error) error {
+	tx, err := r.begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// the applied migrations and the pending migrations
+func (r *Runner) verify(tx TX) ([]Applied, []Migration, error) {
+	applied, err := tx.Migrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := map[int64]bool{}
+	for _, a := range applied {
+		m := r.find(a.Version)
+		if m == nil {
+			return nil, nil, fmt.Errorf("applied migration %d (%s) has no file", a.Version, a.Name)
+		}
+		if m.Checksum != a.Checksum {
+			return nil, nil, fmt.Errorf("checksum of migration %d (%s) differs from the applied one",
+				a.Version, a.Name)
+		}
+		done[a.Version] = true
+	}
+	pending := []Migration{}
+	for _, m := range r.migrations {
+		if done[m.Version] {
+			continue
+		}
+		if last := len(applied) - 1; last >= 0 && m.Version < applied[last].Version {
+			return nil, nil, fmt.Errorf("migration %d (%s) is older than the applied migration %d",
+				m.Version, m.Name, applied[last].Version)
+		}
+		pending = append(pending, m)
+	}
+	return applied, pending, nil
+}
+
+func (r *Runner) find(version int64) *Migration {
+	for i := range r.migrations {
+		if r.migrations[i].Version == version {
+			return &r.migrations[i]
+		}
+	}
+	return nil
+}
+
+func execScript(tx TX, m Migration, script string) error {
+	stmts, err := parser.ParseScript([]byte(script))
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	for i, stmt := range stmts {
+		if _, err := executor.ExecuteQuery(stmt, tx); err != nil {
+			return fmt.Errorf("migration %d (%s): statement %d: %w", m.Version, m.Name, i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package executor
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/query/parser"
+)
+
+// DEFAULT and CHECK constraints. They are stored in the catalog as the
+// SQL text, and parsed once per statement by qlTableRules().
+// A DEFAULT is a constant expression, such as `0` or `now()`, and is
+// evaluated for each row that omits the column on INSERT.
+// A CHECK is evaluated on each new row of INSERT and UPDATE; it fails
+// if it is false, while NULL passes as in SQL.
+
+// the parsed DEFAULT, CHECK and GENERATED expressions of a table
+type qlRules struct {
+	defaults  map[string]QLNode
+	checks    []QLNode
+	generated map[string]QLNode // see generated.go
+}
+
+// qlTableRules parses the DEFAULT, CHECK and GENERATED expressions of a table
+func qlTableRules(tdef *TableDef) (*qlRules, error) {
+	rules := &qlRules{defaults: map[string]QLNode{}, generated: map[string]QLNode{}}
+	for col, text := range tdef.Defaults {
+		if qlColIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("DEFAULT of unknown column: %s", col)
+		}
+		node, err := parser.ParseExpr([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("DEFAULT of column %s: %w", col, err)
+		}
+		if qlHasColumn(node) {
+			return nil, fmt.Errorf("DEFAULT of column %s cannot refer to columns", col)
+		}
+		rules.defaults[col] = node
+	}
+	if len(tdef.CheckNames) != len(tdef.Checks) {
+		return nil, fmt.Errorf("CHECK constraint names mismatch")
+	}
+	for i, text := range tdef.Checks {
+		node, err := parser.ParseExpr([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("CHECK constraint %s: %w", tdef.CheckNames[i], err)
+		}
+		for _, col := range qlColumns(node, nil) {
+			if qlColIndex(tdef, col) < 0 {
+				return nil, fmt.Errorf("CHECK constraint %s: unknown column %s", tdef.CheckNames[i], col)
+			}
+		}
+		rules.checks = append(rules.checks, node)
+	}
+	for col, text := range tdef.Generated {
+		if qlColIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("unknown generated column: %s", col)
+		}
+		node, err := parser.ParseExpr([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("generated column %s: %w", col, err)
+		}
+		for _, c := range qlColumns(node, nil) {
+			if qlColIndex(tdef, c) < 0 {
+				return nil, fmt.Errorf("generated column %s: unknown column %s", col, c)
+			}
+			if _, ok := tdef.Generated[c]; ok {
+				return nil, fmt.Errorf("generated column %s cannot refer to generated column %s", col, c)
+			}
+		}
+		rules.generated[col] = node
+	}
+	return rules, nil
+}
+
+// validateRules checks that the expressions of a new table definition
+// are valid, and that the DEFAULT values have the column types
+func validateRules(tdef *TableDef) error {
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return err
+	}
+	for col := range rules.defaults {
+		v, err := rules.defaultValue(tdef, col)
+		if err != nil {
+			return err
+		}
+		if typ := tdef.Types[qlColIndex(tdef, col)]; !v.Null && v.Type != typ {
+			return fmt.Errorf("DEFAULT of column %s: expected type %d, got %d", col, typ, v.Type)
+		}
+	}
+	return rules.checkGenerated(tdef)
+}
+
+// the DEFAULT value of a column, NULL if there is none
+func (rules *qlRules) defaultValue(tdef *TableDef, col string) (Value, error) {
+	node, ok := rules.defaults[col]
+	if !ok {
+		return Value{Null: true}, nil
+	}
+	ctx := QLEvalContex{}
+	qlEval(&ctx, node)
+	if ctx.err != nil {
+		return Value{}, fmt.Errorf("DEFAULT of column %s: %w", col, ctx.err)
+	}
+	return qlCoerce(ctx.out, tdef.Types[qlColIndex(tdef, col)]), nil
+}
+
+// fill adds the columns missing from an INSERT with their DEFAULT values
+func (rules *qlRules) fill(record *Record, tdef *TableDef) error {
+	for _, col := range tdef.Cols {
+		if record.Get(col) != nil {
+			continue
+		}
+		v, err := rules.defaultValue(tdef, col)
+		if err != nil {
+			return err
+		}
+		record.Cols = append(record.Cols, col)
+		record.Vals = append(record.Vals, v)
+	}
+	return nil
+}
+
+// check evaluates the CHECK constraints on a new row
+func (rules *qlRules) check(record Record, tdef *TableDef) error {
+	for i, node := range rules.checks {
+		ctx := QLEvalContex{env: record}
+		qlEval(&ctx, node)
+		if ctx.err != nil {
+			return fmt.Errorf("CHECK constraint %s: %w", tdef.CheckNames[i], ctx.err)
+		}
+		if !ctx.out.Null && !qlIsBool(ctx.out) {
+			return fmt.Errorf("CHECK constraint %s must be boolean type", tdef.CheckNames[i])
+		}
+		if !ctx.out.Null && ctx.out.I64 == 0 {
+			return fmt.Errorf("row violates CHECK constraint %s: %s", tdef.CheckNames[i], tdef.Checks[i])
+		}
+	}
+	return nil
+}
+
+// qlCheckRefs returns the CHECK constraints that refer to a column, by the index
+func qlCheckRefs(tdef *TableDef, col string) (map[int]bool, error) {
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[int]bool{}
+	for i, node := range rules.checks {
+		for _, c := range qlColumns(node, nil) {
+			refs[i] = refs[i] || c == col
+		}
+	}
+	return refs, nil
+}
+
+// qlCheckForeignKeys fails if a column is in a foreign key of the table,
+// the ones referencing the column are checked by the transaction
+func qlCheckForeignKeys(tdef *TableDef, col string) error {
+	for _, fk := range tdef.ForeignKeys {
+		for _, c := range fk.Cols {
+			if c == col {
+				return fmt.Errorf("column %s is used by foreign key %s", col, fk.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// the columns referred to by an expression
+func qlColumns(node QLNode, out []string) []string {
+	if node.Value.Type == QL_SYM {
+		return append(out, string(node.Value.Str))
+	}
+	for _, kid := range node.Kids {
+		out = qlColumns(kid, out)
+	}
+	return out
+}
@@ -2,22 +2,48 @@ package executor
 
 import (
 	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
 )
 
 // ExecuteCreateTable executes a CREATE TABLE statement
 func ExecuteCreateTable(req *QLCreateTable, tx DBTX) error {
 	// Convert query.TableDef to database.TableDef
 	def := &TableDef{
-		Name:  req.Def.Name,
-		Cols:  req.Def.Cols,
-		Types: req.Def.Types,
-		PKeys: req.Def.PKeys,
+		Name:    req.Def.Name,
+		Cols:    req.Def.Cols,
+		Types:   req.Def.Types,
+		PKeys:   req.Def.PKeys,
+		NotNull: req.Def.NotNull,
+		// the expressions are validated with the column types
+		Defaults:   req.Def.Defaults,
+		Checks:     req.Def.Checks,
+		CheckNames: req.Def.CheckNames,
+		Generated:  req.Def.Generated,
+		Virtual:    req.Def.Virtual,
+		// the sequence is created with the table
+		AutoIncrement: req.Def.AutoIncrement,
+	}
+	for col, dt := range req.Def.Decimals {
+		if def.Decimals == nil {
+			def.Decimals = map[string]database.DecimalType{}
+		}
+		def.Decimals[col] = database.DecimalType{Precision: dt.Precision, Scale: dt.Scale}
+	}
+	for _, fk := range req.Def.ForeignKeys {
+		def.ForeignKeys = append(def.ForeignKeys, database.ForeignKey{
+			Name: fk.Name, Cols: fk.Cols, Table: fk.Table, RefCols: fk.RefCols,
+			OnDelete: fk.OnDelete, OnUpdate: fk.OnUpdate, Deferred: fk.Deferred,
+		})
 	}
 
 	// Validate table definition
 	if err := validateTableDef(def); err != nil {
 		return fmt.Errorf("table definition validation failed: %w", err)
 	}
+	if err := validateRules(def); err != nil {
+		return fmt.Errorf("table definition validation failed: %w", err)
+	}
 
 	// Check if table already exists
 	existing := tx.GetDB().GetTableDef(req.Def.Name)
@@ -31,6 +57,13 @@ func ExecuteCreateTable(req *QLCreateTable, tx DBTX) error {
 		return fmt.Errorf("table creation failed: %w", err)
 	}
 
+	// Create the indexes of the INDEX and UNIQUE clauses
+	for i := range req.Indexes {
+		if err := ExecuteCreateIndexStmt(&req.Indexes[i], tx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -92,12 +125,21 @@ func ExecuteAlterTableAddColumn(tableName string, columnName string, columnType
 		}
 	}
 
-	// Create new table definition with added column
+	// Create new table definition with added column,
+	// which is NULL in the existing rows
 	newDef := &TableDef{
-		Name:  tdef.Name,
-		Cols:  append(tdef.Cols, columnName),
-		Types: append(tdef.Types, columnType),
-		PKeys: tdef.PKeys, // Primary keys remain the same
+		Name:     tdef.Name,
+		Cols:     append(tdef.Cols[:len(tdef.Cols):len(tdef.Cols)], columnName),
+		Types:    append(tdef.Types[:len(tdef.Types):len(tdef.Types)], columnType),
+		PKeys:    tdef.PKeys, // Primary keys remain the same
+		NotNull:  tdef.NotNull,
+		Decimals: tdef.Decimals,
+		// the DEFAULT, CHECK and GENERATED expressions are kept
+		Defaults:   tdef.Defaults,
+		Checks:     tdef.Checks,
+		CheckNames: tdef.CheckNames,
+		Generated:  tdef.Generated,
+		Virtual:    tdef.Virtual,
 	}
 
 	// Alter the table
@@ -152,9 +194,35 @@ func ExecuteAlterTableDropColumn(tableName string, columnName string, tx DBTX) e
 		Types: newTypes,
 		PKeys: tdef.PKeys,
 	}
+	for _, col := range tdef.NotNull {
+		if col != columnName {
+			newDef.NotNull = append(newDef.NotNull, col)
+		}
+	}
+	newDef.Decimals = renameColumn(tdef.Decimals, columnName, "")
+	newDef.Defaults = renameColumn(tdef.Defaults, columnName, "")
+	newDef.Generated = renameColumn(tdef.Generated, columnName, "")
+	newDef.Virtual = renameName(tdef.Virtual, columnName, "")
+	if err := qlCheckForeignKeys(tdef, columnName); err != nil {
+		return err
+	}
+	if err := qlGeneratedRefs(tdef, columnName); err != nil {
+		return err
+	}
+	// the CHECK constraints on the column are dropped with it
+	refs, err := qlCheckRefs(tdef, columnName)
+	if err != nil {
+		return err
+	}
+	for i, check := range tdef.Checks {
+		if !refs[i] {
+			newDef.Checks = append(newDef.Checks, check)
+			newDef.CheckNames = append(newDef.CheckNames, tdef.CheckNames[i])
+		}
+	}
 
 	// Alter the table
-	err := tx.AlterTable(tableName, newDef)
+	err = tx.AlterTable(tableName, newDef)
 	if err != nil {
 		return fmt.Errorf("alter table failed: %w", err)
 	}
@@ -182,17 +250,32 @@ func ExecuteAlterTableModifyColumn(tableName string, columnName string, newType
 	if colIndex == -1 {
 		return fmt.Errorf("column %s does not exist in table %s", columnName, tableName)
 	}
+	if colIndex < tdef.PKeys && newType != tdef.Types[colIndex] {
+		return fmt.Errorf("cannot modify primary key column %s", columnName)
+	}
 
-	// Create new table definition with modified column type
+	// Create new table definition with modified column type,
+	// the stored values are converted to the new type
 	newTypes := make([]uint32, len(tdef.Types))
 	copy(newTypes, tdef.Types)
 	newTypes[colIndex] = newType
 
 	newDef := &TableDef{
-		Name:  tdef.Name,
-		Cols:  tdef.Cols,
-		Types: newTypes,
-		PKeys: tdef.PKeys,
+		Name:     tdef.Name,
+		Cols:     tdef.Cols,
+		Types:    newTypes,
+		PKeys:    tdef.PKeys,
+		NotNull:  tdef.NotNull,
+		Decimals: tdef.Decimals,
+	}
+	if newType != TYPE_DECIMAL {
+		newDef.Decimals = renameColumn(tdef.Decimals, columnName, "")
+	}
+	newDef.Defaults, newDef.Checks, newDef.CheckNames = tdef.Defaults, tdef.Checks, tdef.CheckNames
+	newDef.Generated, newDef.Virtual = tdef.Generated, tdef.Virtual
+	// the DEFAULT and the GENERATED expressions must have the new type
+	if err := validateRules(newDef); err != nil {
+		return err
 	}
 
 	// Alter the table
@@ -204,30 +287,56 @@ func ExecuteAlterTableModifyColumn(tableName string, columnName string, newType
 	return nil
 }
 
+// ExecuteCreateIndexStmt executes a CREATE [UNIQUE] INDEX statement
+func ExecuteCreateIndexStmt(req *QLCreateIndex, tx DBTX) error {
+	cols := append([]string{}, req.Cols...)
+	for i, expr := range req.Exprs {
+		if expr.Value.Type == 0 {
+			continue // a column
+		}
+		name, ok := qlIndexColumn(expr)
+		if !ok {
+			return fmt.Errorf("index expression must be a constant path of a JSON column")
+		}
+		cols[i] = name
+	}
+	if req.Unique {
+		return ExecuteCreateUniqueIndex(req.Name, req.Table, cols, tx)
+	}
+	return ExecuteCreateIndex(req.Name, req.Table, cols, tx)
+}
+
 // ExecuteCreateIndex executes CREATE INDEX statement
 func ExecuteCreateIndex(indexName string, tableName string, columnNames []string, tx DBTX) error {
+	return executeCreateIndex(indexName, tableName, columnNames, false, tx)
+}
+
+// ExecuteCreateUniqueIndex executes CREATE UNIQUE INDEX statement
+func ExecuteCreateUniqueIndex(indexName string, tableName string, columnNames []string, tx DBTX) error {
+	return executeCreateIndex(indexName, tableName, columnNames, true, tx)
+}
+
+func executeCreateIndex(indexName string, tableName string, columnNames []string, unique bool, tx DBTX) error {
 	// Get table definition
 	tdef := tx.GetDB().GetTableDef(tableName)
 	if tdef == nil {
 		return fmt.Errorf("table %s does not exist", tableName)
 	}
 
-	// Validate column names
+	// Validate column names, or the paths of JSON columns
 	for _, colName := range columnNames {
-		found := false
-		for _, tdefCol := range tdef.Cols {
-			if tdefCol == colName {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if database.IndexColType(tdef, colName) == TYPE_ERROR {
 			return fmt.Errorf("column %s does not exist in table %s", colName, tableName)
 		}
 	}
 
 	// Create the index
-	err := tx.CreateIndex(indexName, tableName, columnNames)
+	var err error
+	if unique {
+		err = tx.CreateUniqueIndex(indexName, tableName, columnNames)
+	} else {
+		err = tx.CreateIndex(indexName, tableName, columnNames)
+	}
 	if err != nil {
 		return fmt.Errorf("index creation failed: %w", err)
 	}
@@ -325,9 +434,53 @@ func ExecuteRenameColumn(tableName string, oldName string, newName string, tx DB
 		Types: tdef.Types,
 		PKeys: tdef.PKeys,
 	}
+	for _, col := range tdef.NotNull {
+		if col == oldName {
+			col = newName
+		}
+		newDef.NotNull = append(newDef.NotNull, col)
+	}
+	newDef.Decimals = renameColumn(tdef.Decimals, oldName, newName)
+	newDef.Defaults = renameColumn(tdef.Defaults, oldName, newName)
+	newDef.Generated = renameColumn(tdef.Generated, oldName, newName)
+	newDef.Virtual = renameName(tdef.Virtual, oldName, newName)
+	if err := qlCheckForeignKeys(tdef, oldName); err != nil {
+		return err
+	}
+	if err := qlGeneratedRefs(tdef, oldName); err != nil {
+		return err
+	}
+	// the CHECK expressions are stored as the text, which is not rewritten
+	refs, err := qlCheckRefs(tdef, oldName)
+	if err != nil {
+		return err
+	}
+	for i := range tdef.Checks {
+		if refs[i] {
+			return fmt.Errorf("column %s is used by CHECK constraint %s", oldName, tdef.CheckNames[i])
+		}
+	}
+	newDef.Checks, newDef.CheckNames = tdef.Checks, tdef.CheckNames
+	// the index columns are not rewritten either
+	for i, index := range tdef.Indexes {
+		for _, col := range index {
+			if database.IndexColType(newDef, col) == TYPE_ERROR {
+				return fmt.Errorf("column %s is used by index %s", oldName, tdef.IndexNames[i])
+			}
+		}
+	}
 
-	// Alter the table
-	err := tx.AlterTable(tableName, newDef)
+	// Alter the table, the rows keep their values under the new name
+	err = tx.AlterTableRows(tableName, newDef, func(row Record) (Record, error) {
+		cols := make([]string, len(row.Cols))
+		for i, col := range row.Cols {
+			if col == oldName {
+				col = newName
+			}
+			cols[i] = col
+		}
+		return Record{Cols: cols, Vals: row.Vals}, nil
+	})
 	if err != nil {
 		return fmt.Errorf("alter table failed: %w", err)
 	}
@@ -335,6 +488,42 @@ func ExecuteRenameColumn(tableName string, oldName string, newName string, tx DB
 	return nil
 }
 
+// renameColumn copies a map by the column, such as the DECIMAL columns,
+// with a column renamed,
+// or removed if the new name is empty
+func renameColumn[V any](m map[string]V, oldName string, newName string) map[string]V {
+	if m == nil {
+		return nil
+	}
+	out := map[string]V{}
+	for col, dt := range m {
+		if col == oldName {
+			if newName == "" {
+				continue
+			}
+			col = newName
+		}
+		out[col] = dt
+	}
+	return out
+}
+
+// renameName copies a list of columns, such as the NOT NULL columns,
+// with a column renamed, or removed if the new name is empty
+func renameName(names []string, oldName string, newName string) []string {
+	var out []string
+	for _, col := range names {
+		if col == oldName {
+			if newName == "" {
+				continue
+			}
+			col = newName
+		}
+		out = append(out, col)
+	}
+	return out
+}
+
 // validateTableDef validates a table definition
 func validateTableDef(def *TableDef) error {
 	// Check table name
@@ -383,7 +572,9 @@ func validateTableDef(def *TableDef) error {
 
 	// Validate data types
 	for i, colType := range def.Types {
-		if colType != TYPE_INT64 && colType != TYPE_BYTES {
+		switch colType {
+		case TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_DECIMAL, TYPE_JSON:
+		default:
 			return fmt.Errorf("invalid data type for column %s: %d", def.Cols[i], colType)
 		}
 	}
@@ -422,11 +613,11 @@ func isDigit(b byte) bool {
 	return b >= '0' && b <= '9'
 }
 
-// GetTableInfo returns information about a table
+// GetTableInfo returns information about a table or a view
 func GetTableInfo(tableName string, tx DBTX) (*TableInfo, error) {
 	tdef := tx.GetDB().GetTableDef(tableName)
 	if tdef == nil {
-		return nil, fmt.Errorf("table %s does not exist", tableName)
+		return getViewInfo(tableName, tx)
 	}
 
 	info := &TableInfo{
@@ -434,6 +625,9 @@ func GetTableInfo(tableName string, tx DBTX) (*TableInfo, error) {
 		Columns:     make([]ColumnInfo, len(tdef.Cols)),
 		PrimaryKeys: tdef.PKeys,
 	}
+	if tdef.MatView != nil {
+		info.View = tdef.MatView.Query
+	}
 
 	for i, col := range tdef.Cols {
 		info.Columns[i] = ColumnInfo{
@@ -446,11 +640,46 @@ func GetTableInfo(tableName string, tx DBTX) (*TableInfo, error) {
 	return info, nil
 }
 
+// the columns of a view have the types of the plain columns of its
+// query, the types of the other expressions are unknown (TYPE_ERROR)
+func getViewInfo(name string, tx DBTX) (*TableInfo, error) {
+	view, err := tx.GetView(name)
+	if err != nil {
+		return nil, err
+	}
+	if view == nil {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+	sel, err := qlViewSelect(view)
+	if err != nil {
+		return nil, err
+	}
+	from, err := GetTableInfo(view.Table, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TableInfo{Name: view.Name, View: view.Query}
+	for i, col := range view.Cols {
+		colInfo := ColumnInfo{Name: col, Type: int(TYPE_ERROR)}
+		if node := sel.Output[i]; node.Value.Type == QL_SYM {
+			for _, c := range from.Columns {
+				if c.Name == string(node.Value.Str) {
+					colInfo.Type = c.Type
+				}
+			}
+		}
+		info.Columns = append(info.Columns, colInfo)
+	}
+	return info, nil
+}
+
 // TableInfo represents table metadata
 type TableInfo struct {
 	Name        string
 	Columns     []ColumnInfo
 	PrimaryKeys int
+	View        string // the query of a view or a materialized view, empty for a table
 }
 
 // ColumnInfo represents column metadata
@@ -460,7 +689,7 @@ type ColumnInfo struct {
 	IsPrimaryKey bool
 }
 
-// ListTables returns a list of all table names
+// ListTables returns a list of all table and view names
 func ListTables(tx DBTX) ([]string, error) {
 	return tx.GetDB().ListTables()
 }
@@ -2,6 +2,7 @@ package executor
 
 import (
 	"fmt"
+	"math"
 )
 
 // ExecuteDelete executes a DELETE statement
@@ -11,6 +12,10 @@ func ExecuteDelete(req *QLDelete, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Execute scan to find records to delete
 	var out []Record
@@ -23,13 +28,10 @@ func ExecuteDelete(req *QLDelete, tx DBTX) (uint64, error) {
 
 	// Process each matching record
 	for _, record := range records {
-		// Build primary key for this record
-		key := buildPrimaryKey(record, tdef)
-
-		// Delete the record
-		deleted, err := tx.Delete(req.Table, key)
+		// Delete the record, with the triggers
+		deleted, err := qlDeleteRow(req.Table, tdef, triggers, &record, tx)
 		if err != nil {
-			return 0, fmt.Errorf("delete failed: %w", err)
+			return 0, err
 		}
 
 		if !deleted {
@@ -49,6 +51,10 @@ func ExecuteDeleteWithCondition(req *QLDelete, tx DBTX, condition QLNode) (uint6
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Execute scan to find records to delete
 	var out []Record
@@ -68,22 +74,19 @@ func ExecuteDeleteWithCondition(req *QLDelete, tx DBTX, condition QLNode) (uint6
 			if ctx.err != nil {
 				return 0, fmt.Errorf("condition evaluation failed: %w", ctx.err)
 			}
-			if ctx.out.Type != TYPE_INT64 {
+			if !ctx.out.Null && !qlIsBool(ctx.out) {
 				return 0, fmt.Errorf("condition must be boolean type")
 			}
-			if ctx.out.I64 == 0 {
+			if ctx.out.Null || ctx.out.I64 == 0 {
 				// Condition not met, skip this record
 				continue
 			}
 		}
 
-		// Build primary key for this record
-		key := buildPrimaryKey(record, tdef)
-
-		// Delete the record
-		deleted, err := tx.Delete(req.Table, key)
+		// Delete the record, with the triggers
+		deleted, err := qlDeleteRow(req.Table, tdef, triggers, &record, tx)
 		if err != nil {
-			return 0, fmt.Errorf("delete failed: %w", err)
+			return 0, err
 		}
 
 		if !deleted {
@@ -118,10 +121,21 @@ func ExecuteDeleteSingle(req *QLDelete, tx DBTX, key Record) error {
 		}
 	}
 
-	// Delete the record
-	deleted, err := tx.Delete(req.Table, key)
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
 	if err != nil {
-		return fmt.Errorf("delete failed: %w", err)
+		return err
+	}
+
+	// Delete the record, with the triggers
+	record, err := tx.Get(req.Table, key)
+	if err != nil {
+		return fmt.Errorf("get record failed: %w", err)
+	}
+	deleted := false
+	if record != nil {
+		if deleted, err = qlDeleteRow(req.Table, tdef, triggers, record, tx); err != nil {
+			return err
+		}
 	}
 
 	if !deleted {
@@ -138,6 +152,10 @@ func ExecuteDeleteBatch(req *QLDelete, tx DBTX, keys []Record) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	var deletedCount uint64
 
@@ -149,10 +167,17 @@ func ExecuteDeleteBatch(req *QLDelete, tx DBTX, keys []Record) (uint64, error) {
 				tdef.PKeys, len(key.Cols))
 		}
 
-		// Delete the record
-		deleted, err := tx.Delete(req.Table, key)
+		// Delete the record, with the triggers
+		record, err := tx.Get(req.Table, key)
 		if err != nil {
-			return 0, fmt.Errorf("delete failed: %w", err)
+			return 0, fmt.Errorf("get record failed: %w", err)
+		}
+		if record == nil {
+			continue
+		}
+		deleted, err := qlDeleteRow(req.Table, tdef, triggers, record, tx)
+		if err != nil {
+			return 0, err
 		}
 
 		if deleted {
@@ -170,6 +195,10 @@ func ExecuteDeleteByRange(req *QLDelete, tx DBTX, startKey, endKey Record) (uint
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Create scanner for range scan
 	sc := Scanner{}
@@ -179,32 +208,31 @@ func ExecuteDeleteByRange(req *QLDelete, tx DBTX, startKey, endKey Record) (uint
 	sc.Cmp2 = CMP_LE
 
 	// Execute range scan
-	err := tx.Scan(req.Table, &sc)
+	err = tx.Scan(req.Table, &sc)
 	if err != nil {
 		return 0, fmt.Errorf("range scan failed: %w", err)
 	}
 
+	// the rows are collected first, the scanner
+	// cannot iterate over the tree that is being deleted from
+	records, err := qlScanRun(&QLScan{Limit: math.MaxInt64}, QLNode{}, &sc, nil)
+	if err != nil {
+		return 0, err
+	}
+
 	var deletedCount uint64
 
 	// Process each record in range
-	for sc.Valid() {
-		var record Record
-		sc.Deref(&record)
-
-		// Build primary key for this record
-		key := buildPrimaryKey(record, tdef)
-
-		// Delete the record
-		deleted, err := tx.Delete(req.Table, key)
+	for _, record := range records {
+		// Delete the record, with the triggers
+		deleted, err := qlDeleteRow(req.Table, tdef, triggers, &record, tx)
 		if err != nil {
-			return 0, fmt.Errorf("delete failed: %w", err)
+			return 0, err
 		}
 
 		if deleted {
 			deletedCount++
 		}
-
-		sc.Next()
 	}
 
 	return deletedCount, nil
@@ -217,6 +245,10 @@ func ExecuteDeleteAll(req *QLDelete, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	triggers, err := qlTableTriggers(req.Table, "DELETE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Create scanner for full table scan
 	sc := Scanner{}
@@ -224,32 +256,31 @@ func ExecuteDeleteAll(req *QLDelete, tx DBTX) (uint64, error) {
 	sc.Cmp2 = CMP_LE
 
 	// Execute full table scan
-	err := tx.Scan(req.Table, &sc)
+	err = tx.Scan(req.Table, &sc)
 	if err != nil {
 		return 0, fmt.Errorf("table scan failed: %w", err)
 	}
 
+	// the rows are collected first, the scanner
+	// cannot iterate over the tree that is being deleted from
+	records, err := qlScanRun(&QLScan{Limit: math.MaxInt64}, QLNode{}, &sc, nil)
+	if err != nil {
+		return 0, err
+	}
+
 	var deletedCount uint64
 
 	// Process each record
-	for sc.Valid() {
-		var record Record
-		sc.Deref(&record)
-
-		// Build primary key for this record
-		key := buildPrimaryKey(record, tdef)
-
-		// Delete the record
-		deleted, err := tx.Delete(req.Table, key)
+	for _, record := range records {
+		// Delete the record, with the triggers
+		deleted, err := qlDeleteRow(req.Table, tdef, triggers, &record, tx)
 		if err != nil {
-			return 0, fmt.Errorf("delete failed: %w", err)
+			return 0, err
 		}
 
 		if deleted {
 			deletedCount++
 		}
-
-		sc.Next()
 	}
 
 	return deletedCount, nil
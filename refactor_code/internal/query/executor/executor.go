@@ -18,23 +18,69 @@ type QLInsert = query.QLInsert
 type QLUpdate = query.QLUpdate
 type QLDelete = query.QLDelete
 type QLCreateTable = query.QLCreateTable
+type QLCreateIndex = query.QLCreateIndex
+type QLCreateSequence = query.QLCreateSequence
+type QLDropSequence = query.QLDropSequence
+type QLDropTable = query.QLDropTable
+type QLDropIndex = query.QLDropIndex
+type QLCreateView = query.QLCreateView
+type QLDropView = query.QLDropView
+type QLRefreshView = query.QLRefreshView
+type QLCreateTrigger = query.QLCreateTrigger
+type QLDropTrigger = query.QLDropTrigger
+type QLSetNew = query.QLSetNew
+type Sequence = database.Sequence
+type View = database.View
+type Trigger = database.Trigger
 type QLScan = query.QLScan
 
 // Re-export constants
 const (
-	TYPE_INT64 = database.TYPE_INT64
-	TYPE_BYTES = database.TYPE_BYTES
-	TYPE_ERROR = database.TYPE_ERROR
+	TYPE_INT64     = database.TYPE_INT64
+	TYPE_FLOAT64   = database.TYPE_FLOAT64
+	TYPE_BOOL      = database.TYPE_BOOL
+	TYPE_TIMESTAMP = database.TYPE_TIMESTAMP
+	TYPE_DECIMAL   = database.TYPE_DECIMAL
+	TYPE_JSON      = database.TYPE_JSON
+	TYPE_BYTES     = database.TYPE_BYTES
+	TYPE_ERROR     = database.TYPE_ERROR
 
 	CMP_GE = database.CMP_GE
+	CMP_GT = database.CMP_GT
+	CMP_LT = database.CMP_LT
 	CMP_LE = database.CMP_LE
+	CMP_EQ = database.CMP_EQ
 
-	QL_SYM    = query.QL_SYM
-	QL_I64    = query.QL_I64
-	QL_STR    = query.QL_STR
-	QL_NEG    = query.QL_NEG
-	QL_CMP_EQ = query.QL_CMP_EQ
-	QL_UNINIT = query.QL_UNINIT
+	QL_SYM         = query.QL_SYM
+	QL_TUP         = query.QL_TUP
+	QL_I64         = query.QL_I64
+	QL_STR         = query.QL_STR
+	QL_F64         = query.QL_F64
+	QL_BOOL        = query.QL_BOOL
+	QL_TIMESTAMP   = query.QL_TIMESTAMP
+	QL_DECIMAL     = query.QL_DECIMAL
+	QL_JSON_GET    = query.QL_JSON_GET
+	QL_JSON_TEXT   = query.QL_JSON_TEXT
+	QL_FUNC        = query.QL_FUNC
+	QL_CMP_ADD     = query.QL_CMP_ADD
+	QL_CMP_SUB     = query.QL_CMP_SUB
+	QL_CMP_MUL     = query.QL_CMP_MUL
+	QL_CMP_DIV     = query.QL_CMP_DIV
+	QL_CMP_MOD     = query.QL_CMP_MOD
+	QL_NEG         = query.QL_NEG
+	QL_CMP_GE      = query.QL_CMP_GE
+	QL_CMP_GT      = query.QL_CMP_GT
+	QL_CMP_LT      = query.QL_CMP_LT
+	QL_CMP_LE      = query.QL_CMP_LE
+	QL_CMP_EQ      = query.QL_CMP_EQ
+	QL_CMP_NE      = query.QL_CMP_NE
+	QL_CMP_OR      = query.QL_CMP_OR
+	QL_CMP_AND     = query.QL_CMP_AND
+	QL_NOT         = query.QL_NOT
+	QL_NULL        = query.QL_NULL
+	QL_IS_NULL     = query.QL_IS_NULL
+	QL_IS_NOT_NULL = query.QL_IS_NOT_NULL
+	QL_UNINIT      = query.QL_UNINIT
 )
 
 // DBTX represents a database transaction interface
@@ -49,10 +95,32 @@ type DBTX interface {
 	Update(table string, key Record, record Record) error
 	DropTable(tableName string) error
 	AlterTable(tableName string, newDef *TableDef) error
+	AlterTableRows(tableName string, newDef *TableDef, convert func(Record) (Record, error)) error
 	CreateIndex(indexName string, tableName string, columnNames []string) error
+	CreateUniqueIndex(indexName string, tableName string, columnNames []string) error
 	DropIndex(indexName string) error
 	TruncateTable(tableName string) error
 	RenameTable(oldName string, newName string) error
+	// sequences, and the AUTO_INCREMENT primary keys
+	CreateSequence(seq *Sequence) error
+	DropSequence(name string) error
+	NextVal(name string) (int64, error)
+	CurrVal(name string) (int64, error)
+	// views, which are expanded by the executor
+	CreateView(view *View) error
+	DropView(name string) error
+	GetView(name string) (*View, error)
+	// materialized views, which are maintained by the transaction
+	CreateMatView(def *TableDef) error
+	RefreshMatView(name string) error
+	DropMatView(name string) error
+	// the triggers, which are run by the executor
+	CreateTrigger(trig *Trigger) error
+	DropTrigger(name string) error
+	GetTrigger(name string) (*Trigger, error)
+	GetTriggers(table string) ([]Trigger, error)
+	// runs several writes, which are all undone if one fails
+	Atomic(write func() error) error
 }
 
 // DB represents a database interface
@@ -66,6 +134,8 @@ type QLEvalContex struct {
 	env Record // optional row values
 	out Value
 	err error
+	// for nextval() and currval(), nil where they are not allowed
+	tx DBTX
 }
 
 // ExecuteQuery is the main entry point for query execution
@@ -81,6 +151,37 @@ func ExecuteQuery(stmt interface{}, tx DBTX) (interface{}, error) {
 		return ExecuteDelete(s, tx)
 	case *QLCreateTable:
 		return nil, ExecuteCreateTable(s, tx)
+	case *QLCreateIndex:
+		return nil, ExecuteCreateIndexStmt(s, tx)
+	case *QLCreateSequence:
+		return nil, ExecuteCreateSequence(s, tx)
+	case *QLDropSequence:
+		return nil, ExecuteDropSequence(s.Name, tx)
+	case *QLDropTable:
+		if s.IfExists {
+			return nil, ExecuteDropTableIfExists(s.Name, tx)
+		}
+		return nil, ExecuteDropTable(s.Name, tx)
+	case *QLDropIndex:
+		return nil, ExecuteDropIndex(s.Name, tx)
+	case *QLCreateView:
+		if s.Materialized {
+			return nil, ExecuteCreateMatView(s, tx)
+		}
+		return nil, ExecuteCreateView(s, tx)
+	case *QLDropView:
+		if s.Materialized {
+			return nil, ExecuteDropMatView(s.Name, s.IfExists, tx)
+		}
+		return nil, ExecuteDropView(s.Name, s.IfExists, tx)
+	case *QLRefreshView:
+		return nil, ExecuteRefreshMatView(s.Name, tx)
+	case *QLCreateTrigger:
+		return nil, ExecuteCreateTrigger(s, tx)
+	case *QLDropTrigger:
+		return nil, ExecuteDropTrigger(s.Name, s.IfExists, tx)
+	case *QLSetNew:
+		return nil, fmt.Errorf("SET NEW is only allowed in a BEFORE trigger")
 	default:
 		return nil, fmt.Errorf("unknown statement type")
 	}
@@ -0,0 +1,140 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// qlEvalFunc evaluates a function call:
+//
+//	now(), CURRENT_TIMESTAMP            the current time
+//	nextval('seq'), currval('seq')      the values of a sequence
+//	lower(s), upper(s), concat(s, ...)  the strings, NULL if any is NULL
+//	json_extract(), json_type(), ...    see json.go
+func qlEvalFunc(ctx *QLEvalContex, node QLNode) {
+	args := make([]Value, len(node.Kids))
+	for i, kid := range node.Kids {
+		sub := QLEvalContex{env: ctx.env, tx: ctx.tx}
+		qlEval(&sub, kid)
+		if sub.err != nil {
+			ctx.err = sub.err
+			return
+		}
+		args[i] = sub.out
+	}
+	name := string(node.Value.Str)
+	nargs := func(min, max int) bool {
+		if len(args) < min || len(args) > max {
+			qlErr(ctx, "wrong number of arguments to %s()", name)
+			return false
+		}
+		return true
+	}
+
+	switch name {
+	case "now":
+		if !nargs(0, 0) {
+			return
+		}
+		ctx.out = Value{Type: TYPE_TIMESTAMP, I64: time.Now().UnixMicro()}
+	case "nextval", "currval":
+		if !nargs(1, 1) {
+			return
+		}
+		if ctx.tx == nil {
+			qlErr(ctx, "%s() is not allowed here", name)
+			return
+		}
+		if args[0].Null || args[0].Type != TYPE_BYTES {
+			qlErr(ctx, "expect a sequence name")
+			return
+		}
+		next := ctx.tx.NextVal
+		if name == "currval" {
+			next = ctx.tx.CurrVal
+		}
+		v, err := next(string(args[0].Str))
+		if err != nil {
+			ctx.err = err
+			return
+		}
+		ctx.out = Value{Type: TYPE_INT64, I64: v}
+	case "lower", "upper", "concat":
+		if name != "concat" && !nargs(1, 1) {
+			return
+		}
+		out := []byte{}
+		for _, arg := range args {
+			if arg.Null {
+				ctx.out = Value{Type: TYPE_BYTES, Null: true}
+				return
+			}
+			if arg.Type != TYPE_BYTES {
+				qlErr(ctx, "%s() expects strings", name)
+				return
+			}
+			out = append(out, arg.Str...)
+		}
+		switch name {
+		case "lower":
+			out = bytes.ToLower(out)
+		case "upper":
+			out = bytes.ToUpper(out)
+		}
+		ctx.out = Value{Type: TYPE_BYTES, Str: out}
+	case "json_extract":
+		if !nargs(2, 2) {
+			return
+		}
+		if args[0].Null || args[1].Null {
+			ctx.out = Value{Null: true}
+			return
+		}
+		if args[1].Type != TYPE_BYTES {
+			qlErr(ctx, "bad JSON path")
+			return
+		}
+		path, err := database.ParseJSONPath(string(args[1].Str))
+		if err != nil {
+			ctx.err = err
+			return
+		}
+		ctx.out = qlJSONExtract(args[0], path, true)
+	case "json_type":
+		if !nargs(1, 2) {
+			return
+		}
+		elem := args[0]
+		if len(args) == 2 {
+			elem = qlJSONGet(args[0], args[1], false)
+		} else if !elem.Null {
+			elem = qlJSONExtract(elem, nil, false)
+		}
+		if elem.Null || elem.Type == TYPE_ERROR {
+			ctx.out = elem
+			break
+		}
+		ctx.out = Value{Type: TYPE_BYTES, Str: []byte(qlJSONType(elem.Str))}
+	case "json_valid":
+		if !nargs(1, 1) {
+			return
+		}
+		switch {
+		case args[0].Null:
+			ctx.out = qlNullBool()
+		case args[0].Type == TYPE_JSON:
+			ctx.out = qlBool(true)
+		default:
+			ctx.out = qlBool(args[0].Type == TYPE_BYTES && json.Valid(args[0].Str))
+		}
+	default:
+		qlErr(ctx, "unknown function: %s", name)
+		return
+	}
+	if ctx.out.Type == TYPE_ERROR && !ctx.out.Null {
+		qlErr(ctx, "%s", ctx.out.Str)
+	}
+}
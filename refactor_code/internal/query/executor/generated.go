@@ -0,0 +1,117 @@
+package executor
+
+import "fmt"
+
+// Generated columns, `col type GENERATED ALWAYS AS (expr) [STORED | VIRTUAL]`.
+// The expression refers to the other columns of the row, but not to the
+// generated ones, and is evaluated like a CHECK. A STORED column is
+// computed on each INSERT and UPDATE, after the SET NEW of the BEFORE
+// triggers. A VIRTUAL column is not stored, but computed on read by
+// the function of VirtualFunc(); it is also computed on write, so the
+// CHECK constraints and the triggers see its value. Neither can be
+// written by the statements.
+
+// VirtualFunc returns the function that computes the virtual columns
+// of a row in the table order. It is used by the transactions, through
+// the transaction.GeneratedDB interface.
+func VirtualFunc(tdef *TableDef) (func([]Value) error, error) {
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return nil, err
+	}
+	return func(values []Value) error {
+		row := Record{Cols: tdef.Cols, Vals: values}
+		for _, col := range tdef.Virtual {
+			v, err := rules.generatedValue(tdef, col, row)
+			if err != nil {
+				return err
+			}
+			values[qlColIndex(tdef, col)] = v
+		}
+		return nil
+	}, nil
+}
+
+// writable fails if a statement writes a generated column
+func (rules *qlRules) writable(cols []string) error {
+	for _, col := range cols {
+		if _, ok := rules.generated[col]; ok {
+			return fmt.Errorf("cannot write generated column %s", col)
+		}
+	}
+	return nil
+}
+
+// generate computes the generated columns of a new row
+func (rules *qlRules) generate(record *Record, tdef *TableDef) error {
+	for _, col := range tdef.Cols {
+		if _, ok := rules.generated[col]; !ok {
+			continue
+		}
+		v, err := rules.generatedValue(tdef, col, *record)
+		if err != nil {
+			return err
+		}
+		if old := record.Get(col); old != nil {
+			*old = v
+		} else {
+			record.Cols = append(record.Cols, col)
+			record.Vals = append(record.Vals, v)
+		}
+	}
+	return nil
+}
+
+// the value of a generated column of a row, with the column type
+func (rules *qlRules) generatedValue(tdef *TableDef, col string, row Record) (Value, error) {
+	ctx := QLEvalContex{env: row}
+	qlEval(&ctx, rules.generated[col])
+	if ctx.err != nil {
+		return Value{}, fmt.Errorf("generated column %s: %w", col, ctx.err)
+	}
+	typ := tdef.Types[qlColIndex(tdef, col)]
+	v := qlCoerce(ctx.out, typ)
+	if v.Null {
+		return Value{Type: typ, Null: true}, nil
+	}
+	if v.Type != typ {
+		return Value{}, fmt.Errorf("generated column %s: expected type %d, got %d", col, typ, v.Type)
+	}
+	return v, nil
+}
+
+// checkGenerated checks the types of the generated columns of a new
+// table definition, by computing them on a row of sample values
+func (rules *qlRules) checkGenerated(tdef *TableDef) error {
+	sample := qlSampleRow(tdef)
+	for _, col := range tdef.Cols {
+		if _, ok := rules.generated[col]; !ok {
+			continue
+		}
+		if _, err := rules.generatedValue(tdef, col, sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qlGeneratedRefs fails if a column is used by a generated column,
+// whose expression is stored as the text, which is not rewritten
+func qlGeneratedRefs(tdef *TableDef, col string) error {
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return err
+	}
+	for _, gen := range tdef.Cols {
+		node, ok := rules.generated[gen]
+		if !ok {
+			continue
+		}
+		for _, c := range qlColumns(node, nil) {
+			if c == col {
+				return fmt.Errorf("column %s is used by generated column %s", col, gen)
+			}
+		}
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package executor
 
 import (
 	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
 )
 
 // ExecuteInsert executes an INSERT statement
@@ -18,57 +20,27 @@ func ExecuteInsert(req *QLInsert, tx DBTX) (uint64, error) {
 			len(req.Names), len(req.Values[0]))
 	}
 
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "INSERT", tx)
+	if err != nil {
+		return 0, err
+	}
+
 	var insertedCount uint64
 
 	// Process each value set
 	for _, valueRow := range req.Values {
-		// Create record for insertion
-		record := Record{}
-
-		if len(req.Names) > 0 {
-			// Insert with specified columns
-			record.Cols = req.Names
-			record.Vals = make([]Value, len(valueRow))
-
-			// Evaluate each value expression
-			for i, expr := range valueRow {
-				ctx := QLEvalContex{}
-				qlEval(&ctx, expr)
-				if ctx.err != nil {
-					return 0, fmt.Errorf("value evaluation failed: %w", ctx.err)
-				}
-				record.Vals[i] = ctx.out
-			}
-		} else {
-			// Insert with all columns (in table order)
-			record.Cols = tdef.Cols
-			record.Vals = make([]Value, len(tdef.Cols))
-
-			// Evaluate each value expression
-			for i, expr := range valueRow {
-				if i >= len(tdef.Cols) {
-					return 0, fmt.Errorf("too many values: expected %d, got %d",
-						len(tdef.Cols), len(valueRow))
-				}
-
-				ctx := QLEvalContex{}
-				qlEval(&ctx, expr)
-				if ctx.err != nil {
-					return 0, fmt.Errorf("value evaluation failed: %w", ctx.err)
-				}
-				record.Vals[i] = ctx.out
-			}
-		}
-
-		// Validate record against table schema
-		if err := validateRecord(record, tdef); err != nil {
-			return 0, fmt.Errorf("record validation failed: %w", err)
+		record, err := buildRecord(valueRow, req.Names, tdef, rules, tx)
+		if err != nil {
+			return 0, err
 		}
 
-		// Insert the record
-		err := tx.Insert(req.Table, record)
-		if err != nil {
-			return 0, fmt.Errorf("insert failed: %w", err)
+		// Insert the record, with the triggers
+		if err := qlInsertRow(req.Table, tdef, rules, triggers, record, tx); err != nil {
+			return 0, err
 		}
 
 		insertedCount++
@@ -77,6 +49,41 @@ func ExecuteInsert(req *QLInsert, tx DBTX) (uint64, error) {
 	return insertedCount, nil
 }
 
+// qlCoerce converts the numbers to the column type: an int64 or a decimal
+// to a float64, and an int64 or a float64 to a decimal.
+// The decimals are rounded to the column scale when they are stored.
+// Bytes are taken as the text of a JSON column, which is validated
+// when it is stored.
+func qlCoerce(v Value, typ uint32) Value {
+	if !v.Null && v.Type == TYPE_BYTES && typ == TYPE_JSON {
+		return Value{Type: TYPE_JSON, Str: v.Str}
+	}
+	if v.Null || v.Type == typ || !qlIsNumber(v) {
+		return v
+	}
+	switch typ {
+	case TYPE_FLOAT64:
+		return Value{Type: TYPE_FLOAT64, F64: qlFloat(v)}
+	case TYPE_DECIMAL:
+		if v.Type == TYPE_INT64 {
+			return Value{Type: TYPE_DECIMAL, Dec: database.DecimalFromInt64(v.I64)}
+		}
+		if dec, err := database.DecimalFromFloat64(v.F64); err == nil {
+			return Value{Type: TYPE_DECIMAL, Dec: dec}
+		}
+	}
+	return v
+}
+
+// qlCoerceRecord converts the values of a record with qlCoerce()
+func qlCoerceRecord(record *Record, tdef *TableDef) {
+	for i, col := range record.Cols {
+		if c := qlColIndex(tdef, col); c >= 0 && i < len(record.Vals) {
+			record.Vals[i] = qlCoerce(record.Vals[i], tdef.Types[c])
+		}
+	}
+}
+
 // validateRecord validates a record against table schema
 func validateRecord(record Record, tdef *TableDef) error {
 	// Check column count
@@ -111,7 +118,7 @@ func validateRecord(record Record, tdef *TableDef) error {
 
 		// Validate type
 		value := record.Get(colName)
-		if value != nil && value.Type != colType {
+		if value != nil && !value.Null && value.Type != colType {
 			return fmt.Errorf("type mismatch for column %s: expected %d, got %d",
 				colName, colType, value.Type)
 		}
@@ -149,13 +156,21 @@ func executeInsertOnly(req *QLInsert, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "INSERT", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	var insertedCount uint64
 
 	for _, valueRow := range req.Values {
-		record := buildRecord(valueRow, req.Names, tdef)
-		if record == nil {
-			return 0, fmt.Errorf("failed to build record")
+		record, err := buildRecord(valueRow, req.Names, tdef, rules, tx)
+		if err != nil {
+			return 0, err
 		}
 
 		// Check if record already exists
@@ -170,10 +185,9 @@ func executeInsertOnly(req *QLInsert, tx DBTX) (uint64, error) {
 			continue
 		}
 
-		// Insert the record
-		err = tx.Insert(req.Table, *record)
-		if err != nil {
-			return 0, fmt.Errorf("insert failed: %w", err)
+		// Insert the record, with the triggers
+		if err := qlInsertRow(req.Table, tdef, rules, triggers, record, tx); err != nil {
+			return 0, err
 		}
 
 		insertedCount++
@@ -188,13 +202,21 @@ func executeUpdateOnly(req *QLInsert, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	var updatedCount uint64
 
 	for _, valueRow := range req.Values {
-		record := buildRecord(valueRow, req.Names, tdef)
-		if record == nil {
-			return 0, fmt.Errorf("failed to build record")
+		record, err := buildRecord(valueRow, req.Names, tdef, rules, tx)
+		if err != nil {
+			return 0, err
 		}
 
 		// Check if record exists
@@ -209,10 +231,9 @@ func executeUpdateOnly(req *QLInsert, tx DBTX) (uint64, error) {
 			continue
 		}
 
-		// Update the record
-		err = tx.Update(req.Table, key, *record)
-		if err != nil {
-			return 0, fmt.Errorf("update failed: %w", err)
+		// Update the record, with the triggers
+		if err := qlUpdateRow(req.Table, tdef, rules, triggers, key, record, existing, tx); err != nil {
+			return 0, err
 		}
 
 		updatedCount++
@@ -227,13 +248,25 @@ func executeUpsert(req *QLInsert, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	inserts, err := qlTableTriggers(req.Table, "INSERT", tx)
+	if err != nil {
+		return 0, err
+	}
+	updates, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	var upsertedCount uint64
 
 	for _, valueRow := range req.Values {
-		record := buildRecord(valueRow, req.Names, tdef)
-		if record == nil {
-			return 0, fmt.Errorf("failed to build record")
+		record, err := buildRecord(valueRow, req.Names, tdef, rules, tx)
+		if err != nil {
+			return 0, err
 		}
 
 		// Check if record exists
@@ -245,10 +278,10 @@ func executeUpsert(req *QLInsert, tx DBTX) (uint64, error) {
 
 		if existing == nil {
 			// Insert new record
-			err = tx.Insert(req.Table, *record)
+			err = qlInsertRow(req.Table, tdef, rules, inserts, record, tx)
 		} else {
 			// Update existing record
-			err = tx.Update(req.Table, key, *record)
+			err = qlUpdateRow(req.Table, tdef, rules, updates, key, record, existing, tx)
 		}
 
 		if err != nil {
@@ -261,39 +294,59 @@ func executeUpsert(req *QLInsert, tx DBTX) (uint64, error) {
 	return upsertedCount, nil
 }
 
-// buildRecord constructs a record from value expressions
-func buildRecord(valueRow []QLNode, colNames []string, tdef *TableDef) *Record {
+// buildRecord constructs a record from value expressions, the columns
+// that are not given have their DEFAULT values, or NULL, and the
+// AUTO_INCREMENT primary key is assigned
+func buildRecord(valueRow []QLNode, colNames []string, tdef *TableDef, rules *qlRules, tx DBTX) (*Record, error) {
 	record := &Record{}
-
 	if len(colNames) > 0 {
 		// Use specified column names
-		record.Cols = colNames
-		record.Vals = make([]Value, len(valueRow))
-
-		for i, expr := range valueRow {
-			ctx := QLEvalContex{}
-			qlEval(&ctx, expr)
-			if ctx.err != nil {
-				return nil
-			}
-			record.Vals[i] = ctx.out
+		if len(colNames) != len(valueRow) {
+			return nil, fmt.Errorf("column count mismatch: expected %d, got %d",
+				len(colNames), len(valueRow))
 		}
+		record.Cols = append(record.Cols, colNames...)
 	} else {
-		// Use all table columns in order
-		record.Cols = tdef.Cols
-		record.Vals = make([]Value, len(valueRow))
-
-		for i, expr := range valueRow {
-			ctx := QLEvalContex{}
-			qlEval(&ctx, expr)
-			if ctx.err != nil {
-				return nil
-			}
-			record.Vals[i] = ctx.out
+		// Use the leading table columns in order
+		if len(valueRow) > len(tdef.Cols) {
+			return nil, fmt.Errorf("too many values: expected %d, got %d",
+				len(tdef.Cols), len(valueRow))
 		}
+		record.Cols = append(record.Cols, tdef.Cols[:len(valueRow)]...)
+	}
+	record.Vals = make([]Value, len(valueRow))
+
+	// Evaluate each value expression
+	for i, expr := range valueRow {
+		ctx := QLEvalContex{tx: tx}
+		qlEval(&ctx, expr)
+		if ctx.err != nil {
+			return nil, fmt.Errorf("value evaluation failed: %w", ctx.err)
+		}
+		record.Vals[i] = ctx.out
+	}
+	if err := rules.writable(record.Cols); err != nil {
+		return nil, err
+	}
+	if err := rules.fill(record, tdef); err != nil {
+		return nil, err
+	}
+	if err := qlAutoIncrement(record, tdef, tx); err != nil {
+		return nil, err
 	}
 
-	return record
+	// Validate record against table schema
+	qlCoerceRecord(record, tdef)
+	if err := rules.generate(record, tdef); err != nil {
+		return nil, err
+	}
+	if err := validateRecord(*record, tdef); err != nil {
+		return nil, fmt.Errorf("record validation failed: %w", err)
+	}
+	if err := rules.check(*record, tdef); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
 // buildPrimaryKey constructs primary key from record
@@ -0,0 +1,152 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// JSON operators and functions, as in SQLite:
+//
+//	doc->'key', doc->0, doc->'$.a[0]'   the JSON element, or NULL
+//	doc->>'key', ...                    the SQL value of the element
+//	json_extract(doc, '$.a[0]')         the same as ->>
+//	json_type(doc [, path])             'object', 'array', 'string', ...
+//	json_valid(text)                    whether the text is JSON
+//
+// The document is a JSON value, or bytes that are valid JSON.
+
+// qlJSONGet evaluates `doc->path` or `doc->>path`
+func qlJSONGet(doc Value, arg Value, text bool) Value {
+	if doc.Null || arg.Null {
+		return Value{Null: true}
+	}
+	path, err := qlJSONPath(arg)
+	if err != nil {
+		return Value{Type: TYPE_ERROR, Str: []byte(err.Error())}
+	}
+	return qlJSONExtract(doc, path, text)
+}
+
+func qlJSONExtract(doc Value, path database.JSONPath, text bool) Value {
+	if doc.Type != TYPE_JSON && doc.Type != TYPE_BYTES {
+		return Value{Type: TYPE_ERROR, Str: []byte("JSON operator requires JSON type")}
+	}
+	if doc.Type == TYPE_BYTES && !json.Valid(doc.Str) {
+		return Value{Type: TYPE_ERROR, Str: []byte("invalid JSON")}
+	}
+	elem, ok := database.JSONExtract(doc.Str, path)
+	switch {
+	case !ok:
+		return Value{Null: true}
+	case text:
+		return database.JSONValue(elem)
+	default:
+		return Value{Type: TYPE_JSON, Str: elem}
+	}
+}
+
+// the right operand of -> and ->>: an object key, an array index,
+// or a path from the element that starts with '$'
+func qlJSONPath(arg Value) (database.JSONPath, error) {
+	switch {
+	case arg.Type == TYPE_INT64 && arg.I64 >= 0:
+		return database.JSONPath{{Index: int(arg.I64), IsIndex: true}}, nil
+	case arg.Type == TYPE_BYTES && len(arg.Str) > 0 && arg.Str[0] == '$':
+		return database.ParseJSONPath(string(arg.Str))
+	case arg.Type == TYPE_BYTES:
+		return database.JSONPath{{Key: string(arg.Str)}}, nil
+	default:
+		return nil, fmt.Errorf("bad JSON path")
+	}
+}
+
+// qlJSONOutType returns the type of a JSON expression, which does not
+// depend on the document: `->` is an element and json_type() is a
+// string. The type of `->>` depends on the element.
+func qlJSONOutType(node QLNode) (uint32, bool) {
+	switch {
+	case node.Value.Type == QL_JSON_GET:
+		return TYPE_JSON, true
+	case node.Value.Type == QL_FUNC && string(node.Value.Str) == "json_type":
+		return TYPE_BYTES, true
+	default:
+		return 0, false
+	}
+}
+
+func qlJSONType(elem []byte) string {
+	switch elem[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+// qlIndexColumn returns the index column of `doc->...->>path` or
+// `json_extract(doc, path)`, where the paths are constants.
+// See database.JSONIndexColumn().
+func qlIndexColumn(node QLNode) (string, bool) {
+	var doc, arg QLNode
+	switch {
+	case node.Value.Type == QL_JSON_TEXT:
+		doc, arg = node.Kids[0], node.Kids[1]
+	case node.Value.Type == QL_FUNC && string(node.Value.Str) == "json_extract" && len(node.Kids) == 2:
+		doc, arg = node.Kids[0], node.Kids[1]
+		if arg.Value.Type != QL_STR || len(arg.Value.Str) == 0 || arg.Value.Str[0] != '$' {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	col, path, ok := qlJSONPathOf(doc)
+	if !ok {
+		return "", false
+	}
+	steps, ok := qlConstPath(arg)
+	if !ok {
+		return "", false
+	}
+	return database.JSONIndexColumn(col, append(path, steps...)), true
+}
+
+// the column and the path of `col->a->b...`
+func qlJSONPathOf(node QLNode) (string, database.JSONPath, bool) {
+	switch node.Value.Type {
+	case QL_SYM:
+		return string(node.Value.Str), database.JSONPath{}, true
+	case QL_JSON_GET:
+		col, path, ok := qlJSONPathOf(node.Kids[0])
+		if !ok {
+			return "", nil, false
+		}
+		steps, ok := qlConstPath(node.Kids[1])
+		return col, append(path, steps...), ok
+	default:
+		return "", nil, false
+	}
+}
+
+// a path operand that does not depend on the row
+func qlConstPath(node QLNode) (database.JSONPath, bool) {
+	if qlHasColumn(node) {
+		return nil, false
+	}
+	ctx := QLEvalContex{}
+	qlEval(&ctx, node)
+	if ctx.err != nil || ctx.out.Null {
+		return nil, false
+	}
+	path, err := qlJSONPath(ctx.out)
+	return path, err == nil
+}
@@ -0,0 +1,210 @@
+package executor
+
+import (
+	"fmt"
+	"math"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// A materialized view stores the rows of its query in a table, which
+// is read like any table. Its query selects from a table, with a
+// FILTER and the output expressions, but without INDEX BY and LIMIT,
+// so each row of the table maps to at most one view row. The view rows
+// are maintained by the transaction on each write of the table, with
+// the function of ViewRowFunc().
+//
+// The column types of the view are found by evaluating the outputs on
+// a row of sample values, so an expression has the type of the values
+// it computes. A JSON element is NULL in the sample document, its type
+// is that of the operator, see qlJSONOutType(). The view must select
+// the primary key of the table, which is also the primary key of the
+// view.
+
+// ExecuteCreateMatView executes a CREATE MATERIALIZED VIEW statement
+func ExecuteCreateMatView(req *QLCreateView, tx DBTX) error {
+	def, err := qlMatViewDef(req, tx)
+	if err == nil {
+		err = tx.CreateMatView(def)
+	}
+	if err != nil {
+		return fmt.Errorf("materialized view creation failed: %w", err)
+	}
+	return nil
+}
+
+// ExecuteRefreshMatView executes a REFRESH MATERIALIZED VIEW statement
+func ExecuteRefreshMatView(name string, tx DBTX) error {
+	if err := tx.RefreshMatView(name); err != nil {
+		return fmt.Errorf("materialized view refresh failed: %w", err)
+	}
+	return nil
+}
+
+// ExecuteDropMatView executes a DROP MATERIALIZED VIEW [IF EXISTS] statement
+func ExecuteDropMatView(name string, ifExists bool, tx DBTX) error {
+	if ifExists && tx.GetDB().GetTableDef(name) == nil {
+		return nil
+	}
+	if err := tx.DropMatView(name); err != nil {
+		return fmt.Errorf("materialized view drop failed: %w", err)
+	}
+	return nil
+}
+
+// ViewRowFunc returns the function that computes the row of a
+// materialized view from a row of its table, or nil if the row does
+// not pass the filter. It is used by the transactions, through the
+// transaction.ViewDB interface.
+func ViewRowFunc(view *TableDef) (func(Record) (*Record, error), error) {
+	mv := view.MatView
+	if mv == nil {
+		return nil, fmt.Errorf("%s is not a materialized view", view.Name)
+	}
+	sel, err := qlViewSelect(&View{Name: view.Name, Query: mv.Query, Cols: mv.Cols})
+	if err != nil {
+		return nil, err
+	}
+	return func(row Record) (*Record, error) {
+		if ok, err := qlFilter(sel.Filter, row); err != nil || !ok {
+			return nil, err
+		}
+		rec := &Record{}
+		for i, node := range sel.Output {
+			ctx := QLEvalContex{env: row}
+			qlEval(&ctx, node)
+			if ctx.err != nil {
+				return nil, fmt.Errorf("column %s: %w", mv.Cols[i], ctx.err)
+			}
+			rec.Cols = append(rec.Cols, mv.Cols[i])
+			rec.Vals = append(rec.Vals, ctx.out)
+		}
+		return rec, nil
+	}, nil
+}
+
+// the table definition of a new materialized view
+func qlMatViewDef(req *QLCreateView, tx DBTX) (*TableDef, error) {
+	cols, uses, err := qlViewColumns(req, tx)
+	if err != nil {
+		return nil, err
+	}
+	sel := req.Select
+	base := tx.GetDB().GetTableDef(sel.Table)
+	if base == nil {
+		return nil, fmt.Errorf("materialized view %s must select from a table", req.Name)
+	}
+	if sel.Key1.Value.Type != 0 {
+		return nil, fmt.Errorf("INDEX BY is not supported in materialized view %s", req.Name)
+	}
+	if sel.Offset != 0 || sel.Limit != math.MaxInt64 {
+		return nil, fmt.Errorf("LIMIT is not supported in materialized view %s", req.Name)
+	}
+
+	// the primary key columns come first
+	order := []int{}
+	for _, pk := range base.Cols[:base.PKeys] {
+		found := -1
+		for i, node := range sel.Output {
+			if node.Value.Type == QL_SYM && string(node.Value.Str) == pk {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, fmt.Errorf("materialized view %s must select the primary key column %s of %s",
+				req.Name, pk, base.Name)
+		}
+		order = append(order, found)
+	}
+	for i := range sel.Output {
+		if !qlContainsInt(order, i) {
+			order = append(order, i)
+		}
+	}
+
+	def := &TableDef{
+		Name:  req.Name,
+		PKeys: base.PKeys,
+		MatView: &database.MatView{
+			Query: req.Query,
+			Table: base.Name,
+			Cols:  cols,
+			Uses:  uses,
+			Keys:  append([]string(nil), base.Cols[:base.PKeys]...),
+		},
+	}
+	sample := qlSampleRow(base)
+	for _, i := range order {
+		node := sel.Output[i]
+		ctx := QLEvalContex{env: sample}
+		qlEval(&ctx, node)
+		if ctx.err != nil {
+			return nil, fmt.Errorf("column %s: %w", cols[i], ctx.err)
+		}
+		if ctx.out.Null {
+			// a JSON path that is not in the sample document
+			typ, ok := qlJSONOutType(node)
+			if !ok {
+				return nil, fmt.Errorf("the type of column %s is unknown", cols[i])
+			}
+			ctx.out = Value{Type: typ}
+		}
+		def.Cols = append(def.Cols, cols[i])
+		def.Types = append(def.Types, ctx.out.Type)
+		if ctx.out.Type != TYPE_DECIMAL {
+			continue
+		}
+		if def.Decimals == nil {
+			def.Decimals = map[string]database.DecimalType{}
+		}
+		dt := database.DecimalType{Precision: database.DECIMAL_MAX_PRECISION, Scale: ctx.out.Dec.Scale}
+		if node.Value.Type == QL_SYM {
+			dt = base.Decimals[string(node.Value.Str)]
+		}
+		def.Decimals[cols[i]] = dt
+	}
+	return def, nil
+}
+
+// a row of non-NULL values of the column types, the decimals have the
+// scale of their columns
+func qlSampleRow(tdef *TableDef) Record {
+	rec := Record{}
+	for i, c := range tdef.Cols {
+		v := Value{Type: tdef.Types[i]}
+		switch v.Type {
+		case TYPE_BYTES:
+			v.Str = []byte{}
+		case TYPE_INT64, TYPE_BOOL:
+			v.I64 = 1
+		case TYPE_FLOAT64:
+			v.F64 = 1
+		case TYPE_DECIMAL:
+			v.Dec = database.DecimalFromInt64(1).Round(tdef.Decimals[c].Scale)
+		case TYPE_JSON:
+			v.Str = []byte("{}")
+		}
+		rec.Cols = append(rec.Cols, c)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec
+}
+
+func qlContainsInt(list []int, n int) bool {
+	for _, m := range list {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+func qlContainsStr(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
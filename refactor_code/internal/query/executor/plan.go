@@ -0,0 +1,276 @@
+package executor
+
+import (
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/query"
+)
+
+// Index selection for scans without INDEX BY.
+// The FILTER is split into AND-ed conjuncts. The comparisons between a
+// column and a constant are candidate bounds; the primary key or the
+// index that converts the most of them into a range is scanned, and
+// the other conjuncts are evaluated on each row as the residual filter.
+//
+// A JSON path such as `doc->>'kind'` is a column of the expression
+// indexes over it. The index orders the values as JSON, which differs
+// from the SQL comparisons between types, so its conjuncts only narrow
+// the range and are kept in the residual filter.
+
+// a comparison between a column and a constant, `col cmp val`
+type qlBound struct {
+	col  string
+	cmp  int // CMP_??
+	val  Value
+	cond int  // the conjunct
+	keep bool // still evaluated on the rows
+}
+
+// a scan range over the primary key or an index
+type qlScanPlan struct {
+	index      string // empty for the primary key
+	key1, key2 Record
+	cmp1, cmp2 int
+	used       map[int]bool // the conjuncts converted to the range
+	score      int
+}
+
+// qlPlanScan sets up the scanner from the filter and returns
+// the residual filter.
+func qlPlanScan(filter QLNode, tdef *TableDef, sc *Scanner) QLNode {
+	conds := qlSplitAnd(filter, nil)
+	bounds := []qlBound{}
+	keep := map[int]bool{}
+	for i, node := range conds {
+		if b, ok := qlEvalBound(tdef, node); ok {
+			b.cond = i
+			bounds = append(bounds, b)
+			keep[i] = b.keep
+		}
+	}
+
+	// the primary key wins the ties, it does not fetch the rows by another lookup
+	best := qlPlanIndex("", tdef.Cols[:tdef.PKeys], bounds)
+	for i, index := range tdef.Indexes {
+		if best.score == 2*tdef.PKeys || qlIsBuilding(tdef, tdef.IndexNames[i]) {
+			// no index beats a point query on the primary key
+			continue
+		}
+		plan := qlPlanIndex(tdef.IndexNames[i], index, bounds)
+		if plan.score > best.score {
+			best = plan
+		}
+	}
+
+	sc.Index = best.index
+	sc.Key1, sc.Key2 = best.key1, best.key2
+	sc.Cmp1, sc.Cmp2 = best.cmp1, best.cmp2
+	residual := []QLNode{}
+	for i, node := range conds {
+		if !best.used[i] || keep[i] {
+			residual = append(residual, node)
+		}
+	}
+	return qlJoinAnd(residual)
+}
+
+// the range from the longest equality prefix of the index columns,
+// followed by the bounds of the next column
+func qlPlanIndex(name string, cols []string, bounds []qlBound) qlScanPlan {
+	plan := qlScanPlan{index: name, cmp1: CMP_GE, cmp2: CMP_LE, used: map[int]bool{}}
+	prefix := Record{}
+	for _, col := range cols {
+		eq := qlFindBound(bounds, col, CMP_EQ)
+		if eq == nil {
+			break
+		}
+		prefix.Cols = append(prefix.Cols, col)
+		prefix.Vals = append(prefix.Vals, eq.val)
+		plan.used[eq.cond] = true
+		plan.score += 2
+	}
+	plan.key1 = qlCopyKey(prefix)
+	plan.key2 = qlCopyKey(prefix)
+	if len(prefix.Cols) == len(cols) {
+		return plan
+	}
+
+	col := cols[len(prefix.Cols)]
+	lo := qlFindBound(bounds, col, CMP_GT, CMP_GE)
+	hi := qlFindBound(bounds, col, CMP_LT, CMP_LE)
+	if lo == nil && hi != nil {
+		// NULLs sort first, skip them with `col > NULL`
+		lo = &qlBound{col: col, cmp: CMP_GT, val: Value{Type: hi.val.Type, Null: true}, cond: -1}
+	}
+	if lo != nil {
+		plan.key1.Cols = append(plan.key1.Cols, col)
+		plan.key1.Vals = append(plan.key1.Vals, lo.val)
+		plan.cmp1 = lo.cmp
+		plan.used[lo.cond] = true
+		plan.score++
+	}
+	if hi != nil {
+		plan.key2.Cols = append(plan.key2.Cols, col)
+		plan.key2.Vals = append(plan.key2.Vals, hi.val)
+		plan.cmp2 = hi.cmp
+		plan.used[hi.cond] = true
+		plan.score++
+	}
+	return plan
+}
+
+// the first bound of a column with one of the comparisons
+func qlFindBound(bounds []qlBound, col string, cmps ...int) *qlBound {
+	for i := range bounds {
+		if bounds[i].col != col {
+			continue
+		}
+		for _, cmp := range cmps {
+			if bounds[i].cmp == cmp {
+				return &bounds[i]
+			}
+		}
+	}
+	return nil
+}
+
+// qlEvalBound converts `col op expr` or `expr op col` into a bound,
+// if the expression is a constant of the column type.
+// `col IS NULL` is the bound `col = NULL`.
+func qlEvalBound(tdef *TableDef, node QLNode) (qlBound, bool) {
+	if node.Value.Type == QL_IS_NULL {
+		name, typ, path := qlBoundColumn(tdef, node.Kids[0])
+		if typ == TYPE_ERROR {
+			return qlBound{}, false
+		}
+		return qlBound{col: name, cmp: CMP_EQ, val: Value{Type: typ, Null: true}, keep: path}, true
+	}
+
+	cmp := 0
+	switch node.Value.Type {
+	case QL_CMP_GE:
+		cmp = CMP_GE
+	case QL_CMP_GT:
+		cmp = CMP_GT
+	case QL_CMP_LT:
+		cmp = CMP_LT
+	case QL_CMP_LE:
+		cmp = CMP_LE
+	case QL_CMP_EQ:
+		cmp = CMP_EQ
+	default:
+		return qlBound{}, false
+	}
+
+	col, expr := node.Kids[0], node.Kids[1]
+	if qlHasColumn(expr) {
+		// the constant is on the left
+		col, expr = expr, col
+		cmp = qlFlipCmp(cmp)
+	}
+	name, typ, path := qlBoundColumn(tdef, col)
+	if typ == TYPE_ERROR || qlHasColumn(expr) {
+		return qlBound{}, false
+	}
+
+	ctx := QLEvalContex{}
+	qlEval(&ctx, expr)
+	if path && ctx.err == nil {
+		ctx.out, ctx.err = database.JSONFromValue(ctx.out)
+	}
+	ctx.out = qlCoerce(ctx.out, typ)
+	if ctx.err != nil || ctx.out.Null || ctx.out.Type != typ {
+		return qlBound{}, false // comparing with NULL is never true
+	}
+	return qlBound{col: name, cmp: cmp, val: ctx.out, keep: path}, true
+}
+
+// the index column of a bound: a column, or a JSON path of a column.
+// The type is TYPE_ERROR for other expressions.
+func qlBoundColumn(tdef *TableDef, node QLNode) (string, uint32, bool) {
+	if node.Value.Type == QL_SYM {
+		name := string(node.Value.Str)
+		if c := qlColIndex(tdef, name); c >= 0 {
+			return name, tdef.Types[c], false
+		}
+		return "", TYPE_ERROR, false
+	}
+	if name, ok := qlIndexColumn(node); ok {
+		return name, database.IndexColType(tdef, name), true
+	}
+	return "", TYPE_ERROR, false
+}
+
+// `a < b` is `b > a`
+func qlFlipCmp(cmp int) int {
+	switch cmp {
+	case CMP_GE:
+		return CMP_LE
+	case CMP_GT:
+		return CMP_LT
+	case CMP_LT:
+		return CMP_GT
+	case CMP_LE:
+		return CMP_GE
+	default:
+		return cmp
+	}
+}
+
+// whether the expression refers to a column
+func qlHasColumn(node QLNode) bool {
+	if node.Value.Type == QL_SYM {
+		return true
+	}
+	for _, kid := range node.Kids {
+		if qlHasColumn(kid) {
+			return true
+		}
+	}
+	return false
+}
+
+// split `a AND b AND ...` into the conjuncts
+func qlSplitAnd(node QLNode, out []QLNode) []QLNode {
+	if node.Value.Type == QL_CMP_AND {
+		out = qlSplitAnd(node.Kids[0], out)
+		return qlSplitAnd(node.Kids[1], out)
+	}
+	return append(out, node)
+}
+
+// the reverse of qlSplitAnd(), an empty node for no conjuncts
+func qlJoinAnd(conds []QLNode) QLNode {
+	if len(conds) == 0 {
+		return QLNode{}
+	}
+	out := conds[0]
+	for _, node := range conds[1:] {
+		out = QLNode{Value: query.Value{Type: QL_CMP_AND}, Kids: []QLNode{out, node}}
+	}
+	return out
+}
+
+func qlIsBuilding(tdef *TableDef, name string) bool {
+	for _, building := range tdef.Building {
+		if building == name {
+			return true
+		}
+	}
+	return false
+}
+
+func qlColIndex(tdef *TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+func qlCopyKey(key Record) Record {
+	return Record{
+		Cols: append([]string{}, key.Cols...),
+		Vals: append([]Value{}, key.Vals...),
+	}
+}
@@ -1,7 +1,12 @@
 package executor
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/query"
+	"math"
 )
 
 // ExecuteSelect executes a SELECT statement
@@ -22,7 +27,7 @@ func ExecuteSelect(req *QLSelect, tx DBTX) ([]Record, error) {
 
 		// Evaluate each output expression
 		for _, node := range req.Output {
-			ctx := QLEvalContex{env: irec}
+			ctx := QLEvalContex{env: irec, tx: tx}
 			qlEval(&ctx, node)
 			if ctx.err != nil {
 				return nil, fmt.Errorf("expression evaluation failed: %w", ctx.err)
@@ -39,17 +44,30 @@ func ExecuteSelect(req *QLSelect, tx DBTX) ([]Record, error) {
 // qlScan executes a table scan with conditions
 func qlScan(req *QLScan, tx DBTX, out []Record) ([]Record, error) {
 	sc := Scanner{}
-	err := qlScanInit(req, &sc)
-	if err != nil {
+	filter := req.Filter
+	tdef := tx.GetDB().GetTableDef(req.Table)
+	if tdef == nil {
+		view, err := tx.GetView(req.Table)
+		if err != nil {
+			return nil, err
+		}
+		if view != nil {
+			return qlViewScan(req, view, tx, out)
+		}
+	}
+	if req.Key1.Value.Type == 0 && filter.Value.Type != 0 && tdef != nil {
+		// No INDEX BY clause; select an index from the filter
+		filter = qlPlanScan(filter, tdef, &sc)
+	} else if err := qlScanInit(req, &sc); err != nil {
 		return nil, fmt.Errorf("scan initialization failed: %w", err)
 	}
 
-	err = tx.Scan(req.Table, &sc)
+	err := tx.Scan(req.Table, &sc)
 	if err != nil {
 		return nil, fmt.Errorf("table scan failed: %w", err)
 	}
 
-	return qlScanRun(req, &sc, out)
+	return qlScanRun(req, filter, &sc, out)
 }
 
 // qlScanInit initializes the scanner with scan conditions
@@ -78,64 +96,113 @@ func qlScanInit(req *QLScan, sc *Scanner) error {
 		return fmt.Errorf("bad INDEX BY: cannot use equality with range")
 	}
 
-	if req.Key1.Value.Type == QL_CMP_EQ {
+	switch {
+	case req.Key1.Value.Type == QL_CMP_EQ:
 		sc.Key2 = sc.Key1
 		sc.Cmp1, sc.Cmp2 = CMP_GE, CMP_LE
+	case req.Key2.Value.Type == 0:
+		// open-ended, until the end of the index
+		sc.Key2 = Record{}
+		if sc.Cmp1 == CMP_GE || sc.Cmp1 == CMP_GT {
+			sc.Cmp2 = CMP_LE
+		} else {
+			sc.Cmp2 = CMP_GE
+		}
 	}
 
 	return nil
 }
 
-// qlEvalScanKey evaluates scan key expressions
+// qlEvalScanKey evaluates a comparison of INDEX BY,
+// either `col op expr` or `(col1, col2) op (expr1, expr2)`.
 func qlEvalScanKey(node QLNode) (Record, int, error) {
-	if node.Value.Type == QL_UNINIT {
-		return Record{}, 0, nil
+	cmp := 0
+	switch node.Value.Type {
+	case QL_CMP_GE:
+		cmp = CMP_GE
+	case QL_CMP_GT:
+		cmp = CMP_GT
+	case QL_CMP_LT:
+		cmp = CMP_LT
+	case QL_CMP_LE:
+		cmp = CMP_LE
+	case QL_CMP_EQ:
+		cmp = CMP_EQ
+	default:
+		return Record{}, 0, fmt.Errorf("bad INDEX BY: expect a comparison")
 	}
 
-	// For now, simplified implementation
-	// In a full implementation, this would evaluate complex expressions
-	key, cmp, err := qlEvalScanKey(node.Kids[0])
-	if err != nil {
-		return Record{}, 0, err
+	names, exprs := node.Kids[0], node.Kids[1]
+	if names.Value.Type == QL_TUP {
+		if exprs.Value.Type != QL_TUP || len(exprs.Kids) != len(names.Kids) {
+			return Record{}, 0, fmt.Errorf("bad INDEX BY: tuple size mismatch")
+		}
+	} else {
+		names = QLNode{Value: query.Value{Type: QL_TUP}, Kids: []QLNode{names}}
+		exprs = QLNode{Value: query.Value{Type: QL_TUP}, Kids: []QLNode{exprs}}
 	}
 
+	key := Record{}
+	for i, name := range names.Kids {
+		if name.Value.Type != QL_SYM {
+			return Record{}, 0, fmt.Errorf("bad INDEX BY: expect a column")
+		}
+		// the key is a constant, evaluated without a row
+		ctx := QLEvalContex{}
+		qlEval(&ctx, exprs.Kids[i])
+		if ctx.err != nil {
+			return Record{}, 0, ctx.err
+		}
+		key.Cols = append(key.Cols, string(name.Value.Str))
+		key.Vals = append(key.Vals, ctx.out)
+	}
 	return key, cmp, nil
 }
 
-// qlScanRun processes scan results with filters and limits
-func qlScanRun(req *QLScan, sc *Scanner, out []Record) ([]Record, error) {
-	for i := int64(0); sc.Valid(); i++ {
-		// Apply LIMIT constraints
-		ok := req.Offset <= i && i < req.Limit
-
+// qlScanRun processes scan results with filters and limits.
+// `filter` is the part of the FILTER that is not covered by the scan range.
+func qlScanRun(req *QLScan, filter QLNode, sc *Scanner, out []Record) ([]Record, error) {
+	// i counts the rows that pass the filter
+	for i := int64(0); sc.Valid() && i < req.Limit; sc.Next() {
 		var rec Record
-		if ok {
-			sc.Deref(&rec)
+		sc.Deref(&rec)
+		if err := sc.Err(); err != nil {
+			return nil, err
 		}
 
 		// Apply FILTER conditions
-		if ok && req.Filter.Value.Type != 0 {
-			ctx := QLEvalContex{env: rec}
-			qlEval(&ctx, req.Filter)
-			if ctx.err != nil {
-				return nil, fmt.Errorf("filter evaluation failed: %w", ctx.err)
-			}
-			if ctx.out.Type != TYPE_INT64 {
-				return nil, fmt.Errorf("filter must be boolean type")
-			}
-			ok = (ctx.out.I64 != 0)
+		if ok, err := qlFilter(filter, rec); err != nil {
+			return nil, err
+		} else if !ok {
+			continue // false or unknown
 		}
 
-		if ok {
+		// Apply LIMIT constraints
+		if req.Offset <= i {
 			out = append(out, rec)
 		}
-
-		sc.Next()
+		i++
 	}
 
 	return out, nil
 }
 
+// qlFilter evaluates a FILTER on a row, an empty FILTER passes all rows
+func qlFilter(filter QLNode, rec Record) (bool, error) {
+	if filter.Value.Type == 0 {
+		return true, nil
+	}
+	ctx := QLEvalContex{env: rec}
+	qlEval(&ctx, filter)
+	if ctx.err != nil {
+		return false, fmt.Errorf("filter evaluation failed: %w", ctx.err)
+	}
+	if !ctx.out.Null && !qlIsBool(ctx.out) {
+		return false, fmt.Errorf("filter must be boolean type")
+	}
+	return !ctx.out.Null && ctx.out.I64 != 0, nil
+}
+
 // qlEval evaluates expressions recursively
 func qlEval(ctx *QLEvalContex, node QLNode) {
 	if ctx.err != nil {
@@ -156,6 +223,21 @@ func qlEval(ctx *QLEvalContex, node QLNode) {
 		ctx.out = Value{Type: TYPE_INT64, I64: node.Value.I64}
 	case QL_STR:
 		ctx.out = Value{Type: TYPE_BYTES, Str: node.Value.Str}
+	case QL_F64:
+		ctx.out = Value{Type: TYPE_FLOAT64, F64: node.Value.F64}
+	case QL_BOOL:
+		ctx.out = Value{Type: TYPE_BOOL, I64: node.Value.I64}
+	case QL_TIMESTAMP:
+		ctx.out = Value{Type: TYPE_TIMESTAMP, I64: node.Value.I64}
+	case QL_DECIMAL:
+		dec, err := database.ParseDecimal(string(node.Value.Str))
+		if err != nil {
+			ctx.err = err
+			return
+		}
+		ctx.out = Value{Type: TYPE_DECIMAL, Dec: dec}
+	case QL_NULL:
+		ctx.out = Value{Null: true}
 
 	// Unary operations
 	case QL_NEG:
@@ -163,30 +245,99 @@ func qlEval(ctx *QLEvalContex, node QLNode) {
 		if ctx.err != nil {
 			return
 		}
-		if ctx.out.Type == TYPE_INT64 {
+		if ctx.out.Null {
+			return // NULL
+		}
+		switch ctx.out.Type {
+		case TYPE_INT64:
 			ctx.out.I64 = -ctx.out.I64
+		case TYPE_FLOAT64:
+			ctx.out.F64 = -ctx.out.F64
+		case TYPE_DECIMAL:
+			ctx.out.Dec = ctx.out.Dec.Neg()
+		default:
+			qlErr(ctx, "negation requires numeric type")
+		}
+
+	case QL_NOT:
+		qlEval(ctx, node.Kids[0])
+		if ctx.err != nil {
+			return
+		}
+		if ctx.out.Null {
+			ctx.out = qlNullBool()
+		} else if qlIsBool(ctx.out) {
+			ctx.out = qlBool(ctx.out.I64 == 0)
 		} else {
-			qlErr(ctx, "negation requires integer type")
+			qlErr(ctx, "NOT requires boolean type")
 		}
 
+	case QL_IS_NULL, QL_IS_NOT_NULL:
+		qlEval(ctx, node.Kids[0])
+		if ctx.err != nil {
+			return
+		}
+		isNull := ctx.out.Null
+		ctx.out = qlBool(isNull == (node.Value.Type == QL_IS_NULL))
+
 	// Binary operations
-	case QL_CMP_EQ:
+	case QL_CMP_EQ, QL_CMP_NE, QL_CMP_LT, QL_CMP_LE, QL_CMP_GT, QL_CMP_GE:
 		qlEvalBinaryOp(ctx, node, func(a, b Value) Value {
-			if a.Type != b.Type {
+			if a.Null || b.Null {
+				return qlNullBool() // unknown
+			}
+			r, ok := qlCompare(a, b)
+			if !ok {
 				return Value{Type: TYPE_ERROR, Str: []byte("type mismatch")}
 			}
-			var result int64
-			if a.Type == TYPE_INT64 {
-				if a.I64 == b.I64 {
-					result = 1
-				}
-			} else if a.Type == TYPE_BYTES {
-				if string(a.Str) == string(b.Str) {
-					result = 1
+			var result bool
+			switch node.Value.Type {
+			case QL_CMP_EQ:
+				result = r == 0
+			case QL_CMP_NE:
+				result = r != 0
+			case QL_CMP_LT:
+				result = r < 0
+			case QL_CMP_LE:
+				result = r <= 0
+			case QL_CMP_GT:
+				result = r > 0
+			case QL_CMP_GE:
+				result = r >= 0
+			}
+			return qlBool(result)
+		})
+	case QL_CMP_AND, QL_CMP_OR:
+		// three-valued logic: a NULL operand is unknown, which decides
+		// the result unless the other operand does
+		qlEvalBinaryOp(ctx, node, func(a, b Value) Value {
+			for _, v := range []Value{a, b} {
+				if !v.Null && !qlIsBool(v) {
+					return Value{Type: TYPE_ERROR, Str: []byte("AND/OR requires boolean type")}
 				}
 			}
-			return Value{Type: TYPE_INT64, I64: result}
+			// the value that decides the result, false for AND, true for OR
+			decisive := node.Value.Type == QL_CMP_OR
+			switch {
+			case !a.Null && (a.I64 != 0) == decisive, !b.Null && (b.I64 != 0) == decisive:
+				return qlBool(decisive)
+			case a.Null || b.Null:
+				return qlNullBool()
+			default:
+				return qlBool(!decisive)
+			}
+		})
+	case QL_CMP_ADD, QL_CMP_SUB, QL_CMP_MUL, QL_CMP_DIV, QL_CMP_MOD:
+		qlEvalBinaryOp(ctx, node, func(a, b Value) Value {
+			return qlArith(node.Value.Type, a, b)
 		})
+	case QL_JSON_GET, QL_JSON_TEXT:
+		qlEvalBinaryOp(ctx, node, func(a, b Value) Value {
+			return qlJSONGet(a, b, node.Value.Type == QL_JSON_TEXT)
+		})
+
+	case QL_FUNC:
+		qlEvalFunc(ctx, node)
 
 	default:
 		qlErr(ctx, "unsupported expression type: %d", node.Value.Type)
@@ -201,7 +352,7 @@ func qlEvalBinaryOp(ctx *QLEvalContex, node QLNode, op func(Value, Value) Value)
 	}
 
 	// Evaluate left operand
-	leftCtx := QLEvalContex{env: ctx.env}
+	leftCtx := QLEvalContex{env: ctx.env, tx: ctx.tx}
 	qlEval(&leftCtx, node.Kids[0])
 	if leftCtx.err != nil {
 		ctx.err = leftCtx.err
@@ -209,7 +360,7 @@ func qlEvalBinaryOp(ctx *QLEvalContex, node QLNode, op func(Value, Value) Value)
 	}
 
 	// Evaluate right operand
-	rightCtx := QLEvalContex{env: ctx.env}
+	rightCtx := QLEvalContex{env: ctx.env, tx: ctx.tx}
 	qlEval(&rightCtx, node.Kids[1])
 	if rightCtx.err != nil {
 		ctx.err = rightCtx.err
@@ -218,11 +369,172 @@ func qlEvalBinaryOp(ctx *QLEvalContex, node QLNode, op func(Value, Value) Value)
 
 	// Apply operation
 	ctx.out = op(leftCtx.out, rightCtx.out)
-	if ctx.out.Type == TYPE_ERROR {
+	if ctx.out.Type == TYPE_ERROR && !ctx.out.Null {
 		qlErr(ctx, string(ctx.out.Str))
 	}
 }
 
+// qlArith evaluates + - * / %.
+// A decimal with a decimal or an int64 is exact, see database.Decimal
+// for the scale of the result. An int64 or a decimal is converted to
+// float64 with a float64 operand.
+// A timestamp plus or minus an int64 is moved by that many microseconds,
+// and the difference of two timestamps is in microseconds.
+func qlArith(op uint32, a, b Value) Value {
+	if a.Null || b.Null {
+		return Value{Null: true}
+	}
+	errValue := func(msg string) Value {
+		return Value{Type: TYPE_ERROR, Str: []byte(msg)}
+	}
+
+	switch {
+	case a.Type == TYPE_INT64 && b.Type == TYPE_INT64:
+		if (op == QL_CMP_DIV || op == QL_CMP_MOD) && b.I64 == 0 {
+			return errValue("division by zero")
+		}
+		r := Value{Type: TYPE_INT64}
+		switch op {
+		case QL_CMP_ADD:
+			r.I64 = a.I64 + b.I64
+		case QL_CMP_SUB:
+			r.I64 = a.I64 - b.I64
+		case QL_CMP_MUL:
+			r.I64 = a.I64 * b.I64
+		case QL_CMP_DIV:
+			r.I64 = a.I64 / b.I64
+		case QL_CMP_MOD:
+			r.I64 = a.I64 % b.I64
+		}
+		return r
+	case qlIsExact(a) && qlIsExact(b):
+		x, y := qlDecimal(a), qlDecimal(b)
+		if (op == QL_CMP_DIV || op == QL_CMP_MOD) && y.Sign() == 0 {
+			return errValue("division by zero")
+		}
+		r := Value{Type: TYPE_DECIMAL}
+		switch op {
+		case QL_CMP_ADD:
+			r.Dec = x.Add(y)
+		case QL_CMP_SUB:
+			r.Dec = x.Sub(y)
+		case QL_CMP_MUL:
+			r.Dec = x.Mul(y)
+		case QL_CMP_DIV:
+			r.Dec = x.Div(y)
+		case QL_CMP_MOD:
+			r.Dec = x.Mod(y)
+		}
+		return r
+	case qlIsNumber(a) && qlIsNumber(b):
+		x, y := qlFloat(a), qlFloat(b)
+		if (op == QL_CMP_DIV || op == QL_CMP_MOD) && y == 0 {
+			return errValue("division by zero")
+		}
+		r := Value{Type: TYPE_FLOAT64}
+		switch op {
+		case QL_CMP_ADD:
+			r.F64 = x + y
+		case QL_CMP_SUB:
+			r.F64 = x - y
+		case QL_CMP_MUL:
+			r.F64 = x * y
+		case QL_CMP_DIV:
+			r.F64 = x / y
+		case QL_CMP_MOD:
+			r.F64 = math.Mod(x, y)
+		}
+		return r
+	case a.Type == TYPE_TIMESTAMP && b.Type == TYPE_INT64 && (op == QL_CMP_ADD || op == QL_CMP_SUB):
+		if op == QL_CMP_SUB {
+			b.I64 = -b.I64
+		}
+		return Value{Type: TYPE_TIMESTAMP, I64: a.I64 + b.I64}
+	case a.Type == TYPE_INT64 && b.Type == TYPE_TIMESTAMP && op == QL_CMP_ADD:
+		return Value{Type: TYPE_TIMESTAMP, I64: a.I64 + b.I64}
+	case a.Type == TYPE_TIMESTAMP && b.Type == TYPE_TIMESTAMP && op == QL_CMP_SUB:
+		return Value{Type: TYPE_INT64, I64: a.I64 - b.I64}
+	default:
+		return errValue("type mismatch")
+	}
+}
+
+// qlCompare compares two values of the same type, or two numbers.
+// It returns false if they cannot be compared.
+func qlCompare(a, b Value) (int, bool) {
+	if a.Type != b.Type {
+		switch {
+		case qlIsExact(a) && qlIsExact(b):
+			a = Value{Type: TYPE_DECIMAL, Dec: qlDecimal(a)}
+			b = Value{Type: TYPE_DECIMAL, Dec: qlDecimal(b)}
+		case qlIsNumber(a) && qlIsNumber(b):
+			a = Value{Type: TYPE_FLOAT64, F64: qlFloat(a)}
+			b = Value{Type: TYPE_FLOAT64, F64: qlFloat(b)}
+		default:
+			return 0, false
+		}
+	}
+	switch a.Type {
+	case TYPE_INT64, TYPE_BOOL, TYPE_TIMESTAMP:
+		return cmp.Compare(a.I64, b.I64), true
+	case TYPE_FLOAT64:
+		return cmp.Compare(a.F64, b.F64), true
+	case TYPE_DECIMAL:
+		return a.Dec.Cmp(b.Dec), true
+	case TYPE_JSON:
+		return database.CompareJSON(a.Str, b.Str), true
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str), true
+	default:
+		return 0, false
+	}
+}
+
+func qlIsNumber(v Value) bool {
+	return v.Type == TYPE_INT64 || v.Type == TYPE_FLOAT64 || v.Type == TYPE_DECIMAL
+}
+
+// the numbers without rounding errors
+func qlIsExact(v Value) bool {
+	return v.Type == TYPE_INT64 || v.Type == TYPE_DECIMAL
+}
+
+func qlFloat(v Value) float64 {
+	switch v.Type {
+	case TYPE_INT64:
+		return float64(v.I64)
+	case TYPE_DECIMAL:
+		return v.Dec.Float64()
+	default:
+		return v.F64
+	}
+}
+
+func qlDecimal(v Value) database.Decimal {
+	if v.Type == TYPE_INT64 {
+		return database.DecimalFromInt64(v.I64)
+	}
+	return v.Dec
+}
+
+// the boolean types; an int64 is true if it is not 0
+func qlIsBool(v Value) bool {
+	return v.Type == TYPE_BOOL || v.Type == TYPE_INT64
+}
+
+func qlBool(b bool) Value {
+	v := Value{Type: TYPE_BOOL}
+	if b {
+		v.I64 = 1
+	}
+	return v
+}
+
+// the unknown boolean
+func qlNullBool() Value {
+	return Value{Type: TYPE_BOOL, Null: true}
+}
+
 // qlErr sets an error in the evaluation context
 func qlErr(ctx *QLEvalContex, format string, args ...interface{}) {
 	ctx.err = fmt.Errorf(format, args...)
@@ -0,0 +1,54 @@
+package executor
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// ExecuteCreateSequence executes a CREATE SEQUENCE statement
+func ExecuteCreateSequence(req *QLCreateSequence, tx DBTX) error {
+	seq := &Sequence{
+		Name:      req.Name,
+		Start:     req.Start,
+		Increment: req.Increment,
+		Cache:     req.Cache,
+	}
+	if seq.Cache == 0 {
+		seq.Cache = database.SEQ_CACHE_DEFAULT
+	}
+	if err := tx.CreateSequence(seq); err != nil {
+		return fmt.Errorf("sequence creation failed: %w", err)
+	}
+	return nil
+}
+
+// ExecuteDropSequence executes a DROP SEQUENCE statement
+func ExecuteDropSequence(name string, tx DBTX) error {
+	if err := tx.DropSequence(name); err != nil {
+		return fmt.Errorf("sequence drop failed: %w", err)
+	}
+	return nil
+}
+
+// qlAutoIncrement assigns the AUTO_INCREMENT primary key of a new row,
+// if it is NULL or omitted, so that the modes of INSERT can use the key
+func qlAutoIncrement(record *Record, tdef *TableDef, tx DBTX) error {
+	if tdef.AutoIncrement == "" {
+		return nil
+	}
+	v := record.Get(tdef.Cols[0])
+	if v != nil && !v.Null {
+		return nil
+	}
+	id, err := tx.NextVal(tdef.AutoIncrement)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		record.AddInt64(tdef.Cols[0], id)
+	} else {
+		*v = Value{Type: TYPE_INT64, I64: id}
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+
+	"govetachun/go-mini-db/refactor_code/internal/query"
+	"govetachun/go-mini-db/refactor_code/internal/query/parser"
+)
+
+// Triggers run a statement for each row written by INSERT, UPDATE and
+// DELETE, in the same transaction, in the order of the trigger names.
+// The statement refers to the new row as NEW.col and to the old row as
+// OLD.col, whose values are put in a copy of the parsed statement as
+// literals. The statements are parsed once for each written table.
+// A BEFORE trigger can change the new row with `SET NEW.col = expr`,
+// except its generated columns, which are computed again. A trigger can
+// stop the write with an error, then the row and the writes of the
+// triggers are undone. The statements of the triggers can fire other
+// triggers, up to TRIGGER_MAX_DEPTH levels.
+
+// the maximum nesting of the triggers
+const TRIGGER_MAX_DEPTH = 16
+
+// ExecuteCreateTrigger executes a CREATE TRIGGER statement
+func ExecuteCreateTrigger(req *QLCreateTrigger, tx DBTX) error {
+	tdef := tx.GetDB().GetTableDef(req.Table)
+	if tdef == nil {
+		return fmt.Errorf("trigger creation failed: table %s does not exist", req.Table)
+	}
+	if err := qlCheckTrigger(req, tdef); err != nil {
+		return fmt.Errorf("trigger creation failed: %w", err)
+	}
+	trig := &Trigger{Name: req.Name, Table: req.Table, Timing: req.Timing, Event: req.Event, Body: req.Body}
+	if err := tx.CreateTrigger(trig); err != nil {
+		return fmt.Errorf("trigger creation failed: %w", err)
+	}
+	return nil
+}
+
+// ExecuteDropTrigger executes a DROP TRIGGER [IF EXISTS] statement
+func ExecuteDropTrigger(name string, ifExists bool, tx DBTX) error {
+	if ifExists {
+		trig, err := tx.GetTrigger(name)
+		if err != nil || trig == nil {
+			return err
+		}
+	}
+	if err := tx.DropTrigger(name); err != nil {
+		return fmt.Errorf("trigger drop failed: %w", err)
+	}
+	return nil
+}
+
+// check the statement of a new trigger against its table
+func qlCheckTrigger(req *QLCreateTrigger, tdef *TableDef) error {
+	set, isSet := req.Stmt.(*QLSetNew)
+	if isSet {
+		if req.Timing != "BEFORE" || req.Event == "DELETE" {
+			return fmt.Errorf("SET NEW is only allowed in BEFORE INSERT and BEFORE UPDATE triggers")
+		}
+		for _, col := range set.Names {
+			if qlColIndex(tdef, col) < 0 {
+				return fmt.Errorf("unknown column NEW.%s", col)
+			}
+			if _, ok := tdef.Generated[col]; ok {
+				return fmt.Errorf("cannot write generated column NEW.%s", col)
+			}
+		}
+	}
+	nodes, err := qlStmtExprs(req.Stmt)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		for _, col := range qlColumns(*node, nil) {
+			row, name, ok := strings.Cut(col, ".")
+			if !ok {
+				if isSet {
+					return fmt.Errorf("unknown column %s, expect NEW.%s", col, col)
+				}
+				continue // a column of the table of the statement
+			}
+			if row != "new" && row != "old" {
+				return fmt.Errorf("unknown column %s, expect NEW.%s or OLD.%s", col, name, name)
+			}
+			if (row == "new" && req.Event == "DELETE") || (row == "old" && req.Event == "INSERT") {
+				return fmt.Errorf("%s is not available in %s triggers", strings.ToUpper(row), req.Event)
+			}
+			if qlColIndex(tdef, name) < 0 {
+				return fmt.Errorf("unknown column %s.%s", strings.ToUpper(row), name)
+			}
+		}
+	}
+	return nil
+}
+
+// the expressions of a statement of a trigger
+func qlStmtExprs(stmt interface{}) ([]*QLNode, error) {
+	nodes := []*QLNode{}
+	scan := func(req *QLScan) {
+		nodes = append(nodes, &req.Key1, &req.Key2, &req.Filter)
+	}
+	switch s := stmt.(type) {
+	case *QLInsert:
+		for _, row := range s.Values {
+			for i := range row {
+				nodes = append(nodes, &row[i])
+			}
+		}
+	case *QLUpdate:
+		scan(&s.QLScan)
+		for i := range s.Values {
+			nodes = append(nodes, &s.Values[i])
+		}
+	case *QLDelete:
+		scan(&s.QLScan)
+	case *QLSetNew:
+		for i := range s.Values {
+			nodes = append(nodes, &s.Values[i])
+		}
+	default:
+		return nil, fmt.Errorf("the statement of a trigger must be INSERT, UPDATE, DELETE or SET NEW")
+	}
+	return nodes, nil
+}
+
+// a trigger with its parsed statement, which is bound to the rows of
+// each write, see qlBindStmt()
+type qlTrigger struct {
+	Trigger
+	stmt interface{}
+}
+
+// the triggers of a table for an event
+type qlTriggers struct {
+	before []qlTrigger
+	after  []qlTrigger
+}
+
+// qlTableTriggers loads and parses the triggers of a table for an event
+func qlTableTriggers(table string, event string, tx DBTX) (*qlTriggers, error) {
+	triggers, err := tx.GetTriggers(table)
+	if err != nil {
+		return nil, err
+	}
+	out := &qlTriggers{}
+	for _, trig := range triggers {
+		if trig.Event != event {
+			continue
+		}
+		stmt, err := parser.ParseTriggerBody([]byte(trig.Body))
+		if err != nil {
+			return nil, fmt.Errorf("bad statement of trigger %s: %w", trig.Name, err)
+		}
+		if _, err := qlStmtExprs(stmt); err != nil {
+			return nil, fmt.Errorf("trigger %s: %w", trig.Name, err)
+		}
+		if trig.Timing == "BEFORE" {
+			out.before = append(out.before, qlTrigger{trig, stmt})
+		} else {
+			out.after = append(out.after, qlTrigger{trig, stmt})
+		}
+	}
+	return out, nil
+}
+
+// qlTriggerTX runs the statements of the triggers, it counts the
+// nested triggers
+type qlTriggerTX struct {
+	DBTX
+	depth int
+}
+
+// qlFireTriggers runs the triggers for a row. `newRow` is nil for
+// DELETE, `oldRow` is nil for INSERT. The SET NEW statements change
+// `newRow`, which is then checked against the table again.
+func qlFireTriggers(triggers []qlTrigger, tdef *TableDef, rules *qlRules, newRow *Record, oldRow *Record, tx DBTX) error {
+	if len(triggers) == 0 {
+		return nil
+	}
+	depth := 1
+	if ttx, ok := tx.(*qlTriggerTX); ok {
+		depth = ttx.depth + 1
+	}
+	changed := false
+	for _, trig := range triggers {
+		if depth > TRIGGER_MAX_DEPTH {
+			return fmt.Errorf("trigger %s: more than %d nested triggers", trig.Name, TRIGGER_MAX_DEPTH)
+		}
+		stmt, err := qlBindStmt(trig.stmt, newRow, oldRow)
+		if err != nil {
+			return fmt.Errorf("trigger %s: %w", trig.Name, err)
+		}
+		if set, ok := stmt.(*QLSetNew); ok {
+			if err := qlSetNew(set, newRow, tx); err != nil {
+				return fmt.Errorf("trigger %s: %w", trig.Name, err)
+			}
+			changed = true
+			continue
+		}
+		if _, err := ExecuteQuery(stmt, &qlTriggerTX{DBTX: tx, depth: depth}); err != nil {
+			return fmt.Errorf("trigger %s: %w", trig.Name, err)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	qlCoerceRecord(newRow, tdef)
+	if err := rules.generate(newRow, tdef); err != nil {
+		return err
+	}
+	if err := validateRecord(*newRow, tdef); err != nil {
+		return fmt.Errorf("record validation failed: %w", err)
+	}
+	return rules.check(*newRow, tdef)
+}
+
+// qlInsertRow inserts a row between its BEFORE and AFTER triggers
+func qlInsertRow(table string, tdef *TableDef, rules *qlRules, triggers *qlTriggers, record *Record, tx DBTX) error {
+	return triggers.atomic(tx, func() error {
+		if err := qlFireTriggers(triggers.before, tdef, rules, record, nil, tx); err != nil {
+			return err
+		}
+		if err := tx.Insert(table, *record); err != nil {
+			return fmt.Errorf("insert failed: %w", err)
+		}
+		return qlFireTriggers(triggers.after, tdef, rules, record, nil, tx)
+	})
+}
+
+// qlUpdateRow replaces the row of `key` between its BEFORE and AFTER
+// triggers, `oldRow` is the row before the update
+func qlUpdateRow(table string, tdef *TableDef, rules *qlRules, triggers *qlTriggers,
+	key Record, newRow *Record, oldRow *Record, tx DBTX) error {
+	return triggers.atomic(tx, func() error {
+		if err := qlFireTriggers(triggers.before, tdef, rules, newRow, oldRow, tx); err != nil {
+			return err
+		}
+		if err := tx.Update(table, key, *newRow); err != nil {
+			return fmt.Errorf("update failed: %w", err)
+		}
+		return qlFireTriggers(triggers.after, tdef, rules, newRow, oldRow, tx)
+	})
+}
+
+// qlDeleteRow deletes a row between its BEFORE and AFTER triggers.
+// The AFTER triggers do not run if the row was not deleted.
+func qlDeleteRow(table string, tdef *TableDef, triggers *qlTriggers, oldRow *Record, tx DBTX) (bool, error) {
+	deleted := false
+	err := triggers.atomic(tx, func() error {
+		if err := qlFireTriggers(triggers.before, tdef, nil, nil, oldRow, tx); err != nil {
+			return err
+		}
+		var err error
+		if deleted, err = tx.Delete(table, buildPrimaryKey(*oldRow, tdef)); err != nil {
+			return fmt.Errorf("delete failed: %w", err)
+		}
+		if !deleted {
+			return nil
+		}
+		return qlFireTriggers(triggers.after, tdef, nil, nil, oldRow, tx)
+	})
+	return deleted && err == nil, err
+}
+
+// atomic runs the write of a row with its triggers. The row and the
+// writes of the triggers are undone together if one of them fails.
+func (triggers *qlTriggers) atomic(tx DBTX, write func() error) error {
+	if len(triggers.before) == 0 && len(triggers.after) == 0 {
+		return write()
+	}
+	return tx.Atomic(write)
+}
+
+// qlBindStmt returns a copy of the statement of a trigger, where NEW.col
+// and OLD.col are replaced with the values of the rows. The parsed
+// statement is not changed.
+func qlBindStmt(stmt interface{}, newRow *Record, oldRow *Record) (interface{}, error) {
+	var out interface{}
+	switch s := stmt.(type) {
+	case *QLInsert:
+		c := *s
+		c.Values = make([][]QLNode, len(s.Values))
+		for i, row := range s.Values {
+			c.Values[i] = append([]QLNode(nil), row...)
+		}
+		out = &c
+	case *QLUpdate:
+		c := *s
+		c.Values = append([]QLNode(nil), s.Values...)
+		out = &c
+	case *QLDelete:
+		c := *s
+		out = &c
+	case *QLSetNew:
+		c := *s
+		c.Values = append([]QLNode(nil), s.Values...)
+		out = &c
+	}
+	nodes, err := qlStmtExprs(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if *node, err = qlBindRows(*node, newRow, oldRow); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// replace NEW.col and OLD.col with the values of the rows, in a copy
+// of the node
+func qlBindRows(node QLNode, newRow *Record, oldRow *Record) (QLNode, error) {
+	if node.Value.Type == QL_SYM {
+		row, name, ok := strings.Cut(string(node.Value.Str), ".")
+		if !ok {
+			return node, nil
+		}
+		var rec *Record
+		switch row {
+		case "new":
+			rec = newRow
+		case "old":
+			rec = oldRow
+		}
+		var v *Value
+		if rec != nil {
+			v = rec.Get(name)
+		}
+		if v == nil {
+			return node, fmt.Errorf("unknown column %s.%s", strings.ToUpper(row), name)
+		}
+		return qlLiteral(*v), nil
+	}
+	if len(node.Kids) == 0 {
+		return node, nil
+	}
+	kids := make([]QLNode, len(node.Kids))
+	for i, kid := range node.Kids {
+		var err error
+		if kids[i], err = qlBindRows(kid, newRow, oldRow); err != nil {
+			return node, err
+		}
+	}
+	node.Kids = kids
+	return node, nil
+}
+
+// the literal of a value, a JSON value is its text
+func qlLiteral(v Value) QLNode {
+	switch {
+	case v.Null:
+		return QLNode{Value: query.Value{Type: QL_NULL}}
+	case v.Type == TYPE_DECIMAL:
+		return QLNode{Value: query.Value{Type: QL_DECIMAL, Str: []byte(v.Dec.String())}}
+	case v.Type == TYPE_JSON:
+		return QLNode{Value: query.Value{Type: QL_STR, Str: v.Str}}
+	}
+	return QLNode{Value: query.Value{Type: v.Type, I64: v.I64, Str: v.Str, F64: v.F64}}
+}
+
+// execute SET NEW.col = expr, ... on the new row
+func qlSetNew(set *QLSetNew, newRow *Record, tx DBTX) error {
+	for i, col := range set.Names {
+		ctx := QLEvalContex{tx: tx}
+		qlEval(&ctx, set.Values[i])
+		if ctx.err != nil {
+			return fmt.Errorf("value evaluation failed for column %s: %w", col, ctx.err)
+		}
+		found := false
+		for j, c := range newRow.Cols {
+			if c == col {
+				newRow.Vals[j] = ctx.out
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column NEW.%s", col)
+		}
+	}
+	return nil
+}
@@ -11,12 +11,23 @@ func ExecuteUpdate(req *QLUpdate, tx DBTX) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Validate SET clause
 	if len(req.Names) != len(req.Values) {
 		return 0, fmt.Errorf("column count mismatch in SET clause: %d columns, %d values",
 			len(req.Names), len(req.Values))
 	}
+	if err := rules.writable(req.Names); err != nil {
+		return 0, err
+	}
 
 	// Execute scan to find records to update
 	var out []Record
@@ -32,13 +43,13 @@ func ExecuteUpdate(req *QLUpdate, tx DBTX) (uint64, error) {
 		// Build primary key for this record
 		key := buildPrimaryKey(record, tdef)
 
-		// Create updated record
-		updatedRecord := record // Start with original record
+		// Create updated record, the original one is OLD for the triggers
+		updatedRecord := Record{Cols: record.Cols, Vals: append([]Value(nil), record.Vals...)}
 
 		// Apply SET clause updates
 		for i, colName := range req.Names {
 			// Evaluate the new value
-			ctx := QLEvalContex{env: record}
+			ctx := QLEvalContex{env: record, tx: tx}
 			qlEval(&ctx, req.Values[i])
 			if ctx.err != nil {
 				return 0, fmt.Errorf("value evaluation failed for column %s: %w", colName, ctx.err)
@@ -54,14 +65,20 @@ func ExecuteUpdate(req *QLUpdate, tx DBTX) (uint64, error) {
 		}
 
 		// Validate updated record
+		qlCoerceRecord(&updatedRecord, tdef)
+		if err := rules.generate(&updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 		if err := validateRecord(updatedRecord, tdef); err != nil {
 			return 0, fmt.Errorf("updated record validation failed: %w", err)
 		}
+		if err := rules.check(updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 
-		// Perform the update
-		err := tx.Update(req.Table, key, updatedRecord)
-		if err != nil {
-			return 0, fmt.Errorf("update failed: %w", err)
+		// Perform the update, with the triggers
+		if err := qlUpdateRow(req.Table, tdef, rules, triggers, key, &updatedRecord, &record, tx); err != nil {
+			return 0, err
 		}
 
 		updatedCount++
@@ -77,12 +94,23 @@ func ExecuteUpdateWithCondition(req *QLUpdate, tx DBTX, condition QLNode) (uint6
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Validate SET clause
 	if len(req.Names) != len(req.Values) {
 		return 0, fmt.Errorf("column count mismatch in SET clause: %d columns, %d values",
 			len(req.Names), len(req.Values))
 	}
+	if err := rules.writable(req.Names); err != nil {
+		return 0, err
+	}
 
 	// Execute scan to find records to update
 	var out []Record
@@ -102,10 +130,10 @@ func ExecuteUpdateWithCondition(req *QLUpdate, tx DBTX, condition QLNode) (uint6
 			if ctx.err != nil {
 				return 0, fmt.Errorf("condition evaluation failed: %w", ctx.err)
 			}
-			if ctx.out.Type != TYPE_INT64 {
+			if !ctx.out.Null && !qlIsBool(ctx.out) {
 				return 0, fmt.Errorf("condition must be boolean type")
 			}
-			if ctx.out.I64 == 0 {
+			if ctx.out.Null || ctx.out.I64 == 0 {
 				// Condition not met, skip this record
 				continue
 			}
@@ -114,13 +142,13 @@ func ExecuteUpdateWithCondition(req *QLUpdate, tx DBTX, condition QLNode) (uint6
 		// Build primary key for this record
 		key := buildPrimaryKey(record, tdef)
 
-		// Create updated record
-		updatedRecord := record // Start with original record
+		// Create updated record, the original one is OLD for the triggers
+		updatedRecord := Record{Cols: record.Cols, Vals: append([]Value(nil), record.Vals...)}
 
 		// Apply SET clause updates
 		for i, colName := range req.Names {
 			// Evaluate the new value
-			ctx := QLEvalContex{env: record}
+			ctx := QLEvalContex{env: record, tx: tx}
 			qlEval(&ctx, req.Values[i])
 			if ctx.err != nil {
 				return 0, fmt.Errorf("value evaluation failed for column %s: %w", colName, ctx.err)
@@ -136,14 +164,20 @@ func ExecuteUpdateWithCondition(req *QLUpdate, tx DBTX, condition QLNode) (uint6
 		}
 
 		// Validate updated record
+		qlCoerceRecord(&updatedRecord, tdef)
+		if err := rules.generate(&updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 		if err := validateRecord(updatedRecord, tdef); err != nil {
 			return 0, fmt.Errorf("updated record validation failed: %w", err)
 		}
+		if err := rules.check(updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 
-		// Perform the update
-		err := tx.Update(req.Table, key, updatedRecord)
-		if err != nil {
-			return 0, fmt.Errorf("update failed: %w", err)
+		// Perform the update, with the triggers
+		if err := qlUpdateRow(req.Table, tdef, rules, triggers, key, &updatedRecord, &record, tx); err != nil {
+			return 0, err
 		}
 
 		updatedCount++
@@ -159,6 +193,14 @@ func ExecuteUpdateSingle(req *QLUpdate, tx DBTX, key Record) error {
 	if tdef == nil {
 		return fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return err
+	}
+	triggers, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return err
+	}
 
 	// Get the existing record
 	record, err := tx.Get(req.Table, key)
@@ -174,14 +216,17 @@ func ExecuteUpdateSingle(req *QLUpdate, tx DBTX, key Record) error {
 		return fmt.Errorf("column count mismatch in SET clause: %d columns, %d values",
 			len(req.Names), len(req.Values))
 	}
+	if err := rules.writable(req.Names); err != nil {
+		return err
+	}
 
-	// Create updated record
-	updatedRecord := *record // Start with original record
+	// Create updated record, the original one is OLD for the triggers
+	updatedRecord := Record{Cols: record.Cols, Vals: append([]Value(nil), record.Vals...)}
 
 	// Apply SET clause updates
 	for i, colName := range req.Names {
 		// Evaluate the new value
-		ctx := QLEvalContex{env: *record}
+		ctx := QLEvalContex{env: *record, tx: tx}
 		qlEval(&ctx, req.Values[i])
 		if ctx.err != nil {
 			return fmt.Errorf("value evaluation failed for column %s: %w", colName, ctx.err)
@@ -197,17 +242,19 @@ func ExecuteUpdateSingle(req *QLUpdate, tx DBTX, key Record) error {
 	}
 
 	// Validate updated record
+	qlCoerceRecord(&updatedRecord, tdef)
+	if err := rules.generate(&updatedRecord, tdef); err != nil {
+		return err
+	}
 	if err := validateRecord(updatedRecord, tdef); err != nil {
 		return fmt.Errorf("updated record validation failed: %w", err)
 	}
-
-	// Perform the update
-	err = tx.Update(req.Table, key, updatedRecord)
-	if err != nil {
-		return fmt.Errorf("update failed: %w", err)
+	if err := rules.check(updatedRecord, tdef); err != nil {
+		return err
 	}
 
-	return nil
+	// Perform the update, with the triggers
+	return qlUpdateRow(req.Table, tdef, rules, triggers, key, &updatedRecord, record, tx)
 }
 
 // ExecuteUpdateBatch updates multiple records in a batch
@@ -217,12 +264,23 @@ func ExecuteUpdateBatch(req *QLUpdate, tx DBTX, keys []Record) (uint64, error) {
 	if tdef == nil {
 		return 0, fmt.Errorf("table %s not found", req.Table)
 	}
+	rules, err := qlTableRules(tdef)
+	if err != nil {
+		return 0, err
+	}
+	triggers, err := qlTableTriggers(req.Table, "UPDATE", tx)
+	if err != nil {
+		return 0, err
+	}
 
 	// Validate SET clause
 	if len(req.Names) != len(req.Values) {
 		return 0, fmt.Errorf("column count mismatch in SET clause: %d columns, %d values",
 			len(req.Names), len(req.Values))
 	}
+	if err := rules.writable(req.Names); err != nil {
+		return 0, err
+	}
 
 	var updatedCount uint64
 
@@ -238,13 +296,13 @@ func ExecuteUpdateBatch(req *QLUpdate, tx DBTX, keys []Record) (uint64, error) {
 			continue
 		}
 
-		// Create updated record
-		updatedRecord := *record // Start with original record
+		// Create updated record, the original one is OLD for the triggers
+		updatedRecord := Record{Cols: record.Cols, Vals: append([]Value(nil), record.Vals...)}
 
 		// Apply SET clause updates
 		for i, colName := range req.Names {
 			// Evaluate the new value
-			ctx := QLEvalContex{env: *record}
+			ctx := QLEvalContex{env: *record, tx: tx}
 			qlEval(&ctx, req.Values[i])
 			if ctx.err != nil {
 				return 0, fmt.Errorf("value evaluation failed for column %s: %w", colName, ctx.err)
@@ -260,14 +318,20 @@ func ExecuteUpdateBatch(req *QLUpdate, tx DBTX, keys []Record) (uint64, error) {
 		}
 
 		// Validate updated record
+		qlCoerceRecord(&updatedRecord, tdef)
+		if err := rules.generate(&updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 		if err := validateRecord(updatedRecord, tdef); err != nil {
 			return 0, fmt.Errorf("updated record validation failed: %w", err)
 		}
+		if err := rules.check(updatedRecord, tdef); err != nil {
+			return 0, err
+		}
 
-		// Perform the update
-		err = tx.Update(req.Table, key, updatedRecord)
-		if err != nil {
-			return 0, fmt.Errorf("update failed: %w", err)
+		// Perform the update, with the triggers
+		if err := qlUpdateRow(req.Table, tdef, rules, triggers, key, &updatedRecord, record, tx); err != nil {
+			return 0, err
 		}
 
 		updatedCount++
@@ -315,6 +379,9 @@ func ValidateUpdateRequest(req *QLUpdate, tx DBTX) error {
 				return fmt.Errorf("cannot update primary key column: %s", colName)
 			}
 		}
+		if _, ok := tdef.Generated[colName]; ok {
+			return fmt.Errorf("cannot write generated column %s", colName)
+		}
 	}
 
 	return nil
@@ -0,0 +1,152 @@
+package executor
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/query/parser"
+)
+
+// Views are stored in the catalog as the SQL text of the SELECT, which
+// is run again whenever the view is in FROM. The FILTER and the LIMIT
+// of the outer query are applied to the rows of the view. Views are
+// read-only.
+
+// ExecuteCreateView executes a CREATE VIEW statement
+func ExecuteCreateView(req *QLCreateView, tx DBTX) error {
+	cols, uses, err := qlViewColumns(req, tx)
+	if err != nil {
+		return fmt.Errorf("view creation failed: %w", err)
+	}
+	view := &View{Name: req.Name, Query: req.Query, Cols: cols, Table: req.Select.Table, Uses: uses}
+	if err := tx.CreateView(view); err != nil {
+		return fmt.Errorf("view creation failed: %w", err)
+	}
+	return nil
+}
+
+// ExecuteDropView executes a DROP VIEW [IF EXISTS] statement
+func ExecuteDropView(name string, ifExists bool, tx DBTX) error {
+	if ifExists {
+		view, err := tx.GetView(name)
+		if err != nil || view == nil {
+			return err
+		}
+	}
+	if err := tx.DropView(name); err != nil {
+		return fmt.Errorf("view drop failed: %w", err)
+	}
+	return nil
+}
+
+// the output columns of a new view and the columns it uses, after
+// checking that its query refers to the columns of an existing table
+// or view
+func qlViewColumns(req *QLCreateView, tx DBTX) ([]string, []string, error) {
+	sel := req.Select
+	from, err := qlRelationColumns(sel.Table, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	known := map[string]bool{}
+	for _, col := range from {
+		known[col] = true
+	}
+	uses := []string{}
+	nodes := append([]QLNode{sel.Key1, sel.Key2, sel.Filter}, sel.Output...)
+	for _, node := range nodes {
+		for _, col := range qlColumns(node, nil) {
+			if !known[col] {
+				return nil, nil, fmt.Errorf("unknown column %s in %s", col, sel.Table)
+			}
+			if !qlContainsStr(uses, col) {
+				uses = append(uses, col)
+			}
+		}
+	}
+
+	cols := req.Cols
+	if cols == nil {
+		for i, node := range sel.Output {
+			name := sel.Names[i]
+			if name == "" && node.Value.Type == QL_SYM {
+				name = string(node.Value.Str)
+			}
+			if name == "" {
+				return nil, nil, fmt.Errorf("column %d of view %s needs a name (AS)", i+1, req.Name)
+			}
+			cols = append(cols, name)
+		}
+	}
+	if len(cols) != len(sel.Output) {
+		return nil, nil, fmt.Errorf("view %s has %d columns, got %d names", req.Name, len(sel.Output), len(cols))
+	}
+	seen := map[string]bool{}
+	for _, col := range cols {
+		if seen[col] {
+			return nil, nil, fmt.Errorf("duplicate column: %s", col)
+		}
+		seen[col] = true
+	}
+	return cols, uses, nil
+}
+
+// the columns of a table or a view
+func qlRelationColumns(name string, tx DBTX) ([]string, error) {
+	if tdef := tx.GetDB().GetTableDef(name); tdef != nil {
+		return tdef.Cols, nil
+	}
+	view, err := tx.GetView(name)
+	if err != nil {
+		return nil, err
+	}
+	if view == nil {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+	return view.Cols, nil
+}
+
+// qlViewSelect parses the stored query of a view
+func qlViewSelect(view *View) (*QLSelect, error) {
+	stmt, err := parser.Parse([]byte(view.Query))
+	if err != nil {
+		return nil, fmt.Errorf("bad query of view %s: %w", view.Name, err)
+	}
+	sel, ok := stmt.(*QLSelect)
+	if !ok || len(sel.Output) != len(view.Cols) {
+		return nil, fmt.Errorf("bad query of view %s", view.Name)
+	}
+	return sel, nil
+}
+
+// qlViewScan runs the query of a view in place of a table scan
+func qlViewScan(req *QLScan, view *View, tx DBTX, out []Record) ([]Record, error) {
+	if req.Key1.Value.Type != 0 {
+		return nil, fmt.Errorf("INDEX BY is not supported on view %s", view.Name)
+	}
+	sel, err := qlViewSelect(view)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ExecuteSelect(sel, tx)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", view.Name, err)
+	}
+	// i counts the rows that pass the filter
+	i := int64(0)
+	for _, row := range rows {
+		if i >= req.Limit {
+			break
+		}
+		rec := Record{Cols: view.Cols, Vals: row.Vals}
+		if ok, err := qlFilter(req.Filter, rec); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if req.Offset <= i {
+			out = append(out, rec)
+		}
+		i++
+	}
+	return out, nil
+}
@@ -1,6 +1,10 @@
 package parser
 
-import "govetachun/go-mini-db/refactor_code/pkg/utils"
+import (
+	"strings"
+
+	"govetachun/go-mini-db/refactor_code/pkg/utils"
+)
 
 // pExprTuple parses tuple expressions or single expressions
 func pExprTuple(p *Parser, node *QLNode) {
@@ -64,12 +68,23 @@ func pExprNot(p *Parser, node *QLNode) {
 	}
 }
 
-// pExprCmp parses comparison expressions
+// pExprCmp parses comparison expressions, and `expr IS [NOT] NULL`
 func pExprCmp(p *Parser, node *QLNode) {
 	pExprBinop(p, node,
 		[]string{"<=", ">=", "<", ">", "=", "!="},
 		[]uint32{QL_CMP_LE, QL_CMP_GE, QL_CMP_LT, QL_CMP_GT, QL_CMP_EQ, QL_CMP_NE},
 		pExprAdd)
+	if pKeyword(p, "is") {
+		typ := uint32(QL_IS_NULL)
+		if pKeyword(p, "not") {
+			typ = QL_IS_NOT_NULL
+		}
+		if !pKeyword(p, "null") {
+			pErr(p, node, "expect NULL")
+			return
+		}
+		*node = QLNode{Value: Value{Type: typ}, Kids: []QLNode{*node}}
+	}
 }
 
 // pExprAdd parses addition and subtraction expressions
@@ -83,7 +98,56 @@ func pExprAdd(p *Parser, node *QLNode) {
 // pExprMul parses multiplication, division, and modulo expressions
 func pExprMul(p *Parser, node *QLNode) {
 	pExprBinop(p, node,
-		[]string{"*", "/", "%"}, []uint32{QL_CMP_MUL, QL_CMP_DIV, QL_CMP_MOD}, pExprUnop)
+		[]string{"*", "/", "%"}, []uint32{QL_CMP_MUL, QL_CMP_DIV, QL_CMP_MOD}, pExprJSON)
+}
+
+// pExprJSON parses the JSON operators, `doc->'a'->>'b'`
+func pExprJSON(p *Parser, node *QLNode) {
+	pExprBinop(p, node, []string{"->>", "->"}, []uint32{QL_JSON_TEXT, QL_JSON_GET}, pExprUnop)
+}
+
+// pFunc parses a function call, `name(expr, ...)`
+func pFunc(p *Parser, node *QLNode) bool {
+	save := p.Idx
+	name := QLNode{}
+	if !pSym(p, &name) || !pKeyword(p, "(") {
+		p.Idx = save // a column
+		return false
+	}
+	node.Value = Value{Type: QL_FUNC, Str: []byte(strings.ToLower(string(name.Value.Str)))}
+	node.Kids = []QLNode{}
+	if pKeyword(p, ")") {
+		return true
+	}
+	for {
+		node.Kids = append(node.Kids, QLNode{})
+		pExprOr(p, &node.Kids[len(node.Kids)-1])
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	if !pKeyword(p, ")") {
+		pErr(p, node, "expect ')'")
+	}
+	return true
+}
+
+// pRowRef parses `NEW.col` or `OLD.col` in a trigger, which is the
+// symbol "new.col" or "old.col"
+func pRowRef(p *Parser, node *QLNode) bool {
+	for _, row := range []string{"new", "old"} {
+		if !pKeyword(p, row, ".") {
+			continue
+		}
+		col := QLNode{}
+		if !pSym(p, &col) {
+			pErr(p, node, "expect a column after "+strings.ToUpper(row)+".")
+			return true
+		}
+		node.Value = Value{Type: QL_SYM, Str: []byte(row + "." + string(col.Value.Str))}
+		return true
+	}
+	return false
 }
 
 // pExprUnop parses unary expressions
@@ -106,6 +170,19 @@ func pExprAtom(p *Parser, node *QLNode) {
 		if !pKeyword(p, ")") {
 			pErr(p, node, "unclosed parenthesis")
 		}
+	case pKeyword(p, "null"):
+		node.Value.Type = QL_NULL
+	case pKeyword(p, "true"):
+		node.Value = Value{Type: QL_BOOL, I64: 1}
+	case pKeyword(p, "false"):
+		node.Value = Value{Type: QL_BOOL, I64: 0}
+	case pKeyword(p, "current_timestamp"):
+		node.Value = Value{Type: QL_FUNC, Str: []byte("now")}
+		node.Kids = []QLNode{}
+	case pTimestamp(p, node):
+	case pDecimal(p, node):
+	case pRowRef(p, node):
+	case pFunc(p, node):
 	case pSym(p, node):
 	case pNum(p, node):
 	case pStr(p, node):
@@ -1,7 +1,10 @@
 package parser
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -12,12 +15,24 @@ var pKeywordSet = map[string]bool{
 	"insert": true, "into": true, "values": true, "replace": true,
 	"upsert": true, "delete": true, "update": true, "set": true,
 	"and": true, "or": true, "not": true, "as": true,
+	"null": true, "is": true, "true": true, "false": true,
+	"default": true, "check": true, "constraint": true,
+	"current_timestamp": true, "foreign": true, "references": true,
 }
 
-// skipSpace advances the parser past whitespace
+// skipSpace advances the parser past whitespace and `--` comments
 func skipSpace(p *Parser) {
-	for p.Idx < len(p.Input) && unicode.IsSpace(rune(p.Input[p.Idx])) {
-		p.Idx++
+	for p.Idx < len(p.Input) {
+		switch {
+		case unicode.IsSpace(rune(p.Input[p.Idx])):
+			p.Idx++
+		case strings.HasPrefix(string(p.Input[p.Idx:]), "--"):
+			for p.Idx < len(p.Input) && p.Input[p.Idx] != '\n' {
+				p.Idx++
+			}
+		default:
+			return
+		}
 	}
 }
 
@@ -68,6 +83,16 @@ func pNum(p *Parser, node *QLNode) bool {
 	for p.Idx < len(p.Input) && unicode.IsDigit(rune(p.Input[p.Idx])) {
 		p.Idx++
 	}
+	if pFloatTail(p) {
+		f, err := strconv.ParseFloat(string(p.Input[start:p.Idx]), 64)
+		if err != nil {
+			pErr(p, node, "bad number")
+			return true
+		}
+		node.Value.Type = QL_F64
+		node.Value.F64 = f
+		return true
+	}
 
 	// Convert to int64
 	numStr := string(p.Input[start:p.Idx])
@@ -81,18 +106,46 @@ func pNum(p *Parser, node *QLNode) bool {
 	return true
 }
 
-// pStr parses a string literal
+// the fraction and the exponent of a float literal: 1.5, 1e10, 2.5E-3
+func pFloatTail(p *Parser) bool {
+	isDigit := func(i int) bool {
+		return i < len(p.Input) && unicode.IsDigit(rune(p.Input[i]))
+	}
+	i := p.Idx
+	if i < len(p.Input) && p.Input[i] == '.' && isDigit(i+1) {
+		for i++; isDigit(i); i++ {
+		}
+	}
+	if i < len(p.Input) && (p.Input[i] == 'e' || p.Input[i] == 'E') {
+		j := i + 1
+		if j < len(p.Input) && (p.Input[j] == '+' || p.Input[j] == '-') {
+			j++
+		}
+		if isDigit(j) {
+			for i = j; isDigit(i); i++ {
+			}
+		}
+	}
+	if i == p.Idx {
+		return false
+	}
+	p.Idx = i
+	return true
+}
+
+// pStr parses a string literal, "..." or '...'
 func pStr(p *Parser, node *QLNode) bool {
 	skipSpace(p)
-	if p.Idx >= len(p.Input) || p.Input[p.Idx] != '"' {
+	if p.Idx >= len(p.Input) || (p.Input[p.Idx] != '"' && p.Input[p.Idx] != '\'') {
 		return false
 	}
 
+	quote := p.Input[p.Idx]
 	p.Idx++ // skip opening quote
 	start := p.Idx
 
 	// Find closing quote
-	for p.Idx < len(p.Input) && p.Input[p.Idx] != '"' {
+	for p.Idx < len(p.Input) && p.Input[p.Idx] != quote {
 		if p.Input[p.Idx] == '\\' && p.Idx+1 < len(p.Input) {
 			p.Idx++ // skip escape character
 		}
@@ -109,6 +162,55 @@ func pStr(p *Parser, node *QLNode) bool {
 	return true
 }
 
+// the formats of TIMESTAMP literals, in UTC unless a zone is given
+var pTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// pTimestamp parses TIMESTAMP '2006-01-02 15:04:05'
+func pTimestamp(p *Parser, node *QLNode) bool {
+	save := p.Idx
+	str := QLNode{}
+	if !pKeyword(p, "timestamp") || !pStr(p, &str) {
+		p.Idx = save // not a literal, `timestamp` can be a column
+		return false
+	}
+	for _, layout := range pTimestampLayouts {
+		if t, err := time.Parse(layout, string(str.Value.Str)); err == nil {
+			node.Value.Type = QL_TIMESTAMP
+			node.Value.I64 = t.UnixMicro()
+			return true
+		}
+	}
+	pErr(p, node, fmt.Sprintf("bad timestamp: %s", str.Value.Str))
+	return true
+}
+
+// pDecimal parses DECIMAL '-12.50', the digits are checked here
+// and kept as the string
+func pDecimal(p *Parser, node *QLNode) bool {
+	save := p.Idx
+	str := QLNode{}
+	if !pKeyword(p, "decimal") || !pStr(p, &str) {
+		p.Idx = save // not a literal, `decimal` can be a column
+		return false
+	}
+	digits := strings.TrimPrefix(strings.TrimPrefix(string(str.Value.Str), "-"), "+")
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		digits = digits[:dot] + digits[dot+1:]
+	}
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		pErr(p, node, fmt.Sprintf("bad decimal: %s", str.Value.Str))
+		return true
+	}
+	node.Value.Type = QL_DECIMAL
+	node.Value.Str = str.Value.Str
+	return true
+}
+
 // pSym parses a symbol (identifier)
 func pSym(p *Parser, node *QLNode) bool {
 	skipSpace(p)
@@ -3,6 +3,8 @@ package parser
 import (
 	"fmt"
 	"govetachun/go-mini-db/refactor_code/internal/query"
+	"math"
+	"strings"
 )
 
 // Re-export types from query package
@@ -12,36 +14,69 @@ type QLInsert = query.QLInsert
 type QLUpdate = query.QLUpdate
 type QLDelete = query.QLDelete
 type QLCreateTable = query.QLCreateTable
+type QLCreateIndex = query.QLCreateIndex
+type QLCreateSequence = query.QLCreateSequence
+type QLDropSequence = query.QLDropSequence
+type QLDropTable = query.QLDropTable
+type QLDropIndex = query.QLDropIndex
+type QLCreateView = query.QLCreateView
+type QLDropView = query.QLDropView
+type QLRefreshView = query.QLRefreshView
+type QLCreateTrigger = query.QLCreateTrigger
+type QLDropTrigger = query.QLDropTrigger
+type QLSetNew = query.QLSetNew
 type QLScan = query.QLScan
 type Parser = query.Parser
 type Value = query.Value
 
 // Re-export constants
 const (
-	QL_I64     = query.QL_I64
-	QL_STR     = query.QL_STR
-	QL_SYM     = query.QL_SYM
-	QL_TUP     = query.QL_TUP
-	QL_ERR     = query.QL_ERR
-	QL_NOT     = query.QL_NOT
-	QL_NEG     = query.QL_NEG
-	QL_CMP_OR  = query.QL_CMP_OR
-	QL_CMP_AND = query.QL_CMP_AND
-	QL_CMP_LE  = query.QL_CMP_LE
-	QL_CMP_GE  = query.QL_CMP_GE
-	QL_CMP_LT  = query.QL_CMP_LT
-	QL_CMP_GT  = query.QL_CMP_GT
-	QL_CMP_EQ  = query.QL_CMP_EQ
-	QL_CMP_NE  = query.QL_CMP_NE
-	QL_CMP_ADD = query.QL_CMP_ADD
-	QL_CMP_SUB = query.QL_CMP_SUB
-	QL_CMP_MUL = query.QL_CMP_MUL
-	QL_CMP_DIV = query.QL_CMP_DIV
-	QL_CMP_MOD = query.QL_CMP_MOD
+	QL_I64         = query.QL_I64
+	QL_STR         = query.QL_STR
+	QL_F64         = query.QL_F64
+	QL_BOOL        = query.QL_BOOL
+	QL_TIMESTAMP   = query.QL_TIMESTAMP
+	QL_DECIMAL     = query.QL_DECIMAL
+	QL_JSON_GET    = query.QL_JSON_GET
+	QL_JSON_TEXT   = query.QL_JSON_TEXT
+	QL_FUNC        = query.QL_FUNC
+	QL_SYM         = query.QL_SYM
+	QL_TUP         = query.QL_TUP
+	QL_ERR         = query.QL_ERR
+	QL_NOT         = query.QL_NOT
+	QL_NEG         = query.QL_NEG
+	QL_NULL        = query.QL_NULL
+	QL_IS_NULL     = query.QL_IS_NULL
+	QL_IS_NOT_NULL = query.QL_IS_NOT_NULL
+	QL_CMP_OR      = query.QL_CMP_OR
+	QL_CMP_AND     = query.QL_CMP_AND
+	QL_CMP_LE      = query.QL_CMP_LE
+	QL_CMP_GE      = query.QL_CMP_GE
+	QL_CMP_LT      = query.QL_CMP_LT
+	QL_CMP_GT      = query.QL_CMP_GT
+	QL_CMP_EQ      = query.QL_CMP_EQ
+	QL_CMP_NE      = query.QL_CMP_NE
+	QL_CMP_ADD     = query.QL_CMP_ADD
+	QL_CMP_SUB     = query.QL_CMP_SUB
+	QL_CMP_MUL     = query.QL_CMP_MUL
+	QL_CMP_DIV     = query.QL_CMP_DIV
+	QL_CMP_MOD     = query.QL_CMP_MOD
+
+	TYPE_BYTES     = query.TYPE_BYTES
+	TYPE_INT64     = query.TYPE_INT64
+	TYPE_FLOAT64   = query.TYPE_FLOAT64
+	TYPE_BOOL      = query.TYPE_BOOL
+	TYPE_TIMESTAMP = query.TYPE_TIMESTAMP
+	TYPE_DECIMAL   = query.TYPE_DECIMAL
+	TYPE_JSON      = query.TYPE_JSON
 
 	MODE_INSERT_ONLY = query.MODE_INSERT_ONLY
 	MODE_UPDATE_ONLY = query.MODE_UPDATE_ONLY
 	MODE_UPSERT      = query.MODE_UPSERT
+
+	FK_RESTRICT = query.FK_RESTRICT
+	FK_CASCADE  = query.FK_CASCADE
+	FK_SET_NULL = query.FK_SET_NULL
 )
 
 // pErr sets an error in the parser
@@ -58,6 +93,47 @@ func pStmt(p *Parser) interface{} {
 	switch {
 	case pKeyword(p, "create", "table"):
 		return pQLCreateTable(p)
+	case pKeyword(p, "create", "index"):
+		return pQLCreateIndex(p, false)
+	case pKeyword(p, "create", "unique", "index"):
+		return pQLCreateIndex(p, true)
+	case pKeyword(p, "create", "sequence"):
+		return pQLCreateSequence(p)
+	case pKeyword(p, "drop", "sequence"):
+		stmt := QLDropSequence{Name: pQLMustSym(p)}
+		return &stmt
+	case pKeyword(p, "drop", "table"):
+		stmt := QLDropTable{IfExists: pKeyword(p, "if", "exists")}
+		stmt.Name = pQLMustSym(p)
+		return &stmt
+	case pKeyword(p, "drop", "index"):
+		stmt := QLDropIndex{Name: pQLMustSym(p)}
+		return &stmt
+	case pKeyword(p, "create", "view"):
+		return pQLCreateView(p)
+	case pKeyword(p, "drop", "view"):
+		stmt := QLDropView{IfExists: pKeyword(p, "if", "exists")}
+		stmt.Name = pQLMustSym(p)
+		return &stmt
+	case pKeyword(p, "create", "materialized", "view"):
+		stmt := pQLCreateView(p)
+		if stmt != nil {
+			stmt.Materialized = true
+		}
+		return stmt
+	case pKeyword(p, "drop", "materialized", "view"):
+		stmt := QLDropView{IfExists: pKeyword(p, "if", "exists"), Materialized: true}
+		stmt.Name = pQLMustSym(p)
+		return &stmt
+	case pKeyword(p, "refresh", "materialized", "view"):
+		stmt := QLRefreshView{Name: pQLMustSym(p)}
+		return &stmt
+	case pKeyword(p, "create", "trigger"):
+		return pQLCreateTrigger(p)
+	case pKeyword(p, "drop", "trigger"):
+		stmt := QLDropTrigger{IfExists: pKeyword(p, "if", "exists")}
+		stmt.Name = pQLMustSym(p)
+		return &stmt
 	case pKeyword(p, "select"):
 		return pQLSelect(p)
 	case pKeyword(p, "insert", "into"):
@@ -119,15 +195,20 @@ func pQLScan(p *Parser, scan *QLScan) {
 		// Parse index key
 		scan.Key1 = QLNode{}
 		pExprOr(p, &scan.Key1)
+		// a range: INDEX BY a > 1 AND a < 5
+		if scan.Key1.Value.Type == QL_CMP_AND {
+			scan.Key1, scan.Key2 = scan.Key1.Kids[0], scan.Key1.Kids[1]
+		}
 	}
 
-	// FILTER xxx
-	if pKeyword(p, "filter") {
+	// FILTER xxx, or WHERE xxx
+	if pKeyword(p, "filter") || pKeyword(p, "where") {
 		scan.Filter = QLNode{}
 		pExprOr(p, &scan.Filter)
 	}
 
 	// LIMIT x, y
+	scan.Offset, scan.Limit = 0, math.MaxInt64
 	if pKeyword(p, "limit") {
 		// Parse limit and offset
 		limitNode := QLNode{}
@@ -145,13 +226,535 @@ func pQLScan(p *Parser, scan *QLScan) {
 }
 
 // pQLCreateTable parses a CREATE TABLE statement
+//
+//	CREATE TABLE name (
+//		col type [NOT NULL] [DEFAULT expr] [CHECK (expr)] [UNIQUE] [REFERENCES ...]
+//			[AUTO_INCREMENT], ...,
+//		PRIMARY KEY (col, ...),
+//		[UNIQUE] INDEX [name] (col, ...), ...
+//		[CONSTRAINT name] CHECK (expr), ...
+//		[CONSTRAINT name] FOREIGN KEY (col, ...) REFERENCES ..., ...
+//	)
 func pQLCreateTable(p *Parser) *QLCreateTable {
 	stmt := QLCreateTable{}
-	// Parse table definition
-	// This is a simplified implementation
+	stmt.Def.Name = pQLMustSym(p)
+	if !pKeyword(p, "(") {
+		pErr(p, nil, "expect '('")
+		return nil
+	}
+
+	var pkeys []string
+	for p.Err == nil {
+		switch {
+		case pKeyword(p, "primary", "key"):
+			if pkeys != nil {
+				pErr(p, nil, "duplicate PRIMARY KEY")
+			}
+			pkeys = pQLNameList(p)
+		case pKeyword(p, "index"):
+			pQLTableIndex(p, &stmt, false)
+		case pKeyword(p, "unique", "index"), pKeyword(p, "unique"):
+			pQLTableIndex(p, &stmt, true)
+		case pKeyword(p, "constraint"):
+			name := pQLMustSym(p)
+			switch {
+			case pKeyword(p, "check"):
+				pQLCheck(p, &stmt, name)
+			case pKeyword(p, "foreign", "key"):
+				pQLForeignKey(p, &stmt, name, pQLNameList(p))
+			default:
+				pErr(p, nil, "expect CHECK or FOREIGN KEY")
+			}
+		case pKeyword(p, "check"):
+			pQLCheck(p, &stmt, "")
+		case pKeyword(p, "foreign", "key"):
+			pQLForeignKey(p, &stmt, "", pQLNameList(p))
+		default:
+			pQLColumnDef(p, &stmt)
+		}
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+	}
+	if p.Err != nil {
+		return nil
+	}
+
+	// the primary key columns come first
+	if len(pkeys) == 0 {
+		pErr(p, nil, "expect PRIMARY KEY")
+		return nil
+	}
+	def := &stmt.Def
+	cols, types := []string{}, []uint32{}
+	for _, pk := range pkeys {
+		i := pColIndex(def.Cols, pk)
+		if i < 0 {
+			pErr(p, nil, fmt.Sprintf("unknown primary key column: %s", pk))
+			return nil
+		}
+		cols, types = append(cols, pk), append(types, def.Types[i])
+	}
+	for i, c := range def.Cols {
+		if pColIndex(pkeys, c) < 0 {
+			cols, types = append(cols, c), append(types, def.Types[i])
+		}
+	}
+	def.Cols, def.Types, def.PKeys = cols, types, len(pkeys)
+	if def.AutoIncrement != "" && (len(pkeys) != 1 || def.AutoIncrement != def.Name+"_"+pkeys[0]+"_seq") {
+		pErr(p, nil, "AUTO_INCREMENT must be the primary key")
+		return nil
+	}
+	return &stmt
+}
+
+// col type [NOT NULL | NULL | DEFAULT expr | CHECK (expr) | UNIQUE | REFERENCES ... | AUTO_INCREMENT
+// | GENERATED ALWAYS AS (expr) [STORED | VIRTUAL]]...
+// the sequence of AUTO_INCREMENT is table_col_seq
+func pQLColumnDef(p *Parser, stmt *QLCreateTable) {
+	col := pQLMustSym(p)
+	typ := uint32(0)
+	switch {
+	case pKeyword(p, "json"):
+		typ = TYPE_JSON
+	case pKeyword(p, "decimal"):
+		typ = TYPE_DECIMAL
+		if stmt.Def.Decimals == nil {
+			stmt.Def.Decimals = map[string]query.DecimalType{}
+		}
+		stmt.Def.Decimals[col] = pQLDecimalType(p)
+	case pKeyword(p, "int64"):
+		typ = TYPE_INT64
+	case pKeyword(p, "bytes"):
+		typ = TYPE_BYTES
+	case pKeyword(p, "float64"):
+		typ = TYPE_FLOAT64
+	case pKeyword(p, "bool"):
+		typ = TYPE_BOOL
+	case pKeyword(p, "timestamp"):
+		typ = TYPE_TIMESTAMP
+	default:
+		pErr(p, nil, "expect column type")
+		return
+	}
+	if pColIndex(stmt.Def.Cols, col) >= 0 {
+		pErr(p, nil, fmt.Sprintf("duplicate column: %s", col))
+		return
+	}
+	stmt.Def.Cols = append(stmt.Def.Cols, col)
+	stmt.Def.Types = append(stmt.Def.Types, typ)
+	for p.Err == nil {
+		switch {
+		case pKeyword(p, "not", "null"):
+			stmt.Def.NotNull = append(stmt.Def.NotNull, col)
+		case pKeyword(p, "null"):
+			// nullable, the default
+		case pKeyword(p, "default"):
+			if stmt.Def.Defaults == nil {
+				stmt.Def.Defaults = map[string]string{}
+			}
+			stmt.Def.Defaults[col] = pQLExprText(p)
+		case pKeyword(p, "check"):
+			pQLCheck(p, stmt, stmt.Def.Name+"_"+col+"_check")
+		case pKeyword(p, "unique"):
+			stmt.Indexes = append(stmt.Indexes, QLCreateIndex{
+				Name:   stmt.Def.Name + "_" + col + "_key",
+				Table:  stmt.Def.Name,
+				Cols:   []string{col},
+				Unique: true,
+			})
+		case pKeyword(p, "references"):
+			pQLReferences(p, stmt, "", []string{col})
+		case pKeyword(p, "auto_increment"):
+			stmt.Def.AutoIncrement = stmt.Def.Name + "_" + col + "_seq"
+		case pKeyword(p, "generated", "always", "as"):
+			pQLGenerated(p, stmt, col)
+		default:
+			return
+		}
+	}
+}
+
+// GENERATED ALWAYS AS (expr) [STORED | VIRTUAL], VIRTUAL by default as in MySQL
+func pQLGenerated(p *Parser, stmt *QLCreateTable, col string) {
+	if !pKeyword(p, "(") {
+		pErr(p, nil, "expect '('")
+		return
+	}
+	expr := pQLExprText(p)
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+		return
+	}
+	if stmt.Def.Generated == nil {
+		stmt.Def.Generated = map[string]string{}
+	}
+	stmt.Def.Generated[col] = expr
+	if !pKeyword(p, "stored") {
+		pKeyword(p, "virtual")
+		stmt.Def.Virtual = append(stmt.Def.Virtual, col)
+	}
+}
+
+// CHECK (expr), the default name is table_check1, table_check2, ...
+func pQLCheck(p *Parser, stmt *QLCreateTable, name string) {
+	if !pKeyword(p, "(") {
+		pErr(p, nil, "expect '('")
+		return
+	}
+	expr := pQLExprText(p)
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+		return
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s_check%d", stmt.Def.Name, len(stmt.Def.Checks)+1)
+	}
+	stmt.Def.Checks = append(stmt.Def.Checks, expr)
+	stmt.Def.CheckNames = append(stmt.Def.CheckNames, name)
+}
+
+// FOREIGN KEY (col, ...) REFERENCES ...
+func pQLForeignKey(p *Parser, stmt *QLCreateTable, name string, cols []string) {
+	if p.Err != nil {
+		return
+	}
+	if !pKeyword(p, "references") {
+		pErr(p, nil, "expect REFERENCES")
+		return
+	}
+	pQLReferences(p, stmt, name, cols)
+}
+
+// REFERENCES table [(col, ...)] [ON DELETE action] [ON UPDATE action]
+// [[NOT] DEFERRABLE [INITIALLY DEFERRED | INITIALLY IMMEDIATE]],
+// the action is RESTRICT, NO ACTION, CASCADE or SET NULL.
+// the default name is table_col_fkey.
+func pQLReferences(p *Parser, stmt *QLCreateTable, name string, cols []string) {
+	fk := query.ForeignKey{Name: name, Cols: cols, Table: pQLMustSym(p)}
+	skipSpace(p)
+	if p.Idx < len(p.Input) && p.Input[p.Idx] == '(' {
+		fk.RefCols = pQLNameList(p)
+	}
+	for p.Err == nil {
+		switch {
+		case pKeyword(p, "on", "delete"):
+			fk.OnDelete = pQLAction(p)
+		case pKeyword(p, "on", "update"):
+			fk.OnUpdate = pQLAction(p)
+		case pKeyword(p, "not", "deferrable"), pKeyword(p, "deferrable"):
+		case pKeyword(p, "initially", "deferred"):
+			fk.Deferred = true
+		case pKeyword(p, "initially", "immediate"):
+			fk.Deferred = false
+		default:
+			if fk.Name == "" {
+				fk.Name = stmt.Def.Name + "_" + strings.Join(cols, "_") + "_fkey"
+			}
+			stmt.Def.ForeignKeys = append(stmt.Def.ForeignKeys, fk)
+			return
+		}
+	}
+}
+
+func pQLAction(p *Parser) int {
+	switch {
+	case pKeyword(p, "restrict"), pKeyword(p, "no", "action"):
+		return FK_RESTRICT
+	case pKeyword(p, "cascade"):
+		return FK_CASCADE
+	case pKeyword(p, "set", "null"):
+		return FK_SET_NULL
+	default:
+		pErr(p, nil, "expect RESTRICT, NO ACTION, CASCADE or SET NULL")
+		return FK_RESTRICT
+	}
+}
+
+// an expression as its source text, which is stored in the catalog
+// and parsed again by ParseExpr()
+func pQLExprText(p *Parser) string {
+	skipSpace(p)
+	start := p.Idx
+	pExprOr(p, &QLNode{})
+	return string(p.Input[start:p.Idx])
+}
+
+// [(precision [, scale])], DECIMAL(10,0) by default as in MySQL
+func pQLDecimalType(p *Parser) query.DecimalType {
+	dt := query.DecimalType{Precision: 10}
+	if !pKeyword(p, "(") {
+		return dt
+	}
+	num := QLNode{}
+	if !pNum(p, &num) || num.Value.Type != QL_I64 {
+		pErr(p, nil, "expect DECIMAL precision")
+		return dt
+	}
+	dt.Precision = int(num.Value.I64)
+	if pKeyword(p, ",") {
+		if !pNum(p, &num) || num.Value.Type != QL_I64 {
+			pErr(p, nil, "expect DECIMAL scale")
+			return dt
+		}
+		dt.Scale = int(num.Value.I64)
+	}
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+	}
+	return dt
+}
+
+// [UNIQUE] INDEX [name] (col, ...)
+func pQLTableIndex(p *Parser, stmt *QLCreateTable, unique bool) {
+	index := QLCreateIndex{Table: stmt.Def.Name, Unique: unique}
+	name := QLNode{}
+	if pSym(p, &name) {
+		index.Name = string(name.Value.Str)
+	}
+	pQLIndexCols(p, &index)
+	if index.Name == "" {
+		// the default name, as in PostgreSQL
+		suffix := "_idx"
+		if unique {
+			suffix = "_key"
+		}
+		index.Name = stmt.Def.Name + "_" + strings.Join(index.Cols, "_") + suffix
+	}
+	stmt.Indexes = append(stmt.Indexes, index)
+}
+
+// CREATE [MATERIALIZED] VIEW name [(col, ...)] AS SELECT ...
+func pQLCreateView(p *Parser) *QLCreateView {
+	stmt := QLCreateView{Name: pQLMustSym(p)}
+	skipSpace(p)
+	if p.Err == nil && p.Idx < len(p.Input) && p.Input[p.Idx] == '(' {
+		stmt.Cols = pQLNameList(p)
+	}
+	if p.Err == nil && !pKeyword(p, "as") {
+		pErr(p, nil, "expect `AS` SELECT")
+	}
+	skipSpace(p)
+	start := p.Idx
+	if p.Err == nil && !pKeyword(p, "select") {
+		pErr(p, nil, "expect SELECT")
+	}
+	if p.Err != nil {
+		return nil
+	}
+	stmt.Select = pQLSelect(p)
+	if p.Err != nil {
+		return nil
+	}
+	stmt.Query = strings.TrimSpace(string(p.Input[start:p.Idx]))
 	return &stmt
 }
 
+// CREATE TRIGGER name {BEFORE | AFTER} {INSERT | UPDATE | DELETE}
+// ON table FOR EACH ROW stmt
+func pQLCreateTrigger(p *Parser) *QLCreateTrigger {
+	stmt := QLCreateTrigger{Name: pQLMustSym(p)}
+	switch {
+	case pKeyword(p, "before"):
+		stmt.Timing = "BEFORE"
+	case pKeyword(p, "after"):
+		stmt.Timing = "AFTER"
+	default:
+		pErr(p, nil, "expect BEFORE or AFTER")
+	}
+	switch {
+	case p.Err != nil:
+	case pKeyword(p, "insert"):
+		stmt.Event = "INSERT"
+	case pKeyword(p, "update"):
+		stmt.Event = "UPDATE"
+	case pKeyword(p, "delete"):
+		stmt.Event = "DELETE"
+	default:
+		pErr(p, nil, "expect INSERT, UPDATE or DELETE")
+	}
+	if p.Err == nil && !pKeyword(p, "on") {
+		pErr(p, nil, "expect ON table")
+	}
+	stmt.Table = pQLMustSym(p)
+	if p.Err == nil && !pKeyword(p, "for", "each", "row") {
+		pErr(p, nil, "expect FOR EACH ROW")
+	}
+	skipSpace(p)
+	start := p.Idx
+	if p.Err != nil {
+		return nil
+	}
+	stmt.Stmt = pTriggerBody(p)
+	if p.Err != nil {
+		return nil
+	}
+	stmt.Body = strings.TrimSpace(string(p.Input[start:p.Idx]))
+	return &stmt
+}
+
+// the statement of a trigger, or SET NEW.col = expr, ...
+func pTriggerBody(p *Parser) interface{} {
+	if !pKeyword(p, "set") {
+		return pStmt(p)
+	}
+	stmt := QLSetNew{}
+	for p.Err == nil {
+		if !pKeyword(p, "new", ".") {
+			pErr(p, nil, "expect NEW.column")
+			break
+		}
+		stmt.Names = append(stmt.Names, pQLMustSym(p))
+		if !pKeyword(p, "=") {
+			pErr(p, nil, "expect '='")
+			break
+		}
+		expr := QLNode{}
+		pExprOr(p, &expr)
+		stmt.Values = append(stmt.Values, expr)
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	return &stmt
+}
+
+// CREATE SEQUENCE name [START [WITH] n] [INCREMENT [BY] n] [CACHE n]
+func pQLCreateSequence(p *Parser) *QLCreateSequence {
+	stmt := QLCreateSequence{Name: pQLMustSym(p), Start: 1, Increment: 1}
+	for p.Err == nil {
+		switch {
+		case pKeyword(p, "start", "with"), pKeyword(p, "start"):
+			stmt.Start = pQLInt(p)
+		case pKeyword(p, "increment", "by"), pKeyword(p, "increment"):
+			stmt.Increment = pQLInt(p)
+		case pKeyword(p, "cache"):
+			stmt.Cache = pQLInt(p)
+		default:
+			return &stmt
+		}
+	}
+	return nil
+}
+
+// an integer literal, possibly negative
+func pQLInt(p *Parser) int64 {
+	neg := pKeyword(p, "-")
+	num := QLNode{}
+	if !pNum(p, &num) || num.Value.Type != QL_I64 {
+		pErr(p, nil, "expect an integer")
+		return 0
+	}
+	if neg {
+		return -num.Value.I64
+	}
+	return num.Value.I64
+}
+
+// pQLCreateIndex parses a CREATE [UNIQUE] INDEX statement
+//
+//	CREATE [UNIQUE] INDEX name ON table (col, ...)
+func pQLCreateIndex(p *Parser, unique bool) *QLCreateIndex {
+	stmt := QLCreateIndex{Unique: unique}
+	stmt.Name = pQLMustSym(p)
+	if !pKeyword(p, "on") {
+		pErr(p, nil, "expect `ON` table")
+		return nil
+	}
+	stmt.Table = pQLMustSym(p)
+	pQLIndexCols(p, &stmt)
+	if p.Err != nil {
+		return nil
+	}
+	return &stmt
+}
+
+// (col | json path expression, ...)
+//
+// The expressions are kept in Exprs, Cols has a name for the default index
+// name, which is replaced by the index column of the expression.
+func pQLIndexCols(p *Parser, index *QLCreateIndex) {
+	if !pKeyword(p, "(") {
+		pErr(p, nil, "expect '('")
+		return
+	}
+	exprs, hasExpr := []QLNode{}, false
+	for {
+		node := QLNode{}
+		pExprJSON(p, &node)
+		switch node.Value.Type {
+		case QL_SYM:
+			index.Cols = append(index.Cols, string(node.Value.Str))
+			exprs = append(exprs, QLNode{})
+		case QL_JSON_GET, QL_JSON_TEXT, QL_FUNC:
+			index.Cols = append(index.Cols, pQLExprName(node))
+			exprs = append(exprs, node)
+			hasExpr = true
+		default:
+			pErr(p, nil, "expect column or JSON path")
+		}
+		if p.Err != nil || !pKeyword(p, ",") {
+			break
+		}
+	}
+	if hasExpr {
+		index.Exprs = exprs
+	}
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+	}
+}
+
+// the columns and the names in an expression, joined by '_'
+func pQLExprName(node QLNode) string {
+	parts := []string{}
+	if node.Value.Type == QL_SYM || node.Value.Type == QL_STR {
+		name := strings.Map(func(r rune) rune {
+			if isSym(byte(r)) && r < 128 {
+				return r
+			}
+			return -1
+		}, string(node.Value.Str))
+		if name != "" {
+			parts = append(parts, name)
+		}
+	}
+	for _, kid := range node.Kids {
+		if name := pQLExprName(kid); name != "" {
+			parts = append(parts, name)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// (col, ...)
+func pQLNameList(p *Parser) []string {
+	if !pKeyword(p, "(") {
+		pErr(p, nil, "expect '('")
+		return nil
+	}
+	names := []string{pQLMustSym(p)}
+	for pKeyword(p, ",") {
+		names = append(names, pQLMustSym(p))
+	}
+	if !pKeyword(p, ")") {
+		pErr(p, nil, "expect ')'")
+	}
+	return names
+}
+
+func pColIndex(cols []string, col string) int {
+	for i, c := range cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
 // pQLInsert parses an INSERT/REPLACE/UPSERT statement
 func pQLInsert(p *Parser, mode int) *QLInsert {
 	stmt := QLInsert{Mode: mode}
@@ -255,3 +858,55 @@ func Parse(input []byte) (interface{}, error) {
 	}
 	return stmt, nil
 }
+
+// ParseScript parses the statements of a script, such as a migration,
+// which are separated by `;`
+func ParseScript(input []byte) ([]interface{}, error) {
+	p := &Parser{Input: input, Idx: 0}
+	stmts := []interface{}{}
+	for {
+		if pKeyword(p, ";") {
+			continue // an empty statement
+		}
+		skipSpace(p)
+		if p.Idx >= len(p.Input) {
+			return stmts, nil
+		}
+		stmt := pStmt(p)
+		if p.Err == nil && !pKeyword(p, ";") {
+			skipSpace(p)
+			if p.Idx < len(p.Input) {
+				pErr(p, nil, "expect `;` between statements")
+			}
+		}
+		if p.Err != nil {
+			return nil, fmt.Errorf("statement %d: %w", len(stmts)+1, p.Err)
+		}
+		stmts = append(stmts, stmt)
+	}
+}
+
+// ParseTriggerBody parses the stored statement of a trigger
+func ParseTriggerBody(input []byte) (interface{}, error) {
+	p := &Parser{Input: input, Idx: 0}
+	stmt := pTriggerBody(p)
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	return stmt, nil
+}
+
+// ParseExpr parses a single expression, such as a stored DEFAULT or CHECK
+func ParseExpr(input []byte) (QLNode, error) {
+	p := &Parser{Input: input, Idx: 0}
+	node := QLNode{}
+	pExprOr(p, &node)
+	skipSpace(p)
+	if p.Err == nil && p.Idx < len(p.Input) {
+		pErr(p, nil, "trailing garbage")
+	}
+	if p.Err != nil {
+		return QLNode{}, p.Err
+	}
+	return node, nil
+}
@@ -5,13 +5,19 @@ type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
+	F64  float64
 }
 
 // Data types
 const (
-	TYPE_ERROR = 0
-	TYPE_BYTES = 1
-	TYPE_INT64 = 2
+	TYPE_ERROR     = 0
+	TYPE_BYTES     = 1
+	TYPE_INT64     = 2
+	TYPE_FLOAT64   = 3
+	TYPE_BOOL      = 4 // I64 is 0 or 1
+	TYPE_TIMESTAMP = 5 // I64 is the microseconds since the Unix epoch
+	TYPE_DECIMAL   = 6
+	TYPE_JSON      = 7 // Str is the text
 )
 
 // Insert modes
@@ -21,6 +27,13 @@ const (
 	MODE_INSERT_ONLY = 2 // only add new keys
 )
 
+// Foreign key actions
+const (
+	FK_RESTRICT = 0 // also NO ACTION
+	FK_CASCADE  = 1
+	FK_SET_NULL = 2
+)
+
 // QLNode represents a node in the query language AST
 type QLNode struct {
 	Value Value // Type, I64, Str
@@ -31,29 +44,39 @@ type QLNode struct {
 const (
 	QL_UNINIT = 0
 	// scalar
-	QL_STR = TYPE_BYTES
-	QL_I64 = TYPE_INT64
+	QL_STR       = TYPE_BYTES
+	QL_I64       = TYPE_INT64
+	QL_F64       = TYPE_FLOAT64
+	QL_BOOL      = TYPE_BOOL
+	QL_TIMESTAMP = TYPE_TIMESTAMP
+	QL_DECIMAL   = TYPE_DECIMAL // Str is the number, as in `DECIMAL '1.50'`
 	// binary ops
-	QL_CMP_GE  = 10 // >=
-	QL_CMP_GT  = 11 // >
-	QL_CMP_LT  = 12 // <
-	QL_CMP_LE  = 13 // <=
-	QL_CMP_EQ  = 14 // =
-	QL_CMP_NE  = 15 // !=
-	QL_CMP_OR  = 16 // OR
-	QL_CMP_AND = 17 // AND
-	QL_CMP_ADD = 18 // +
-	QL_CMP_SUB = 19 // -
-	QL_CMP_MUL = 20 // *
-	QL_CMP_DIV = 21 // /
-	QL_CMP_MOD = 22 // %
+	QL_CMP_GE    = 10 // >=
+	QL_CMP_GT    = 11 // >
+	QL_CMP_LT    = 12 // <
+	QL_CMP_LE    = 13 // <=
+	QL_CMP_EQ    = 14 // =
+	QL_CMP_NE    = 15 // !=
+	QL_CMP_OR    = 16 // OR
+	QL_CMP_AND   = 17 // AND
+	QL_CMP_ADD   = 18 // +
+	QL_CMP_SUB   = 19 // -
+	QL_CMP_MUL   = 20 // *
+	QL_CMP_DIV   = 21 // /
+	QL_CMP_MOD   = 22 // %
+	QL_JSON_GET  = 23 // ->, the JSON element
+	QL_JSON_TEXT = 24 // ->>, the SQL value of the JSON element
 	// unary ops
-	QL_NOT = 50
-	QL_NEG = 51
+	QL_NOT         = 50
+	QL_NEG         = 51
+	QL_IS_NULL     = 52 // IS NULL
+	QL_IS_NOT_NULL = 53 // IS NOT NULL
 	// others
-	QL_SYM = 100 // column
-	QL_TUP = 101 // tuple
-	QL_ERR = 200 // error; from parsing or evaluation
+	QL_SYM  = 100 // column
+	QL_TUP  = 101 // tuple
+	QL_NULL = 102 // NULL
+	QL_FUNC = 103 // function call, Str is the name and Kids are the arguments
+	QL_ERR  = 200 // error; from parsing or evaluation
 )
 
 // common structure for queries: `INDEX BY`, `FILTER`, `LIMIT`
@@ -98,7 +121,92 @@ type QLDelete struct {
 
 // stmt: create table
 type QLCreateTable struct {
-	Def TableDef // This will need to be imported from database package
+	Def     TableDef // This will need to be imported from database package
+	Indexes []QLCreateIndex
+}
+
+// stmt: create sequence
+type QLCreateSequence struct {
+	Name      string
+	Start     int64
+	Increment int64
+	Cache     int64
+}
+
+// stmt: drop sequence
+type QLDropSequence struct {
+	Name string
+}
+
+// stmt: drop table [if exists]
+type QLDropTable struct {
+	Name     string
+	IfExists bool
+}
+
+// stmt: drop index
+type QLDropIndex struct {
+	Name string
+}
+
+// stmt: create view
+type QLCreateView struct {
+	Name         string
+	Cols         []string // optional, the names of the output columns
+	Query        string   // the SQL text of the SELECT
+	Select       *QLSelect
+	Materialized bool // CREATE MATERIALIZED VIEW
+}
+
+// stmt: drop [materialized] view [if exists]
+type QLDropView struct {
+	Name         string
+	IfExists     bool
+	Materialized bool
+}
+
+// stmt: refresh materialized view
+type QLRefreshView struct {
+	Name string
+}
+
+// stmt: create trigger
+//
+//	CREATE TRIGGER name {BEFORE | AFTER} {INSERT | UPDATE | DELETE}
+//	ON table FOR EACH ROW stmt
+//
+// The statement refers to the written row as NEW.col and OLD.col.
+type QLCreateTrigger struct {
+	Name   string
+	Timing string // BEFORE or AFTER
+	Event  string // INSERT, UPDATE or DELETE
+	Table  string
+	Body   string      // the SQL text of the statement
+	Stmt   interface{} // the parsed statement
+}
+
+// stmt: drop trigger [if exists]
+type QLDropTrigger struct {
+	Name     string
+	IfExists bool
+}
+
+// stmt: SET NEW.col = expr, ... in a BEFORE trigger, which changes
+// the row to be written
+type QLSetNew struct {
+	Names  []string
+	Values []QLNode
+}
+
+// stmt: create index, also the INDEX and UNIQUE clauses of create table
+type QLCreateIndex struct {
+	Name  string
+	Table string
+	Cols  []string
+	// the JSON path expressions, in the same order as Cols.
+	// an empty node for a column, nil if all are columns.
+	Exprs  []QLNode
+	Unique bool
 }
 
 // Parser represents the SQL parser state
@@ -110,8 +218,42 @@ type Parser struct {
 
 // Placeholder for TableDef - this will be properly defined in database package
 type TableDef struct {
-	Name  string
-	Cols  []string
-	Types []uint32
-	PKeys int
+	Name    string
+	Cols    []string
+	Types   []uint32
+	PKeys   int
+	NotNull []string
+	// the precision and the scale of the DECIMAL columns
+	Decimals map[string]DecimalType
+	// the DEFAULT expressions of the columns, as the source text
+	Defaults map[string]string
+	// the GENERATED ALWAYS AS expressions of the columns, as the source
+	// text, and the generated columns that are VIRTUAL
+	Generated map[string]string
+	Virtual   []string
+	// the CHECK expressions as the source text, and their names
+	Checks     []string
+	CheckNames []string
+	// the references to other tables
+	ForeignKeys []ForeignKey
+	// the sequence of the AUTO_INCREMENT primary key
+	AutoIncrement string
+}
+
+// ForeignKey is a FOREIGN KEY (Cols) REFERENCES Table (RefCols) constraint,
+// RefCols is empty for the primary key of the table
+type ForeignKey struct {
+	Name     string
+	Cols     []string
+	Table    string
+	RefCols  []string
+	OnDelete int
+	OnUpdate int
+	Deferred bool // INITIALLY DEFERRED
+}
+
+// DecimalType is the precision and the scale of a DECIMAL(p,s) column
+type DecimalType struct {
+	Precision int
+	Scale     int
 }
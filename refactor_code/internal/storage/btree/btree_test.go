@@ -0,0 +1,73 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+// memTree builds a B-tree whose pages live in a map
+func memTree() *BTree {
+	pages := map[uint64]BNode{}
+	next := uint64(1)
+	tree := &BTree{}
+	tree.SetGet(func(ptr uint64) BNode {
+		node, ok := pages[ptr]
+		if !ok {
+			panic("bad ptr")
+		}
+		return node
+	})
+	tree.SetNew(func(node BNode) uint64 {
+		ptr := next
+		next++
+		pages[ptr] = node
+		return ptr
+	})
+	tree.SetDel(func(ptr uint64) {
+		delete(pages, ptr)
+	})
+	return tree
+}
+
+func TestEstimateRange(t *testing.T) {
+	fmt.Println("Testing EstimateRange...")
+
+	tree := memTree()
+	if est := tree.EstimateRange(nil, nil); est.Keys != 0 {
+		t.Errorf("Expected an empty estimate for an empty tree, got %+v", est)
+	}
+
+	const n = 20000
+	val := make([]byte, 50)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		if err := tree.Insert(key, val); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	// the whole tree
+	all := tree.EstimateRange(nil, nil)
+	if all.Keys < n*8/10 || all.Keys > n*12/10 {
+		t.Errorf("Expected about %d keys, got %d", n, all.Keys)
+	}
+	kvSize := uint64(len("key00000000") + len(val))
+	if all.Bytes < all.Keys*kvSize*8/10 || all.Bytes > all.Keys*kvSize*12/10 {
+		t.Errorf("Expected about %d bytes, got %d", all.Keys*kvSize, all.Bytes)
+	}
+
+	// a quarter of the tree
+	start := []byte(fmt.Sprintf("key%08d", n/4))
+	end := []byte(fmt.Sprintf("key%08d", n/2))
+	part := tree.EstimateRange(start, end)
+	if part.Keys < n/4*7/10 || part.Keys > n/4*13/10 {
+		t.Errorf("Expected about %d keys, got %d", n/4, part.Keys)
+	}
+
+	// an inverted range
+	if est := tree.EstimateRange(end, start); est.Keys != 0 {
+		t.Errorf("Expected an empty estimate for an inverted range, got %+v", est)
+	}
+
+	fmt.Println("EstimateRange tests passed!")
+}
@@ -0,0 +1,93 @@
+package btree
+
+import "bytes"
+
+// RangeEstimate is the approximate size of a key range
+type RangeEstimate struct {
+	Keys  uint64 // approximate number of keys in the range
+	Bytes uint64 // approximate number of key and value bytes in the range
+}
+
+// keyPos is where a key falls in the tree, as seen along one root-to-leaf path
+type keyPos struct {
+	pos   float64 // relative position in the key space, in [0, 1]
+	total float64 // estimated number of keys in the whole tree
+	avgKV float64 // average key+value size in the leaf
+}
+
+// EstimateRange approximates the number of keys and bytes in [start, end)
+// without scanning the range. A nil `start` means the beginning of the key
+// space and a nil `end` means the end of it.
+// It descends the tree twice, so it costs O(height) page reads.
+func (tree *BTree) EstimateRange(start []byte, end []byte) RangeEstimate {
+	if tree.root == 0 {
+		return RangeEstimate{}
+	}
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return RangeEstimate{}
+	}
+
+	lo := tree.estimatePos(start)
+	hi := keyPos{pos: 1}
+	if end != nil {
+		hi = tree.estimatePos(end)
+	} else {
+		hi.total, hi.avgKV = lo.total, lo.avgKV
+	}
+	if hi.pos <= lo.pos {
+		return RangeEstimate{}
+	}
+
+	// each path sees a different part of the tree, average them
+	total := (lo.total + hi.total) / 2
+	avgKV := (lo.avgKV + hi.avgKV) / 2
+	keys := (hi.pos - lo.pos) * total
+	return RangeEstimate{
+		Keys:  uint64(keys + 0.5),
+		Bytes: uint64(keys*avgKV + 0.5),
+	}
+}
+
+// estimatePos interpolates the position of a key across the child pointers
+// of each node on the path to its leaf. A nil key is the start of the tree.
+func (tree *BTree) estimatePos(key []byte) keyPos {
+	kp := keyPos{}
+	scale := 1.0  // the fraction of the key space covered by the current node
+	fanout := 1.0 // the estimated number of nodes on the current level
+	node := tree.get(tree.root)
+	for {
+		n := node.nkeys()
+		idx := uint16(0)
+		if key != nil {
+			idx = nodeLookupLE(node, key)
+		}
+		switch node.btype() {
+		case BNODE_NODE:
+			kp.pos += scale * float64(idx) / float64(n)
+			scale /= float64(n)
+			fanout *= float64(n)
+			node = tree.get(node.getPtr(idx))
+		case BNODE_LEAF:
+			// the number of keys in this leaf that are less than the key
+			rank := idx
+			if key != nil && !bytes.Equal(node.getKey(idx), key) {
+				rank++
+			}
+			kp.pos += scale * float64(rank) / float64(n)
+			kp.total = fanout * float64(n)
+			kp.avgKV = leafAvgKV(node)
+			return kp
+		default:
+			panic("invalid node type")
+		}
+	}
+}
+
+// leafAvgKV is the average size of the key-value pairs in a leaf
+func leafAvgKV(node BNode) float64 {
+	n := node.nkeys()
+	// exclude the header, the pointers and the offsets
+	kvBytes := node.nbytes() - HEADER - 8*n - 2*n
+	// exclude the 4-byte KV size prefixes
+	return float64(kvBytes-4*n) / float64(n)
+}
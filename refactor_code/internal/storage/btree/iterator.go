@@ -36,25 +36,41 @@ func (iter *BIter) Deref() ([]byte, []byte) {
 
 // precondition of the Deref()
 func (iter *BIter) Valid() bool {
-	return len(iter.Path) > 0 && len(iter.Pos) > 0
+	if len(iter.Path) == 0 {
+		return false
+	}
+	leaf := iter.Path[len(iter.Path)-1]
+	return iter.Pos[len(iter.Pos)-1] < leaf.NKeys()
 }
 
 // moving backward and forward
 func (iter *BIter) Prev() {
-	iterPrev(iter, len(iter.Path)-1)
+	if len(iter.Path) > 0 {
+		iterPrev(iter, len(iter.Path)-1)
+	}
 }
 
+// moving past the last key leaves the iterator invalid,
+// a Prev() from there goes back to the last key.
 func (iter *BIter) Next() {
-	iterNext(iter, len(iter.Path)-1)
+	if len(iter.Path) == 0 {
+		return
+	}
+	last := len(iter.Path) - 1
+	if !iterNext(iter, last) {
+		iter.Pos[last] = iter.Path[last].NKeys()
+	}
 }
 
-func iterPrev(iter *BIter, level int) {
+func iterPrev(iter *BIter, level int) bool {
 	if iter.Pos[level] > 0 {
 		iter.Pos[level]-- // move within this node
 	} else if level > 0 {
-		iterPrev(iter, level-1) // move to a sibling node
+		if !iterPrev(iter, level-1) { // move to a sibling node
+			return false
+		}
 	} else {
-		return // dummy key
+		return false // dummy key
 	}
 	if level+1 < len(iter.Pos) {
 		// update the kid node
@@ -63,15 +79,18 @@ func iterPrev(iter *BIter, level int) {
 		iter.Path[level+1] = kid
 		iter.Pos[level+1] = kid.NKeys() - 1
 	}
+	return true
 }
 
-func iterNext(iter *BIter, level int) {
+func iterNext(iter *BIter, level int) bool {
 	if iter.Pos[level]+1 < iter.Path[level].NKeys() {
 		iter.Pos[level]++ // move within this node
 	} else if level > 0 {
-		iterNext(iter, level-1) // move to a sibling node
+		if !iterNext(iter, level-1) { // move to a sibling node
+			return false
+		}
 	} else {
-		return // dummy key
+		return false // the last key
 	}
 	if level+1 < len(iter.Pos) {
 		// update the kid node
@@ -80,4 +99,5 @@ func iterNext(iter *BIter, level int) {
 		iter.Path[level+1] = kid
 		iter.Pos[level+1] = 0
 	}
+	return true
 }
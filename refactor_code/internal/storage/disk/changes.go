@@ -0,0 +1,526 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// change operations
+const (
+	CHANGE_PUT = 1
+	CHANGE_DEL = 2
+)
+
+// the change log lives next to the database file
+const CHANGELOG_SUFFIX = ".changes"
+
+const changeNil = 0xffffffff // the encoded length of a nil value
+
+// ChangeEvent is a committed put or delete of a single key
+type ChangeEvent struct {
+	Seq  uint64    // sequence number of the commit
+	Time time.Time // when the commit happened
+	Op   int       // CHANGE_PUT or CHANGE_DEL
+	Key  []byte
+	Old  []byte // nil if the key did not exist
+	New  []byte // nil for deletes
+}
+
+// record the changes of the current commit
+func (db *KV) recordPut(key []byte, old []byte, val []byte) {
+	db.changes.pending = append(db.changes.pending, ChangeEvent{
+		Op:  CHANGE_PUT,
+		Key: cloneBytes(key),
+		Old: cloneBytes(old),
+		New: append([]byte{}, val...), // never nil for puts
+	})
+}
+
+func (db *KV) recordDel(key []byte, old []byte) {
+	db.changes.pending = append(db.changes.pending, ChangeEvent{
+		Op:  CHANGE_DEL,
+		Key: cloneBytes(key),
+		Old: cloneBytes(old),
+	})
+}
+
+// the returned slice does not share memory with mmap'ed pages
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Seq returns the sequence number of the last commit
+func (db *KV) Seq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+// Watch subscribes to the committed puts and deletes of keys under `prefix`.
+// Changes from the commits after `from` are delivered in commit order,
+// so a consumer can restart from the last sequence number it has processed.
+// It fails if the commits after `from` were truncated from the log.
+func (db *KV) Watch(prefix []byte, from uint64) (*Watcher, error) {
+	if db.changes.log == nil {
+		return nil, errors.New("KV.Watch: database is not open")
+	}
+	return db.changes.log.watch(prefix, from)
+}
+
+// TruncateChanges removes the commits up to `upto` from the change log,
+// such as the ones in a base backup, see Backup(). The watchers that
+// have not yet read them stop with an error.
+func (db *KV) TruncateChanges(upto uint64) error {
+	if db.changes.log == nil {
+		return errors.New("KV.TruncateChanges: database is not open")
+	}
+	// no commit is appended meanwhile
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if err := db.changes.log.Truncate(upto); err != nil {
+		return fmt.Errorf("KV.TruncateChanges: %w", err)
+	}
+	return nil
+}
+
+// The change log is a file of records, one per commit:
+// | size | crc32 | seq | time | nevents | events |
+// |  4B  |   4B  |  8B |  8B  |    4B   |  ...   |
+// each event:
+// | op | klen | olen | nlen | key | old | new |
+// | 1B |  4B  |  4B  |  4B  | ... | ... | ... |
+// `size` and `crc32` cover the bytes after them. A nil value has the length 0xffffffff.
+// `time` is the commit time in Unix nanoseconds.
+// A record is committed once the master page contains its sequence number.
+// The log doubles as the archive for point-in-time recovery, so it is
+// only truncated on request, after a base backup. A truncated log starts
+// with a record without events whose sequence number is the last
+// truncated commit.
+type changeLog struct {
+	path    string
+	fp      *os.File
+	mu      sync.Mutex
+	size    int64         // the end of the last committed record
+	tail    int64         // the end of the appended records
+	seq     uint64        // the last committed sequence number
+	first   uint64        // the commits up to it were truncated
+	index   []changeIndex // the offsets of some records, to seek by the sequence
+	count   int           // the number of records
+	gen     int           // incremented when the file is rewritten
+	notify  chan struct{} // closed and replaced on every commit
+	closing chan struct{} // closed when the log is closed
+	closed  bool
+	wg      sync.WaitGroup // running watchers
+}
+
+// a record of the log in changeLog.index
+type changeIndex struct {
+	seq uint64
+	off int64
+}
+
+// every CHANGELOG_INDEX_STEP-th record is in changeLog.index
+const CHANGELOG_INDEX_STEP = 64
+
+// open the change log and discard the records after the commit `committed`
+func openChangeLog(path string, committed uint64) (*changeLog, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open change log: %w", err)
+	}
+	data, err := io.ReadAll(fp)
+	if err != nil {
+		_ = fp.Close()
+		return nil, fmt.Errorf("read change log: %w", err)
+	}
+	cl := &changeLog{
+		path:    path,
+		fp:      fp,
+		notify:  make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	// find the last valid record
+	off := 0
+	for off < len(data) {
+		commit, n, err := decodeChangeRecord(data[off:])
+		if err != nil || commit.seq <= cl.seq || commit.seq > committed {
+			break // torn write or not committed
+		}
+		if off == 0 && len(commit.events) == 0 {
+			cl.first = commit.seq // truncated
+		}
+		cl.addIndex(commit.seq, int64(off))
+		off, cl.seq = off+n, commit.seq
+	}
+	if err := fp.Truncate(int64(off)); err != nil {
+		_ = fp.Close()
+		return nil, fmt.Errorf("truncate change log: %w", err)
+	}
+	cl.size, cl.tail = int64(off), int64(off)
+	return cl, nil
+}
+
+// count a new record at the offset
+func (cl *changeLog) addIndex(seq uint64, off int64) {
+	if cl.count%CHANGELOG_INDEX_STEP == 0 {
+		cl.index = append(cl.index, changeIndex{seq: seq, off: off})
+	}
+	cl.count++
+}
+
+// the offset of the first record after the commit `from`, the caller
+// holds the lock
+func (cl *changeLog) seek(from uint64) (int64, error) {
+	if from < cl.first {
+		return 0, fmt.Errorf("the commits up to %d were truncated from the change log", cl.first)
+	}
+	// the last indexed record not after `from`
+	i := sort.Search(len(cl.index), func(i int) bool { return cl.index[i].seq > from })
+	off := int64(0)
+	if i > 0 {
+		off = cl.index[i-1].off
+	}
+	for off < cl.size {
+		commit, n, err := cl.readLocked(off)
+		if err != nil {
+			return 0, err
+		}
+		if commit.seq > from {
+			break
+		}
+		off += int64(n)
+	}
+	return off, nil
+}
+
+// Close stops the watchers and closes the file
+func (cl *changeLog) Close() {
+	cl.mu.Lock()
+	if cl.closed {
+		cl.mu.Unlock()
+		return
+	}
+	cl.closed = true
+	close(cl.closing)
+	cl.mu.Unlock()
+	cl.wg.Wait()
+	_ = cl.fp.Close()
+}
+
+// Append writes the changes of a commit. They are invisible until Publish().
+func (cl *changeLog) Append(seq uint64, when time.Time, events []ChangeEvent) error {
+	rec := encodeChangeRecord(seq, when, events)
+	if _, err := cl.fp.WriteAt(rec, cl.tail); err != nil {
+		return fmt.Errorf("write change log: %w", err)
+	}
+	if err := cl.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync change log: %w", err)
+	}
+	cl.mu.Lock()
+	cl.addIndex(seq, cl.tail)
+	cl.tail += int64(len(rec))
+	cl.mu.Unlock()
+	return nil
+}
+
+// Truncate rewrites the log without the commits up to `upto`. The
+// records after them are copied to a new file, which replaces the log.
+// It is not called concurrently with Append().
+func (cl *changeLog) Truncate(upto uint64) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	upto = min(upto, cl.seq)
+	if upto <= cl.first {
+		return nil
+	}
+	start, err := cl.seek(upto)
+	if err != nil {
+		return err
+	}
+	rest := make([]byte, cl.size-start)
+	if _, err := cl.fp.ReadAt(rest, start); err != nil {
+		return fmt.Errorf("read change log: %w", err)
+	}
+	marker := encodeChangeRecord(upto, time.Now(), nil)
+
+	tmp := cl.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = fp.Write(append(marker, rest...))
+		if err == nil {
+			err = fp.Sync()
+		}
+		if err == nil {
+			err = os.Rename(tmp, cl.path)
+		}
+		if err != nil {
+			_ = fp.Close()
+			_ = os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("rewrite change log: %w", err)
+	}
+	_ = cl.fp.Close()
+	cl.fp = fp
+
+	// the records are moved by `shift`
+	shift := int64(len(marker)) - start
+	index := []changeIndex{{seq: upto, off: 0}}
+	for _, ent := range cl.index {
+		if ent.off >= start {
+			index = append(index, changeIndex{seq: ent.seq, off: ent.off + shift})
+		}
+	}
+	cl.index = index
+	cl.size += shift
+	cl.tail += shift
+	cl.first = upto
+	cl.gen++
+	return nil
+}
+
+// Publish makes the appended records visible to the watchers
+func (cl *changeLog) Publish(seq uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.size = cl.tail
+	cl.seq = seq
+	close(cl.notify)
+	cl.notify = make(chan struct{})
+}
+
+// the committed part of the log, the channel to wait for more, and the
+// generation of the file
+func (cl *changeLog) state() (int64, chan struct{}, int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.size, cl.notify, cl.gen
+}
+
+// the offset of the first record after the commit `from`, and the
+// generation of the file
+func (cl *changeLog) position(from uint64) (int64, int, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	off, err := cl.seek(from)
+	return off, cl.gen, err
+}
+
+// errChangeLogMoved means that the log was rewritten since the offset was found
+var errChangeLogMoved = errors.New("the change log was rewritten")
+
+// read the record at the offset of the file generation `gen`
+func (cl *changeLog) read(off int64, gen int) (changeRecord, int, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if gen != cl.gen {
+		return changeRecord{}, 0, errChangeLogMoved
+	}
+	return cl.readLocked(off)
+}
+
+func (cl *changeLog) readLocked(off int64) (changeRecord, int, error) {
+	var hdr [8]byte
+	if _, err := cl.fp.ReadAt(hdr[:], off); err != nil {
+		return changeRecord{}, 0, fmt.Errorf("read change log: %w", err)
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:])
+	data := make([]byte, 8+int(size))
+	if _, err := cl.fp.ReadAt(data, off); err != nil {
+		return changeRecord{}, 0, fmt.Errorf("read change log: %w", err)
+	}
+	return decodeChangeRecord(data)
+}
+
+// the decoded form of a log record
+type changeRecord struct {
+	seq    uint64
+	time   time.Time
+	events []ChangeEvent
+}
+
+func encodeChangeRecord(seq uint64, when time.Time, events []ChangeEvent) []byte {
+	rec := make([]byte, 8, 8+20+len(events)*32)
+	rec = binary.LittleEndian.AppendUint64(rec, seq)
+	rec = binary.LittleEndian.AppendUint64(rec, uint64(when.UnixNano()))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(events)))
+	for _, ev := range events {
+		rec = append(rec, byte(ev.Op))
+		rec = appendLen(rec, ev.Key)
+		rec = appendLen(rec, ev.Old)
+		rec = appendLen(rec, ev.New)
+		rec = append(rec, ev.Key...)
+		rec = append(rec, ev.Old...)
+		rec = append(rec, ev.New...)
+	}
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(rec)-8))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+	return rec
+}
+
+func appendLen(out []byte, b []byte) []byte {
+	if b == nil {
+		return binary.LittleEndian.AppendUint32(out, changeNil)
+	}
+	return binary.LittleEndian.AppendUint32(out, uint32(len(b)))
+}
+
+var errBadChangeRecord = errors.New("bad change log record")
+
+// decode a record from the start of `data`, returns the record size
+func decodeChangeRecord(data []byte) (changeRecord, int, error) {
+	if len(data) < 8 {
+		return changeRecord{}, 0, errBadChangeRecord
+	}
+	size := int(binary.LittleEndian.Uint32(data[0:]))
+	if len(data) < 8+size || size < 20 {
+		return changeRecord{}, 0, errBadChangeRecord
+	}
+	body := data[8 : 8+size]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[4:]) {
+		return changeRecord{}, 0, errBadChangeRecord
+	}
+	rec := changeRecord{
+		seq:  binary.LittleEndian.Uint64(body[0:]),
+		time: time.Unix(0, int64(binary.LittleEndian.Uint64(body[8:]))),
+	}
+	count := binary.LittleEndian.Uint32(body[16:])
+	pos := 20
+	for i := uint32(0); i < count; i++ {
+		if pos+13 > len(body) {
+			return changeRecord{}, 0, errBadChangeRecord
+		}
+		ev := ChangeEvent{Seq: rec.seq, Time: rec.time, Op: int(body[pos])}
+		lens := [3]uint32{
+			binary.LittleEndian.Uint32(body[pos+1:]),
+			binary.LittleEndian.Uint32(body[pos+5:]),
+			binary.LittleEndian.Uint32(body[pos+9:]),
+		}
+		pos += 13
+		vals := [3][]byte{}
+		for j, n := range lens {
+			if n == changeNil {
+				continue
+			}
+			if pos+int(n) > len(body) {
+				return changeRecord{}, 0, errBadChangeRecord
+			}
+			vals[j] = body[pos : pos+int(n) : pos+int(n)]
+			pos += int(n)
+		}
+		ev.Key, ev.Old, ev.New = vals[0], vals[1], vals[2]
+		rec.events = append(rec.events, ev)
+	}
+	return rec, 8 + size, nil
+}
+
+// Watcher delivers the committed changes under a key prefix
+type Watcher struct {
+	C      <-chan ChangeEvent // closed when the watcher stops
+	ch     chan ChangeEvent
+	log    *changeLog
+	prefix []byte
+	from   uint64 // the last commit read
+	stop   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (cl *changeLog) watch(prefix []byte, from uint64) (*Watcher, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return nil, errors.New("KV.Watch: change log is closed")
+	}
+	if from < cl.first {
+		return nil, fmt.Errorf("KV.Watch: the commits up to %d were truncated from the change log", cl.first)
+	}
+	ch := make(chan ChangeEvent, 64)
+	w := &Watcher{
+		C:      ch,
+		ch:     ch,
+		log:    cl,
+		prefix: cloneBytes(prefix),
+		from:   from,
+		stop:   make(chan struct{}),
+	}
+	cl.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Close stops the delivery. Events not yet received are dropped.
+func (w *Watcher) Close() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// Err returns the error that stopped the watcher, if any.
+// It is only meaningful after the channel is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// follow the log from the commit after `from`
+func (w *Watcher) run() {
+	defer w.log.wg.Done()
+	defer close(w.ch)
+	off, gen := int64(0), -1
+	for {
+		size, notify, cur := w.log.state()
+		if gen != cur {
+			// the first time, or after the log is rewritten
+			off, gen, w.err = w.log.position(w.from)
+			if w.err != nil {
+				return
+			}
+			continue
+		}
+		for off < size {
+			commit, n, err := w.log.read(off, gen)
+			if err == errChangeLogMoved {
+				gen = -1
+				break
+			}
+			if err != nil {
+				w.err = err
+				return
+			}
+			off += int64(n)
+			w.from = commit.seq
+			for _, ev := range commit.events {
+				if !bytes.HasPrefix(ev.Key, w.prefix) {
+					continue
+				}
+				select {
+				case w.ch <- ev:
+				case <-w.stop:
+					return
+				case <-w.log.closing:
+					return
+				}
+			}
+		}
+		if gen < 0 {
+			continue
+		}
+		select {
+		case <-notify:
+		case <-w.stop:
+			return
+		case <-w.log.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package disk
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receive the next event or fail after a timeout
+func nextChange(t *testing.T, w *Watcher) ChangeEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-w.C:
+		if !ok {
+			t.Fatalf("Watcher stopped: %v", w.Err())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a change")
+	}
+	return ChangeEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	fmt.Println("Testing Watch...")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	w, err := db.Watch([]byte("user:"), 0)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	must(db.Set([]byte("user:1"), []byte("alice")))
+	must(db.Set([]byte("order:1"), []byte("ignored")))
+	must(db.Set([]byte("user:1"), []byte("bob")))
+	_, err = db.Del([]byte("user:1"))
+	must(err)
+
+	ev := nextChange(t, w)
+	if ev.Op != CHANGE_PUT || string(ev.Key) != "user:1" || ev.Old != nil || string(ev.New) != "alice" {
+		t.Errorf("Unexpected first event: %+v", ev)
+	}
+	first := ev.Seq
+	ev = nextChange(t, w)
+	if ev.Op != CHANGE_PUT || string(ev.Old) != "alice" || string(ev.New) != "bob" {
+		t.Errorf("Unexpected second event: %+v", ev)
+	}
+	ev = nextChange(t, w)
+	if ev.Op != CHANGE_DEL || string(ev.Old) != "bob" || ev.New != nil {
+		t.Errorf("Unexpected third event: %+v", ev)
+	}
+	if ev.Seq != first+3 {
+		t.Errorf("Expected seq %d, got %d", first+3, ev.Seq)
+	}
+	w.Close()
+
+	// resume after a restart
+	db.Close()
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if db.Seq() != first+3 {
+		t.Errorf("Expected seq %d after reopen, got %d", first+3, db.Seq())
+	}
+	w, err = db.Watch([]byte("user:"), first)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer w.Close()
+	ev = nextChange(t, w)
+	if string(ev.New) != "bob" || ev.Seq != first+2 {
+		t.Errorf("Expected to resume at the second event, got %+v", ev)
+	}
+	ev = nextChange(t, w)
+	if ev.Op != CHANGE_DEL {
+		t.Errorf("Expected the delete, got %+v", ev)
+	}
+	must(db.Set([]byte("user:2"), []byte("carol")))
+	ev = nextChange(t, w)
+	if string(ev.Key) != "user:2" || ev.Seq != first+4 {
+		t.Errorf("Expected the new put, got %+v", ev)
+	}
+
+	fmt.Println("Watch tests passed!")
+}
+
+func TestReopenPersistence(t *testing.T) {
+	fmt.Println("Testing KV reopen...")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	const n = 3000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := db.Set(key, []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < n; i += 97 {
+		val, ok := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if !ok || string(val) != fmt.Sprintf("val%d", i) {
+			t.Errorf("Expected val%d, got %q %v", i, val, ok)
+		}
+	}
+
+	fmt.Println("KV reopen tests passed!")
+}
@@ -3,34 +3,27 @@ package disk
 import (
 	"fmt"
 	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
-	"govetachun/go-mini-db/refactor_code/pkg/utils"
-	"os"
-	"syscall"
+	"time"
 )
 
-const DB_SIG = "BuildYourOwnDB06"
-
 func (db *KV) Open() error {
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	err := db.file.Open(db.Path)
 	if err != nil {
-		return fmt.Errorf("OpenFile: %w", err)
+		return fmt.Errorf("KV.Open: %w", err)
 	}
-	db.fp = fp
-	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
+	// the committed tree, transactions update their own copy of it
+	db.tree.SetGet(db.pageRead)
+	// read the master page
+	err = masterLoad(db)
 	if err != nil {
 		goto fail
 	}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
-	// btree callbacks
-	db.tree.SetGet(db.pageGet)
-	db.tree.SetNew(db.pageNew)
-	db.tree.SetDel(db.pageDel)
-	// read the master page
-	err = masterLoad(db)
+	// open the change log, discarding records that were never committed
+	if db.ChangeLog == "" {
+		db.ChangeLog = db.Path + CHANGELOG_SUFFIX
+	}
+	db.changes.log, err = openChangeLog(db.ChangeLog, db.seq)
 	if err != nil {
 		goto fail
 	}
@@ -43,34 +36,23 @@ fail:
 
 // cleanups
 func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		utils.Assert(err == nil, "err == nil")
+	if db.changes.log != nil {
+		db.changes.log.Close()
+		db.changes.log = nil
 	}
-	_ = db.fp.Close()
+	db.file.Close()
 }
 
 func writePages(db *KV) error {
-	// update the free list
-	freed := []uint64{}
-	for ptr, page := range db.page.updates {
-		if page == nil {
-			freed = append(freed, ptr)
-		}
-	}
-	db.free.Update(db.page.nfree, freed)
 	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + db.free.Total()
-	if err := extendFile(db, npages); err != nil {
-		return err
-	}
-	if err := extendMmap(db, npages); err != nil {
+	npages := int(db.page.flushed) + db.page.nappend
+	if err := db.file.Extend(npages); err != nil {
 		return err
 	}
 	// copy data to the file
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr).GetData(), page)
+			copy(db.file.Page(ptr).GetData(), page)
 		}
 	}
 	return nil
@@ -84,78 +66,122 @@ func flushPages(db *KV) error {
 	return syncPages(db)
 }
 
-// | sig | root_ptr | page_used |
-// | 16B |    8B    |     8B    |
 func syncPages(db *KV) error {
 	// flush data to the disk. must be done before updating the master page.
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if err := db.file.Sync(); err != nil {
+		return err
 	}
-	db.page.flushed += uint64(db.free.Total())
-	db.free.head = db.free.head
+	pages := db.page.updates
+	nfree := db.page.nfree
+	db.page.flushed += uint64(db.page.nappend)
 	db.page.nfree = 0
 	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	// the change log must also reach the disk before the master page,
+	// the commit sequence number in the master page marks it as committed.
+	changes := db.changes.pending
+	db.changes.pending = nil
+	if len(changes) == 0 && len(pages) == 0 {
+		return nil // nothing was committed
+	}
+	when := db.changes.time
+	if when.IsZero() {
+		when = time.Now()
+	}
+	db.changes.time = time.Time{}
+	db.seq++
+	if len(changes) > 0 {
+		if err := db.changes.log.Append(db.seq, when, changes); err != nil {
+			db.seq--
+			return err
+		}
+	}
 	// update & flush the master page
-	if err := masterStore(db); err != nil {
+	if err := db.file.StoreMaster(db.master()); err != nil {
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
 		return err
 	}
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	// the freed pages can be reused once the old tree is unreachable
+	freed := []uint64{}
+	for ptr, page := range pages {
+		if page == nil {
+			freed = append(freed, ptr)
+		}
+	}
+	db.free.Update(nfree, freed)
+	// the commit is durable, let the watchers and the followers see it
+	if len(changes) > 0 {
+		db.changes.log.Publish(db.seq)
 	}
+	db.shipPages(pages)
 	return nil
 }
 
 // read the db
 func (db *KV) Get(key []byte) ([]byte, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.tree.Get(key)
 }
 
+// Scan visits the committed keys >= start in order until `fn` returns false.
+// The database cannot be updated from `fn`.
+func (db *KV) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	scanTree(&db.tree, start, fn)
+}
+
+// single-key updates are transactions on their own
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	_, err := db.Update(key, val, 0)
+	return err
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	deleted, err := tx.Del(key)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
 }
 
 func (db *KV) Update(key []byte, val []byte, mode int) (bool, error) {
-	switch mode {
-	case 0: // MODE_UPSERT - insert or replace
-		db.tree.Insert(key, val)
-		return true, flushPages(db)
-	case 1: // MODE_UPDATE_ONLY - update existing keys
-		if _, exists := db.tree.Get(key); exists {
-			db.tree.Insert(key, val)
-			return true, flushPages(db)
-		}
-		return false, nil
-	case 2: // MODE_INSERT_ONLY - only add new keys
-		if _, exists := db.tree.Get(key); !exists {
-			db.tree.Insert(key, val)
-			return true, flushPages(db)
-		}
-		return false, nil
-	default:
-		return false, fmt.Errorf("invalid mode: %d", mode)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	updated, err := tx.Update(key, val, mode)
+	if err != nil || !updated {
+		tx.Abort()
+		return false, err
 	}
+	return true, tx.Commit()
 }
 
-// Helper functions for master page operations (simplified implementations)
+// read the master page, see PageFile.LoadMaster()
 func masterLoad(db *KV) error {
-	// Load master page - simplified implementation
-	if db.mmap.file == 0 {
-		// Empty file, initialize
-		db.page.updates = make(map[uint64][]byte)
-		return nil
+	db.page.updates = map[uint64][]byte{}
+	m, err := db.file.LoadMaster()
+	if err != nil {
+		return err
 	}
+	db.tree.SetRoot(m.Root)
+	db.page.flushed = m.Used
+	db.seq = m.Seq
 	return nil
 }
 
-func masterStore(db *KV) error {
-	// Store master page - simplified implementation
-	return nil
+// the master page of the current state
+func (db *KV) master() Master {
+	return Master{Root: db.tree.GetRoot(), Used: db.page.flushed, Seq: db.seq}
 }
 
 // Exported methods for transaction use
@@ -180,11 +206,11 @@ func (db *KV) FlushPages() error {
 }
 
 func (db *KV) Sync() error {
-	return db.fp.Sync()
+	return db.file.Sync()
 }
 
 func (db *KV) StoreMaster() error {
-	return masterStore(db)
+	return db.file.StoreMaster(db.master())
 }
 
 func (db *KV) ResetPages() {
@@ -196,3 +222,10 @@ func (db *KV) ResetPages() {
 func (db *KV) GetTree() *btree.BTree {
 	return &db.tree
 }
+
+// EstimateRange approximates the number of keys and bytes in [start, end)
+func (db *KV) EstimateRange(start []byte, end []byte) btree.RangeEstimate {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.tree.EstimateRange(start, end)
+}
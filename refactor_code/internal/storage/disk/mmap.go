@@ -1,8 +1,11 @@
 package disk
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
 	"govetachun/go-mini-db/refactor_code/pkg/utils"
 	"os"
 	"syscall"
@@ -10,6 +13,92 @@ import (
 
 const BTREE_PAGE_SIZE = 4096
 
+const DB_SIG = "BuildYourOwnDB06"
+
+// PageFile is a database file of BTREE_PAGE_SIZE pages, read and written
+// through mmap. The page 0 is the master page. It is the storage of both
+// this KV and the concurrent one of the concurrency package.
+type PageFile struct {
+	fp   *os.File
+	mmap struct {
+		file   int      // file size, can be larger than the database size
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+}
+
+// Open opens or creates the file and maps it
+func (f *PageFile) Open(path string) error {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	f.fp = fp
+	// create the initial mmap
+	sz, chunk, err := mmapInit(f.fp)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.mmap.file = sz
+	f.mmap.total = len(chunk)
+	f.mmap.chunks = [][]byte{chunk}
+	return nil
+}
+
+// Close unmaps and closes the file
+func (f *PageFile) Close() {
+	for _, chunk := range f.mmap.chunks {
+		err := syscall.Munmap(chunk)
+		utils.Assert(err == nil, "err == nil")
+	}
+	f.mmap.chunks = nil
+	if f.fp != nil {
+		_ = f.fp.Close()
+	}
+}
+
+// Chunks returns the mmaps. Extend() only adds new ones, so a copy of
+// the list keeps reading the pages that existed when it was taken.
+func (f *PageFile) Chunks() [][]byte {
+	return f.mmap.chunks
+}
+
+// Page returns a page of the mmap
+func (f *PageFile) Page(ptr uint64) btree.BNode {
+	return MappedPage(f.mmap.chunks, ptr)
+}
+
+// MappedPage returns a page of a list of mmaps, see Chunks()
+func MappedPage(chunks [][]byte, ptr uint64) btree.BNode {
+	start := uint64(0)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return btree.NewBNode(chunk[offset : offset+BTREE_PAGE_SIZE])
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+// Extend extends the file and the mmap to at least `npages`
+func (f *PageFile) Extend(npages int) error {
+	if err := extendFile(f, npages); err != nil {
+		return err
+	}
+	return extendMmap(f, npages*BTREE_PAGE_SIZE)
+}
+
+// Sync flushes the file to the disk
+func (f *PageFile) Sync() error {
+	if err := f.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
 // create the initial mmap that covers the whole file.
 func mmapInit(fp *os.File) (int, []byte, error) {
 	fi, err := fp.Stat()
@@ -36,29 +125,29 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 }
 
 // extend the mmap by adding new mappings.
-func extendMmap(db *KV, size int) error {
-	if size <= db.mmap.total {
+func extendMmap(f *PageFile, size int) error {
+	if size <= f.mmap.total {
 		return nil // enough range
 	}
-	alloc := max(db.mmap.total, 64<<20) // double the current address space
-	for db.mmap.total+alloc < size {
+	alloc := max(f.mmap.total, 64<<20) // double the current address space
+	for f.mmap.total+alloc < size {
 		alloc *= 2 // still not enough?
 	}
 	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), alloc,
-		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
+		int(f.fp.Fd()), int64(f.mmap.total), alloc,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
 	)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
-	db.mmap.total += alloc
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	f.mmap.total += alloc
+	f.mmap.chunks = append(f.mmap.chunks, chunk)
 	return nil
 }
 
 // extend the file to at least `npages`.
-func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+func extendFile(f *PageFile, npages int) error {
+	filePages := f.mmap.file / BTREE_PAGE_SIZE
 	if filePages >= npages {
 		return nil
 	}
@@ -72,12 +161,65 @@ func extendFile(db *KV, npages int) error {
 		filePages += inc
 	}
 	fileSize := filePages * BTREE_PAGE_SIZE
-	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+	err := syscall.Fallocate(int(f.fp.Fd()), 0, 0, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
-	db.mmap.file = fileSize
+	f.mmap.file = fileSize
+	return nil
+}
+
+// Master is the content of the master page.
+// it contains the pointer to the root and other important bits.
+// | sig | btree_root | page_used | commit_seq |
+// | 16B |     8B     |     8B    |     8B     |
+type Master struct {
+	Root uint64 // the root of the B-tree
+	Used uint64 // database size in number of pages
+	Seq  uint64 // the sequence number of the last commit
+}
+
+// LoadMaster reads and verifies the master page.
+// An empty file has no master page yet, it is created on the first write.
+func (f *PageFile) LoadMaster() (Master, error) {
+	if f.mmap.file == 0 {
+		return Master{Used: 1}, nil // reserved for the master page
+	}
+	data := f.mmap.chunks[0]
+	m := Master{
+		Root: binary.LittleEndian.Uint64(data[16:]),
+		Used: binary.LittleEndian.Uint64(data[24:]),
+		Seq:  binary.LittleEndian.Uint64(data[32:]),
+	}
+	// verify the page
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		return Master{}, errors.New("Bad signature.")
+	}
+	bad := !(1 <= m.Used && m.Used <= uint64(f.mmap.file/BTREE_PAGE_SIZE))
+	bad = bad || !(m.Root < m.Used)
+	if bad {
+		return Master{}, errors.New("Bad master page.")
+	}
+	return m, nil
+}
+
+// StoreMaster updates the master page. it must be atomic.
+func (f *PageFile) StoreMaster(m Master) error {
+	data := m.encode()
+	// NOTE: Updating the page via mmap is not atomic.
+	// Use the `pwrite()` syscall instead.
+	_, err := f.fp.WriteAt(data[:], 0)
+	if err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
 	return nil
 }
 
-// Remove KV definition from here as it's defined in page_manager.go
+func (m Master) encode() [40]byte {
+	var data [40]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], m.Root)
+	binary.LittleEndian.PutUint64(data[24:], m.Used)
+	binary.LittleEndian.PutUint64(data[32:], m.Seq)
+	return data
+}
@@ -3,20 +3,19 @@ package disk
 import (
 	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
 	"govetachun/go-mini-db/refactor_code/pkg/utils"
-	"os"
+	"sync"
+	"time"
 )
 
 // KV represents the key-value store with page management
 type KV struct {
 	Path string
+	// the change log, which is also the archive of the commits for recovery.
+	// defaults to Path + CHANGELOG_SUFFIX.
+	ChangeLog string
 	// internals
-	fp   *os.File
+	file PageFile
 	tree btree.BTree
-	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
 	page struct {
 		flushed uint64 // database size in number of pages
 		nfree   int    // number of pages taken from the free list
@@ -26,6 +25,21 @@ type KV struct {
 		updates map[uint64][]byte
 	}
 	free FreeList
+	// the sequence number of the last commit, stored in the master page
+	seq     uint64
+	changes struct {
+		log     *changeLog    // committed puts and deletes, for watchers
+		pending []ChangeEvent // changes of the current commit
+		time    time.Time     // the commit time when replaying, otherwise now
+	}
+	replica struct {
+		following bool       // read-only, updated by Follow()
+		shippers  []*Shipper // followers of this database
+	}
+	// readers vs. commits and applied page sets
+	mu sync.RWMutex
+	// serializes the transactions, see KVTX
+	writer sync.Mutex
 }
 
 // FreeList represents the free list for page management
@@ -45,34 +59,12 @@ func (db *KV) pageGet(ptr uint64) btree.BNode {
 		utils.Assert(page != nil, "page != nil")
 		return btree.NewBNode(page) // for new pages
 	}
-	return pageGetMapped(db, ptr) // for written pages
-}
-
-func pageGetMapped(db *KV, ptr uint64) btree.BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return btree.NewBNode(chunk[offset : offset+BTREE_PAGE_SIZE])
-		}
-		start = end
-	}
-	panic("bad ptr")
+	return db.file.Page(ptr) // for written pages
 }
 
 // callback for BTree, read a page.
 func (db *KV) pageRead(ptr uint64) btree.BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return btree.NewBNode(chunk[offset : offset+BTREE_PAGE_SIZE])
-		}
-		start = end
-	}
-	panic("bad ptr")
+	return db.file.Page(ptr)
 }
 
 // callback for FreeList, allocate a new page.
@@ -0,0 +1,161 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Backup writes a consistent copy of the database to a new file.
+// The copy is a base backup for Restore(), the commits after it are
+// replayed from the change log. It returns the sequence number of the
+// last commit in the copy, the change log can be truncated up to it
+// by TruncateChanges().
+func (db *KV) Backup(path string) (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := db.backup(path); err != nil {
+		return 0, fmt.Errorf("KV.Backup: %w", err)
+	}
+	return db.seq, nil
+}
+
+func (db *KV) backup(path string) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	// the master page, then the used pages
+	master := make([]byte, BTREE_PAGE_SIZE)
+	data := db.master().encode()
+	copy(master, data[:])
+	if _, err := fp.Write(master); err != nil {
+		return err
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if _, err := fp.Write(db.file.Page(ptr).GetData()); err != nil {
+			return err
+		}
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// RestoreTarget is where the recovery stops. Zero fields are not limits.
+type RestoreTarget struct {
+	Seq  uint64    // the last commit to replay
+	Time time.Time // replay the commits made at or before this time
+}
+
+// reached reports whether the commit is past the target
+func (t RestoreTarget) reached(seq uint64, when time.Time) bool {
+	if t.Seq != 0 && seq > t.Seq {
+		return true
+	}
+	return !t.Time.IsZero() && when.After(t.Time)
+}
+
+// Restore creates the database `out` from the base backup `base` and replays
+// the commits archived in the change log `archive` up to the target.
+// It returns the sequence number of the last replayed commit.
+func Restore(base string, archive string, out string, target RestoreTarget) (uint64, error) {
+	if _, err := os.Stat(out + CHANGELOG_SUFFIX); err == nil {
+		return 0, fmt.Errorf("Restore: %s already exists", out+CHANGELOG_SUFFIX)
+	}
+	if err := copyFile(base, out); err != nil {
+		return 0, fmt.Errorf("Restore: %w", err)
+	}
+	log, err := os.ReadFile(archive)
+	if err != nil {
+		return 0, fmt.Errorf("Restore: read archive: %w", err)
+	}
+
+	db := &KV{Path: out}
+	if err := db.Open(); err != nil {
+		return 0, fmt.Errorf("Restore: %w", err)
+	}
+	defer db.Close()
+	for off := 0; off < len(log); {
+		commit, n, err := decodeChangeRecord(log[off:])
+		if err != nil {
+			break // the archive ends with a torn write
+		}
+		off += n
+		if len(commit.events) == 0 {
+			// the start of a truncated archive
+			if commit.seq > db.seq {
+				return 0, fmt.Errorf("Restore: the archive starts after commit %d, the base backup is at %d",
+					commit.seq, db.seq)
+			}
+			continue
+		}
+		if commit.seq <= db.seq {
+			continue // already in the base backup
+		}
+		if target.reached(commit.seq, commit.time) {
+			break
+		}
+		if err := db.replay(commit); err != nil {
+			return 0, fmt.Errorf("Restore: commit %d: %w", commit.seq, err)
+		}
+	}
+	return db.seq, nil
+}
+
+var errArchiveMismatch = errors.New("the archive does not match the base backup")
+
+// apply an archived commit with its original sequence number and time
+func (db *KV) replay(commit changeRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, ev := range commit.events {
+		cur, ok := tx.Get(ev.Key)
+		if ok != (ev.Old != nil) || !bytes.Equal(cur, ev.Old) {
+			tx.Abort()
+			return errArchiveMismatch
+		}
+		switch ev.Op {
+		case CHANGE_PUT:
+			err = tx.Set(ev.Key, ev.New)
+		case CHANGE_DEL:
+			_, err = tx.Del(ev.Key)
+		default:
+			err = fmt.Errorf("bad change op: %d", ev.Op)
+		}
+		if err != nil {
+			tx.Abort()
+			return err
+		}
+	}
+	db.mu.Lock()
+	db.seq = commit.seq - 1
+	db.changes.time = commit.time
+	db.mu.Unlock()
+	return tx.Commit()
+}
+
+// copy a file, failing if the destination exists
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,195 @@
+package disk
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPointInTimeRestore(t *testing.T) {
+	fmt.Println("Testing point-in-time restore...")
+
+	dir := t.TempDir()
+	db := &KV{Path: filepath.Join(dir, "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	set := func(key string, val string) {
+		t.Helper()
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	set("a", "1")
+	base := filepath.Join(dir, "base.db")
+	if _, err := db.Backup(base); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	set("a", "2")
+	set("b", "1")
+	middle := db.Seq()
+	time.Sleep(10 * time.Millisecond)
+	beforeDeploy := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	set("a", "bad")
+	if _, err := db.Del([]byte("b")); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	db.Close()
+	archive := db.ChangeLog
+
+	check := func(path string, want map[string]string) {
+		t.Helper()
+		restored := &KV{Path: path}
+		if err := restored.Open(); err != nil {
+			t.Fatalf("Failed to open the restored db: %v", err)
+		}
+		defer restored.Close()
+		for _, key := range []string{"a", "b"} {
+			val, ok := restored.Get([]byte(key))
+			if want[key] == "" && ok {
+				t.Errorf("Expected %s to be absent, got %q", key, val)
+			} else if want[key] != "" && string(val) != want[key] {
+				t.Errorf("Expected %s=%s, got %q %v", key, want[key], val, ok)
+			}
+		}
+	}
+
+	// restore by time
+	out := filepath.Join(dir, "by_time.db")
+	last, err := Restore(base, archive, out, RestoreTarget{Time: beforeDeploy})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if last != middle {
+		t.Errorf("Expected to stop at commit %d, got %d", middle, last)
+	}
+	check(out, map[string]string{"a": "2", "b": "1"})
+
+	// restore by sequence number
+	out = filepath.Join(dir, "by_seq.db")
+	if _, err := Restore(base, archive, out, RestoreTarget{Seq: middle - 1}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	check(out, map[string]string{"a": "2"})
+
+	// replay everything
+	out = filepath.Join(dir, "all.db")
+	if _, err := Restore(base, archive, out, RestoreTarget{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	check(out, map[string]string{"a": "bad"})
+
+	// the output is never overwritten
+	if _, err := Restore(base, archive, out, RestoreTarget{}); err == nil {
+		t.Errorf("Expected an error when the output exists")
+	}
+
+	fmt.Println("Point-in-time restore tests passed!")
+}
+
+func TestTruncateChanges(t *testing.T) {
+	fmt.Println("Testing change log truncation...")
+
+	dir := t.TempDir()
+	db := &KV{Path: filepath.Join(dir, "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	set := func(key string, val string) {
+		t.Helper()
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// more commits than CHANGELOG_INDEX_STEP, so Watch() seeks by the index
+	for i := 0; i < 3*CHANGELOG_INDEX_STEP; i++ {
+		set(fmt.Sprintf("k%03d", i), "old")
+	}
+	oldBase := filepath.Join(dir, "old_base.db")
+	if _, err := db.Backup(oldBase); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	set("a", "1")
+	// a watcher behind the truncation point
+	behind, err := db.Watch([]byte("a"), 0)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	base := filepath.Join(dir, "base.db")
+	seq, err := db.Backup(base)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if ev := nextChange(t, behind); string(ev.Key) != "a" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	from := seq - 2*CHANGELOG_INDEX_STEP
+	w, err := db.Watch([]byte("k"), from)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	if ev := nextChange(t, w); ev.Seq != from+1 {
+		t.Errorf("Expected to start after commit %d, got %+v", from, ev)
+	}
+
+	if err := db.TruncateChanges(seq); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	set("a", "2")
+	if ev := nextChange(t, behind); string(ev.New) != "2" {
+		t.Errorf("Expected the watcher to continue after the truncation, got %+v", ev)
+	}
+	behind.Close()
+	// the watcher on k has not read all of its commits, which were truncated
+	for range w.C {
+	}
+	if w.Err() == nil {
+		t.Errorf("Expected the watcher to stop on the truncation")
+	}
+	if _, err := db.Watch(nil, seq-1); err == nil {
+		t.Errorf("Expected an error watching truncated commits")
+	}
+	db.Close()
+
+	// the truncation point is kept in the log
+	db = &KV{Path: filepath.Join(dir, "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if _, err := db.Watch(nil, seq-1); err == nil {
+		t.Errorf("Expected an error watching truncated commits after reopen")
+	}
+	w, err = db.Watch(nil, seq)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	if ev := nextChange(t, w); string(ev.Key) != "a" || string(ev.New) != "2" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	w.Close()
+	db.Close()
+
+	// the archive restores the new base backup, but not the older one
+	archive := db.ChangeLog
+	if _, err := Restore(oldBase, archive, filepath.Join(dir, "old.db"), RestoreTarget{}); err == nil {
+		t.Errorf("Expected an error restoring a base backup older than the archive")
+	}
+	out := filepath.Join(dir, "new.db")
+	if _, err := Restore(base, archive, out, RestoreTarget{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored := &KV{Path: out}
+	if err := restored.Open(); err != nil {
+		t.Fatalf("Failed to open the restored db: %v", err)
+	}
+	defer restored.Close()
+	if val, _ := restored.Get([]byte("a")); string(val) != "2" {
+		t.Errorf("Expected a=2, got %q", val)
+	}
+
+	fmt.Println("Change log truncation tests passed!")
+}
@@ -0,0 +1,257 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// ErrFollower is returned when updating a database that follows a primary
+var ErrFollower = errors.New("the database is a read-only follower")
+
+// page set flags
+const (
+	PAGESET_SNAPSHOT = 1 // contains every page of the database
+)
+
+// PageSet is a committed set of pages plus the new master page.
+// A follower applies them in order to mirror the primary.
+type PageSet struct {
+	Seq   uint64            // the commit sequence number
+	Flags uint32            // PAGESET_SNAPSHOT
+	Root  uint64            // the B-tree root
+	Used  uint64            // database size in number of pages
+	Pages map[uint64][]byte // page contents keyed by the pointer
+}
+
+// The page set format on the wire:
+// | size | crc32 | seq | flags | root | used | npages | pages |
+// |  4B  |   4B  |  8B |  4B   |  8B  |  8B  |   4B   |  ...  |
+// each page:
+// | ptr | data  |
+// | 8B  | 4096B |
+// `size` and `crc32` cover the bytes after them.
+func encodePageSet(ps *PageSet) []byte {
+	ptrs := make([]uint64, 0, len(ps.Pages))
+	for ptr := range ps.Pages {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+
+	out := make([]byte, 8, 8+32+len(ptrs)*(8+BTREE_PAGE_SIZE))
+	out = binary.LittleEndian.AppendUint64(out, ps.Seq)
+	out = binary.LittleEndian.AppendUint32(out, ps.Flags)
+	out = binary.LittleEndian.AppendUint64(out, ps.Root)
+	out = binary.LittleEndian.AppendUint64(out, ps.Used)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(ptrs)))
+	for _, ptr := range ptrs {
+		out = binary.LittleEndian.AppendUint64(out, ptr)
+		page := make([]byte, BTREE_PAGE_SIZE)
+		copy(page, ps.Pages[ptr])
+		out = append(out, page...)
+	}
+	binary.LittleEndian.PutUint32(out[0:], uint32(len(out)-8))
+	binary.LittleEndian.PutUint32(out[4:], crc32.ChecksumIEEE(out[8:]))
+	return out
+}
+
+var errBadPageSet = errors.New("bad page set")
+
+// read the next page set from the stream
+func readPageSet(r io.Reader) (*PageSet, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err // io.EOF at a frame boundary
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:])
+	if size < 32 || (size-32)%(8+BTREE_PAGE_SIZE) != 0 {
+		return nil, errBadPageSet
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read page set: %w", err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, errBadPageSet
+	}
+	ps := &PageSet{
+		Seq:   binary.LittleEndian.Uint64(body[0:]),
+		Flags: binary.LittleEndian.Uint32(body[8:]),
+		Root:  binary.LittleEndian.Uint64(body[12:]),
+		Used:  binary.LittleEndian.Uint64(body[20:]),
+		Pages: map[uint64][]byte{},
+	}
+	count := int(binary.LittleEndian.Uint32(body[28:]))
+	if count != int(size-32)/(8+BTREE_PAGE_SIZE) {
+		return nil, errBadPageSet
+	}
+	for pos := 32; pos < len(body); pos += 8 + BTREE_PAGE_SIZE {
+		ptr := binary.LittleEndian.Uint64(body[pos:])
+		ps.Pages[ptr] = body[pos+8 : pos+8+BTREE_PAGE_SIZE]
+	}
+	return ps, nil
+}
+
+// Shipper sends the committed page sets of a primary to a follower
+type Shipper struct {
+	db  *KV
+	w   io.Writer
+	err error
+}
+
+// Ship starts replicating the database to `w`, which is usually a pipe
+// or a socket read by the follower's Follow(). The first page set is a
+// snapshot of the whole database, then every commit is sent in order.
+// Sending is synchronous, so a slow follower slows down the commits.
+func (db *KV) Ship(w io.Writer) (*Shipper, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	snap := &PageSet{
+		Seq:   db.seq,
+		Flags: PAGESET_SNAPSHOT,
+		Root:  db.tree.GetRoot(),
+		Used:  db.page.flushed,
+		Pages: map[uint64][]byte{},
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		snap.Pages[ptr] = db.file.Page(ptr).GetData()
+	}
+	if _, err := w.Write(encodePageSet(snap)); err != nil {
+		return nil, fmt.Errorf("KV.Ship: %w", err)
+	}
+	s := &Shipper{db: db, w: w}
+	db.replica.shippers = append(db.replica.shippers, s)
+	return s, nil
+}
+
+// Close stops sending page sets to the follower
+func (s *Shipper) Close() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.removeShipper(s)
+}
+
+// Err returns the error that stopped the replication, if any
+func (s *Shipper) Err() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.err
+}
+
+func (db *KV) removeShipper(s *Shipper) {
+	for i, other := range db.replica.shippers {
+		if other == s {
+			db.replica.shippers = append(db.replica.shippers[:i], db.replica.shippers[i+1:]...)
+			return
+		}
+	}
+}
+
+// send the pages of the last commit to the followers.
+// a follower that fails to receive them is dropped.
+func (db *KV) shipPages(updates map[uint64][]byte) {
+	if len(db.replica.shippers) == 0 {
+		return
+	}
+	ps := &PageSet{
+		Seq:   db.seq,
+		Root:  db.tree.GetRoot(),
+		Used:  db.page.flushed,
+		Pages: map[uint64][]byte{},
+	}
+	for ptr, page := range updates {
+		if page != nil {
+			ps.Pages[ptr] = page
+		}
+	}
+	data := encodePageSet(ps)
+	for _, s := range append([]*Shipper{}, db.replica.shippers...) {
+		if _, err := s.w.Write(data); err != nil {
+			s.err = fmt.Errorf("ship page set %d: %w", ps.Seq, err)
+			db.removeShipper(s)
+		}
+	}
+}
+
+// Follow makes the database a read-only follower and applies the page sets
+// read from `r` until the end of the stream or until Promote().
+// Readers keep seeing the state of the last applied commit meanwhile.
+func (db *KV) Follow(r io.Reader) error {
+	db.mu.Lock()
+	db.replica.following = true
+	db.mu.Unlock()
+	for {
+		ps, err := readPageSet(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("KV.Follow: %w", err)
+		}
+		err = db.ApplyPageSet(ps)
+		if errors.Is(err, errPromoted) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errPromoted = errors.New("the follower has been promoted")
+
+// ApplyPageSet writes the pages of a primary's commit and switches to its root
+func (db *KV) ApplyPageSet(ps *PageSet) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.replica.following {
+		return errPromoted
+	}
+	if ps.Flags&PAGESET_SNAPSHOT == 0 && ps.Seq != db.seq+1 {
+		return fmt.Errorf("KV.ApplyPageSet: expected commit %d, got %d", db.seq+1, ps.Seq)
+	}
+	if !(1 <= ps.Used && ps.Root < ps.Used) {
+		return errors.New("KV.ApplyPageSet: bad master page")
+	}
+	// write the pages, the current root does not reference them
+	if err := db.file.Extend(int(ps.Used)); err != nil {
+		return err
+	}
+	for ptr, page := range ps.Pages {
+		if ptr == 0 || ptr >= ps.Used {
+			return fmt.Errorf("KV.ApplyPageSet: bad page pointer %d", ptr)
+		}
+		copy(db.file.Page(ptr).GetData(), page)
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	// switch to the new root
+	db.tree.SetRoot(ps.Root)
+	db.page.flushed = ps.Used
+	db.seq = ps.Seq
+	if err := db.file.StoreMaster(db.master()); err != nil {
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Promote turns a follower into a primary that accepts updates.
+// Follow() returns before applying any further page set.
+// The change log of a follower does not contain the primary's commits,
+// so watchers of the promoted database only see the new commits.
+func (db *KV) Promote() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.replica.following {
+		return errors.New("KV.Promote: the database is not a follower")
+	}
+	db.replica.following = false
+	return nil
+}
@@ -0,0 +1,97 @@
+package disk
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// wait until the follower has applied the commit `seq`
+func waitSeq(t *testing.T, db *KV, seq uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Seq() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for commit %d, at %d", seq, db.Seq())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	fmt.Println("Testing Replication...")
+
+	primary := &KV{Path: filepath.Join(t.TempDir(), "primary.db")}
+	if err := primary.Open(); err != nil {
+		t.Fatalf("Failed to open primary: %v", err)
+	}
+	defer primary.Close()
+	follower := &KV{Path: filepath.Join(t.TempDir(), "follower.db")}
+	if err := follower.Open(); err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer follower.Close()
+
+	// data written before the follower starts comes with the snapshot
+	for i := 0; i < 500; i++ {
+		if err := primary.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v1")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- follower.Follow(r) }()
+	shipper, err := primary.Ship(w)
+	if err != nil {
+		t.Fatalf("Failed to ship: %v", err)
+	}
+	waitSeq(t, follower, primary.Seq())
+
+	// then every commit
+	for i := 250; i < 1000; i++ {
+		if err := primary.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v2")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if _, err := primary.Del([]byte("key0000")); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	waitSeq(t, follower, primary.Seq())
+	for i := 1; i < 1000; i++ {
+		want := "v1"
+		if i >= 250 {
+			want = "v2"
+		}
+		val, ok := follower.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if !ok || string(val) != want {
+			t.Fatalf("Expected %s for key%04d, got %q %v", want, i, val, ok)
+		}
+	}
+	if _, ok := follower.Get([]byte("key0000")); ok {
+		t.Errorf("Expected the deleted key to be gone on the follower")
+	}
+	if err := follower.Set([]byte("x"), []byte("y")); err != ErrFollower {
+		t.Errorf("Expected ErrFollower, got %v", err)
+	}
+
+	// promote the follower
+	shipper.Close()
+	if err := follower.Promote(); err != nil {
+		t.Fatalf("Failed to promote: %v", err)
+	}
+	_ = w.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Follow failed: %v", err)
+	}
+	if err := follower.Set([]byte("key0000"), []byte("v3")); err != nil {
+		t.Fatalf("Set on the promoted follower failed: %v", err)
+	}
+	if val, ok := follower.Get([]byte("key0000")); !ok || string(val) != "v3" {
+		t.Errorf("Expected v3, got %q %v", val, ok)
+	}
+
+	fmt.Println("Replication tests passed!")
+}
@@ -0,0 +1,144 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+	"time"
+)
+
+// KVTX is a read-write transaction.
+// Its updates are invisible to the readers until Commit(),
+// which makes all of them durable in a single commit.
+// Writers are serialized by `KV.writer`, only one transaction runs at a time.
+type KVTX struct {
+	db   *KV
+	tree btree.BTree
+	done bool
+}
+
+// begin a transaction
+func (db *KV) Begin() (*KVTX, error) {
+	db.writer.Lock()
+	db.mu.RLock()
+	following := db.replica.following
+	root := db.tree.GetRoot()
+	db.mu.RUnlock()
+	if following {
+		db.writer.Unlock()
+		return nil, ErrFollower
+	}
+	tx := &KVTX{db: db}
+	tx.tree.SetRoot(root)
+	tx.tree.SetGet(db.pageGet)
+	tx.tree.SetNew(db.pageNew)
+	tx.tree.SetDel(db.pageDel)
+	return tx, nil
+}
+
+// end a transaction: commit updates
+func (tx *KVTX) Commit() error {
+	if tx.done {
+		return fmt.Errorf("KVTX.Commit: the transaction has ended")
+	}
+	db := tx.db
+	defer tx.end()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	root := db.tree.GetRoot()
+	db.tree.SetRoot(tx.tree.GetRoot())
+	if err := flushPages(db); err != nil {
+		// NOTE: the state of the master page is unknown after a failure.
+		db.tree.SetRoot(root)
+		db.rollbackPages()
+		return err
+	}
+	return nil
+}
+
+// end a transaction: rollback
+func (tx *KVTX) Abort() {
+	if tx.done {
+		return
+	}
+	tx.db.rollbackPages()
+	tx.end()
+}
+
+func (tx *KVTX) end() {
+	tx.done = true
+	tx.db.writer.Unlock()
+}
+
+// discard the pages and the changes that are not committed
+func (db *KV) rollbackPages() {
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.changes.pending = nil
+	db.changes.time = time.Time{}
+}
+
+// KV operations
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	return tx.tree.Get(key)
+}
+
+// Seek finds the closest position that is less or equal to the key
+func (tx *KVTX) Seek(key []byte) *btree.BIter {
+	return tx.tree.SeekLE(key)
+}
+
+// Scan visits the keys >= start in order until `fn` returns false
+func (tx *KVTX) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	scanTree(&tx.tree, start, fn)
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	_, err := tx.Update(key, val, 0)
+	return err
+}
+
+func (tx *KVTX) Update(key []byte, val []byte, mode int) (bool, error) {
+	old, exists := tx.tree.Get(key)
+	switch mode {
+	case 0: // MODE_UPSERT - insert or replace
+	case 1: // MODE_UPDATE_ONLY - update existing keys
+		if !exists {
+			return false, nil
+		}
+	case 2: // MODE_INSERT_ONLY - only add new keys
+		if exists {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("invalid mode: %d", mode)
+	}
+	if err := tx.tree.Insert(key, val); err != nil {
+		return false, err
+	}
+	tx.db.recordPut(key, old, val)
+	return true, nil
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	old, _ := tx.tree.Get(key)
+	deleted := tx.tree.Delete(key)
+	if deleted {
+		tx.db.recordDel(key, old)
+	}
+	return deleted, nil
+}
+
+func scanTree(tree *btree.BTree, start []byte, fn func(key []byte, val []byte) bool) {
+	iter := tree.SeekLE(start)
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if bytes.Compare(key, start) < 0 {
+			continue // SeekLE() can stop before the start
+		}
+		if !fn(key, val) {
+			return
+		}
+	}
+}
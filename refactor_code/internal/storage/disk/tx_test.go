@@ -0,0 +1,78 @@
+package disk
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	fmt.Println("Testing KV Transactions...")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	// aborted updates are discarded
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if err := tx.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	if _, err := tx.Del([]byte("a")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, ok := tx.Get([]byte("b")); !ok {
+		t.Errorf("The transaction does not see its own update")
+	}
+	if _, ok := db.Get([]byte("b")); ok {
+		t.Errorf("Uncommitted update is visible")
+	}
+	tx.Abort()
+	if _, ok := db.Get([]byte("a")); !ok {
+		t.Errorf("Aborted delete is visible")
+	}
+	seq := db.Seq()
+
+	// committed updates are one commit
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		if err := tx.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if db.Seq() != seq+1 {
+		t.Errorf("Expected commit %d, got %d", seq+1, db.Seq())
+	}
+
+	// scan the committed keys after reopen
+	db.Close()
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer db.Close()
+	keys := ""
+	db.Scan([]byte("b"), func(key []byte, val []byte) bool {
+		keys += string(key)
+		return string(key) < "d"
+	})
+	if keys != "cd" {
+		t.Errorf("Expected keys cd, got %q", keys)
+	}
+
+	fmt.Println("KV Transaction tests passed!")
+}
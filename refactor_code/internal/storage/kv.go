@@ -13,6 +13,9 @@ type KVStore interface {
 	Set(key []byte, val []byte) error
 	Del(key []byte) (bool, error)
 	Update(key []byte, val []byte, mode int) (bool, error)
+	Scan(start []byte, fn func(key []byte, val []byte) bool)
+	// multi-key updates
+	Begin() (*KVTX, error)
 }
 
 // NewKVStore creates a new key-value store
@@ -24,3 +27,15 @@ func NewKVStore(path string) KVStore {
 type BTree = btree.BTree
 type BNode = btree.BNode
 type BIter = btree.BIter
+type RangeEstimate = btree.RangeEstimate
+
+// Re-export the transaction type from disk package
+type KVTX = disk.KVTX
+
+// Re-export the change stream types from disk package
+type ChangeEvent = disk.ChangeEvent
+type Watcher = disk.Watcher
+
+// Re-export the replication types from disk package
+type PageSet = disk.PageSet
+type Shipper = disk.Shipper
@@ -0,0 +1,355 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// Foreign keys are enforced by the writes of a DBTX.
+// A new or changed row must match a row of the referenced table, which
+// is found by its primary key or unique index. When a referenced row is
+// deleted or its key is changed, the foreign keys that reference it
+// apply their actions to the referencing rows:
+//
+//	RESTRICT   the write fails if there are referencing rows
+//	CASCADE    the referencing rows are deleted, or updated to the new key
+//	SET NULL   the columns of the referencing rows are set to NULL
+//
+// The checks of a deferred foreign key, including RESTRICT, are queued
+// and done at the commit, so the rows can be written in any order.
+// The CASCADE and SET NULL actions are always done at once.
+
+// a deferred check: unless the referenced table has a row with the
+// values, no row of the table can have them
+type fkCheck struct {
+	table string
+	fk    string
+	key   Record // the values of the foreign key columns
+}
+
+// a foreign key of another table that references a table
+type fkRef struct {
+	tdef *TableDef
+	fk   database.ForeignKey
+}
+
+// the values of the columns of a row under other column names,
+// and whether they are all non-NULL
+func fkKey(rec Record, cols []string, names []string) (Record, bool) {
+	key := Record{}
+	for i, c := range cols {
+		v := rec.Get(c)
+		if v == nil {
+			return Record{}, false
+		}
+		key.Cols = append(key.Cols, names[i])
+		key.Vals = append(key.Vals, *v)
+	}
+	for _, v := range key.Vals {
+		if v.Null {
+			return key, false
+		}
+	}
+	return key, true
+}
+
+// the foreign keys of all tables that reference a table
+func (tx *DBTX) referencing(table string) ([]fkRef, error) {
+	names, err := database.CatalogList(tx.kv)
+	if err != nil {
+		return nil, err
+	}
+	refs := []fkRef{}
+	for _, name := range names {
+		tdef := tx.getTableDef(name)
+		if tdef == nil {
+			continue
+		}
+		for _, fk := range tdef.ForeignKeys {
+			if fk.Table == table {
+				refs = append(refs, fkRef{tdef: tdef, fk: fk})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// checkForeignKeys checks that a new or changed row matches the referenced rows
+func (tx *DBTX) checkForeignKeys(tdef *TableDef, rec Record) error {
+	for _, fk := range tdef.ForeignKeys {
+		key, ok := fkKey(rec, fk.Cols, fk.Cols)
+		if !ok {
+			continue // a NULL does not reference anything
+		}
+		if fk.Deferred {
+			tx.deferred = append(tx.deferred, fkCheck{table: tdef.Name, fk: fk.Name, key: key})
+			continue
+		}
+		found, err := tx.hasReferenced(fk, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return &database.ForeignKeyError{Table: tdef.Name, ForeignKey: fk.Name, Key: key}
+		}
+	}
+	return nil
+}
+
+// whether the referenced table has a row with the values of the foreign key
+func (tx *DBTX) hasReferenced(fk database.ForeignKey, key Record) (bool, error) {
+	parent := tx.getTableDef(fk.Table)
+	if parent == nil {
+		return false, fmt.Errorf("table %s does not exist", fk.Table)
+	}
+	ref := Record{Cols: fk.RefCols, Vals: key.Vals}
+	rows, err := database.TableFind(tx.kv, parent, ref, 1)
+	return len(rows) > 0, err
+}
+
+// a change of a referenced key, from the values of `old` to the ones of
+// `rec`, or the deletion of `old` if `rec` is nil
+type fkChange struct {
+	ref    fkRef
+	key    Record // the old values under the foreign key columns
+	newKey Record // the new values, possibly NULL
+	action int
+}
+
+// the foreign keys whose referenced values are changed by a write of `old`
+func (tx *DBTX) referencedChanges(refs []fkRef, old Record, rec *Record) []fkChange {
+	changes := []fkChange{}
+	for _, ref := range refs {
+		key, ok := fkKey(old, ref.fk.RefCols, ref.fk.Cols)
+		if !ok {
+			continue
+		}
+		change := fkChange{ref: ref, key: key, action: ref.fk.OnDelete}
+		if rec != nil {
+			change.newKey, _ = fkKey(*rec, ref.fk.RefCols, ref.fk.Cols)
+			if database.EqualValues(change.newKey.Vals, key.Vals) {
+				continue // the key is not changed
+			}
+			change.action = ref.fk.OnUpdate
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// restrictChanges fails on the RESTRICT foreign keys with referencing
+// rows, before the referenced row is written. The deferred ones are queued.
+func (tx *DBTX) restrictChanges(changes []fkChange) error {
+	for _, change := range changes {
+		if change.action != database.FK_RESTRICT {
+			continue
+		}
+		if change.ref.fk.Deferred {
+			tx.deferred = append(tx.deferred,
+				fkCheck{table: change.ref.tdef.Name, fk: change.ref.fk.Name, key: change.key})
+			continue
+		}
+		rows, err := database.TableFind(tx.kv, change.ref.tdef, change.key, 1)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			return &database.ForeignKeyError{
+				Table: change.ref.tdef.Name, ForeignKey: change.ref.fk.Name,
+				Key: change.key, Referenced: true,
+			}
+		}
+	}
+	return nil
+}
+
+// applyChanges does the CASCADE and SET NULL actions on the referencing
+// rows, after the referenced row is written
+func (tx *DBTX) applyChanges(changes []fkChange) error {
+	for _, change := range changes {
+		if change.action == database.FK_RESTRICT {
+			continue
+		}
+		child := change.ref.tdef.Name
+		rows, err := database.TableFind(tx.kv, change.ref.tdef, change.key, 0)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			pk, _ := fkKey(row, change.ref.tdef.Cols[:change.ref.tdef.PKeys], change.ref.tdef.Cols)
+			if change.action == database.FK_CASCADE && change.newKey.Cols == nil {
+				if _, err := tx.Delete(child, pk); err != nil {
+					return err
+				}
+				continue
+			}
+			updated := Record{Cols: row.Cols, Vals: append([]Value{}, row.Vals...)}
+			for i, c := range change.ref.fk.Cols {
+				v := updated.Get(c)
+				if change.action == database.FK_CASCADE {
+					*v = change.newKey.Vals[i]
+				} else {
+					*v = Value{Type: v.Type, Null: true}
+				}
+			}
+			if err := tx.Update(child, pk, updated); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDeferred does the deferred checks before the commit
+func (tx *DBTX) checkDeferred() error {
+	for _, check := range tx.deferred {
+		tdef := tx.getTableDef(check.table)
+		if tdef == nil {
+			continue // dropped
+		}
+		for _, fk := range tdef.ForeignKeys {
+			if fk.Name != check.fk {
+				continue
+			}
+			found, err := tx.hasReferenced(fk, check.key)
+			if err != nil || found {
+				return err
+			}
+			rows, err := database.TableFind(tx.kv, tdef, check.key, 1)
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 {
+				return &database.ForeignKeyError{Table: tdef.Name, ForeignKey: fk.Name, Key: check.key}
+			}
+		}
+	}
+	return nil
+}
+
+// validateForeignKeys checks the referenced tables of a new table and
+// sets the default referenced columns, which are the primary key
+func (tx *DBTX) validateForeignKeys(def *TableDef) error {
+	for i := range def.ForeignKeys {
+		fk := &def.ForeignKeys[i]
+		parent := def
+		if fk.Table != def.Name {
+			parent = tx.getTableDef(fk.Table)
+		}
+		if parent == nil {
+			return fmt.Errorf("foreign key %s: table %s does not exist", fk.Name, fk.Table)
+		}
+		if len(fk.RefCols) == 0 {
+			fk.RefCols = append([]string{}, parent.Cols[:parent.PKeys]...)
+		}
+		if _, ok := database.RefIndex(parent, fk.RefCols); !ok {
+			return fmt.Errorf("foreign key %s: %v is not a primary key or a unique index of table %s",
+				fk.Name, fk.RefCols, fk.Table)
+		}
+		if len(fk.Cols) != len(fk.RefCols) {
+			return fmt.Errorf("foreign key %s: column count mismatch", fk.Name)
+		}
+		for j, c := range fk.Cols {
+			typ, ref := colType(def, c), colType(parent, fk.RefCols[j])
+			if typ == database.TYPE_ERROR || typ != ref {
+				return fmt.Errorf("foreign key %s: column %s does not match %s.%s",
+					fk.Name, c, fk.Table, fk.RefCols[j])
+			}
+		}
+	}
+	return nil
+}
+
+// the type of a column, or TYPE_ERROR
+func colType(tdef *TableDef, col string) uint32 {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return tdef.Types[i]
+		}
+	}
+	return database.TYPE_ERROR
+}
+
+// checkReferenced fails if other tables reference a table
+func (tx *DBTX) checkReferenced(table string, op string) error {
+	refs, err := tx.referencing(table)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.tdef.Name != table {
+			return fmt.Errorf("cannot %s table %s: referenced by foreign key %s of table %s",
+				op, table, ref.fk.Name, ref.tdef.Name)
+		}
+	}
+	return nil
+}
+
+// checkRefColumns checks a changed table definition against the foreign
+// keys of the table and the ones that reference it
+func (tx *DBTX) checkRefColumns(newDef *TableDef) error {
+	if err := tx.validateForeignKeys(newDef); err != nil {
+		return err
+	}
+	refs, err := tx.referencing(newDef.Name)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		for j, c := range ref.fk.RefCols {
+			typ := colType(newDef, c)
+			if typ == database.TYPE_ERROR || typ != colType(ref.tdef, ref.fk.Cols[j]) {
+				return fmt.Errorf("column %s is referenced by foreign key %s of table %s",
+					c, ref.fk.Name, ref.tdef.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRefIndex fails if a foreign key uses the unique index
+func (tx *DBTX) checkRefIndex(indexName string) error {
+	tdef, _, err := database.CatalogFindIndex(tx.kv, indexName)
+	if err != nil || tdef == nil {
+		return err
+	}
+	refs, err := tx.referencing(tdef.Name)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if name, ok := database.RefIndex(tdef, ref.fk.RefCols); ok && name == indexName {
+			return fmt.Errorf("index %s is referenced by foreign key %s of table %s",
+				indexName, ref.fk.Name, ref.tdef.Name)
+		}
+	}
+	return nil
+}
+
+// renameReferences points the foreign keys of a renamed table to its new name
+func (tx *DBTX) renameReferences(refs []fkRef, oldName string, newName string) error {
+	done := map[string]bool{}
+	for _, ref := range refs {
+		table := ref.tdef.Name
+		if table == oldName {
+			table = newName // a self-reference
+		}
+		if done[table] {
+			continue
+		}
+		done[table] = true
+		tdef := *tx.getTableDef(table)
+		tdef.ForeignKeys = append([]database.ForeignKey(nil), tdef.ForeignKeys...)
+		for i := range tdef.ForeignKeys {
+			if tdef.ForeignKeys[i].Table == oldName {
+				tdef.ForeignKeys[i].Table = newName
+			}
+		}
+		if err := database.CatalogUpdate(tx.kv, &tdef); err != nil {
+			return err
+		}
+		tx.tables[table] = &tdef
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package transaction
+
+// GeneratedDB is a database whose query executor computes the virtual
+// generated columns, see database.TableDef.VirtualFunc. Without it, the
+// virtual columns are NULL on read, and their tables cannot be written.
+type GeneratedDB interface {
+	// VirtualFunc returns the function that fills the virtual columns
+	// of a row in the table order
+	VirtualFunc(tdef *TableDef) (func(values []Value) error, error)
+}
+
+// withVirtual returns a copy of a table definition with the function of
+// its virtual columns. The definition itself is not changed, since it
+// can be shared, e.g. with the caller of AlterTableRows().
+func (tx *DBTX) withVirtual(tdef *TableDef) *TableDef {
+	if tdef == nil || len(tdef.Virtual) == 0 || tdef.VirtualFunc != nil {
+		return tdef
+	}
+	gdb, ok := tx.db.(GeneratedDB)
+	if !ok {
+		return tdef
+	}
+	fn, err := gdb.VirtualFunc(tdef)
+	if err != nil {
+		// a bad expression fails the reads and the writes
+		fn = func([]Value) error { return err }
+	}
+	vdef := *tdef
+	vdef.VirtualFunc = fn
+	return &vdef
+}
@@ -0,0 +1,166 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// Materialized views are maintained by the writes of a DBTX.
+// When a row of a table is inserted, updated or deleted, the view row
+// of the old row is deleted, and the view row of the new row is added
+// if it passes the filter. The view rows are computed by the query
+// executor, through the ViewDB. If a view row fails, the write of the
+// row is undone, see DBTX.atomic(). A materialized view cannot be
+// written otherwise, except by RefreshMatView().
+
+// ViewDB is a database whose query executor computes the rows of the
+// materialized views. Without it, the tables in FROM of the
+// materialized views cannot be written.
+type ViewDB interface {
+	// ViewRowFunc returns the function that maps a row of the table in
+	// FROM to the row of the view, or to nil if it is filtered out
+	ViewRowFunc(view *TableDef) (func(Record) (*Record, error), error)
+}
+
+// CreateMatView creates the table of a materialized view and fills it.
+// Its query is validated by the executor, see database.MatView.
+func (tx *DBTX) CreateMatView(def *TableDef) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	if def.MatView == nil {
+		return fmt.Errorf("%s is not a materialized view", def.Name)
+	}
+	base := tx.getTableDef(def.MatView.Table)
+	if base == nil {
+		return fmt.Errorf("table %s does not exist", def.MatView.Table)
+	}
+	if base.MatView != nil {
+		return fmt.Errorf("materialized view %s cannot select from materialized view %s",
+			def.Name, base.Name)
+	}
+	if view, err := database.ViewGet(tx.kv, def.Name); err != nil || view != nil {
+		if err == nil {
+			err = fmt.Errorf("view %s already exists", def.Name)
+		}
+		return err
+	}
+	if err := tx.TableNew(def); err != nil {
+		return err
+	}
+	return tx.RefreshMatView(def.Name)
+}
+
+// RefreshMatView recomputes all rows of a materialized view
+func (tx *DBTX) RefreshMatView(name string) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	view, err := tx.getMatView(name)
+	if err != nil {
+		return err
+	}
+	base := tx.getTableDef(view.MatView.Table)
+	if base == nil {
+		return fmt.Errorf("table %s does not exist", view.MatView.Table)
+	}
+	viewRow, err := tx.viewRowFunc(view)
+	if err != nil {
+		return err
+	}
+	return database.MatViewRefresh(tx.kv, view, base, viewRow)
+}
+
+// DropMatView drops a materialized view, unless a view selects from it
+func (tx *DBTX) DropMatView(name string) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	view, err := tx.getMatView(name)
+	if err != nil {
+		return err
+	}
+	if err := tx.checkViewUsers(name); err != nil {
+		return err
+	}
+	if err := database.TableTruncate(tx.kv, view); err != nil {
+		return err
+	}
+	if _, err := database.CatalogDrop(tx.kv, name); err != nil {
+		return err
+	}
+	delete(tx.tables, name)
+	delete(tx.viewRows, name)
+	return nil
+}
+
+func (tx *DBTX) getMatView(name string) (*TableDef, error) {
+	view := tx.getTableDef(name)
+	if view == nil {
+		return nil, fmt.Errorf("materialized view %s does not exist", name)
+	}
+	if view.MatView == nil {
+		return nil, fmt.Errorf("%s is not a materialized view", name)
+	}
+	return view, nil
+}
+
+// checkNotMatView fails on the writes to a materialized view
+func checkNotMatView(tdef *TableDef) error {
+	if tdef.MatView != nil {
+		return fmt.Errorf("cannot modify materialized view %s", tdef.Name)
+	}
+	return nil
+}
+
+// viewRowFunc returns the row function of a materialized view. It is
+// built once per transaction, not for each written row.
+func (tx *DBTX) viewRowFunc(view *TableDef) (func(Record) (*Record, error), error) {
+	if viewRow := tx.viewRows[view.Name]; viewRow != nil {
+		return viewRow, nil
+	}
+	vdb, ok := tx.db.(ViewDB)
+	if !ok {
+		return nil, fmt.Errorf("materialized view %s cannot be computed by this database", view.Name)
+	}
+	viewRow, err := vdb.ViewRowFunc(view)
+	if err != nil {
+		return nil, err
+	}
+	tx.viewRows[view.Name] = viewRow
+	return viewRow, nil
+}
+
+// the materialized views of a table
+func (tx *DBTX) matViews(table string) ([]*TableDef, error) {
+	return database.MatViewList(tx.kv, table)
+}
+
+// maintainViews applies a change of a row of a table to its materialized
+// views: the view row of `old` is deleted, and the view row of `rec` is
+// added. `old` is nil for an insert, `rec` is nil for a delete.
+func (tx *DBTX) maintainViews(views []*TableDef, old *Record, rec *Record) error {
+	for _, view := range views {
+		if old != nil {
+			if _, err := database.TableDelete(tx.kv, view, database.MatViewKey(view, *old)); err != nil {
+				return fmt.Errorf("materialized view %s: %w", view.Name, err)
+			}
+		}
+		if rec == nil {
+			continue
+		}
+		viewRow, err := tx.viewRowFunc(view)
+		if err != nil {
+			return err
+		}
+		row, err := viewRow(*rec)
+		if err == nil && row != nil {
+			_, err = database.TableSet(tx.kv, view, *row, database.MODE_UPSERT)
+		}
+		if err != nil {
+			return fmt.Errorf("materialized view %s: %w", view.Name, err)
+		}
+	}
+	return nil
+}
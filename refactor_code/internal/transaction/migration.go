@@ -0,0 +1,40 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// Migrations returns the history of the migrations applied by the
+// migration runner, see database.SchemaMigration
+func (tx *DBTX) Migrations() ([]database.SchemaMigration, error) {
+	if !tx.active {
+		return nil, fmt.Errorf("transaction not active")
+	}
+	return database.MigrationList(tx.kv)
+}
+
+// RecordMigration adds an applied migration to the history, with the
+// schema changes of the transaction
+func (tx *DBTX) RecordMigration(m *database.SchemaMigration) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	return database.MigrationRecord(tx.kv, m)
+}
+
+// ForgetMigration removes a reverted migration from the history
+func (tx *DBTX) ForgetMigration(version int64) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	forgot, err := database.MigrationForget(tx.kv, version)
+	if err != nil {
+		return err
+	}
+	if !forgot {
+		return fmt.Errorf("migration %d is not applied", version)
+	}
+	return nil
+}
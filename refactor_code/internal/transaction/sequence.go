@@ -0,0 +1,94 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// CreateSequence creates a sequence, see database.Sequence
+func (tx *DBTX) CreateSequence(seq *database.Sequence) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	if err := database.SequenceCreate(tx.kv, seq); err != nil {
+		return err
+	}
+	tx.seqs.Forget(seq.Name)
+	return nil
+}
+
+// DropSequence drops a sequence, unless it is used by AUTO_INCREMENT
+func (tx *DBTX) DropSequence(name string) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	tables, err := database.CatalogList(tx.kv)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if tdef := tx.getTableDef(table); tdef != nil && tdef.AutoIncrement == name {
+			return fmt.Errorf("sequence %s is used by table %s", name, table)
+		}
+	}
+	dropped, err := database.SequenceDrop(tx.kv, name)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return fmt.Errorf("sequence %s does not exist", name)
+	}
+	tx.seqs.Forget(name)
+	delete(tx.currval, name)
+	return nil
+}
+
+// NextVal returns the next value of a sequence. The values are taken
+// from the blocks of the database, so they are not rolled back.
+func (tx *DBTX) NextVal(name string) (int64, error) {
+	if !tx.active {
+		return 0, fmt.Errorf("transaction not active")
+	}
+	v, err := tx.seqs.NextVal(tx.kv, name)
+	if err != nil {
+		return 0, err
+	}
+	tx.currval[name] = v
+	return v, nil
+}
+
+// CurrVal returns the value of the last NextVal() of a sequence
+// in this session, which is kept across the transactions of the DBTX
+func (tx *DBTX) CurrVal(name string) (int64, error) {
+	v, ok := tx.currval[name]
+	if !ok {
+		return 0, fmt.Errorf("currval of sequence %s is not yet defined in this session", name)
+	}
+	return v, nil
+}
+
+// autoIncrement assigns the AUTO_INCREMENT primary key of a new row
+// if it is missing or NULL
+func (tx *DBTX) autoIncrement(tdef *TableDef, record Record) (Record, error) {
+	if tdef.AutoIncrement == "" {
+		return record, nil
+	}
+	pk := tdef.Cols[0]
+	if v := record.Get(pk); v != nil && !v.Null {
+		return record, nil
+	}
+	id, err := tx.NextVal(tdef.AutoIncrement)
+	if err != nil {
+		return record, err
+	}
+	out := Record{}
+	out.AddInt64(pk, id)
+	for i, col := range record.Cols {
+		if col != pk {
+			out.Cols = append(out.Cols, col)
+			out.Vals = append(out.Vals, record.Vals[i])
+		}
+	}
+	return out, nil
+}
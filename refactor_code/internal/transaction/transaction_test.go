@@ -1,8 +1,11 @@
 package transaction
 
 import (
+	"bytes"
 	"fmt"
 	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/storage"
+	"path/filepath"
 	"testing"
 )
 
@@ -373,3 +376,192 @@ func TestTransactionCleanup(t *testing.T) {
 
 	fmt.Println("Transaction Cleanup tests passed!")
 }
+
+func TestTransactionalDDL(t *testing.T) {
+	fmt.Println("Testing Transactional DDL...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "ddl.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	db := database.NewSimpleDB(store)
+
+	tableDef := &TableDef{
+		Name:  "users",
+		Cols:  []string{"id", "name"},
+		Types: []uint32{database.TYPE_INT64, database.TYPE_BYTES},
+		PKeys: 1,
+	}
+
+	// Aborted DDL is not visible
+	tx := NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := tx.TableNew(tableDef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if tx.GetDB().GetTableDef("users") == nil {
+		t.Errorf("The transaction does not see its own table")
+	}
+	if db.GetTableDef("users") != nil {
+		t.Errorf("Uncommitted table is visible")
+	}
+	if err := tx.Abort(); err != nil {
+		t.Fatalf("Failed to abort transaction: %v", err)
+	}
+	if db.GetTableDef("users") != nil {
+		t.Errorf("Aborted table is visible")
+	}
+
+	// Committed DDL is
+	tx = NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := tx.TableNew(tableDef); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := tx.CreateIndex("idx_name", "users", []string{"name"}); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+	users := db.GetTableDef("users")
+	if users == nil || len(users.IndexNames) != 1 || users.IndexNames[0] != "idx_name" {
+		t.Errorf("Committed table or index is missing: %+v", users)
+	}
+
+	// Dropping an index is also transactional
+	tx = NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := tx.DropIndex("idx_name"); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+	if err := tx.DropIndex("idx_name"); err == nil {
+		t.Errorf("Expected an error for a dropped index")
+	}
+	if err := tx.Abort(); err != nil {
+		t.Fatalf("Failed to abort transaction: %v", err)
+	}
+	if users := db.GetTableDef("users"); users == nil || len(users.IndexNames) != 1 {
+		t.Errorf("Aborted index drop is visible: %+v", users)
+	}
+
+	fmt.Println("Transactional DDL tests passed!")
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	fmt.Println("Testing Secondary Indexes...")
+
+	store := storage.NewKVStore(filepath.Join(t.TempDir(), "indexes.db"))
+	if err := store.Open(); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	db := database.NewSimpleDB(store)
+
+	row := func(id int64, name string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+	}
+	// the ids in the index order
+	scanNames := func(tx *DBTX) string {
+		sc := Scanner{Cmp1: database.CMP_GE, Cmp2: database.CMP_LE}
+		sc.Key1 = *(&Record{}).AddStr("name", nil)
+		if err := tx.Scan("users", &sc); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		ids := []int64{}
+		for ; sc.Valid(); sc.Next() {
+			var rec Record
+			sc.Deref(&rec)
+			ids = append(ids, rec.Get("id").I64)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	// Existing rows are indexed by CreateIndex
+	tx := NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	err := tx.TableNew(&TableDef{
+		Name:  "users",
+		Cols:  []string{"id", "name"},
+		Types: []uint32{database.TYPE_INT64, database.TYPE_BYTES},
+		PKeys: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i, name := range []string{"carol", "alice", "dave", "bob"} {
+		if err := tx.Insert("users", row(int64(i+1), name)); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := tx.CreateIndex("idx_name", "users", []string{"name"}); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if ids := scanNames(tx); ids != "[2 4 1 3]" {
+		t.Errorf("Unexpected index order after the build: %s", ids)
+	}
+
+	// The index follows updates and deletes
+	if err := tx.Update("users", row(3, ""), row(3, "aaron")); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if err := tx.Update("users", row(4, ""), row(5, "bob")); err != nil {
+		t.Fatalf("Failed to update the primary key: %v", err)
+	}
+	if _, err := tx.Delete("users", row(1, "")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if ids := scanNames(tx); ids != "[3 2 5]" {
+		t.Errorf("Unexpected index order after the updates: %s", ids)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+
+	// Aborted writes leave no index entries
+	tx = NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := tx.Insert("users", row(9, "zed")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := tx.Abort(); err != nil {
+		t.Fatalf("Failed to abort transaction: %v", err)
+	}
+	table := database.NewKVTableManager(store).GetTable("users")
+	if err := table.ValidateTableIntegrity(); err != nil {
+		t.Errorf("Index out of sync: %v", err)
+	}
+
+	// Dropping the index deletes its entries
+	tx = NewDBTX(db)
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := tx.DropIndex("idx_name"); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+	prefix := table.Def.IndexPrefixes[0]
+	start := []byte{byte(prefix >> 24), byte(prefix >> 16), byte(prefix >> 8), byte(prefix)}
+	store.Scan(start, func(key []byte, val []byte) bool {
+		if bytes.HasPrefix(key, start) {
+			t.Errorf("Index entry left after the drop: %q", key)
+		}
+		return false
+	})
+
+	fmt.Println("Secondary Indexes tests passed!")
+}
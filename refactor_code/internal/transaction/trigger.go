@@ -0,0 +1,83 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// CreateTrigger adds a trigger to a table, see database.Trigger.
+// Its statement is validated and run by the executor.
+func (tx *DBTX) CreateTrigger(trig *database.Trigger) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	tdef := tx.getTableDef(trig.Table)
+	if tdef == nil {
+		return fmt.Errorf("table %s does not exist", trig.Table)
+	}
+	if tdef.MatView != nil {
+		return fmt.Errorf("cannot add a trigger to materialized view %s", trig.Table)
+	}
+	return database.TriggerCreate(tx.kv, trig, false)
+}
+
+// DropTrigger removes a trigger
+func (tx *DBTX) DropTrigger(name string) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	dropped, err := database.TriggerDrop(tx.kv, name)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return fmt.Errorf("trigger %s does not exist", name)
+	}
+	return nil
+}
+
+// GetTrigger returns a trigger, or nil if it does not exist
+func (tx *DBTX) GetTrigger(name string) (*database.Trigger, error) {
+	if !tx.active {
+		return nil, fmt.Errorf("transaction not active")
+	}
+	return database.TriggerGet(tx.kv, name)
+}
+
+// GetTriggers returns the triggers of a table in the order of the names
+func (tx *DBTX) GetTriggers(table string) ([]database.Trigger, error) {
+	if !tx.active {
+		return nil, fmt.Errorf("transaction not active")
+	}
+	return database.TriggerList(tx.kv, table)
+}
+
+// the triggers of a dropped table are dropped with it
+func (tx *DBTX) dropTriggers(table string) error {
+	triggers, err := database.TriggerList(tx.kv, table)
+	if err != nil {
+		return err
+	}
+	for _, trig := range triggers {
+		if _, err := database.TriggerDrop(tx.kv, trig.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the triggers of a renamed table follow it
+func (tx *DBTX) renameTriggers(oldName string, newName string) error {
+	triggers, err := database.TriggerList(tx.kv, oldName)
+	if err != nil {
+		return err
+	}
+	for _, trig := range triggers {
+		trig.Table = newName
+		if err := database.TriggerCreate(tx.kv, &trig, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
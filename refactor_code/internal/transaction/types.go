@@ -3,7 +3,7 @@ package transaction
 import (
 	"fmt"
 	"govetachun/go-mini-db/refactor_code/internal/database"
-	"strings"
+	"govetachun/go-mini-db/refactor_code/internal/storage"
 )
 
 // Re-export types
@@ -17,9 +17,18 @@ type DBTX struct {
 	db DB
 	// Transaction state
 	active bool
-	// For simple in-memory implementation
-	tables  map[string]*TableDef
-	records map[string]map[string]*Record // table -> key -> record
+	// The catalog and the rows are read and updated through `kv`, which is
+	// a KV transaction for a KVDB, or an in-memory KV for other databases.
+	kv     database.KVWriter
+	store  *storage.KVTX
+	tables map[string]*TableDef // definitions read by this transaction
+	// the checks of the deferred foreign keys, done by Commit()
+	deferred []fkCheck
+	// the sequence values, see NextVal()
+	seqs    *database.SequenceCache
+	currval map[string]int64 // the last values of this session
+	// the row functions of the materialized views, see viewRowFunc()
+	viewRows map[string]func(Record) (*Record, error)
 }
 
 // DB represents a database interface
@@ -28,6 +37,19 @@ type DB interface {
 	ListTables() ([]string, error)
 }
 
+// KVDB is a database stored in a KV store.
+// Its transactions update the catalog atomically with the KV transaction.
+type KVDB interface {
+	DB
+	GetStore() storage.KVStore
+}
+
+// SequenceDB is a database that shares the blocks of sequence values
+// among its transactions. Otherwise each DBTX allocates its own blocks.
+type SequenceDB interface {
+	Sequences() *database.SequenceCache
+}
+
 // TableNew creates a new table
 func (tx *DBTX) TableNew(def *TableDef) error {
 	if !tx.active {
@@ -43,11 +65,6 @@ func (tx *DBTX) TableNew(def *TableDef) error {
 		return fmt.Errorf("invalid table definition: %w", err)
 	}
 
-	// Check if table already exists
-	if _, exists := tx.tables[def.Name]; exists {
-		return fmt.Errorf("table %s already exists", def.Name)
-	}
-
 	// Create a copy of the definition
 	tableDef := &TableDef{
 		Name:  def.Name,
@@ -58,20 +75,81 @@ func (tx *DBTX) TableNew(def *TableDef) error {
 
 	copy(tableDef.Cols, def.Cols)
 	copy(tableDef.Types, def.Types)
+	tableDef.NotNull = append([]string(nil), def.NotNull...)
+	if def.Decimals != nil {
+		tableDef.Decimals = map[string]database.DecimalType{}
+		for col, dt := range def.Decimals {
+			tableDef.Decimals[col] = dt
+		}
+	}
+	if def.Defaults != nil {
+		tableDef.Defaults = map[string]string{}
+		for col, expr := range def.Defaults {
+			tableDef.Defaults[col] = expr
+		}
+	}
+	tableDef.Checks = append([]string(nil), def.Checks...)
+	tableDef.CheckNames = append([]string(nil), def.CheckNames...)
+	if def.Generated != nil {
+		tableDef.Generated = map[string]string{}
+		for col, expr := range def.Generated {
+			tableDef.Generated[col] = expr
+		}
+	}
+	tableDef.Virtual = append([]string(nil), def.Virtual...)
+	for _, fk := range def.ForeignKeys {
+		fk.Cols = append([]string(nil), fk.Cols...)
+		fk.RefCols = append([]string(nil), fk.RefCols...)
+		tableDef.ForeignKeys = append(tableDef.ForeignKeys, fk)
+	}
+	if err := tx.validateForeignKeys(tableDef); err != nil {
+		return fmt.Errorf("invalid table definition: %w", err)
+	}
+	if def.MatView != nil {
+		mv := *def.MatView
+		mv.Cols = append([]string(nil), mv.Cols...)
+		mv.Keys = append([]string(nil), mv.Keys...)
+		tableDef.MatView = &mv
+	}
 
-	// Add to transaction tables
-	tx.tables[def.Name] = tableDef
+	// The sequence of the AUTO_INCREMENT primary key is created with the table
+	tableDef.AutoIncrement = def.AutoIncrement
+	if tableDef.AutoIncrement != "" {
+		seq := &database.Sequence{
+			Name: tableDef.AutoIncrement, Start: 1, Increment: 1, Cache: database.SEQ_CACHE_DEFAULT,
+		}
+		if err := tx.CreateSequence(seq); err != nil {
+			return err
+		}
+	}
 
-	// Initialize records map for this table
-	tx.records[def.Name] = make(map[string]*Record)
+	// Add to the catalog, which fails if the table already exists
+	if err := database.CatalogCreate(tx.kv, tableDef); err != nil {
+		if tableDef.AutoIncrement != "" {
+			if _, serr := database.SequenceDrop(tx.kv, tableDef.AutoIncrement); serr != nil {
+				return fmt.Errorf("%w (dropping the sequence: %v)", err, serr)
+			}
+		}
+		return err
+	}
+	tx.tables[def.Name] = tableDef
 
 	return nil
 }
 
-// Scan performs a table scan
+// Scan positions the scanner at the start of its range,
+// the rows are read from the B-tree while iterating.
 func (tx *DBTX) Scan(table string, scanner *Scanner) error {
-	// Implementation would go here
-	return nil
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+
+	tableDef := tx.getTableDef(table)
+	if tableDef == nil {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+
+	return database.TableScan(tx.kv, tableDef, scanner)
 }
 
 // Delete deletes a record
@@ -80,25 +158,47 @@ func (tx *DBTX) Delete(table string, key Record) (bool, error) {
 		return false, fmt.Errorf("transaction not active")
 	}
 
-	tableRecords, exists := tx.records[table]
-	if !exists {
+	tableDef := tx.getTableDef(table)
+	if tableDef == nil {
 		return false, fmt.Errorf("table %s does not exist", table)
 	}
-
-	// Generate key string from primary key columns
-	keyStr := tx.generateKeyString(table, key)
-	if keyStr == "" {
-		return false, fmt.Errorf("invalid primary key")
+	if err := checkNotMatView(tableDef); err != nil {
+		return false, err
 	}
 
-	// Check if record exists
-	if _, exists := tableRecords[keyStr]; !exists {
-		return false, nil
+	// The foreign keys referencing the deleted row, and the views of it
+	refs, err := tx.referencing(table)
+	if err != nil {
+		return false, err
+	}
+	views, err := tx.matViews(table)
+	if err != nil {
+		return false, err
+	}
+	if len(refs) == 0 && len(views) == 0 {
+		return database.TableDelete(tx.kv, tableDef, key)
+	}
+	old, err := database.TableGet(tx.kv, tableDef, key)
+	if err != nil || old == nil {
+		return false, err
+	}
+	changes := tx.referencedChanges(refs, *old, nil)
+	if err := tx.restrictChanges(changes); err != nil {
+		return false, err
 	}
 
-	// Delete the record
-	delete(tableRecords, keyStr)
-	return true, nil
+	// the row, its view rows and the referencing rows, or none of them
+	deleted := false
+	err = tx.atomic(func() error {
+		if deleted, err = database.TableDelete(tx.kv, tableDef, key); err != nil {
+			return err
+		}
+		if err := tx.maintainViews(views, old, nil); err != nil {
+			return err
+		}
+		return tx.applyChanges(changes)
+	})
+	return deleted && err == nil, err
 }
 
 // Insert inserts a record
@@ -107,33 +207,61 @@ func (tx *DBTX) Insert(table string, record Record) error {
 		return fmt.Errorf("transaction not active")
 	}
 
-	tableDef, exists := tx.tables[table]
-	if !exists {
+	tableDef := tx.getTableDef(table)
+	if tableDef == nil {
 		return fmt.Errorf("table %s does not exist", table)
 	}
+	if err := checkNotMatView(tableDef); err != nil {
+		return err
+	}
+
+	// Assign the AUTO_INCREMENT primary key of a row without one
+	record, err := tx.autoIncrement(tableDef, record)
+	if err != nil {
+		return err
+	}
 
 	// Validate record against table schema
 	if err := tx.validateRecord(record, tableDef); err != nil {
 		return fmt.Errorf("record validation failed: %w", err)
 	}
-
-	// Generate key string from primary key columns
-	keyStr := tx.generateKeyString(table, record)
-	if keyStr == "" {
-		return fmt.Errorf("failed to generate primary key")
+	if err := tx.checkForeignKeys(tableDef, record); err != nil {
+		return err
 	}
 
-	// Check if record already exists
-	tableRecords := tx.records[table]
-	if _, exists := tableRecords[keyStr]; exists {
-		return fmt.Errorf("record with primary key already exists")
+	views, err := tx.matViews(table)
+	if err != nil {
+		return err
 	}
+	// Add the row, unless the primary key exists, and its view rows
+	write := func() error {
+		added, err := database.TableSet(tx.kv, tableDef, record, database.MODE_INSERT_ONLY)
+		if err != nil {
+			return err
+		}
+		if !added {
+			return fmt.Errorf("record with primary key already exists")
+		}
+		return tx.addViewRows(tableDef, views, nil, record)
+	}
+	if len(views) == 0 {
+		return write()
+	}
+	return tx.atomic(write)
+}
 
-	// Create a copy of the record
-	recordCopy := tx.copyRecord(record)
-	tableRecords[keyStr] = &recordCopy
-
-	return nil
+// addViewRows maintains the materialized views of a table after a write
+// of `rec`, from the stored row, whose decimals are rounded.
+// `old` is the replaced row, nil for an insert.
+func (tx *DBTX) addViewRows(tdef *TableDef, views []*TableDef, old *Record, rec Record) error {
+	if len(views) == 0 {
+		return nil
+	}
+	row, err := database.TableGet(tx.kv, tdef, rec)
+	if err != nil {
+		return err
+	}
+	return tx.maintainViews(views, old, row)
 }
 
 // Get retrieves a record
@@ -142,26 +270,12 @@ func (tx *DBTX) Get(table string, key Record) (*Record, error) {
 		return nil, fmt.Errorf("transaction not active")
 	}
 
-	tableRecords, exists := tx.records[table]
-	if !exists {
+	tableDef := tx.getTableDef(table)
+	if tableDef == nil {
 		return nil, fmt.Errorf("table %s does not exist", table)
 	}
 
-	// Generate key string from primary key columns
-	keyStr := tx.generateKeyString(table, key)
-	if keyStr == "" {
-		return nil, fmt.Errorf("invalid primary key")
-	}
-
-	// Check if record exists
-	record, exists := tableRecords[keyStr]
-	if !exists {
-		return nil, nil
-	}
-
-	// Return a copy
-	result := tx.copyRecord(*record)
-	return &result, nil
+	return database.TableGet(tx.kv, tableDef, key)
 }
 
 // Update updates a record
@@ -170,33 +284,66 @@ func (tx *DBTX) Update(table string, key Record, record Record) error {
 		return fmt.Errorf("transaction not active")
 	}
 
-	tableDef, exists := tx.tables[table]
-	if !exists {
+	tableDef := tx.getTableDef(table)
+	if tableDef == nil {
 		return fmt.Errorf("table %s does not exist", table)
 	}
+	if err := checkNotMatView(tableDef); err != nil {
+		return err
+	}
 
 	// Validate new record against table schema
 	if err := tx.validateRecord(record, tableDef); err != nil {
 		return fmt.Errorf("record validation failed: %w", err)
 	}
-
-	// Generate key string from primary key columns
-	keyStr := tx.generateKeyString(table, key)
-	if keyStr == "" {
-		return fmt.Errorf("invalid primary key")
+	if err := tx.checkForeignKeys(tableDef, record); err != nil {
+		return err
 	}
 
-	// Check if record exists
-	tableRecords := tx.records[table]
-	if _, exists := tableRecords[keyStr]; !exists {
-		return fmt.Errorf("record not found")
+	// The foreign keys referencing the changed key values,
+	// and the views of the old row
+	refs, err := tx.referencing(table)
+	if err != nil {
+		return err
+	}
+	views, err := tx.matViews(table)
+	if err != nil {
+		return err
+	}
+	changes := []fkChange{}
+	var old *Record
+	if len(refs) > 0 || len(views) > 0 {
+		old, err = database.TableGet(tx.kv, tableDef, key)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			changes = tx.referencedChanges(refs, *old, &record)
+		}
+	}
+	if err := tx.restrictChanges(changes); err != nil {
+		return err
 	}
 
-	// Create a copy of the new record
-	recordCopy := tx.copyRecord(record)
-	tableRecords[keyStr] = &recordCopy
-
-	return nil
+	// Replace the row, the primary key can be changed,
+	// then its view rows and the referencing rows
+	write := func() error {
+		updated, err := database.TableReplace(tx.kv, tableDef, key, record)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return fmt.Errorf("record not found")
+		}
+		if err := tx.addViewRows(tableDef, views, old, record); err != nil {
+			return err
+		}
+		return tx.applyChanges(changes)
+	}
+	if len(views) == 0 && len(changes) == 0 {
+		return write()
+	}
+	return tx.atomic(write)
 }
 
 // DropTable drops a table
@@ -209,20 +356,52 @@ func (tx *DBTX) DropTable(tableName string) error {
 		return fmt.Errorf("table name cannot be empty")
 	}
 
-	// Check if table exists
-	if _, exists := tx.tables[tableName]; !exists {
+	tableDef := tx.getTableDef(tableName)
+	if tableDef == nil {
 		return fmt.Errorf("table %s does not exist", tableName)
 	}
+	if tableDef.MatView != nil {
+		return fmt.Errorf("%s is a materialized view", tableName)
+	}
+	if err := tx.checkReferenced(tableName, "drop"); err != nil {
+		return err
+	}
+	if err := tx.checkViewUsers(tableName); err != nil {
+		return err
+	}
 
-	// Remove table definition and all records
+	// Remove all records and the table definition
+	if err := database.TableTruncate(tx.kv, tableDef); err != nil {
+		return err
+	}
+	if _, err := database.CatalogDrop(tx.kv, tableName); err != nil {
+		return err
+	}
 	delete(tx.tables, tableName)
-	delete(tx.records, tableName)
+	if err := tx.dropTriggers(tableName); err != nil {
+		return err
+	}
+	if tableDef.AutoIncrement != "" {
+		if err := tx.DropSequence(tableDef.AutoIncrement); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// AlterTable alters a table
+// AlterTable alters a table, the stored rows are converted to the new
+// columns by name, see AlterTableRows
 func (tx *DBTX) AlterTable(tableName string, newDef *TableDef) error {
+	return tx.AlterTableRows(tableName, newDef, nil)
+}
+
+// AlterTableRows alters a table and rewrites its rows with `convert`,
+// which maps a row of the old definition to a row of the new one.
+// A nil `convert` keeps the columns by name, see database.ConvertRow().
+// The indexes on the removed columns are dropped. The columns used by
+// the views cannot be removed or retyped.
+func (tx *DBTX) AlterTableRows(tableName string, newDef *TableDef, convert func(Record) (Record, error)) error {
 	if !tx.active {
 		return fmt.Errorf("transaction not active")
 	}
@@ -236,24 +415,69 @@ func (tx *DBTX) AlterTable(tableName string, newDef *TableDef) error {
 	}
 
 	// Check if table exists
-	if _, exists := tx.tables[tableName]; !exists {
+	oldDef := tx.getTableDef(tableName)
+	if oldDef == nil {
 		return fmt.Errorf("table %s does not exist", tableName)
 	}
+	if err := checkNotMatView(oldDef); err != nil {
+		return err
+	}
 
 	// Validate new table definition
 	if err := tx.validateTableDef(newDef); err != nil {
 		return fmt.Errorf("invalid table definition: %w", err)
 	}
 
-	// Preserve the original name
+	// Preserve the original name, the indexes and the constraints
 	newDef.Name = tableName
+	database.KeepIndexes(oldDef, newDef)
+	newDef.ForeignKeys = oldDef.ForeignKeys
+	newDef.AutoIncrement = oldDef.AutoIncrement
+	if err := tx.checkRefColumns(newDef); err != nil {
+		return err
+	}
+	if err := database.ViewColumnsCheck(tx.kv, oldDef, newDef); err != nil {
+		return err
+	}
+
+	// Rewrite the rows and the indexes under new prefixes
+	rewrite := *newDef
+	rewrite.VirtualFunc = nil // of the old columns
+	newDef = tx.withVirtual(&rewrite)
+	if err := database.TableRewrite(tx.kv, oldDef, newDef, convert); err != nil {
+		return err
+	}
+	if err := database.CatalogUpdate(tx.kv, newDef); err != nil {
+		return err
+	}
 	tx.tables[tableName] = newDef
 
+	// Recompute the materialized views from the new columns
+	views, err := tx.matViews(tableName)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		if err := tx.RefreshMatView(view.Name); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // CreateIndex creates an index
 func (tx *DBTX) CreateIndex(indexName string, tableName string, columnNames []string) error {
+	return tx.createIndex(indexName, tableName, columnNames, false)
+}
+
+// CreateUniqueIndex creates a UNIQUE index, the existing rows must not
+// have duplicates of the indexed columns
+func (tx *DBTX) CreateUniqueIndex(indexName string, tableName string, columnNames []string) error {
+	return tx.createIndex(indexName, tableName, columnNames, true)
+}
+
+func (tx *DBTX) createIndex(indexName string, tableName string, columnNames []string, unique bool) error {
 	if !tx.active {
 		return fmt.Errorf("transaction not active")
 	}
@@ -271,26 +495,40 @@ func (tx *DBTX) CreateIndex(indexName string, tableName string, columnNames []st
 	}
 
 	// Check if table exists
-	tableDef, exists := tx.tables[tableName]
-	if !exists {
+	tableDef := tx.getTableDef(tableName)
+	if tableDef == nil {
 		return fmt.Errorf("table %s does not exist", tableName)
 	}
 
-	// Validate column names exist in table
+	// Validate column names exist in table, or are paths of JSON columns
 	for _, colName := range columnNames {
-		found := false
-		for _, tableCol := range tableDef.Cols {
-			if tableCol == colName {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if database.IndexColType(tableDef, colName) == database.TYPE_ERROR {
 			return fmt.Errorf("column %s does not exist in table %s", colName, tableName)
 		}
 	}
 
-	// For now, just return success (index creation would be implemented in a full system)
+	// Add the index to the table definition, then index the existing rows
+	tableDef, err := database.CatalogAddIndex(tx.kv, tableName, indexName, columnNames, unique)
+	if err != nil {
+		return err
+	}
+	i := len(tableDef.Indexes) - 1
+	if err := database.IndexBuild(tx.kv, tx.withVirtual(tableDef), i); err != nil {
+		// undo the index, e.g. on duplicates of a unique index
+		delete(tx.tables, tableName)
+		if uerr := database.IndexClear(tx.kv, tableDef, i); uerr != nil {
+			return fmt.Errorf("%w (removing the index: %v)", err, uerr)
+		}
+		if _, uerr := database.CatalogDropIndex(tx.kv, indexName); uerr != nil {
+			return fmt.Errorf("%w (removing the index: %v)", err, uerr)
+		}
+		return err
+	}
+	// the whole table is indexed in this transaction
+	if tableDef, err = database.CatalogIndexReady(tx.kv, indexName); err != nil {
+		return err
+	}
+	tx.tables[tableName] = tableDef
 	return nil
 }
 
@@ -304,7 +542,26 @@ func (tx *DBTX) DropIndex(indexName string) error {
 		return fmt.Errorf("index name cannot be empty")
 	}
 
-	// For now, just return success (index dropping would be implemented in a full system)
+	if err := tx.checkRefIndex(indexName); err != nil {
+		return err
+	}
+
+	// Remove the index from its table definition
+	tableDef, err := database.CatalogDropIndex(tx.kv, indexName)
+	if err != nil {
+		return err
+	}
+	if tableDef == nil {
+		return fmt.Errorf("index %s does not exist", indexName)
+	}
+	delete(tx.tables, tableDef.Name)
+
+	// Delete the index entries
+	for i, name := range tableDef.IndexNames {
+		if name == indexName {
+			return database.IndexClear(tx.kv, tableDef, i)
+		}
+	}
 	return nil
 }
 
@@ -319,13 +576,28 @@ func (tx *DBTX) TruncateTable(tableName string) error {
 	}
 
 	// Check if table exists
-	if _, exists := tx.tables[tableName]; !exists {
+	tableDef := tx.getTableDef(tableName)
+	if tableDef == nil {
 		return fmt.Errorf("table %s does not exist", tableName)
 	}
+	if err := checkNotMatView(tableDef); err != nil {
+		return err
+	}
+	if err := tx.checkReferenced(tableName, "truncate"); err != nil {
+		return err
+	}
 
-	// Clear all records but keep table definition
-	tx.records[tableName] = make(map[string]*Record)
-
+	// Clear all records but keep table definition, the materialized
+	// views of the table become empty too
+	views, err := tx.matViews(tableName)
+	if err != nil {
+		return err
+	}
+	for _, view := range append(views, tableDef) {
+		if err := database.TableTruncate(tx.kv, view); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -348,56 +620,95 @@ func (tx *DBTX) RenameTable(oldName string, newName string) error {
 	}
 
 	// Check if old table exists
-	tableDef, exists := tx.tables[oldName]
-	if !exists {
+	if tx.getTableDef(oldName) == nil {
 		return fmt.Errorf("table %s does not exist", oldName)
 	}
+	refs, err := tx.referencing(oldName)
+	if err != nil {
+		return err
+	}
+	if err := tx.checkViewUsers(oldName); err != nil {
+		return err
+	}
 
 	// Check if new table name already exists
-	if _, exists := tx.tables[newName]; exists {
+	if tx.getTableDef(newName) != nil {
 		return fmt.Errorf("table %s already exists", newName)
 	}
 
-	// Get records from old table
-	oldRecords := tx.records[oldName]
-
-	// Create new table definition with new name
-	newDef := &TableDef{
-		Name:  newName,
-		Cols:  tableDef.Cols,
-		Types: tableDef.Types,
-		PKeys: tableDef.PKeys,
+	// Move the definition, the records stay under the same prefix
+	if err := database.CatalogRename(tx.kv, oldName, newName); err != nil {
+		return err
 	}
-
-	// Add new table and remove old one
-	tx.tables[newName] = newDef
-	tx.records[newName] = oldRecords
 	delete(tx.tables, oldName)
-	delete(tx.records, oldName)
+	delete(tx.viewRows, oldName)
+
+	// Point the foreign keys and the triggers to the new name
+	if err := tx.renameReferences(refs, oldName, newName); err != nil {
+		return err
+	}
+	if err := tx.renameTriggers(oldName, newName); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-// GetDB returns the underlying database
+// GetDB returns the database as seen by the transaction,
+// including its uncommitted schema changes
 func (tx *DBTX) GetDB() DB {
-	return tx.db
+	if !tx.active {
+		return tx.db
+	}
+	return &txDB{tx: tx}
+}
+
+// txDB reads the catalog within a transaction
+type txDB struct {
+	tx *DBTX
+}
+
+func (db *txDB) GetTableDef(name string) *TableDef {
+	return db.tx.getTableDef(name)
+}
+
+func (db *txDB) ListTables() ([]string, error) {
+	return database.CatalogNames(db.tx.kv)
 }
 
 // NewDBTX creates a new database transaction
 func NewDBTX(db DB) *DBTX {
+	seqs := database.NewSequenceCache()
+	if sdb, ok := db.(SequenceDB); ok && sdb.Sequences() != nil {
+		seqs = sdb.Sequences()
+	}
 	return &DBTX{
 		db:      db,
 		active:  false,
 		tables:  make(map[string]*TableDef),
-		records: make(map[string]map[string]*Record),
+		seqs:    seqs,
+		currval: make(map[string]int64),
 	}
 }
 
-// Begin starts the transaction
+// Begin starts the transaction.
+// For a KVDB, it waits for the other KV transactions to finish.
 func (tx *DBTX) Begin() error {
 	if tx.active {
 		return fmt.Errorf("transaction already active")
 	}
+	if kvdb, ok := tx.db.(KVDB); ok {
+		store, err := kvdb.GetStore().Begin()
+		if err != nil {
+			return err
+		}
+		tx.kv, tx.store = store, store
+	} else if tx.kv == nil {
+		tx.kv = database.NewMemKV()
+	}
+	tx.tables = make(map[string]*TableDef)
+	tx.viewRows = make(map[string]func(Record) (*Record, error))
+	tx.deferred = nil
 	tx.active = true
 	return nil
 }
@@ -407,7 +718,18 @@ func (tx *DBTX) Commit() error {
 	if !tx.active {
 		return fmt.Errorf("transaction not active")
 	}
+	// A violated deferred foreign key aborts the transaction
+	if err := tx.checkDeferred(); err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.deferred = nil
 	tx.active = false
+	if tx.store != nil {
+		store := tx.store
+		tx.kv, tx.store = nil, nil
+		return store.Commit()
+	}
 	return nil
 }
 
@@ -417,70 +739,31 @@ func (tx *DBTX) Abort() error {
 		return fmt.Errorf("transaction not active")
 	}
 	tx.active = false
+	if tx.store != nil {
+		tx.store.Abort()
+	}
 	// Clear transaction state
+	tx.kv, tx.store = nil, nil
 	tx.tables = make(map[string]*TableDef)
-	tx.records = make(map[string]map[string]*Record)
+	tx.deferred = nil
 	return nil
 }
 
 // Helper Methods
 
-// generateKeyString generates a string key from primary key values
-func (tx *DBTX) generateKeyString(table string, record Record) string {
-	tableDef, exists := tx.tables[table]
-	if !exists {
-		return ""
-	}
-
-	if len(record.Cols) == 0 || len(record.Vals) == 0 {
-		return ""
-	}
-
-	// Find primary key values
-	var keyParts []string
-	for i := 0; i < tableDef.PKeys && i < len(record.Cols); i++ {
-		colName := tableDef.Cols[i]
-		value := record.Get(colName)
-		if value == nil {
-			return ""
+// getTableDef reads a table definition from the catalog
+func (tx *DBTX) getTableDef(name string) *TableDef {
+	tdef, ok := tx.tables[name]
+	if !ok {
+		var err error
+		if tdef, err = database.CatalogGet(tx.kv, name); err != nil || tdef == nil {
+			return nil
 		}
-		keyParts = append(keyParts, tx.valueToString(*value))
 	}
-
-	// Join with separator
-	return strings.Join(keyParts, "|")
-}
-
-// valueToString converts a Value to string representation
-func (tx *DBTX) valueToString(value Value) string {
-	switch value.Type {
-	case database.TYPE_INT64:
-		return fmt.Sprintf("%d", value.I64)
-	case database.TYPE_BYTES:
-		return string(value.Str)
-	default:
-		return ""
-	}
-}
-
-// copyRecord creates a deep copy of a record
-func (tx *DBTX) copyRecord(record Record) Record {
-	recordCopy := Record{
-		Cols: make([]string, len(record.Cols)),
-		Vals: make([]Value, len(record.Vals)),
-	}
-
-	copy(recordCopy.Cols, record.Cols)
-	for i, val := range record.Vals {
-		recordCopy.Vals[i] = Value{
-			Type: val.Type,
-			I64:  val.I64,
-			Str:  make([]byte, len(val.Str)),
-		}
-		copy(recordCopy.Vals[i].Str, val.Str)
-	}
-
-	return recordCopy
+	// the copy with the function of the virtual columns is cached
+	tdef = tx.withVirtual(tdef)
+	tx.tables[name] = tdef
+	return tdef
 }
 
 // validateRecord validates a record against table schema
@@ -517,7 +800,7 @@ func (tx *DBTX) validateRecord(record Record, tdef *TableDef) error {
 
 		// Validate type
 		value := record.Get(colName)
-		if value != nil && value.Type != colType {
+		if value != nil && !value.Null && value.Type != colType {
 			return fmt.Errorf("type mismatch for column %s: expected %d, got %d",
 				colName, colType, value.Type)
 		}
@@ -571,7 +854,10 @@ func (tx *DBTX) validateTableDef(def *TableDef) error {
 
 	// Validate data types
 	for i, colType := range def.Types {
-		if colType != database.TYPE_INT64 && colType != database.TYPE_BYTES {
+		switch colType {
+		case database.TYPE_INT64, database.TYPE_BYTES, database.TYPE_FLOAT64,
+			database.TYPE_BOOL, database.TYPE_TIMESTAMP, database.TYPE_DECIMAL, database.TYPE_JSON:
+		default:
 			return fmt.Errorf("invalid data type for column %s: %d", def.Cols[i], colType)
 		}
 	}
@@ -0,0 +1,101 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+	"govetachun/go-mini-db/refactor_code/internal/storage/btree"
+)
+
+// A write of a row is several KV updates: the row, its index entries,
+// the rows of its materialized views and the rows changed by its
+// foreign keys. If one of them fails, the write is undone, so a caller
+// that handles the error can go on with the transaction and commit.
+
+// undoKV records the old values of the keys updated through it,
+// see DBTX.atomic()
+type undoKV struct {
+	database.KVWriter
+	keys [][]byte
+	olds [][]byte // nil for a key that did not exist
+	seen map[string]bool
+}
+
+// Seek is for the range scans, see database.TableScan()
+func (kv *undoKV) Seek(key []byte) *btree.BIter {
+	return kv.KVWriter.(database.KVSeeker).Seek(key)
+}
+
+func (kv *undoKV) Update(key []byte, val []byte, mode int) (bool, error) {
+	kv.save(key)
+	return kv.KVWriter.Update(key, val, mode)
+}
+
+func (kv *undoKV) Del(key []byte) (bool, error) {
+	kv.save(key)
+	return kv.KVWriter.Del(key)
+}
+
+// keep the value of a key before its first update
+func (kv *undoKV) save(key []byte) {
+	if kv.seen[string(key)] {
+		return
+	}
+	kv.seen[string(key)] = true
+	var old []byte
+	if val, ok := kv.KVWriter.Get(key); ok {
+		old = append([]byte{}, val...)
+	}
+	kv.keys = append(kv.keys, append([]byte{}, key...))
+	kv.olds = append(kv.olds, old)
+}
+
+// restore the old values
+func (kv *undoKV) rollback() error {
+	for i := len(kv.keys) - 1; i >= 0; i-- {
+		var err error
+		if kv.olds[i] == nil {
+			_, err = kv.KVWriter.Del(kv.keys[i])
+		} else {
+			_, err = kv.KVWriter.Update(kv.keys[i], kv.olds[i], database.MODE_UPSERT)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Atomic runs several writes, which are all undone if one fails.
+// The executor runs a row with the statements of its triggers in it.
+func (tx *DBTX) Atomic(write func() error) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	return tx.atomic(write)
+}
+
+// atomic runs a write of a row, which is undone if it fails.
+// The writes nested in it, such as the foreign key actions, are undone
+// with it.
+func (tx *DBTX) atomic(write func() error) error {
+	if _, ok := tx.kv.(*undoKV); ok {
+		return write() // nested
+	}
+	kv := tx.kv
+	undo := &undoKV{KVWriter: kv, seen: map[string]bool{}}
+	ndeferred := len(tx.deferred)
+	tx.kv = undo
+	err := write()
+	tx.kv = kv
+	if err == nil {
+		return nil
+	}
+	tx.deferred = tx.deferred[:ndeferred]
+	if uerr := undo.rollback(); uerr != nil {
+		// the transaction cannot be committed
+		tx.Abort()
+		return fmt.Errorf("%w (undoing the write: %v)", err, uerr)
+	}
+	return err
+}
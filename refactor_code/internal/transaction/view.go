@@ -0,0 +1,54 @@
+package transaction
+
+import (
+	"fmt"
+
+	"govetachun/go-mini-db/refactor_code/internal/database"
+)
+
+// CreateView creates a view, see database.View.
+// Its query is validated by the executor.
+func (tx *DBTX) CreateView(view *database.View) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	return database.ViewCreate(tx.kv, view)
+}
+
+// DropView drops a view, unless another view selects from it
+func (tx *DBTX) DropView(name string) error {
+	if !tx.active {
+		return fmt.Errorf("transaction not active")
+	}
+	if err := tx.checkViewUsers(name); err != nil {
+		return err
+	}
+	dropped, err := database.ViewDrop(tx.kv, name)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return fmt.Errorf("view %s does not exist", name)
+	}
+	return nil
+}
+
+// GetView returns a view, or nil if it does not exist
+func (tx *DBTX) GetView(name string) (*database.View, error) {
+	if !tx.active {
+		return nil, fmt.Errorf("transaction not active")
+	}
+	return database.ViewGet(tx.kv, name)
+}
+
+// checkViewUsers fails if a view selects from the table or the view
+func (tx *DBTX) checkViewUsers(name string) error {
+	users, err := database.ViewUsers(tx.kv, name)
+	if err != nil {
+		return err
+	}
+	if len(users) != 0 {
+		return fmt.Errorf("%s is used by view %s", name, users[0])
+	}
+	return nil
+}